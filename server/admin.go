@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// messageSystemNotice is the y-websocket message type carrying a system
+// notice. y-websocket ignores message types it has no handler for, so
+// clients that do not know about notices are unaffected.
+const messageSystemNotice = 100
+
+// streamSystemNotice prefixes notices queued for WebTransport clients; each
+// notice is delivered on its own unidirectional stream starting with it
+const streamSystemNotice = 0x05
+
+// SystemNotice is a message from the operators shown to everyone in a room
+type SystemNotice struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// encode returns the notice framed for WebSocket (a y-protocol message:
+// varuint type, then the JSON as a varstring) and for WebTransport (the
+// stream type byte, then the JSON)
+func (n SystemNotice) encode() (wsMsg, wtMsg []byte) {
+	payload, _ := json.Marshal(n)
+
+	wsMsg = binary.AppendUvarint(nil, messageSystemNotice)
+	wsMsg = binary.AppendUvarint(wsMsg, uint64(len(payload)))
+	wsMsg = append(wsMsg, payload...)
+
+	wtMsg = append([]byte{streamSystemNotice}, payload...)
+	return wsMsg, wtMsg
+}
+
+// adminAuth requires "Authorization: Bearer <token>" on every request
+func adminAuth(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				log.Printf("[WARN] Rejected admin request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+				writeError(w, r, errUnauthorized())
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// AdminRoutes returns the admin API, mounted at /api/admin. Every route
+// requires the configured admin token.
+func AdminRoutes(hub *CollaborationHub, token string) http.Handler {
+	r := chi.NewRouter()
+	r.Use(adminAuth(token))
+
+	r.Get("/rooms", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"rooms": hub.RoomInfos()})
+	})
+
+	r.Get("/rooms/{roomID}", func(w http.ResponseWriter, r *http.Request) {
+		room, ok := hub.Room(chi.URLParam(r, "roomID"))
+		if !ok {
+			writeError(w, r, errNotFound("Room not found"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":      room.ID,
+			"clients": room.ClientInfos(),
+		})
+	})
+
+	r.Delete("/rooms/{roomID}", func(w http.ResponseWriter, r *http.Request) {
+		roomID := chi.URLParam(r, "roomID")
+		if !hub.CloseRoom(roomID, "Room closed by an administrator") {
+			writeError(w, r, errNotFound("Room not found"))
+			return
+		}
+		log.Printf("[INFO] Admin closed room %s", roomID)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Delete("/rooms/{roomID}/clients/{clientID}", func(w http.ResponseWriter, r *http.Request) {
+		roomID, clientID := chi.URLParam(r, "roomID"), chi.URLParam(r, "clientID")
+		room, ok := hub.Room(roomID)
+		if !ok {
+			writeError(w, r, errNotFound("Room not found"))
+			return
+		}
+		client, ok := room.Client(clientID)
+		if !ok {
+			writeError(w, r, errNotFound("Client not found"))
+			return
+		}
+		client.Close(CloseKicked, "Disconnected by an administrator")
+		log.Printf("[INFO] Admin kicked client %s from room %s", clientID, roomID)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Post("/rooms/{roomID}/notice", func(w http.ResponseWriter, r *http.Request) {
+		notice, err := decodeNotice(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		room, ok := hub.Room(chi.URLParam(r, "roomID"))
+		if !ok {
+			writeError(w, r, errNotFound("Room not found"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"delivered": room.Notify(notice)})
+	})
+
+	r.Post("/notice", func(w http.ResponseWriter, r *http.Request) {
+		notice, err := decodeNotice(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		delivered := 0
+		for _, info := range hub.RoomInfos() {
+			if room, ok := hub.Room(info.ID); ok {
+				delivered += room.Notify(notice)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"delivered": delivered})
+	})
+
+	return r
+}
+
+// decodeNotice reads {"message": "..."} from the request body
+func decodeNotice(r *http.Request) (SystemNotice, error) {
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return SystemNotice{}, errBadRequest("Invalid request body")
+	}
+	req.Message = strings.TrimSpace(req.Message)
+	if req.Message == "" || len(req.Message) > 1000 {
+		return SystemNotice{}, errBadRequest("message is required and must be at most 1000 bytes")
+	}
+	return SystemNotice{Message: req.Message, Time: time.Now().UTC()}, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "test-admin-token-0123"
+
+func adminRequest(t *testing.T, h http.Handler, method, path, body string, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// joinTestClient adds a client to a room as the transports do
+func joinTestClient(t *testing.T, hub *CollaborationHub, roomID, protocol string) *Client {
+	t.Helper()
+	client, err := hub.Join(roomID, protocol)
+	if err != nil {
+		t.Fatalf("Join %s: %v", roomID, err)
+	}
+	return client
+}
+
+func TestAdminAuth(t *testing.T) {
+	h := AdminRoutes(NewCollaborationHub(DefaultConfig().Collab, nil), testAdminToken)
+
+	for _, token := range []string{"", "wrong-token"} {
+		if rec := adminRequest(t, h, http.MethodGet, "/rooms", "", token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: status = %d, want 401", token, rec.Code)
+		}
+	}
+	if rec := adminRequest(t, h, http.MethodGet, "/rooms", "", testAdminToken); rec.Code != http.StatusOK {
+		t.Errorf("valid token: status = %d, want 200", rec.Code)
+	}
+}
+
+func TestAdminRooms(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	h := AdminRoutes(hub, testAdminToken)
+
+	ws := joinTestClient(t, hub, "doc-1", "WebSocket")
+	joinTestClient(t, hub, "doc-1", "WebTransport")
+	joinTestClient(t, hub, "doc-2", "WebSocket")
+
+	rec := adminRequest(t, h, http.MethodGet, "/rooms", "", testAdminToken)
+	var list struct{ Rooms []RoomInfo }
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatalf("decode rooms: %v", err)
+	}
+	if len(list.Rooms) != 2 || list.Rooms[0].Clients != 2 || list.Rooms[0].Protocols["WebTransport"] != 1 {
+		t.Errorf("rooms = %+v", list.Rooms)
+	}
+
+	ws.bytesIn.Add(42)
+	rec = adminRequest(t, h, http.MethodGet, "/rooms/doc-1", "", testAdminToken)
+	var detail struct{ Clients []ClientInfo }
+	if err := json.NewDecoder(rec.Body).Decode(&detail); err != nil {
+		t.Fatalf("decode room: %v", err)
+	}
+	if len(detail.Clients) != 2 || detail.Clients[0].ID != ws.ID || detail.Clients[0].BytesIn != 42 {
+		t.Errorf("clients = %+v", detail.Clients)
+	}
+
+	if rec := adminRequest(t, h, http.MethodGet, "/rooms/nope", "", testAdminToken); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown room: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestAdminKickAndClose(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	h := AdminRoutes(hub, testAdminToken)
+
+	a := joinTestClient(t, hub, "doc", "WebSocket")
+	b := joinTestClient(t, hub, "doc", "WebTransport")
+
+	rec := adminRequest(t, h, http.MethodDelete, "/rooms/doc/clients/"+a.ID, "", testAdminToken)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("kick: status = %d, want 204", rec.Code)
+	}
+	if code, _ := a.CloseStatus(); code != CloseKicked {
+		t.Errorf("kick close code = %d, want %d", code, CloseKicked)
+	}
+	a.Room.Leave(a)
+
+	room, _ := hub.Room("doc")
+	if rec := adminRequest(t, h, http.MethodDelete, "/rooms/doc", "", testAdminToken); rec.Code != http.StatusNoContent {
+		t.Fatalf("close: status = %d, want 204", rec.Code)
+	}
+	if code, _ := b.CloseStatus(); code != CloseRoomClosed {
+		t.Errorf("room close code = %d, want %d", code, CloseRoomClosed)
+	}
+	if _, ok := hub.Room("doc"); ok {
+		t.Errorf("closed room is still listed")
+	}
+
+	// The room stops once its last client has left
+	b.Room.Leave(b)
+	select {
+	case <-room.stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("room did not stop")
+	}
+	if err := room.Join(NewClient(room, "WebSocket")); err != errRoomStopped {
+		t.Errorf("Join on a stopped room = %v, want errRoomStopped", err)
+	}
+}
+
+func TestAdminNotice(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	h := AdminRoutes(hub, testAdminToken)
+
+	ws := joinTestClient(t, hub, "doc", "WebSocket")
+	wt := joinTestClient(t, hub, "doc", "WebTransport")
+
+	rec := adminRequest(t, h, http.MethodPost, "/rooms/doc/notice", `{"message":"Maintenance in 5 minutes"}`, testAdminToken)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"delivered":2`) {
+		t.Fatalf("notice: got %d %s", rec.Code, rec.Body)
+	}
+
+	// WebSocket: y-protocol message type, then the JSON as a varstring
+	msg := <-ws.Send
+	msgType, n := binary.Uvarint(msg)
+	length, m := binary.Uvarint(msg[n:])
+	var notice SystemNotice
+	if msgType != messageSystemNotice || int(length) != len(msg)-n-m {
+		t.Fatalf("WebSocket notice framing: type %d length %d of %d bytes", msgType, length, len(msg))
+	}
+	if err := json.Unmarshal(msg[n+m:], &notice); err != nil || notice.Message != "Maintenance in 5 minutes" {
+		t.Errorf("WebSocket notice = %+v (%v)", notice, err)
+	}
+
+	// WebTransport: stream type byte, then the JSON
+	msg = <-wt.Send
+	if msg[0] != streamSystemNotice || !json.Valid(msg[1:]) {
+		t.Errorf("WebTransport notice = %q", msg)
+	}
+
+	if rec := adminRequest(t, h, http.MethodPost, "/notice", `{"message":""}`, testAdminToken); rec.Code != http.StatusBadRequest {
+		t.Errorf("empty notice: status = %d, want 400", rec.Code)
+	}
+}
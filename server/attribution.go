@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// AttributedRange is a run of a document's text written by one user
+type AttributedRange struct {
+	// Start and End are offsets into the document's text in UTF-16 code
+	// units, as editors count them, with a newline between paragraphs
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Text  string `json:"text"`
+	// User is empty for text from Y.js clients the server has no user for,
+	// such as edits made before attribution was recorded
+	User string `json:"user,omitempty"`
+}
+
+// Author is who an update comes from: the user and the Y.js client ID their
+// session edits with
+type Author struct {
+	User string
+	// Client is the session's Y.js client ID, if Known. Sessions reveal it
+	// with their first edit; the ID they declare in awareness updates is
+	// only believed once an update of theirs has structs from it.
+	Client uint64
+	Known  bool
+}
+
+// claim attributes the author's Y.js client ID to their user, if no one
+// owns it yet and update has structs from it, and returns the new
+// attribution. Only the session's own client ID is claimed: updates that
+// carry or unblock other clients' structs do not make them the sender's, and
+// neither does an update without structs of the client. s.mu must be held.
+func (s *DocState) claim(author Author, update []byte) map[uint64]string {
+	if author.User == "" || !author.Known {
+		return nil
+	}
+	owner, owned := s.authors[author.Client]
+	if owner == author.User || !hasStructsFrom(update, author.Client) {
+		return nil
+	}
+	if owned {
+		log.Printf("[WARN] Room %s: %s sent updates as Y.js client %d, which belongs to %s", s.RoomID, author.User, author.Client, owner)
+		return nil
+	}
+	return s.attribute(author.Client, author.User)
+}
+
+// attribute records that user owns a Y.js client ID and returns the new
+// attribution; s.mu must be held
+func (s *DocState) attribute(client uint64, user string) map[uint64]string {
+	s.authors[client] = user
+	return map[uint64]string{client: user}
+}
+
+// hasStructsFrom reports whether update has structs of the Y.js client
+func hasStructsFrom(update []byte, client uint64) bool {
+	u, err := decodeUpdate(update)
+	if err != nil {
+		return false
+	}
+	for _, st := range u.structs {
+		if st.id.client == client {
+			return true
+		}
+	}
+	return false
+}
+
+// editClient returns the Y.js client ID a session of user sent update with,
+// unless another user owns it. That is the client the session declared, if
+// update has structs from it, or for an edit of the session's own the only
+// client update has structs from.
+func (s *DocState) editClient(update []byte, user string, declared uint64, hasDeclared, own bool) (uint64, bool) {
+	u, err := decodeUpdate(update)
+	if err != nil || len(u.structs) == 0 {
+		return 0, false
+	}
+	id, found := u.structs[0].id.client, false
+	for _, st := range u.structs {
+		if hasDeclared && st.id.client == declared {
+			id, found = declared, true
+			break
+		}
+	}
+	if !found {
+		if !own {
+			return 0, false
+		}
+		for _, st := range u.structs {
+			if st.id.client != id {
+				return 0, false
+			}
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if owner, ok := s.authors[id]; ok && owner != user {
+		return 0, false
+	}
+	return id, true
+}
+
+// Attribution lists who wrote the document's current text, in document
+// order. Ranges do not span paragraphs, and the newlines between paragraphs
+// belong to none.
+func (s *DocState) Attribution() []AttributedRange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ranges := []AttributedRange{}
+	offset := 0
+	for i, t := range s.doc.textTypes() {
+		if i > 0 {
+			offset++
+		}
+		first := len(ranges)
+		for it := t.start; it != nil; it = it.right {
+			c, ok := it.content.(*contentString)
+			if !ok || it.deleted {
+				continue
+			}
+			user := s.authors[it.id.client]
+			end := offset + len(c.s)
+			if n := len(ranges); n > first && ranges[n-1].User == user {
+				ranges[n-1].End = end
+				ranges[n-1].Text += c.String()
+			} else {
+				ranges = append(ranges, AttributedRange{Start: offset, End: end, Text: c.String(), User: user})
+			}
+			offset = end
+		}
+	}
+	return ranges
+}
+
+// documentAttribution serves GET /api/documents/{id}/attribution
+func documentAttribution(w http.ResponseWriter, r *http.Request, hub *CollaborationHub, doc Document) {
+	state, err := hub.OpenState(doc.RoomID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer hub.ReleaseState(state)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"document": doc.ID,
+		"ranges":   state.Attribution(),
+	})
+}
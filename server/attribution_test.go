@@ -0,0 +1,255 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAttribution(t *testing.T) {
+	store := testStore(t, 1000)
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	hub.UseStore(store)
+	docs, _ := NewDocuments(store)
+	auth := NewAuthenticator(AuthConfig{Users: []UserConfig{
+		{Name: "ada", Token: "ada-token-0123456789"},
+		{Name: "grace", Token: "grace-token-0123456789"},
+	}})
+	hub.UseAccess(NewRoomAccess(auth, docs))
+	r := chi.NewRouter()
+	r.Use(auth.Middleware)
+	r.Mount("/api/documents", DocumentRoutes(hub, docs))
+	const ada, nonMember = "ada-token-0123456789", "grace-token-0123456789"
+
+	doc, _ := docs.Create(Document{Title: "Plan", Owner: "ada", Tags: []string{}, Members: map[string]Role{}})
+	root := &PMNode{Type: "doc", Content: []*PMNode{
+		pmBlock("paragraph", nil, pmText("hi 😀")),
+		pmBlock("paragraph", nil, pmText("bye")),
+	}}
+	if _, err := hub.ReplaceContent(doc.RoomID, NewYDocFromProseMirror(root), "ada", ""); err != nil {
+		t.Fatal(err)
+	}
+	state, _ := hub.LookupState(doc.RoomID)
+
+	editor := joinTestClient(t, hub, doc.RoomID, "WebSocket")
+	editor.User, editor.Role = "grace", RoleEditor
+	anonymous := joinTestClient(t, hub, doc.RoomID, "WebSocket")
+	room := editor.Room
+
+	// Edits from a session's own Y.js client
+	edit := func(d *YDoc, s string) []byte {
+		text := firstText(d)
+		return d.Transact(func(tx *yTransaction) {
+			left := text.start
+			for left.right != nil {
+				left = left.right
+			}
+			tx.insert(text, left, newContentString(s))
+		})
+	}
+	grace := replica(t, state)
+	if err := room.ApplyEdit(edit(grace, "!"), editor); err != nil {
+		t.Fatal(err)
+	}
+	update := edit(replica(t, state), "?")
+	if err := room.ApplyEdit(update, anonymous); err != nil {
+		t.Fatal(err)
+	}
+	mustApply(t, grace, update)
+	// Compaction keeps the attributions made so far
+	state.Compact()
+	if err := room.ApplyEdit(edit(grace, "."), editor); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []AttributedRange{
+		{Start: 0, End: 5, Text: "hi 😀", User: "ada"},
+		{Start: 5, End: 6, Text: "!", User: "grace"},
+		{Start: 6, End: 7, Text: "?"},
+		{Start: 7, End: 8, Text: ".", User: "grace"},
+		{Start: 9, End: 12, Text: "bye", User: "ada"},
+	}
+	check := func(name string, got []AttributedRange) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("%s: ranges = %+v", name, got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: range %d = %+v, want %+v", name, i, got[i], want[i])
+			}
+		}
+	}
+
+	var resp struct {
+		Document string            `json:"document"`
+		Ranges   []AttributedRange `json:"ranges"`
+	}
+	if code := authRequest(t, r, nonMember, http.MethodGet, "/api/documents/"+doc.ID+"/attribution", "", nil); code != http.StatusNotFound {
+		t.Errorf("non-member: status = %d, want 404", code)
+	}
+	if code := authRequest(t, r, ada, http.MethodGet, "/api/documents/"+doc.ID+"/attribution", "", &resp); code != http.StatusOK || resp.Document != doc.ID {
+		t.Fatalf("attribution: status = %d, response = %+v", code, resp)
+	}
+	check("attribution", resp.Ranges)
+
+	// The attributions survive a restart, from the compacted state and
+	// the log after it
+	restarted := NewCollaborationHub(DefaultConfig().Collab, nil)
+	restarted.UseStore(store)
+	recovered, ok := restarted.LookupState(doc.RoomID)
+	if !ok {
+		t.Fatalf("room not found after restart")
+	}
+	check("after restart", recovered.Attribution())
+}
+
+// awarenessMessage is a y-websocket awareness message with the state of one
+// Y.js client
+func awarenessMessage(client uint64) []byte {
+	var u yEncoder
+	u.writeLen(1)
+	u.writeVarUint(client)
+	u.writeVarUint(1)
+	u.writeVarString(`{"user":{}}`)
+	var e yEncoder
+	e.writeVarUint(messageAwareness)
+	e.writeVarBytes(u.bytes())
+	return e.bytes()
+}
+
+func TestAttributionOwnClientOnly(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	root := &PMNode{Type: "doc", Content: []*PMNode{pmBlock("paragraph", nil, pmText("x"))}}
+	if _, err := hub.ReplaceContent("notes", NewYDocFromProseMirror(root), "linus", ""); err != nil {
+		t.Fatal(err)
+	}
+	state, _ := hub.LookupState("notes")
+	ada := joinTestClient(t, hub, "notes", "WebSocket")
+	ada.User = "ada"
+	grace := joinTestClient(t, hub, "notes", "WebSocket")
+	grace.User = "grace"
+	room := ada.Room
+
+	appendTo := func(d *YDoc, s string) []byte {
+		text := firstText(d)
+		return d.Transact(func(tx *yTransaction) {
+			left := text.start
+			for left.right != nil {
+				left = left.right
+			}
+			tx.insert(text, left, newContentString(s))
+		})
+	}
+	adaDoc, graceDoc := replica(t, state), replica(t, state)
+	first, second := appendTo(adaDoc, "a"), appendTo(adaDoc, "b")
+	mustApply(t, graceDoc, first)
+
+	// Grace declares her client ID, then syncs ada's first edit after ada's
+	// second one reached the server and is waiting for it
+	(&WebSocketSession{client: grace, room: room}).handleMessage(awarenessMessage(graceDoc.clientID))
+	if err := room.ApplyEdit(second, ada); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.ApplyUpdate(first, grace); err != nil {
+		t.Fatal(err)
+	}
+	mustApply(t, graceDoc, second)
+	update := appendTo(graceDoc, "c")
+	if err := room.ApplyEdit(update, grace); err != nil {
+		t.Fatal(err)
+	}
+	mustApply(t, adaDoc, update)
+
+	want := []AttributedRange{
+		{Start: 0, End: 1, Text: "x", User: "linus"},
+		{Start: 1, End: 3, Text: "ab", User: "ada"},
+		{Start: 3, End: 4, Text: "c", User: "grace"},
+	}
+	got := state.Attribution()
+	if len(got) != len(want) {
+		t.Fatalf("ranges = %+v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("range %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	// A session cannot take over a client ID another user owns
+	if id, ok := ada.DocClient(); !ok || id != adaDoc.clientID {
+		t.Errorf("ada's client = %d, %v, want %d", id, ok, adaDoc.clientID)
+	}
+	intruder := joinTestClient(t, hub, "notes", "WebSocket")
+	intruder.User = "mallory"
+	if err := room.ApplyEdit(appendTo(adaDoc, "d"), intruder); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := intruder.DocClient(); ok {
+		t.Errorf("intruder took over ada's client ID")
+	}
+	if got := state.Attribution(); len(got) != 4 || got[3].User != "ada" || got[3].Text != "d" {
+		t.Errorf("ranges after intrusion = %+v", got)
+	}
+}
+
+func TestAttributionIgnoresSpoofedClient(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	root := &PMNode{Type: "doc", Content: []*PMNode{pmBlock("paragraph", nil, pmText("x"))}}
+	if _, err := hub.ReplaceContent("notes", NewYDocFromProseMirror(root), "linus", ""); err != nil {
+		t.Fatal(err)
+	}
+	state, _ := hub.LookupState("notes")
+	ada := joinTestClient(t, hub, "notes", "WebSocket")
+	ada.User = "ada"
+	mallory := joinTestClient(t, hub, "notes", "WebSocket")
+	mallory.User = "mallory"
+	room := ada.Room
+
+	appendTo := func(d *YDoc, s string) []byte {
+		text := firstText(d)
+		return d.Transact(func(tx *yTransaction) {
+			left := text.start
+			for left.right != nil {
+				left = left.right
+			}
+			tx.insert(text, left, newContentString(s))
+		})
+	}
+	adaDoc, malloryDoc := replica(t, state), replica(t, state)
+
+	// Mallory names ada's client ID in her awareness, then sends an update
+	// without structs from it and an edit of her own
+	session := &WebSocketSession{client: mallory, room: room}
+	session.handleMessage(awarenessMessage(adaDoc.clientID))
+	if err := room.ApplyUpdate(deleteUpdate(malloryDoc.clientID, 0, 0), mallory); err != nil {
+		t.Fatal(err)
+	}
+	update := appendTo(malloryDoc, "m")
+	if err := room.ApplyEdit(update, mallory); err != nil {
+		t.Fatal(err)
+	}
+	mustApply(t, adaDoc, update)
+	if id, ok := mallory.DocClient(); !ok || id != malloryDoc.clientID {
+		t.Errorf("mallory's client = %d, %v, want her own %d", id, ok, malloryDoc.clientID)
+	}
+
+	if err := room.ApplyEdit(appendTo(adaDoc, "a"), ada); err != nil {
+		t.Fatal(err)
+	}
+	want := []AttributedRange{
+		{Start: 0, End: 1, Text: "x", User: "linus"},
+		{Start: 1, End: 2, Text: "m", User: "mallory"},
+		{Start: 2, End: 3, Text: "a", User: "ada"},
+	}
+	got := state.Attribution()
+	if len(got) != len(want) {
+		t.Fatalf("ranges = %+v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("range %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
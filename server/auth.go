@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Role is what a user may do with a document
+type Role string
+
+const (
+	// RoleOwner may do anything, including sharing and deleting
+	RoleOwner Role = "owner"
+	// RoleEditor may change the content
+	RoleEditor Role = "editor"
+	// RoleCommenter may read and comment
+	RoleCommenter Role = "commenter"
+	// RoleViewer may only read
+	RoleViewer Role = "viewer"
+)
+
+// roleRank orders roles by what they allow; no role is 0
+var roleRank = map[Role]int{RoleViewer: 1, RoleCommenter: 2, RoleEditor: 3, RoleOwner: 4}
+
+// AtLeast reports whether r allows everything min allows
+func (r Role) AtLeast(min Role) bool {
+	return roleRank[r] >= roleRank[min]
+}
+
+// memberRoles are the roles a document can grant besides its owner's
+var memberRoles = map[Role]bool{RoleEditor: true, RoleCommenter: true, RoleViewer: true}
+
+// Caller is who made a request
+type Caller struct {
+	// User is the authenticated user, or "" for an anonymous caller
+	User string
+	// Trusted is set when authentication is off: every caller may do
+	// everything, as before users were configured
+	Trusted bool
+}
+
+// Role returns the caller's role on a document, or "" without access
+func (c Caller) Role(doc Document) Role {
+	switch {
+	case c.Trusted:
+		return RoleOwner
+	case c.User == "":
+		return ""
+	case doc.Owner == c.User:
+		return RoleOwner
+	}
+	return doc.Members[c.User]
+}
+
+// CanRead reports whether the caller may see a document at all
+func (c Caller) CanRead(doc Document) bool {
+	return c.Role(doc) != ""
+}
+
+type callerKey struct{}
+
+// callerFrom returns the caller identified by Authenticator.Middleware.
+// Requests that did not pass through it are trusted.
+func callerFrom(r *http.Request) Caller {
+	if c, ok := r.Context().Value(callerKey{}).(Caller); ok {
+		return c
+	}
+	return Caller{Trusted: true}
+}
+
+// withCaller returns r carrying the caller
+func withCaller(r *http.Request, c Caller) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), callerKey{}, c))
+}
+
+// Authenticator maps bearer tokens to the users configured in auth.users.
+// With no users configured authentication is off.
+type Authenticator struct {
+	tokens map[string]string // token -> user
+}
+
+// NewAuthenticator indexes the configured users by token
+func NewAuthenticator(cfg AuthConfig) *Authenticator {
+	a := &Authenticator{tokens: make(map[string]string)}
+	for _, u := range cfg.Users {
+		a.tokens[u.Token] = u.Name
+	}
+	return a
+}
+
+// Enabled reports whether any users are configured
+func (a *Authenticator) Enabled() bool {
+	return len(a.tokens) > 0
+}
+
+// Identify returns the caller of a request from "Authorization: Bearer
+// <token>" or, for WebSocket and WebTransport clients that cannot set
+// headers, ?access_token=. A request without a token is anonymous; an
+// unknown token is an error.
+func (a *Authenticator) Identify(r *http.Request) (Caller, error) {
+	if !a.Enabled() {
+		return Caller{Trusted: true}, nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		return Caller{}, nil
+	}
+	for known, user := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return Caller{User: user}, nil
+		}
+	}
+	return Caller{}, errUnauthorized()
+}
+
+// Middleware identifies the caller of every request; a request with an
+// unknown token is refused
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, err := a.Identify(r)
+		if err != nil {
+			log.Printf("[WARN] Rejected request %s %s from %s: unknown token", r.Method, r.URL.Path, r.RemoteAddr)
+			writeError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, withCaller(r, caller))
+	})
+}
+
+// requireUser refuses anonymous callers while authentication is on
+func requireUser(caller Caller) error {
+	if !caller.Trusted && caller.User == "" {
+		return errUnauthorized()
+	}
+	return nil
+}
+
+// requireRole refuses callers whose role on doc is below min. Callers who
+// cannot read the document are told it does not exist.
+func requireRole(caller Caller, doc Document, min Role) error {
+	role := caller.Role(doc)
+	switch {
+	case role == "":
+		return errNotFound("Document not found")
+	case !role.AtLeast(min):
+		return errForbidden(fmt.Sprintf("This needs the %s role on the document", min))
+	}
+	return nil
+}
+
+// requireRoomRole checks that the caller has at least min in a room: their
+// role on the room's document, or in a room without one the role they would
+// join it with
+func requireRoomRole(caller Caller, docs *Documents, roomID string, min Role) error {
+	if doc, ok := docs.ByRoom(roomID); ok {
+		return requireRole(caller, doc, min)
+	}
+	switch {
+	case caller.Trusted:
+		return nil
+	case caller.User == "":
+		return errUnauthorized()
+	case !RoleEditor.AtLeast(min):
+		return errForbidden(fmt.Sprintf("This needs the %s role on the room", min))
+	}
+	return nil
+}
+
+// RoomAccess decides who may join a collaboration room, and with which
+// role, from the document the room belongs to
+type RoomAccess struct {
+	auth *Authenticator
+	docs *Documents
+}
+
+// NewRoomAccess checks room joins against the documents in docs
+func NewRoomAccess(auth *Authenticator, docs *Documents) *RoomAccess {
+	return &RoomAccess{auth: auth, docs: docs}
+}
+
+// Role identifies the caller of a WebSocket or WebTransport upgrade and
+// returns their role in the room. Rooms without a document are open to
+// every user as editors, as before documents had members; anonymous callers
+// are refused while authentication is on.
+func (a *RoomAccess) Role(r *http.Request, roomID string) (Caller, Role, error) {
+	caller, err := a.auth.Identify(r)
+	if err != nil {
+		return caller, "", err
+	}
+	var role Role
+	if doc, ok := a.docs.ByRoom(roomID); ok {
+		role = caller.Role(doc)
+	} else if caller.Trusted {
+		role = RoleOwner
+	} else if caller.User != "" {
+		role = RoleEditor
+	}
+	switch {
+	case role != "":
+		return caller, role, nil
+	case caller.User == "":
+		return caller, "", errUnauthorized()
+	}
+	return caller, "", errNotFound("Room not found")
+}
+
+// Suggesting reports whether the room's document is in suggesting mode
+func (a *RoomAccess) Suggesting(roomID string) bool {
+	doc, ok := a.docs.ByRoom(roomID)
+	return ok && doc.Suggesting
+}
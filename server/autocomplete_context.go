@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Token budget for the document context sent with an autocomplete request.
+// The budget is split between the headings outline, the text before the
+// cursor and the text after it (for fill-in-the-middle).
+const (
+	autocompleteContextTokens = 3000
+	outlineBudgetShare        = 0.15
+	suffixBudgetShare         = 0.20
+)
+
+// autocompleteWindow is the slice of a document the model gets to see
+type autocompleteWindow struct {
+	Outline []string // Headings of the whole document as an indented list
+	Section string   // Heading of the section the cursor is in
+	Before  string   // Text preceding the cursor
+	After   string   // Text following the cursor
+}
+
+// estimateTokens approximates the number of BPE tokens in s.
+// It pre-tokenizes the way GPT-style tokenizers do (runs of letters, digits,
+// punctuation and whitespace) and charges long runs one token per 4 bytes,
+// which tracks the Llama tokenizer closely enough for budgeting.
+func estimateTokens(s string) int {
+	tokens := 0
+	runLen := 0
+	runClass := -1
+
+	flush := func() {
+		if runLen == 0 {
+			return
+		}
+		switch runClass {
+		case 0: // whitespace is usually merged into the following word
+			if runLen > 1 {
+				tokens++
+			}
+		case 3: // punctuation and symbols are mostly one token each
+			tokens += runLen
+		default:
+			tokens += (runLen + 3) / 4
+		}
+		runLen = 0
+	}
+
+	for _, r := range s {
+		class := 3
+		switch {
+		case unicode.IsSpace(r):
+			class = 0
+		case unicode.IsLetter(r):
+			class = 1
+		case unicode.IsDigit(r):
+			class = 2
+		}
+		if class != runClass {
+			flush()
+			runClass = class
+		}
+		if class == 3 {
+			runLen++
+		} else {
+			runLen += utf8.RuneLen(r)
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+// parseHeading returns the level and title of a Markdown ATX heading line, or
+// level 0 if the line is not a heading
+func parseHeading(line string) (int, string) {
+	trimmed := strings.TrimSpace(line)
+	level := 0
+	for level < len(trimmed) && trimmed[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || level == len(trimmed) || trimmed[level] != ' ' {
+		return 0, ""
+	}
+	return level, strings.TrimSpace(trimmed[level:])
+}
+
+// splitParagraphs splits text into blank-line separated blocks, keeping the
+// separators attached so the blocks can be joined back losslessly
+func splitParagraphs(text string) []string {
+	var blocks []string
+	for len(text) > 0 {
+		idx := strings.Index(text, "\n\n")
+		if idx < 0 {
+			blocks = append(blocks, text)
+			break
+		}
+		end := idx + 2
+		for end < len(text) && text[end] == '\n' {
+			end++
+		}
+		blocks = append(blocks, text[:end])
+		text = text[end:]
+	}
+	return blocks
+}
+
+// truncateStart keeps the tail of s that fits into budget tokens, cutting at a
+// word boundary, or between runes in text without spaces
+func truncateStart(s string, budget int) string {
+	if estimateTokens(s) <= budget {
+		return s
+	}
+	// Tokens average ~4 bytes; start from that guess and shrink until it fits
+	keep := budget * 4
+	if keep > len(s) {
+		keep = len(s)
+	}
+	for keep > 0 {
+		// Cut between runes
+		start := len(s) - keep
+		for start < len(s) && !utf8.RuneStart(s[start]) {
+			start++
+		}
+		tail := s[start:]
+		if idx := strings.IndexAny(tail, " \n"); idx >= 0 && idx < len(tail)-1 {
+			tail = tail[idx+1:]
+		}
+		if estimateTokens(tail) <= budget {
+			return tail
+		}
+		keep -= keep/8 + 1
+	}
+	return ""
+}
+
+// truncateEnd keeps the head of s that fits into budget tokens, cutting at a
+// word boundary, or between runes in text without spaces
+func truncateEnd(s string, budget int) string {
+	if estimateTokens(s) <= budget {
+		return s
+	}
+	keep := budget * 4
+	if keep > len(s) {
+		keep = len(s)
+	}
+	for keep > 0 {
+		end := keep
+		for end > 0 && end < len(s) && !utf8.RuneStart(s[end]) {
+			end--
+		}
+		head := s[:end]
+		if idx := strings.LastIndexAny(head, " \n"); idx > 0 {
+			head = head[:idx]
+		}
+		if estimateTokens(head) <= budget {
+			return head
+		}
+		keep -= keep/8 + 1
+	}
+	return ""
+}
+
+// utf16Offset converts an offset in UTF-16 code units, which is how the
+// editor counts positions, into a byte offset into s. It reports false when
+// the offset is past the end of s or falls inside a surrogate pair.
+func utf16Offset(s string, units int) (int, bool) {
+	if units < 0 {
+		return 0, false
+	}
+	n := 0
+	for i, r := range s {
+		if n == units {
+			return i, true
+		}
+		if n > units {
+			return 0, false
+		}
+		n += utf16.RuneLen(r)
+	}
+	if n != units {
+		return 0, false
+	}
+	return len(s), true
+}
+
+// buildAutocompleteWindow selects the context around cursor (a byte offset
+// into document, or -1 for its end) that fits into budget tokens. Whole
+// paragraphs are preferred; only the paragraphs directly touching the cursor
+// are cut mid-way.
+func buildAutocompleteWindow(document string, cursor, budget int) autocompleteWindow {
+	byteCursor := len(document)
+	if cursor >= 0 && cursor < len(document) {
+		byteCursor = cursor
+		for byteCursor > 0 && !utf8.RuneStart(document[byteCursor]) {
+			byteCursor--
+		}
+	}
+	before, after := document[:byteCursor], document[byteCursor:]
+
+	var win autocompleteWindow
+
+	// Headings outline, and the heading of the section containing the cursor
+	outlineBudget := int(float64(budget) * outlineBudgetShare)
+	outlineUsed := 0
+	for _, line := range strings.Split(before, "\n") {
+		if level, title := parseHeading(line); level > 0 {
+			win.Section = title
+		}
+	}
+	for _, line := range strings.Split(document, "\n") {
+		level, title := parseHeading(line)
+		if level == 0 {
+			continue
+		}
+		h := strings.Repeat("  ", level-1) + "- " + title
+		cost := estimateTokens(h) + 1
+		if outlineUsed+cost > outlineBudget {
+			break
+		}
+		win.Outline = append(win.Outline, h)
+		outlineUsed += cost
+	}
+
+	// Following text, paragraph by paragraph
+	suffixBudget := int(float64(budget) * suffixBudgetShare)
+	var sb strings.Builder
+	suffixUsed := 0
+	for _, block := range splitParagraphs(after) {
+		cost := estimateTokens(block)
+		if suffixUsed+cost > suffixBudget {
+			sb.WriteString(truncateEnd(block, suffixBudget-suffixUsed))
+			suffixUsed = suffixBudget
+			break
+		}
+		sb.WriteString(block)
+		suffixUsed += cost
+	}
+	win.After = sb.String()
+
+	// Preceding text gets everything that is left, walking backwards
+	prefixBudget := budget - outlineUsed - suffixUsed
+	blocks := splitParagraphs(before)
+	prefixUsed := 0
+	start := len(blocks)
+	var head string
+	for start > 0 {
+		block := blocks[start-1]
+		cost := estimateTokens(block)
+		if prefixUsed+cost > prefixBudget {
+			head = truncateStart(block, prefixBudget-prefixUsed)
+			break
+		}
+		prefixUsed += cost
+		start--
+	}
+	win.Before = head + strings.Join(blocks[start:], "")
+
+	return win
+}
+
+// buildAutocompletePrompt renders a window into the user prompt for the model
+func buildAutocompletePrompt(win autocompleteWindow) string {
+	var b strings.Builder
+
+	if len(win.Outline) > 0 {
+		b.WriteString("Document outline:\n")
+		for _, h := range win.Outline {
+			b.WriteString(h)
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+	}
+	if win.Section != "" {
+		fmt.Fprintf(&b, "The writer is in the section: %s\n\n", win.Section)
+	}
+
+	b.WriteString("Text before the cursor:\n<before>")
+	b.WriteString(win.Before)
+	b.WriteString("</before>\n")
+
+	if strings.TrimSpace(win.After) != "" {
+		b.WriteString("\nText after the cursor:\n<after>")
+		b.WriteString(win.After)
+		b.WriteString("</after>\n")
+		b.WriteString("\nWrite the text that belongs at the cursor so that it flows into the text after it.")
+	} else {
+		b.WriteString("\nContinue the text from the cursor.")
+	}
+
+	return b.String()
+}
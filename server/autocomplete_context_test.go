@@ -0,0 +1,261 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"a", 1},
+		{"hello", 2}, // 5 letters, one token per 4 bytes
+		{"a b", 2},   // single spaces merge into the next word
+		{"a  b", 3},  // longer whitespace runs are a token
+		{"hello, world!", 6},
+		{"12345678", 2},
+		{"...", 3},   // punctuation is a token per character
+		{"héllo", 2}, // runs are measured in bytes
+		{"日本語", 3},
+		{"😀😀", 2},
+		{"line\n\nnext", 3},
+	} {
+		if got := estimateTokens(tc.in); got != tc.want {
+			t.Errorf("estimateTokens(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseHeading(t *testing.T) {
+	for _, tc := range []struct {
+		line  string
+		level int
+		title string
+	}{
+		{"# Title", 1, "Title"},
+		{"###### Six", 6, "Six"},
+		{"  ## Indented  ", 2, "Indented"},
+		{"####### Seven", 0, ""},
+		{"#NoSpace", 0, ""},
+		{"#", 0, ""},
+		{"# ", 0, ""},
+		{"plain text", 0, ""},
+		{"", 0, ""},
+	} {
+		level, title := parseHeading(tc.line)
+		if level != tc.level || title != tc.title {
+			t.Errorf("parseHeading(%q) = %d, %q, want %d, %q", tc.line, level, title, tc.level, tc.title)
+		}
+	}
+}
+
+func TestSplitParagraphs(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"one", []string{"one"}},
+		{"one\ntwo", []string{"one\ntwo"}},
+		{"one\n\ntwo", []string{"one\n\n", "two"}},
+		{"one\n\n\n\ntwo\n", []string{"one\n\n\n\n", "two\n"}},
+		{"one\n\n", []string{"one\n\n"}},
+		{"\n\none", []string{"\n\n", "one"}},
+	} {
+		got := splitParagraphs(tc.in)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitParagraphs(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+		if joined := strings.Join(got, ""); joined != tc.in {
+			t.Errorf("splitParagraphs(%q) joins back to %q", tc.in, joined)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	words := "alpha beta gamma delta epsilon zeta eta theta iota kappa"
+	for _, tc := range []struct {
+		name          string
+		in            string
+		budget        int
+		wantStart     string
+		wantEnd       string
+		checkBoundary bool
+	}{
+		{"fits", words, 100, words, words, true},
+		{"exact fit", "alpha beta", estimateTokens("alpha beta"), "alpha beta", "alpha beta", true},
+		{"no budget", words, 0, "", "", true},
+		{"negative budget", words, -3, "", "", true},
+		{"a few words", words, 6, "eta theta iota kappa", "alpha beta gamma", true},
+		{"one word", words, 2, "kappa", "alpha", true},
+		{"multi-byte words", "café crème brûlée soufflé", 5, "brûlée soufflé", "café crème", true},
+		// Without spaces the cut falls between runes, never inside one
+		{"no spaces", "a" + strings.Repeat("日本語", 20) + "a", 5, "", "", false},
+		{"empty", "", 5, "", "", true},
+	} {
+		start, end := truncateStart(tc.in, tc.budget), truncateEnd(tc.in, tc.budget)
+		for _, got := range []struct {
+			fn, s string
+			ok    bool
+			want  string
+		}{
+			{"truncateStart", start, strings.HasSuffix(tc.in, start), tc.wantStart},
+			{"truncateEnd", end, strings.HasPrefix(tc.in, end), tc.wantEnd},
+		} {
+			if !got.ok {
+				t.Errorf("%s: %s = %q is not part of the input's %s", tc.name, got.fn, got.s, got.fn[len("truncate"):])
+			}
+			if !utf8.ValidString(got.s) {
+				t.Errorf("%s: %s = %q splits a rune", tc.name, got.fn, got.s)
+			}
+			if n := estimateTokens(got.s); n > tc.budget && got.s != "" {
+				t.Errorf("%s: %s = %q is %d tokens, over %d", tc.name, got.fn, got.s, n, tc.budget)
+			}
+			if tc.checkBoundary && got.s != got.want {
+				t.Errorf("%s: %s = %q, want %q", tc.name, got.fn, got.s, got.want)
+			}
+		}
+		if !tc.checkBoundary && tc.budget > 0 && (start == "" || end == "") {
+			t.Errorf("%s: kept nothing: start %q, end %q", tc.name, start, end)
+		}
+	}
+}
+
+func TestBuildAutocompleteWindow(t *testing.T) {
+	doc := "# Intro\n\nCafé au lait.\n\n## Details\n\nMore text here.\n\n# Outro\n\nBye."
+	cursorAfter := func(prefix string) int {
+		return len(prefix)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		cursor  int
+		section string
+		before  string
+		after   string
+	}{
+		{"after a multi-byte rune", cursorAfter("# Intro\n\nCafé"), "Intro", "# Intro\n\nCafé", " au lait.\n\n## Details\n\nMore text here.\n\n# Outro\n\nBye."},
+		// A cursor inside a rune moves back to its start
+		{"inside a rune", cursorAfter("# Intro\n\nCaf") + 1, "Intro", "# Intro\n\nCaf", "é au lait.\n\n## Details\n\nMore text here.\n\n# Outro\n\nBye."},
+		{"start", 0, "", "", doc},
+		{"in a subsection", cursorAfter("# Intro\n\nCafé au lait.\n\n## Details\n\nMore"), "Details", "# Intro\n\nCafé au lait.\n\n## Details\n\nMore", " text here.\n\n# Outro\n\nBye."},
+		{"end", len(doc), "Outro", doc, ""},
+		{"past the end", 1000, "Outro", doc, ""},
+		{"negative", -1, "Outro", doc, ""},
+	} {
+		win := buildAutocompleteWindow(doc, tc.cursor, autocompleteContextTokens)
+		if win.Section != tc.section || win.Before != tc.before || win.After != tc.after {
+			t.Errorf("%s: window = %+v", tc.name, win)
+		}
+		if want := []string{"- Intro", "  - Details", "- Outro"}; !reflect.DeepEqual(win.Outline, want) {
+			t.Errorf("%s: outline = %q, want %q", tc.name, win.Outline, want)
+		}
+	}
+}
+
+func TestUTF16Offset(t *testing.T) {
+	s := "a😀é\nb" // 😀 is a surrogate pair in UTF-16
+	for _, tc := range []struct {
+		units  int
+		offset int
+		ok     bool
+	}{
+		{0, 0, true},
+		{1, 1, true},
+		{2, 0, false}, // between the halves of 😀
+		{3, 5, true},
+		{4, 7, true},
+		{6, 9, true},
+		{7, 0, false},
+		{-1, 0, false},
+	} {
+		offset, ok := utf16Offset(s, tc.units)
+		if offset != tc.offset || ok != tc.ok {
+			t.Errorf("utf16Offset(%q, %d) = %d, %v, want %d, %v", s, tc.units, offset, ok, tc.offset, tc.ok)
+		}
+	}
+	if offset, ok := utf16Offset("", 0); offset != 0 || !ok {
+		t.Errorf("utf16Offset of an empty string = %d, %v", offset, ok)
+	}
+}
+
+func TestBuildAutocompleteWindowBudget(t *testing.T) {
+	var paragraphs []string
+	for i := 0; i < 200; i++ {
+		paragraphs = append(paragraphs, "# Heading\n\n"+strings.Repeat("Some words to fill the paragraph. ", 5))
+	}
+	doc := strings.Join(paragraphs, "\n\n")
+	cursor := len(doc) / 2
+	before, after := doc[:cursor], doc[cursor:] // the document is ASCII
+
+	for _, budget := range []int{0, 10, 100, 500, 3000} {
+		win := buildAutocompleteWindow(doc, cursor, budget)
+		if !strings.HasSuffix(before, win.Before) || !strings.HasPrefix(after, win.After) {
+			t.Errorf("budget %d: window is not around the cursor: %+v", budget, win)
+		}
+		used := estimateTokens(win.Before) + estimateTokens(win.After)
+		for _, h := range win.Outline {
+			used += estimateTokens(h) + 1
+		}
+		if used > budget {
+			t.Errorf("budget %d: window uses %d tokens", budget, used)
+		}
+		if outline := len(win.Outline); budget >= 500 && outline == 0 {
+			t.Errorf("budget %d: no outline", budget)
+		}
+		if budget >= 100 && (win.Before == "" || win.After == "") {
+			t.Errorf("budget %d: empty side: %+v", budget, win)
+		}
+	}
+}
+
+func TestBuildAutocompletePrompt(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		win      autocompleteWindow
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "continuation",
+			win:      autocompleteWindow{Before: "Once upon"},
+			contains: []string{"<before>Once upon</before>", "Continue the text from the cursor."},
+			excludes: []string{"outline", "section", "<after>"},
+		},
+		{
+			name: "fill in the middle",
+			win:  autocompleteWindow{Outline: []string{"- Intro", "  - Details"}, Section: "Details", Before: "a", After: " b"},
+			contains: []string{
+				"Document outline:\n- Intro\n  - Details\n\n",
+				"The writer is in the section: Details\n",
+				"<before>a</before>",
+				"<after> b</after>",
+				"flows into the text after it",
+			},
+			excludes: []string{"Continue the text"},
+		},
+		{
+			name:     "only whitespace after",
+			win:      autocompleteWindow{Before: "a", After: "\n\n"},
+			contains: []string{"Continue the text from the cursor."},
+			excludes: []string{"<after>"},
+		},
+	} {
+		prompt := buildAutocompletePrompt(tc.win)
+		for _, want := range tc.contains {
+			if !strings.Contains(prompt, want) {
+				t.Errorf("%s: prompt is missing %q:\n%s", tc.name, want, prompt)
+			}
+		}
+		for _, unwanted := range tc.excludes {
+			if strings.Contains(prompt, unwanted) {
+				t.Errorf("%s: prompt has %q:\n%s", tc.name, unwanted, prompt)
+			}
+		}
+	}
+}
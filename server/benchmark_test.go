@@ -12,6 +12,8 @@ import (
 	"github.com/quic-go/webtransport-go"
 )
 
+// The WebSocket benchmark needs the API listener served over TLS
+// (tls.serveHttp / -tls-http)
 const (
 	wsURL = "wss://localhost:8080/collab/bench-room"
 	wtURL = "https://localhost:4433/collab/bench-room"
@@ -108,6 +110,72 @@ func BenchmarkWebTransportLatency(b *testing.B) {
 	}
 }
 
+// BenchmarkLogAppend measures how fast a room applies and logs keystroke
+// sized updates; it needs no running server
+func BenchmarkLogAppend(b *testing.B) {
+	for _, fsync := range []bool{false, true} {
+		b.Run(fmt.Sprintf("fsync=%v", fsync), func(b *testing.B) {
+			store := testStore(b, 1000)
+			store.cfg.Fsync = fsync
+			state, err := loadDocState("bench", 10, store)
+			if err != nil {
+				b.Fatalf("loadDocState: %v", err)
+			}
+			defer state.Close()
+
+			editor := NewYDoc()
+			updates := make([][]byte, b.N)
+			for i := range updates {
+				updates[i] = insertText(editor, "t", "x")
+			}
+			b.SetBytes(int64(len(updates[0])))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := state.Apply(updates[i], "bench", Author{}); err != nil {
+					b.Fatalf("Apply: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRoomRecovery measures how long a large room takes to load after
+// a crash, from the log alone and from a compacted state plus its tail
+func BenchmarkRoomRecovery(b *testing.B) {
+	const edits = 20000
+	for _, tail := range []int{edits, 500} {
+		b.Run(fmt.Sprintf("tail=%d", tail), func(b *testing.B) {
+			store := testStore(b, edits+1)
+			state, err := loadDocState("bench", 10, store)
+			if err != nil {
+				b.Fatalf("loadDocState: %v", err)
+			}
+			editor := NewYDoc()
+			for i := 0; i < edits; i++ {
+				if i == edits-tail {
+					state.Compact()
+				}
+				if err := state.Apply(insertText(editor, "t", "word "), "bench", Author{}); err != nil {
+					b.Fatalf("Apply: %v", err)
+				}
+			}
+			// Stop without the compaction Close does, as a crash would
+			_ = state.log.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				recovered, err := loadDocState("bench", 10, store)
+				if err != nil {
+					b.Fatalf("loadDocState: %v", err)
+				}
+				b.StopTimer()
+				_ = recovered.log.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
 func TestRunBenchmarks(t *testing.T) {
 	fmt.Println("Running Benchmarks...")
 	fmt.Println("Ensure server is running with: go run .")
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// WebTransport with serverCertificateHashes requires short-lived certs (max 14 days)
+const selfSignedValidity = 10 * 24 * time.Hour
+
+// CertManager serves the TLS certificate for the HTTP/3 server. It reloads
+// the certificate when the files change, regenerates self-signed development
+// certificates before they expire, and remembers previously served
+// certificates until they expire so clients pinning their hashes keep working
+// during a rotation.
+type CertManager struct {
+	cfg TLSConfig
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	leaf     *x509.Certificate
+	previous []*x509.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewCertManager loads (and in self-signed mode, creates) the certificate
+func NewCertManager(cfg TLSConfig) (*CertManager, error) {
+	m := &CertManager{cfg: cfg, stop: make(chan struct{})}
+
+	if cfg.SelfSigned {
+		if err := m.renewIfNeeded(); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (m *CertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cert, nil
+}
+
+// TLSConfig returns a tls.Config that always serves the current certificate.
+// It is shared by the HTTP/3 server and, when enabled, the TLS API listener.
+func (m *CertManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// NotAfter returns the expiry of the current certificate
+func (m *CertManager) NotAfter() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.leaf.NotAfter
+}
+
+// Hashes returns the base64 SHA-256 hashes of every certificate that is
+// still valid, the current one first
+func (m *CertManager) Hashes() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	hashes := []string{certHash(m.leaf)}
+	for i := len(m.previous) - 1; i >= 0; i-- {
+		if now.Before(m.previous[i].NotAfter) {
+			hashes = append(hashes, certHash(m.previous[i]))
+		}
+	}
+	return hashes
+}
+
+// Watch polls for certificate changes until Close is called
+func (m *CertManager) Watch() {
+	ticker := time.NewTicker(m.cfg.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if m.cfg.SelfSigned {
+				if err := m.renewIfNeeded(); err != nil {
+					log.Printf("[ERROR] Failed to renew self-signed certificate: %v", err)
+				}
+			}
+			if m.changed() {
+				if err := m.reload(); err != nil {
+					// Keep serving the old certificate until the files are fixed
+					log.Printf("[ERROR] Failed to reload certificate: %v", err)
+				}
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Close stops Watch
+func (m *CertManager) Close() {
+	m.once.Do(func() { close(m.stop) })
+}
+
+// changed reports whether the certificate or key file was modified since the
+// last load
+func (m *CertManager) changed() bool {
+	certInfo, err := os.Stat(m.cfg.CertFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(m.cfg.KeyFile)
+	if err != nil {
+		return false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return !certInfo.ModTime().Equal(m.certMod) || !keyInfo.ModTime().Equal(m.keyMod)
+}
+
+// reload reads the key pair from disk and makes it the current certificate
+func (m *CertManager) reload() error {
+	certInfo, err := os.Stat(m.cfg.CertFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(m.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(m.cfg.CertFile, m.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parse certificate: %w", err)
+	}
+	cert.Leaf = leaf
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.leaf != nil && !m.leaf.Equal(leaf) {
+		m.previous = append(m.previous, m.leaf)
+		// Forget certificates that can no longer be presented by anyone
+		now := time.Now()
+		kept := m.previous[:0]
+		for _, prev := range m.previous {
+			if now.Before(prev.NotAfter) {
+				kept = append(kept, prev)
+			}
+		}
+		m.previous = kept
+	}
+	m.cert = &cert
+	m.leaf = leaf
+	m.certMod = certInfo.ModTime()
+	m.keyMod = keyInfo.ModTime()
+
+	sha256Hash := sha256.Sum256(leaf.Raw)
+	log.Printf("[INFO] Loaded certificate %s (SHA-256 %x), valid until %s",
+		m.cfg.CertFile, sha256Hash, leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// renewIfNeeded generates a new self-signed certificate if there is none or
+// the existing one expires within RenewBefore
+func (m *CertManager) renewIfNeeded() error {
+	certPEM, err := os.ReadFile(m.cfg.CertFile)
+	if err == nil {
+		if block, _ := pem.Decode(certPEM); block != nil {
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil &&
+				time.Until(cert.NotAfter) > m.cfg.RenewBefore {
+				return nil
+			}
+		}
+		log.Printf("[INFO] Self-signed certificate %s is expiring or unreadable, regenerating", m.cfg.CertFile)
+	} else if !os.IsNotExist(err) {
+		return err
+	} else {
+		log.Println("Generating self-signed certificates for WebTransport...")
+	}
+
+	return generateCert(m.cfg.CertFile, m.cfg.KeyFile)
+}
+
+// certHash is the base64 SHA-256 of a certificate, as WebTransport's
+// serverCertificateHashes expects
+func certHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Helper to generate self-signed certs
+func generateCert(certFile, keyFile string) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate private key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("generate serial number: %w", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"WritePad Dev"},
+		},
+		NotBefore: time.Now().Add(-time.Minute),
+		NotAfter:  time.Now().Add(selfSignedValidity),
+
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		DNSNames:              []string{"localhost"},
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return fmt.Errorf("create certificate: %w", err)
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("marshal private key: %w", err)
+	}
+
+	// Write the key first: a watcher that sees the new certificate must find
+	// the matching key already in place
+	if err := writePEMAtomic(keyFile, "EC PRIVATE KEY", keyBytes, 0o600); err != nil {
+		return fmt.Errorf("write key: %w", err)
+	}
+	if err := writePEMAtomic(certFile, "CERTIFICATE", derBytes, 0o644); err != nil {
+		return fmt.Errorf("write cert: %w", err)
+	}
+	return nil
+}
+
+// writePEMAtomic writes a PEM block via a temporary file and rename so
+// readers never see a partially written file
+func writePEMAtomic(path, blockType string, der []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if err := pem.Encode(tmp, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
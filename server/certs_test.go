@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertManagerRotation(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultConfig().TLS
+	cfg.CertFile = filepath.Join(dir, "cert.pem")
+	cfg.KeyFile = filepath.Join(dir, "key.pem")
+
+	m, err := NewCertManager(cfg)
+	if err != nil {
+		t.Fatalf("NewCertManager: %v", err)
+	}
+	first := m.Hashes()
+	if len(first) != 1 {
+		t.Fatalf("Hashes() = %v, want one hash for a fresh certificate", first)
+	}
+
+	// Simulate an external rotation of the files
+	if err := generateCert(cfg.CertFile, cfg.KeyFile); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Second)
+	_ = os.Chtimes(cfg.CertFile, future, future)
+	if !m.changed() {
+		t.Fatal("changed() = false after the files were replaced")
+	}
+	if err := m.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	hashes := m.Hashes()
+	if len(hashes) != 2 || hashes[1] != first[0] || hashes[0] == first[0] {
+		t.Errorf("Hashes() = %v, want the new hash followed by %s", hashes, first[0])
+	}
+	cert, _ := m.GetCertificate(nil)
+	if certHash(cert.Leaf) != hashes[0] {
+		t.Errorf("GetCertificate does not serve the reloaded certificate")
+	}
+}
+
+func TestCertManagerRenewsExpiringSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultConfig().TLS
+	cfg.CertFile = filepath.Join(dir, "cert.pem")
+	cfg.KeyFile = filepath.Join(dir, "key.pem")
+
+	m, err := NewCertManager(cfg)
+	if err != nil {
+		t.Fatalf("NewCertManager: %v", err)
+	}
+	before := m.Hashes()[0]
+
+	// A certificate within RenewBefore of its expiry gets replaced
+	m.cfg.RenewBefore = selfSignedValidity + time.Hour
+	if err := m.renewIfNeeded(); err != nil {
+		t.Fatalf("renewIfNeeded: %v", err)
+	}
+	if err := m.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if m.Hashes()[0] == before {
+		t.Errorf("certificate was not renewed")
+	}
+}
@@ -1,23 +1,154 @@
 package main
 
 import (
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/google/uuid"
 )
 
+// Close codes sent when the server ends a connection. They are used as the
+// WebSocket close status and as the WebTransport session error code, so both
+// transports report the same number.
+const (
+	ClosePolicyViolation = 1008 // Broke collab.maxMessageSize or the rate limits
+
+	CloseKicked     = 4000 // Disconnected by an administrator
+	CloseRoomClosed = 4001 // The room was closed by an administrator or its document deleted
+	CloseRoomFull   = 4002 // The room has collab.maxClientsPerRoom clients
+	CloseServerFull = 4003 // The server is at collab.maxRooms or collab.maxConnections
+)
+
 // Client represents a connected client (WebSocket or WebTransport)
 type Client struct {
-	ID       string
-	Room     *Room
-	Send     chan []byte
-	Protocol string // "WebSocket" or "WebTransport"
+	ID          string
+	Room        *Room
+	Send        chan []byte
+	Protocol    string // "WebSocket" or "WebTransport"
+	ConnectedAt time.Time
+	// User is the authenticated user, "" for an anonymous or trusted client
+	User string
+	// Role is the client's role on the room's document when it joined. The
+	// server only applies edits from editors and owners directly.
+	Role Role
+
+	// docClient is the Y.js client ID the session edits with, once an
+	// update of its own has shown it. declared is the ID its awareness
+	// updates name, which is only believed once an update confirms it.
+	docMu       sync.Mutex
+	docClient   uint64
+	docKnown    bool
+	declared    uint64
+	hasDeclared bool
+
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	limiter  *inboundLimiter
+
+	done        chan struct{}
+	closeOnce   sync.Once
+	closeCode   int
+	closeReason string
 }
 
 // NewClient creates a new client
 func NewClient(room *Room, protocol string) *Client {
 	return &Client{
-		ID:       uuid.New().String(),
-		Room:     room,
-		Send:     make(chan []byte, 256),
-		Protocol: protocol,
+		ID:          uuid.New().String(),
+		Room:        room,
+		Send:        make(chan []byte, room.Hub.config.SendBuffer),
+		Protocol:    protocol,
+		ConnectedAt: time.Now(),
+		Role:        RoleOwner,
+		limiter:     newInboundLimiter(room.Hub.config),
+		done:        make(chan struct{}),
+	}
+}
+
+// DocClient returns the Y.js client ID the session edits with, if known
+func (c *Client) DocClient() (uint64, bool) {
+	c.docMu.Lock()
+	defer c.docMu.Unlock()
+	return c.docClient, c.docKnown
+}
+
+// setDocClient records the session's Y.js client ID; later calls are
+// ignored, so a session cannot move to another client ID
+func (c *Client) setDocClient(id uint64) {
+	c.docMu.Lock()
+	defer c.docMu.Unlock()
+	if !c.docKnown {
+		c.docClient, c.docKnown = id, true
+	}
+}
+
+// declareDocClient records the Y.js client ID the session's awareness
+// updates name, for a later update to confirm
+func (c *Client) declareDocClient(id uint64) {
+	c.docMu.Lock()
+	defer c.docMu.Unlock()
+	c.declared, c.hasDeclared = id, true
+}
+
+// declaredDocClient returns the Y.js client ID the session declared, if any
+func (c *Client) declaredDocClient() (uint64, bool) {
+	c.docMu.Lock()
+	defer c.docMu.Unlock()
+	return c.declared, c.hasDeclared
+}
+
+// Author is who the session's updates come from
+func (c *Client) Author() Author {
+	id, known := c.DocClient()
+	return Author{User: c.User, Client: id, Known: known}
+}
+
+// Close asks the transport to end the connection with code and reason. Only
+// the first call has an effect.
+func (c *Client) Close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.done)
+	})
+}
+
+// Done is closed when Close has been called
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// CloseStatus returns the code and reason given to Close
+func (c *Client) CloseStatus() (int, string) {
+	<-c.done
+	return c.closeCode, c.closeReason
+}
+
+// ClientInfo is a point-in-time view of a client for the admin API
+type ClientInfo struct {
+	ID            string    `json:"id"`
+	Protocol      string    `json:"protocol"`
+	User          string    `json:"user,omitempty"`
+	Role          Role      `json:"role"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+	BytesIn       int64     `json:"bytesIn"`
+	BytesOut      int64     `json:"bytesOut"`
+	SendQueue     int       `json:"sendQueue"`
+	SendQueueSize int       `json:"sendQueueSize"`
+}
+
+// Info reports the client's traffic counters and send queue depth
+func (c *Client) Info() ClientInfo {
+	return ClientInfo{
+		ID:            c.ID,
+		Protocol:      c.Protocol,
+		User:          c.User,
+		Role:          c.Role,
+		ConnectedAt:   c.ConnectedAt,
+		BytesIn:       c.bytesIn.Load(),
+		BytesOut:      c.bytesOut.Load(),
+		SendQueue:     len(c.Send),
+		SendQueueSize: cap(c.Send),
 	}
 }
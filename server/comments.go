@@ -0,0 +1,597 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// messageComment is the y-websocket message type carrying a comment event,
+// framed like a system notice
+const messageComment = 101
+
+// streamComments is the type of the unidirectional WebTransport stream
+// comment events are delivered on: the server opens one per session on the
+// first event, and writes each event to it as a two-byte length and the
+// JSON
+const streamComments = 0x06
+
+// Limits on comments
+const (
+	maxCommentLength  = 8000
+	maxThreadsPerRoom = 1000
+	maxThreadComments = 500
+	maxAnchorLength   = 256
+)
+
+// CommentThread is a discussion anchored to a range of the document: the
+// opening comment and its replies, oldest first
+type CommentThread struct {
+	ID         string        `json:"id"`
+	Anchor     CommentAnchor `json:"anchor"`
+	Comments   []Comment     `json:"comments"`
+	Resolved   bool          `json:"resolved"`
+	ResolvedBy string        `json:"resolvedBy,omitempty"`
+	ResolvedAt *time.Time    `json:"resolvedAt,omitempty"`
+	CreatedAt  time.Time     `json:"createdAt"`
+	UpdatedAt  time.Time     `json:"updatedAt"`
+}
+
+// CommentAnchor is the commented range as two Y.js relative positions,
+// base64 of Y.encodeRelativePosition, so it follows the text as it is
+// edited
+type CommentAnchor struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Quote is the commented text when the thread was opened
+	Quote string `json:"quote"`
+	// Text is the range's text now, and Detached is set once the text the
+	// thread was opened on is gone
+	Text     string `json:"text"`
+	Detached bool   `json:"detached"`
+}
+
+// Comment is one message in a thread
+type Comment struct {
+	ID        string     `json:"id"`
+	Author    string     `json:"author"`
+	Body      string     `json:"body"`
+	CreatedAt time.Time  `json:"createdAt"`
+	EditedAt  *time.Time `json:"editedAt,omitempty"`
+}
+
+// clone copies t so callers cannot modify the room's threads
+func (t *CommentThread) clone() *CommentThread {
+	c := *t
+	c.Comments = append([]Comment{}, t.Comments...)
+	return &c
+}
+
+// comment returns the index of a comment in the thread, or -1
+func (t *CommentThread) comment(id string) int {
+	for i, c := range t.Comments {
+		if c.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// decodeAnchorPosition decodes one end of an anchor
+func decodeAnchorPosition(encoded string) (*yRelativePosition, error) {
+	if encoded == "" || len(encoded) > maxAnchorLength {
+		return nil, fmt.Errorf("must be 1 to %d bytes", maxAnchorLength)
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("is not base64")
+	}
+	return decodeRelativePosition(b)
+}
+
+// anchorText resolves an anchor against the document; ok is false if
+// either end is not in the document
+func (d *YDoc) anchorText(a CommentAnchor) (text string, ok bool) {
+	start, err1 := decodeAnchorPosition(a.Start)
+	end, err2 := decodeAnchorPosition(a.End)
+	if err1 != nil || err2 != nil {
+		return "", false
+	}
+	from, ok1 := d.resolveRelativePosition(start)
+	to, ok2 := d.resolveRelativePosition(end)
+	if !ok1 || !ok2 {
+		return "", false
+	}
+	return d.textBetween(from, to), true
+}
+
+// resolve fills in the anchor's current text; s.mu must be held
+func (s *DocState) resolve(t *CommentThread) *CommentThread {
+	c := t.clone()
+	text, ok := s.doc.anchorText(c.Anchor)
+	c.Anchor.Text = text
+	c.Anchor.Detached = c.Anchor.Quote != "" && (!ok || text == "")
+	return c
+}
+
+// Threads returns the document's comment threads, oldest first, with their
+// anchors resolved against the current document
+func (s *DocState) Threads() []*CommentThread {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	threads := make([]*CommentThread, 0, len(s.threads))
+	for _, t := range s.threads {
+		threads = append(threads, s.resolve(t))
+	}
+	return threads
+}
+
+// Thread returns one comment thread
+func (s *DocState) Thread(id string) (*CommentThread, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.threads {
+		if t.ID == id {
+			return s.resolve(t), true
+		}
+	}
+	return nil, false
+}
+
+// OpenThread starts a thread on the range between two encoded relative
+// positions. The quoted text is taken from the server's document; a range
+// the server has not received yet is accepted with an empty quote.
+func (s *DocState) OpenThread(anchor CommentAnchor, first Comment) (*CommentThread, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.threads) >= maxThreadsPerRoom {
+		return nil, errConflict(fmt.Sprintf("The document already has %d comment threads", maxThreadsPerRoom))
+	}
+	anchor.Quote, _ = s.doc.anchorText(anchor)
+	t := &CommentThread{
+		ID:        uuid.New().String(),
+		Anchor:    anchor,
+		Comments:  []Comment{first},
+		CreatedAt: first.CreatedAt,
+		UpdatedAt: first.CreatedAt,
+	}
+	if err := s.saveThreads(append(s.threads, t)); err != nil {
+		return nil, err
+	}
+	s.threads = append(s.threads, t)
+	return s.resolve(t), nil
+}
+
+// EditThread changes a thread with fn, which works on a copy; the change is
+// kept only if fn succeeds and the threads are saved
+func (s *DocState) EditThread(id string, fn func(t *CommentThread) error) (*CommentThread, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.threads {
+		if t.ID != id {
+			continue
+		}
+		edited := t.clone()
+		if err := fn(edited); err != nil {
+			return nil, err
+		}
+		threads := append([]*CommentThread{}, s.threads...)
+		threads[i] = edited
+		if err := s.saveThreads(threads); err != nil {
+			return nil, err
+		}
+		s.threads = threads
+		return s.resolve(edited), nil
+	}
+	return nil, errNotFound("Comment thread not found")
+}
+
+// DeleteThread removes a thread with all its comments
+func (s *DocState) DeleteThread(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.threads {
+		if t.ID != id {
+			continue
+		}
+		threads := append(append([]*CommentThread{}, s.threads[:i]...), s.threads[i+1:]...)
+		if err := s.saveThreads(threads); err != nil {
+			return err
+		}
+		s.threads = threads
+		return nil
+	}
+	return errNotFound("Comment thread not found")
+}
+
+// saveThreads writes threads to the room's directory; s.mu must be held
+func (s *DocState) saveThreads(threads []*CommentThread) error {
+	if s.log == nil {
+		return nil
+	}
+	return s.log.SaveComments(threads)
+}
+
+// CommentEvent is delivered live to the clients of a room when a thread
+// changes
+type CommentEvent struct {
+	// Type is thread.opened, thread.resolved, thread.reopened,
+	// thread.deleted, comment.added, comment.edited or comment.deleted
+	Type     string `json:"type"`
+	Document string `json:"document"`
+	Thread   string `json:"thread"`
+	// Anchor comes with thread.opened
+	Anchor *CommentAnchor `json:"anchor,omitempty"`
+	// Comment comes with thread.opened and the comment events; for
+	// comment.deleted only its ID is set
+	Comment *Comment  `json:"comment,omitempty"`
+	By      string    `json:"by"`
+	Time    time.Time `json:"time"`
+}
+
+// encode returns the event framed for WebSocket (a y-protocol message:
+// varuint type, then the JSON as a varstring) and for WebTransport (the
+// stream type byte, then the JSON)
+func (ev CommentEvent) encode() (wsMsg, wtMsg []byte) {
+	payload, _ := json.Marshal(ev)
+
+	wsMsg = binary.AppendUvarint(nil, messageComment)
+	wsMsg = binary.AppendUvarint(wsMsg, uint64(len(payload)))
+	wsMsg = append(wsMsg, payload...)
+
+	wtMsg = append([]byte{streamComments}, payload...)
+	return wsMsg, wtMsg
+}
+
+// commentRequest is the body of the requests that add or edit a comment
+type commentRequest struct {
+	Body string `json:"body"`
+	// Author names the commenter while authentication is off; users always
+	// comment as themselves
+	Author string         `json:"author"`
+	Anchor *CommentAnchor `json:"anchor"`
+	// Resolved resolves or reopens a thread
+	Resolved *bool `json:"resolved"`
+}
+
+// decodeCommentRequest reads a commentRequest
+func decodeCommentRequest(r *http.Request) (commentRequest, error) {
+	var req commentRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		return req, errBadRequest("Invalid request body: %v", err)
+	}
+	req.Body = strings.TrimSpace(req.Body)
+	req.Author = strings.TrimSpace(req.Author)
+	if req.Author == "" {
+		req.Author = "anonymous"
+	}
+	if len(req.Author) > 200 {
+		return req, errBadRequest("author must be at most 200 bytes")
+	}
+	return req, nil
+}
+
+// newComment validates the body of a new or edited comment
+func newComment(req commentRequest, author string) (Comment, error) {
+	if req.Body == "" || len(req.Body) > maxCommentLength {
+		return Comment{}, errBadRequest("body must be 1 to %d bytes", maxCommentLength)
+	}
+	return Comment{ID: uuid.New().String(), Author: author, Body: req.Body, CreatedAt: time.Now().UTC()}, nil
+}
+
+// commentAuthor is who a request comments as: the user, or with
+// authentication off the author named in the body
+func commentAuthor(caller Caller, req commentRequest) string {
+	if caller.Trusted {
+		return req.Author
+	}
+	return caller.User
+}
+
+// callerName names the caller in events that have no request body
+func callerName(caller Caller) string {
+	if caller.User == "" {
+		return "anonymous"
+	}
+	return caller.User
+}
+
+// mayModerate reports whether the caller may edit or delete what author
+// wrote: authors may change their own comments, and owners may delete
+// anyone's
+func mayModerate(caller Caller, doc Document, author string, deleting bool) bool {
+	if caller.Trusted || caller.User == author {
+		return true
+	}
+	return deleting && caller.Role(doc) == RoleOwner
+}
+
+// CommentRoutes returns the comment API of a document, mounted at
+// /api/documents/{id}/comments
+func CommentRoutes(hub *CollaborationHub, docs *Documents) http.Handler {
+	r := chi.NewRouter()
+
+	// document resolves the {id} parameter for a caller with at least min,
+	// and the document's room state, which the caller releases
+	document := func(w http.ResponseWriter, r *http.Request, min Role) (Document, *DocState, bool) {
+		doc, ok := docs.Get(chi.URLParam(r, "id"))
+		if !ok {
+			writeError(w, r, errNotFound("Document not found"))
+			return doc, nil, false
+		}
+		if err := requireRole(callerFrom(r), doc, min); err != nil {
+			writeError(w, r, err)
+			return doc, nil, false
+		}
+		state, err := hub.OpenState(doc.RoomID)
+		if err != nil {
+			writeError(w, r, err)
+			return doc, nil, false
+		}
+		return doc, state, true
+	}
+
+	// publish sends an event to everyone in the document's room
+	publish := func(doc Document, ev CommentEvent) {
+		ev.Document = doc.ID
+		ev.Time = time.Now().UTC()
+		if room, ok := hub.Room(doc.RoomID); ok {
+			room.Deliver(ev.encode())
+		}
+	}
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		_, state, ok := document(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		defer hub.ReleaseState(state)
+		threads := state.Threads()
+		switch status := r.URL.Query().Get("status"); status {
+		case "", "all":
+		case "open", "resolved":
+			filtered := threads[:0]
+			for _, t := range threads {
+				if t.Resolved == (status == "resolved") {
+					filtered = append(filtered, t)
+				}
+			}
+			threads = filtered
+		default:
+			writeError(w, r, errBadRequest("status must be open, resolved or all"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"threads": threads})
+	})
+
+	r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		doc, state, ok := document(w, r, RoleCommenter)
+		if !ok {
+			return
+		}
+		defer hub.ReleaseState(state)
+		req, err := decodeCommentRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if req.Anchor == nil {
+			writeError(w, r, errBadRequest("anchor is required"))
+			return
+		}
+		for name, pos := range map[string]string{"anchor.start": req.Anchor.Start, "anchor.end": req.Anchor.End} {
+			if _, err := decodeAnchorPosition(pos); err != nil {
+				writeError(w, r, errBadRequest("%s %v", name, err))
+				return
+			}
+		}
+		caller := callerFrom(r)
+		first, err := newComment(req, commentAuthor(caller, req))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		anchor := CommentAnchor{Start: req.Anchor.Start, End: req.Anchor.End}
+		thread, err := state.OpenThread(anchor, first)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		publish(doc, CommentEvent{Type: "thread.opened", Thread: thread.ID, Anchor: &thread.Anchor, Comment: &first, By: first.Author})
+		log.Printf("[INFO] Comment thread %s opened on document %s by %s", thread.ID, doc.ID, first.Author)
+		w.Header().Set("Location", "/api/documents/"+doc.ID+"/comments/"+thread.ID)
+		writeJSON(w, http.StatusCreated, thread)
+	})
+
+	r.Get("/{threadID}", func(w http.ResponseWriter, r *http.Request) {
+		_, state, ok := document(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		defer hub.ReleaseState(state)
+		thread, ok := state.Thread(chi.URLParam(r, "threadID"))
+		if !ok {
+			writeError(w, r, errNotFound("Comment thread not found"))
+			return
+		}
+		writeJSON(w, http.StatusOK, thread)
+	})
+
+	// Resolving and reopening
+	r.Patch("/{threadID}", func(w http.ResponseWriter, r *http.Request) {
+		doc, state, ok := document(w, r, RoleCommenter)
+		if !ok {
+			return
+		}
+		defer hub.ReleaseState(state)
+		req, err := decodeCommentRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if req.Resolved == nil {
+			writeError(w, r, errBadRequest("resolved is required"))
+			return
+		}
+		by := commentAuthor(callerFrom(r), req)
+		now := time.Now().UTC()
+		thread, err := state.EditThread(chi.URLParam(r, "threadID"), func(t *CommentThread) error {
+			t.Resolved = *req.Resolved
+			t.ResolvedBy, t.ResolvedAt = "", nil
+			if t.Resolved {
+				t.ResolvedBy, t.ResolvedAt = by, &now
+			}
+			t.UpdatedAt = now
+			return nil
+		})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		event := "thread.reopened"
+		if thread.Resolved {
+			event = "thread.resolved"
+		}
+		publish(doc, CommentEvent{Type: event, Thread: thread.ID, By: by})
+		writeJSON(w, http.StatusOK, thread)
+	})
+
+	r.Delete("/{threadID}", func(w http.ResponseWriter, r *http.Request) {
+		doc, state, ok := document(w, r, RoleCommenter)
+		if !ok {
+			return
+		}
+		defer hub.ReleaseState(state)
+		caller := callerFrom(r)
+		thread, ok := state.Thread(chi.URLParam(r, "threadID"))
+		if !ok {
+			writeError(w, r, errNotFound("Comment thread not found"))
+			return
+		}
+		if !mayModerate(caller, doc, thread.Comments[0].Author, true) {
+			writeError(w, r, errForbidden("Only the thread's author and the document's owner may delete it"))
+			return
+		}
+		if err := state.DeleteThread(thread.ID); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		publish(doc, CommentEvent{Type: "thread.deleted", Thread: thread.ID, By: callerName(caller)})
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Replies
+	r.Post("/{threadID}/comments", func(w http.ResponseWriter, r *http.Request) {
+		doc, state, ok := document(w, r, RoleCommenter)
+		if !ok {
+			return
+		}
+		defer hub.ReleaseState(state)
+		req, err := decodeCommentRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		reply, err := newComment(req, commentAuthor(callerFrom(r), req))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		thread, err := state.EditThread(chi.URLParam(r, "threadID"), func(t *CommentThread) error {
+			if len(t.Comments) >= maxThreadComments {
+				return errConflict(fmt.Sprintf("The thread already has %d comments", maxThreadComments))
+			}
+			t.Comments = append(t.Comments, reply)
+			t.UpdatedAt = reply.CreatedAt
+			return nil
+		})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		publish(doc, CommentEvent{Type: "comment.added", Thread: thread.ID, Comment: &reply, By: reply.Author})
+		writeJSON(w, http.StatusCreated, reply)
+	})
+
+	r.Patch("/{threadID}/comments/{commentID}", func(w http.ResponseWriter, r *http.Request) {
+		doc, state, ok := document(w, r, RoleCommenter)
+		if !ok {
+			return
+		}
+		defer hub.ReleaseState(state)
+		req, err := decodeCommentRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		edit, err := newComment(req, "")
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		caller := callerFrom(r)
+		var edited Comment
+		thread, err := state.EditThread(chi.URLParam(r, "threadID"), func(t *CommentThread) error {
+			i := t.comment(chi.URLParam(r, "commentID"))
+			if i < 0 {
+				return errNotFound("Comment not found")
+			}
+			if !mayModerate(caller, doc, t.Comments[i].Author, false) {
+				return errForbidden("Only the author may edit a comment")
+			}
+			t.Comments[i].Body = edit.Body
+			t.Comments[i].EditedAt = &edit.CreatedAt
+			t.UpdatedAt = edit.CreatedAt
+			edited = t.Comments[i]
+			return nil
+		})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		publish(doc, CommentEvent{Type: "comment.edited", Thread: thread.ID, Comment: &edited, By: edited.Author})
+		writeJSON(w, http.StatusOK, edited)
+	})
+
+	r.Delete("/{threadID}/comments/{commentID}", func(w http.ResponseWriter, r *http.Request) {
+		doc, state, ok := document(w, r, RoleCommenter)
+		if !ok {
+			return
+		}
+		defer hub.ReleaseState(state)
+		caller := callerFrom(r)
+		commentID := chi.URLParam(r, "commentID")
+		thread, err := state.EditThread(chi.URLParam(r, "threadID"), func(t *CommentThread) error {
+			i := t.comment(commentID)
+			switch {
+			case i < 0:
+				return errNotFound("Comment not found")
+			case i == 0:
+				return errBadRequest("The first comment is deleted with its thread")
+			case !mayModerate(caller, doc, t.Comments[i].Author, true):
+				return errForbidden("Only the author and the document's owner may delete a comment")
+			}
+			t.Comments = append(t.Comments[:i], t.Comments[i+1:]...)
+			t.UpdatedAt = time.Now().UTC()
+			return nil
+		})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		publish(doc, CommentEvent{Type: "comment.deleted", Thread: thread.ID, Comment: &Comment{ID: commentID}, By: callerName(caller)})
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return r
+}
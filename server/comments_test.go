@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// firstText returns the XmlText of the document's first paragraph
+func firstText(d *YDoc) *yType {
+	paragraph := d.root(defaultFragment).start.content.(*contentType).t
+	return paragraph.start.content.(*contentType).t
+}
+
+// commentEvent reads the next comment event queued for a WebSocket client
+func commentEvent(t *testing.T, client *Client) CommentEvent {
+	t.Helper()
+	for {
+		select {
+		case msg := <-client.Send:
+			d := newYDecoder(msg)
+			if kind, _ := d.readVarUint(); kind != messageComment {
+				continue
+			}
+			payload, err := d.readVarBytes()
+			var ev CommentEvent
+			if err == nil {
+				err = json.Unmarshal(payload, &ev)
+			}
+			if err != nil {
+				t.Fatalf("comment event: %v", err)
+			}
+			return ev
+		default:
+			t.Fatalf("no comment event queued")
+		}
+	}
+}
+
+func TestCommentRoutes(t *testing.T) {
+	store := testStore(t, 1000)
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	hub.UseStore(store)
+	docs, _ := NewDocuments(store)
+	auth := NewAuthenticator(AuthConfig{Users: []UserConfig{
+		{Name: "ada", Token: "ada-token-0123456789"},
+		{Name: "grace", Token: "grace-token-0123456789"},
+		{Name: "linus", Token: "linus-token-0123456789"},
+	}})
+	r := chi.NewRouter()
+	r.Use(auth.Middleware)
+	r.Mount("/api/documents", DocumentRoutes(hub, docs))
+	const ada, grace, linus = "ada-token-0123456789", "grace-token-0123456789", "linus-token-0123456789"
+
+	doc, _ := docs.Create(Document{Title: "Plan", Owner: "ada", Tags: []string{}, Members: map[string]Role{"grace": RoleCommenter, "linus": RoleViewer}})
+	root := &PMNode{Type: "doc", Content: []*PMNode{pmBlock("paragraph", nil, pmText("hello "), pmText("world", "bold"))}}
+	if _, err := hub.ReplaceContent(doc.RoomID, NewYDocFromProseMirror(root), "ada", ""); err != nil {
+		t.Fatal(err)
+	}
+	state, _ := hub.LookupState(doc.RoomID)
+	text := firstText(state.doc)
+	encode := func(p *yRelativePosition) string { return base64.StdEncoding.EncodeToString(p.encode()) }
+	body := `{"body":"Which world?","anchor":{"start":"` + encode(text.relativePosition(6, 0)) + `","end":"` + encode(text.relativePosition(11, -1)) + `"}}`
+	base := "/api/documents/" + doc.ID + "/comments"
+
+	ws := joinTestClient(t, hub, doc.RoomID, "WebSocket")
+	wt := joinTestClient(t, hub, doc.RoomID, "WebTransport")
+
+	if code := authRequest(t, r, linus, http.MethodPost, base, body, nil); code != http.StatusForbidden {
+		t.Errorf("viewer opens a thread: status = %d, want 403", code)
+	}
+	if code := authRequest(t, r, grace, http.MethodPost, base, `{"body":"x","anchor":{"start":"!","end":"AAAA"}}`, nil); code != http.StatusBadRequest {
+		t.Errorf("bad anchor: status = %d, want 400", code)
+	}
+	var thread CommentThread
+	if code := authRequest(t, r, grace, http.MethodPost, base, body, &thread); code != http.StatusCreated {
+		t.Fatalf("open thread: status = %d", code)
+	}
+	if thread.Anchor.Quote != "world" || thread.Anchor.Text != "world" || thread.Anchor.Detached || thread.Comments[0].Author != "grace" {
+		t.Errorf("thread = %+v", thread)
+	}
+	if ev := commentEvent(t, ws); ev.Type != "thread.opened" || ev.Thread != thread.ID || ev.Comment.Body != "Which world?" || ev.By != "grace" {
+		t.Errorf("WebSocket event = %+v", ev)
+	}
+	if msg := <-wt.Send; msg[0] != streamComments {
+		t.Errorf("WebTransport message type = %#x, want the comment stream", msg[0])
+	}
+
+	// Replies: anyone with the commenter role; edits: only the author
+	var reply Comment
+	if code := authRequest(t, r, ada, http.MethodPost, base+"/"+thread.ID+"/comments", `{"body":"This one."}`, &reply); code != http.StatusCreated {
+		t.Fatalf("reply: status = %d", code)
+	}
+	if code := authRequest(t, r, grace, http.MethodPatch, base+"/"+thread.ID+"/comments/"+reply.ID, `{"body":"Mine now"}`, nil); code != http.StatusForbidden {
+		t.Errorf("editing someone else's comment: status = %d, want 403", code)
+	}
+	if code := authRequest(t, r, ada, http.MethodPatch, base+"/"+thread.ID+"/comments/"+reply.ID, `{"body":"This one!"}`, &reply); code != http.StatusOK || reply.Body != "This one!" || reply.EditedAt == nil {
+		t.Errorf("edit: status = %d, reply = %+v", code, reply)
+	}
+	if code := authRequest(t, r, ada, http.MethodDelete, base+"/"+thread.ID+"/comments/"+thread.Comments[0].ID, "", nil); code != http.StatusBadRequest {
+		t.Errorf("deleting the first comment: status = %d, want 400", code)
+	}
+
+	// Resolve, filter, reopen
+	if code := authRequest(t, r, grace, http.MethodPatch, base+"/"+thread.ID, `{"resolved":true}`, &thread); code != http.StatusOK || !thread.Resolved || thread.ResolvedBy != "grace" {
+		t.Errorf("resolve: status = %d, thread = %+v", code, thread)
+	}
+	var list struct{ Threads []CommentThread }
+	authRequest(t, r, linus, http.MethodGet, base+"?status=open", "", &list)
+	if len(list.Threads) != 0 {
+		t.Errorf("open threads = %d, want 0", len(list.Threads))
+	}
+	authRequest(t, r, linus, http.MethodGet, base+"?status=resolved", "", &list)
+	if len(list.Threads) != 1 || len(list.Threads[0].Comments) != 2 {
+		t.Errorf("resolved threads = %+v", list.Threads)
+	}
+	var reopened CommentThread
+	if code := authRequest(t, r, ada, http.MethodPatch, base+"/"+thread.ID, `{"resolved":false}`, &reopened); code != http.StatusOK || reopened.Resolved || reopened.ResolvedAt != nil {
+		t.Errorf("reopen: status = %d, thread = %+v", code, reopened)
+	}
+
+	// The anchor follows the text, and detaches when it is deleted
+	editor := NewYDoc()
+	update, _ := state.Diff(nil)
+	mustApply(t, editor, update)
+	edit := editor.Transact(func(tx *yTransaction) {
+		tx.insert(firstText(editor), nil, newContentString("Oh, "))
+	})
+	if err := ws.Room.ApplyUpdate(edit, ws); err != nil {
+		t.Fatal(err)
+	}
+	authRequest(t, r, grace, http.MethodGet, base+"/"+thread.ID, "", &thread)
+	if thread.Anchor.Text != "world" || thread.Anchor.Detached {
+		t.Errorf("after an insert before it: anchor = %+v", thread.Anchor)
+	}
+	edit = editor.Transact(func(tx *yTransaction) {
+		for it := firstText(editor).start; it != nil; it = it.right {
+			if s, ok := it.content.(*contentString); ok && s.String() == "world" {
+				tx.delete(it)
+			}
+		}
+	})
+	if err := ws.Room.ApplyUpdate(edit, ws); err != nil {
+		t.Fatal(err)
+	}
+	authRequest(t, r, grace, http.MethodGet, base+"/"+thread.ID, "", &thread)
+	if thread.Anchor.Text != "" || !thread.Anchor.Detached || thread.Anchor.Quote != "world" {
+		t.Errorf("after deleting its text: anchor = %+v", thread.Anchor)
+	}
+
+	// Threads are saved with the room
+	reloaded := NewCollaborationHub(DefaultConfig().Collab, nil)
+	reloaded.UseStore(store)
+	if s, ok := reloaded.LookupState(doc.RoomID); !ok || len(s.Threads()) != 1 || len(s.Threads()[0].Comments) != 2 {
+		t.Errorf("threads not recovered")
+	}
+
+	if code := authRequest(t, r, linus, http.MethodDelete, base+"/"+thread.ID, "", nil); code != http.StatusForbidden {
+		t.Errorf("viewer deletes: status = %d, want 403", code)
+	}
+	if code := authRequest(t, r, grace, http.MethodDelete, base+"/"+thread.ID, "", nil); code != http.StatusNoContent {
+		t.Errorf("author deletes: status = %d", code)
+	}
+	if code := authRequest(t, r, grace, http.MethodGet, base+"/"+thread.ID, "", nil); code != http.StatusNotFound {
+		t.Errorf("deleted thread: status = %d, want 404", code)
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete server configuration. It is loaded once at startup
+// from, in increasing order of precedence: built-in defaults, a YAML file,
+// environment variables and command-line flags.
+type Config struct {
+	// Port is the TCP port for the HTTP API and WebSocket collaboration
+	Port int `yaml:"port"`
+	// HTTP3Port is the UDP port for HTTP/3 and WebTransport
+	HTTP3Port int `yaml:"http3Port"`
+	// SinglePort serves everything on Port: the API and WebSocket over TCP
+	// TLS, HTTP/3 and WebTransport over UDP. It implies TLS.ServeHTTP and
+	// overrides HTTP3Port.
+	SinglePort bool `yaml:"singlePort"`
+	// AllowedOrigins are the browser origins allowed to call the API and open
+	// collaboration sessions. "https://*.example.com" allows any subdomain.
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+	// TemplateDir holds extra template kinds (see template_catalog.go)
+	TemplateDir string `yaml:"templateDir"`
+
+	TLS         TLSConfig         `yaml:"tls"`
+	Groq        GroqConfig        `yaml:"groq"`
+	Collab      CollabConfig      `yaml:"collab"`
+	Shutdown    ShutdownConfig    `yaml:"shutdown"`
+	Admin       AdminConfig       `yaml:"admin"`
+	Auth        AuthConfig        `yaml:"auth"`
+	Persistence PersistenceConfig `yaml:"persistence"`
+}
+
+// TLSConfig locates the certificate used by the HTTP/3 server
+type TLSConfig struct {
+	// ServeHTTP also serves the API and WebSocket listener over TLS (with
+	// HTTP/2), sharing the HTTP/3 certificate
+	ServeHTTP bool `yaml:"serveHttp"`
+
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// SelfSigned generates a short-lived development certificate when the
+	// files are missing and regenerates it RenewBefore its expiry. Turn it off
+	// when bringing your own certificate.
+	SelfSigned  bool          `yaml:"selfSigned"`
+	RenewBefore time.Duration `yaml:"renewBefore"`
+	// ReloadInterval is how often the files are checked for changes
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+// GroqConfig configures the AI backend
+type GroqConfig struct {
+	APIKey   string        `yaml:"apiKey"`
+	Endpoint string        `yaml:"endpoint"`
+	Model    string        `yaml:"model"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// CollabConfig tunes the collaboration hub
+type CollabConfig struct {
+	// SendBuffer is the number of messages queued per client before
+	// further messages to it are dropped
+	SendBuffer int `yaml:"sendBuffer"`
+	// MaxClientsPerRoom, MaxRooms and MaxConnections cap how many clients
+	// share a room, how many rooms are open and how many clients are
+	// connected in total. Zero means unlimited.
+	MaxClientsPerRoom int `yaml:"maxClientsPerRoom"`
+	MaxRooms          int `yaml:"maxRooms"`
+	MaxConnections    int `yaml:"maxConnections"`
+
+	// MaxMessageSize is the largest inbound message in bytes. Clients that
+	// send a larger one, or exceed MessagesPerSecond or BytesPerSecond
+	// (token buckets holding up to MessageBurst and ByteBurst), are
+	// disconnected. Zero disables a limit.
+	MaxMessageSize    int `yaml:"maxMessageSize"`
+	MessagesPerSecond int `yaml:"messagesPerSecond"`
+	MessageBurst      int `yaml:"messageBurst"`
+	BytesPerSecond    int `yaml:"bytesPerSecond"`
+	ByteBurst         int `yaml:"byteBurst"`
+
+	// PingInterval is how often WebSocket clients are pinged. A client that
+	// sends nothing (not even a pong) for ReadTimeout is disconnected, as is
+	// one that does not accept a write within WriteTimeout.
+	PingInterval time.Duration `yaml:"pingInterval"`
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+
+	// SnapshotInterval is how often the document of an open room is
+	// snapshotted if it changed; zero disables periodic snapshots.
+	// MaxSnapshots is how many snapshots a room keeps; automatic ones are
+	// pruned first.
+	SnapshotInterval time.Duration `yaml:"snapshotInterval"`
+	MaxSnapshots     int           `yaml:"maxSnapshots"`
+}
+
+// AdminConfig protects the admin API
+type AdminConfig struct {
+	// Token is the bearer token required by /api/admin; the admin API is
+	// disabled when it is empty
+	Token string `yaml:"token"`
+}
+
+// AuthConfig lists the users of the API and the collaboration server
+type AuthConfig struct {
+	// Users identify themselves with their token. Without users
+	// authentication is off and every caller may do everything.
+	Users []UserConfig `yaml:"users"`
+}
+
+// UserConfig is a user and the bearer token identifying them
+type UserConfig struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+}
+
+// PersistenceConfig stores room documents on disk
+type PersistenceConfig struct {
+	// Dir holds a directory per room with its compacted document, the log
+	// of updates since and its snapshots. Documents are kept in memory only
+	// when it is empty.
+	Dir string `yaml:"dir"`
+	// A room's log is compacted into its document once it holds
+	// CompactUpdates updates or CompactBytes bytes
+	CompactUpdates int `yaml:"compactUpdates"`
+	CompactBytes   int `yaml:"compactBytes"`
+	// Fsync flushes every update to stable storage before it is relayed.
+	// Without it a crash of the server loses nothing, but a crash of the
+	// machine can lose the last updates.
+	Fsync bool `yaml:"fsync"`
+}
+
+// ShutdownConfig controls graceful shutdown on SIGINT or SIGTERM
+type ShutdownConfig struct {
+	// Delay is how long /readyz fails before the listeners stop accepting,
+	// giving load balancers time to take the server out of rotation
+	Delay time.Duration `yaml:"delay"`
+	// Timeout bounds how long in-flight requests may take to finish
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// DefaultConfig returns the configuration used when nothing is overridden;
+// it matches a local development setup
+func DefaultConfig() *Config {
+	return &Config{
+		Port:           8080,
+		HTTP3Port:      4433,
+		AllowedOrigins: []string{"http://localhost:3000", "https://localhost:3000"},
+		TLS: TLSConfig{
+			CertFile:       "localhost.pem",
+			KeyFile:        "localhost-key.pem",
+			SelfSigned:     true,
+			RenewBefore:    3 * 24 * time.Hour,
+			ReloadInterval: 30 * time.Second,
+		},
+		Groq: GroqConfig{
+			Endpoint: "https://api.groq.com/openai/v1/chat/completions",
+			Model:    "llama-3.3-70b-versatile",
+			Timeout:  30 * time.Second,
+		},
+		Collab: CollabConfig{
+			SendBuffer:        256,
+			MaxClientsPerRoom: 100,
+			MaxRooms:          1000,
+			MaxConnections:    5000,
+			MaxMessageSize:    4 << 20,
+			MessagesPerSecond: 100,
+			MessageBurst:      300,
+			BytesPerSecond:    1 << 20,
+			ByteBurst:         8 << 20,
+			PingInterval:      25 * time.Second,
+			ReadTimeout:       60 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			SnapshotInterval:  10 * time.Minute,
+			MaxSnapshots:      100,
+		},
+		Shutdown: ShutdownConfig{
+			Delay:   5 * time.Second,
+			Timeout: 30 * time.Second,
+		},
+		Persistence: PersistenceConfig{
+			CompactUpdates: 1000,
+			CompactBytes:   8 << 20,
+		},
+	}
+}
+
+// LoadConfig builds the configuration from defaults, the file named by
+// -config (or WRITEPAD_CONFIG), the environment and the flags in args
+func LoadConfig(args []string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("writepad-server", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("WRITEPAD_CONFIG"), "path to a YAML config file")
+	port := fs.Int("port", 0, "TCP port for the HTTP API and WebSocket (env PORT)")
+	http3Port := fs.Int("http3-port", 0, "UDP port for HTTP/3 and WebTransport (env HTTP3_PORT)")
+	singlePort := fs.Bool("single-port", false, "serve TCP and UDP on -port only (env SINGLE_PORT)")
+	origins := fs.String("allowed-origins", "", "comma-separated allowed browser origins (env ALLOWED_ORIGINS)")
+	certFile := fs.String("tls-cert", "", "TLS certificate file (env TLS_CERT_FILE)")
+	keyFile := fs.String("tls-key", "", "TLS private key file (env TLS_KEY_FILE)")
+	serveHTTP := fs.Bool("tls-http", false, "serve the API and WebSocket listener over TLS (env TLS_SERVE_HTTP)")
+	selfSigned := fs.Bool("tls-self-signed", false, "generate and renew a self-signed certificate (env TLS_SELF_SIGNED)")
+	templateDir := fs.String("template-dir", "", "directory of extra template kinds (env TEMPLATE_DIR)")
+	dataDir := fs.String("persistence-dir", "", "directory for room documents; empty keeps them in memory (env PERSISTENCE_DIR)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return nil, fmt.Errorf("read config file: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("parse config file %s: %w", *configFile, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	// Only flags given on the command line override the other sources
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "http3-port":
+			cfg.HTTP3Port = *http3Port
+		case "single-port":
+			cfg.SinglePort = *singlePort
+		case "allowed-origins":
+			cfg.AllowedOrigins = splitList(*origins)
+		case "tls-cert":
+			cfg.TLS.CertFile = *certFile
+		case "tls-key":
+			cfg.TLS.KeyFile = *keyFile
+		case "tls-http":
+			cfg.TLS.ServeHTTP = *serveHTTP
+		case "tls-self-signed":
+			cfg.TLS.SelfSigned = *selfSigned
+		case "template-dir":
+			cfg.TemplateDir = *templateDir
+		case "persistence-dir":
+			cfg.Persistence.Dir = *dataDir
+		}
+	})
+
+	if cfg.SinglePort {
+		cfg.HTTP3Port = cfg.Port
+		cfg.TLS.ServeHTTP = true
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides fields from environment variables that are set
+func (c *Config) applyEnv() error {
+	intVars := map[string]*int{
+		"PORT":                        &c.Port,
+		"HTTP3_PORT":                  &c.HTTP3Port,
+		"COLLAB_SEND_BUFFER":          &c.Collab.SendBuffer,
+		"COLLAB_MAX_CLIENTS_PER_ROOM": &c.Collab.MaxClientsPerRoom,
+		"COLLAB_MAX_ROOMS":            &c.Collab.MaxRooms,
+		"COLLAB_MAX_CONNECTIONS":      &c.Collab.MaxConnections,
+		"COLLAB_MAX_MESSAGE_SIZE":     &c.Collab.MaxMessageSize,
+		"COLLAB_MESSAGES_PER_SECOND":  &c.Collab.MessagesPerSecond,
+		"COLLAB_MESSAGE_BURST":        &c.Collab.MessageBurst,
+		"COLLAB_BYTES_PER_SECOND":     &c.Collab.BytesPerSecond,
+		"COLLAB_BYTE_BURST":           &c.Collab.ByteBurst,
+		"COLLAB_MAX_SNAPSHOTS":        &c.Collab.MaxSnapshots,
+		"PERSISTENCE_COMPACT_UPDATES": &c.Persistence.CompactUpdates,
+		"PERSISTENCE_COMPACT_BYTES":   &c.Persistence.CompactBytes,
+	}
+	for name, field := range intVars {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a number", name, v)
+			}
+			*field = n
+		}
+	}
+
+	stringVars := map[string]*string{
+		"TLS_CERT_FILE":   &c.TLS.CertFile,
+		"TLS_KEY_FILE":    &c.TLS.KeyFile,
+		"TEMPLATE_DIR":    &c.TemplateDir,
+		"GROQ_API_KEY":    &c.Groq.APIKey,
+		"GROQ_ENDPOINT":   &c.Groq.Endpoint,
+		"GROQ_MODEL":      &c.Groq.Model,
+		"ADMIN_TOKEN":     &c.Admin.Token,
+		"PERSISTENCE_DIR": &c.Persistence.Dir,
+	}
+	for name, field := range stringVars {
+		if v := os.Getenv(name); v != "" {
+			*field = v
+		}
+	}
+
+	if v := os.Getenv("ALLOWED_ORIGINS"); v != "" {
+		c.AllowedOrigins = splitList(v)
+	}
+	if v := os.Getenv("AUTH_USERS"); v != "" {
+		c.Auth.Users = nil
+		for _, entry := range splitList(v) {
+			name, token, ok := strings.Cut(entry, ":")
+			if !ok {
+				return fmt.Errorf("AUTH_USERS: %q is not name:token", entry)
+			}
+			c.Auth.Users = append(c.Auth.Users, UserConfig{Name: strings.TrimSpace(name), Token: strings.TrimSpace(token)})
+		}
+	}
+	boolVars := map[string]*bool{
+		"SINGLE_PORT":       &c.SinglePort,
+		"TLS_SERVE_HTTP":    &c.TLS.ServeHTTP,
+		"TLS_SELF_SIGNED":   &c.TLS.SelfSigned,
+		"PERSISTENCE_FSYNC": &c.Persistence.Fsync,
+	}
+	for name, field := range boolVars {
+		if v := os.Getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a boolean", name, v)
+			}
+			*field = b
+		}
+	}
+
+	durationVars := map[string]*time.Duration{
+		"GROQ_TIMEOUT":             &c.Groq.Timeout,
+		"TLS_RENEW_BEFORE":         &c.TLS.RenewBefore,
+		"TLS_RELOAD_INTERVAL":      &c.TLS.ReloadInterval,
+		"COLLAB_PING_INTERVAL":     &c.Collab.PingInterval,
+		"COLLAB_READ_TIMEOUT":      &c.Collab.ReadTimeout,
+		"COLLAB_WRITE_TIMEOUT":     &c.Collab.WriteTimeout,
+		"COLLAB_SNAPSHOT_INTERVAL": &c.Collab.SnapshotInterval,
+		"SHUTDOWN_DELAY":           &c.Shutdown.Delay,
+		"SHUTDOWN_TIMEOUT":         &c.Shutdown.Timeout,
+	}
+	for name, field := range durationVars {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*field = d
+		}
+	}
+	return nil
+}
+
+// Validate reports the first invalid setting
+func (c *Config) Validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port %d is out of range", c.Port)
+	}
+	if c.HTTP3Port < 1 || c.HTTP3Port > 65535 {
+		return fmt.Errorf("http3Port %d is out of range", c.HTTP3Port)
+	}
+	if _, err := NewOriginPolicy(c.AllowedOrigins); err != nil {
+		return err
+	}
+	if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+		return fmt.Errorf("tls.certFile and tls.keyFile are required")
+	}
+	if c.TLS.SelfSigned && (c.TLS.RenewBefore <= 0 || c.TLS.RenewBefore >= selfSignedValidity) {
+		return fmt.Errorf("tls.renewBefore must be between 0 and %s", selfSignedValidity)
+	}
+	if c.TLS.ReloadInterval <= 0 {
+		return fmt.Errorf("tls.reloadInterval must be positive")
+	}
+	if c.Groq.Endpoint == "" || c.Groq.Model == "" {
+		return fmt.Errorf("groq.endpoint and groq.model are required")
+	}
+	if c.Groq.Timeout <= 0 {
+		return fmt.Errorf("groq.timeout must be positive")
+	}
+	if c.Collab.SendBuffer < 1 {
+		return fmt.Errorf("collab.sendBuffer must be at least 1")
+	}
+	if c.Collab.MaxClientsPerRoom < 0 || c.Collab.MaxRooms < 0 || c.Collab.MaxConnections < 0 {
+		return fmt.Errorf("collab limits must not be negative (0 means unlimited)")
+	}
+	if c.Collab.MaxMessageSize < 0 || c.Collab.MessagesPerSecond < 0 || c.Collab.BytesPerSecond < 0 {
+		return fmt.Errorf("collab message limits must not be negative (0 means unlimited)")
+	}
+	if c.Collab.MessagesPerSecond > 0 && c.Collab.MessageBurst < 1 {
+		return fmt.Errorf("collab.messageBurst must be at least 1")
+	}
+	// Otherwise a message of the maximum size could never be admitted
+	if c.Collab.BytesPerSecond > 0 && c.Collab.MaxMessageSize > 0 && c.Collab.ByteBurst < c.Collab.MaxMessageSize {
+		return fmt.Errorf("collab.byteBurst must be at least collab.maxMessageSize")
+	}
+	if c.Shutdown.Delay < 0 || c.Shutdown.Timeout <= 0 {
+		return fmt.Errorf("shutdown.delay must not be negative and shutdown.timeout must be positive")
+	}
+	if c.Collab.PingInterval <= 0 || c.Collab.WriteTimeout <= 0 {
+		return fmt.Errorf("collab.pingInterval and collab.writeTimeout must be positive")
+	}
+	// A client must get at least one ping to answer before it times out
+	if c.Collab.ReadTimeout <= c.Collab.PingInterval {
+		return fmt.Errorf("collab.readTimeout must be longer than collab.pingInterval")
+	}
+	if c.Collab.SnapshotInterval < 0 || c.Collab.MaxSnapshots < 1 {
+		return fmt.Errorf("collab.snapshotInterval must not be negative and collab.maxSnapshots must be at least 1")
+	}
+	if c.Persistence.CompactUpdates < 1 || c.Persistence.CompactBytes < 1 {
+		return fmt.Errorf("persistence.compactUpdates and persistence.compactBytes must be at least 1")
+	}
+	if c.Admin.Token != "" && len(c.Admin.Token) < 16 {
+		return fmt.Errorf("admin.token must be at least 16 characters")
+	}
+	names, tokens := make(map[string]bool), make(map[string]bool)
+	for _, u := range c.Auth.Users {
+		if u.Name == "" || len(u.Name) > 200 {
+			return fmt.Errorf("auth.users: names must be 1 to 200 bytes")
+		}
+		if len(u.Token) < 16 {
+			return fmt.Errorf("auth.users: the token of %s must be at least 16 characters", u.Name)
+		}
+		if names[u.Name] || tokens[u.Token] {
+			return fmt.Errorf("auth.users: %s is listed twice or shares a token", u.Name)
+		}
+		names[u.Name], tokens[u.Token] = true, true
+	}
+	if c.TemplateDir != "" {
+		if info, err := os.Stat(c.TemplateDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("templateDir %q is not a directory", c.TemplateDir)
+		}
+	}
+	return nil
+}
+
+// splitList parses a comma-separated list, dropping empty entries
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("port: 9000\nhttp3Port: 9443\ngroq:\n  timeout: 5s\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("WRITEPAD_CONFIG", file)
+	t.Setenv("HTTP3_PORT", "9444")
+	t.Setenv("ALLOWED_ORIGINS", "https://a.example, https://b.example")
+
+	cfg, err := LoadConfig([]string{"-http3-port", "9445"})
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	if cfg.Port != 9000 {
+		t.Errorf("Port = %d, want 9000 from the file", cfg.Port)
+	}
+	if cfg.HTTP3Port != 9445 {
+		t.Errorf("HTTP3Port = %d, want 9445 from the flag", cfg.HTTP3Port)
+	}
+	if cfg.Groq.Timeout != 5*time.Second {
+		t.Errorf("Groq.Timeout = %v, want 5s from the file", cfg.Groq.Timeout)
+	}
+	if len(cfg.AllowedOrigins) != 2 || cfg.AllowedOrigins[1] != "https://b.example" {
+		t.Errorf("AllowedOrigins = %v, want the env list", cfg.AllowedOrigins)
+	}
+	if cfg.Groq.Model != DefaultConfig().Groq.Model {
+		t.Errorf("Groq.Model = %q, want the default", cfg.Groq.Model)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	for name, args := range map[string][]string{
+		"port out of range": {"-port", "70000"},
+		"bad origin":        {"-allowed-origins", "localhost:3000"},
+		"missing dir":       {"-template-dir", "/does/not/exist"},
+	} {
+		if _, err := LoadConfig(args); err == nil {
+			t.Errorf("%s: LoadConfig succeeded, want an error", name)
+		}
+	}
+}
+
+func TestLoadConfigAuthUsers(t *testing.T) {
+	t.Setenv("AUTH_USERS", "ada:0123456789abcdef, grace:fedcba9876543210")
+	cfg, err := LoadConfig(nil)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if len(cfg.Auth.Users) != 2 || cfg.Auth.Users[1] != (UserConfig{Name: "grace", Token: "fedcba9876543210"}) {
+		t.Errorf("Auth.Users = %+v", cfg.Auth.Users)
+	}
+
+	for _, users := range []string{"ada", "ada:short", "ada:0123456789abcdef,ada:fedcba9876543210", "ada:0123456789abcdef,grace:0123456789abcdef"} {
+		t.Setenv("AUTH_USERS", users)
+		if _, err := LoadConfig(nil); err == nil {
+			t.Errorf("AUTH_USERS=%s: LoadConfig succeeded, want an error", users)
+		}
+	}
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// documentsFile holds the document registry in the persistence directory
+const documentsFile = "documents.json"
+
+// documentsFlushInterval is how often content changes are written to the
+// registry; metadata changes through the API are written at once
+const documentsFlushInterval = 5 * time.Second
+
+// Limits on document metadata
+const (
+	defaultDocumentTitle = "Untitled Document"
+	maxTitleLength       = 200
+	maxTags              = 20
+	maxTagLength         = 50
+	maxMembers           = 100
+	defaultPageSize      = 50
+	maxPageSize          = 200
+)
+
+// Document is a named document and the collaboration room holding its
+// content
+type Document struct {
+	ID     string   `json:"id"`
+	Title  string   `json:"title"`
+	Owner  string   `json:"owner"`
+	RoomID string   `json:"roomId"`
+	Tags   []string `json:"tags"`
+	// Members are the users the owner shared the document with
+	Members map[string]Role `json:"members,omitempty"`
+	// Suggesting stores edits by commenters as suggestions for the owner
+	// to accept or reject
+	Suggesting bool      `json:"suggesting"`
+	CreatedAt  time.Time `json:"createdAt"`
+	// UpdatedAt is the latest change to the metadata or the content
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// clone copies doc so callers cannot modify the registry's tags and
+// members
+func (doc *Document) clone() Document {
+	c := *doc
+	c.Tags = append([]string{}, doc.Tags...)
+	if doc.Members != nil {
+		c.Members = make(map[string]Role, len(doc.Members))
+		for user, role := range doc.Members {
+			c.Members[user] = role
+		}
+	}
+	return c
+}
+
+// Documents is the registry of documents. Each document owns one room; a
+// room belongs to at most one document. With a store the registry is saved
+// next to the rooms, otherwise it is kept in memory.
+type Documents struct {
+	mu    sync.Mutex
+	docs  map[string]*Document
+	rooms map[string]string // room ID -> document ID
+	store *Store
+	// dirty is set when UpdatedAt changed since the last save
+	dirty bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewDocuments loads the registry from store, or starts an empty one
+func NewDocuments(store *Store) (*Documents, error) {
+	d := &Documents{
+		docs:  make(map[string]*Document),
+		rooms: make(map[string]string),
+		store: store,
+		done:  make(chan struct{}),
+	}
+	if store == nil {
+		return d, nil
+	}
+	data, err := os.ReadFile(filepath.Join(store.dir, documentsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*Document
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", documentsFile, err)
+	}
+	for _, doc := range list {
+		d.docs[doc.ID] = doc
+		d.rooms[doc.RoomID] = doc.ID
+	}
+	return d, nil
+}
+
+// Run writes content changes to disk every documentsFlushInterval until
+// Close is called
+func (d *Documents) Run() {
+	ticker := time.NewTicker(documentsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.mu.Lock()
+			if d.dirty {
+				_ = d.save()
+			}
+			d.mu.Unlock()
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// Close stops Run and saves pending changes
+func (d *Documents) Close() {
+	d.closeOnce.Do(func() { close(d.done) })
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dirty {
+		_ = d.save()
+	}
+}
+
+// save writes the registry; d.mu must be held
+func (d *Documents) save() error {
+	d.dirty = false
+	if d.store == nil {
+		return nil
+	}
+	list := make([]*Document, 0, len(d.docs))
+	for _, doc := range d.docs {
+		list = append(list, doc)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return d.store.record(writeFileAtomic(filepath.Join(d.store.dir, documentsFile), data))
+}
+
+// Create registers doc under a new ID. Without a room ID the document gets
+// a room named after itself.
+func (d *Documents) Create(doc Document) (Document, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	doc.ID = uuid.New().String()
+	if doc.RoomID == "" {
+		doc.RoomID = doc.ID
+	}
+	if other, ok := d.rooms[doc.RoomID]; ok {
+		return Document{}, errConflict(fmt.Sprintf("Room %s already belongs to document %s", doc.RoomID, other))
+	}
+	doc.CreatedAt = time.Now().UTC()
+	doc.UpdatedAt = doc.CreatedAt
+	d.docs[doc.ID] = &doc
+	d.rooms[doc.RoomID] = doc.ID
+	if err := d.save(); err != nil {
+		delete(d.docs, doc.ID)
+		delete(d.rooms, doc.RoomID)
+		return Document{}, err
+	}
+	return doc.clone(), nil
+}
+
+// Get returns the document with the given ID
+func (d *Documents) Get(id string) (Document, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	doc, ok := d.docs[id]
+	if !ok {
+		return Document{}, false
+	}
+	return doc.clone(), true
+}
+
+// ByRoom returns the document a room belongs to
+func (d *Documents) ByRoom(roomID string) (Document, bool) {
+	d.mu.Lock()
+	id, ok := d.rooms[roomID]
+	d.mu.Unlock()
+	if !ok {
+		return Document{}, false
+	}
+	return d.Get(id)
+}
+
+// DocumentFilter narrows a listing; empty fields match everything
+type DocumentFilter struct {
+	Owner string
+	Tag   string
+	// Caller only sees the documents they can read
+	Caller Caller
+}
+
+// List returns one page of the documents matching filter, most recently
+// updated first, and the number of matches
+func (d *Documents) List(filter DocumentFilter, offset, limit int) ([]Document, int) {
+	d.mu.Lock()
+	var matches []*Document
+	for _, doc := range d.docs {
+		if filter.Owner != "" && doc.Owner != filter.Owner {
+			continue
+		}
+		if filter.Tag != "" && !containsString(doc.Tags, filter.Tag) {
+			continue
+		}
+		if !filter.Caller.CanRead(*doc) {
+			continue
+		}
+		matches = append(matches, doc)
+	}
+	page := make([]Document, 0, limit)
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].UpdatedAt.Equal(matches[j].UpdatedAt) {
+			return matches[i].UpdatedAt.After(matches[j].UpdatedAt)
+		}
+		return matches[i].ID < matches[j].ID
+	})
+	for i := offset; i < len(matches) && len(page) < limit; i++ {
+		page = append(page, matches[i].clone())
+	}
+	d.mu.Unlock()
+	return page, len(matches)
+}
+
+// All returns every document, in no particular order
+func (d *Documents) All() []Document {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]Document, 0, len(d.docs))
+	for _, doc := range d.docs {
+		list = append(list, doc.clone())
+	}
+	return list
+}
+
+// DocumentPatch changes a document's metadata; nil fields are left alone
+type DocumentPatch struct {
+	Title      *string          `json:"title"`
+	Owner      *string          `json:"owner"`
+	Tags       *[]string        `json:"tags"`
+	Members    *map[string]Role `json:"members"`
+	Suggesting *bool            `json:"suggesting"`
+}
+
+// Update applies patch to a document
+func (d *Documents) Update(id string, patch DocumentPatch) (Document, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	doc, ok := d.docs[id]
+	if !ok {
+		return Document{}, errNotFound("Document not found")
+	}
+	old := doc.clone()
+	if patch.Title != nil {
+		doc.Title = *patch.Title
+	}
+	if patch.Owner != nil {
+		doc.Owner = *patch.Owner
+	}
+	if patch.Tags != nil {
+		doc.Tags = *patch.Tags
+	}
+	if patch.Members != nil {
+		doc.Members = *patch.Members
+	}
+	if patch.Suggesting != nil {
+		doc.Suggesting = *patch.Suggesting
+	}
+	doc.UpdatedAt = time.Now().UTC()
+	if err := d.save(); err != nil {
+		*doc = old
+		return Document{}, err
+	}
+	return doc.clone(), nil
+}
+
+// Delete removes a document from the registry and returns it; its room is
+// left to the caller
+func (d *Documents) Delete(id string) (Document, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	doc, ok := d.docs[id]
+	if !ok {
+		return Document{}, errNotFound("Document not found")
+	}
+	delete(d.docs, id)
+	delete(d.rooms, doc.RoomID)
+	if err := d.save(); err != nil {
+		d.docs[id] = doc
+		d.rooms[doc.RoomID] = id
+		return Document{}, err
+	}
+	return doc.clone(), nil
+}
+
+// Touch marks the document of a room as updated now. It is registered with
+// the hub for content changes and saved by Run.
+func (d *Documents) Touch(roomID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if doc, ok := d.docs[d.rooms[roomID]]; ok {
+		doc.UpdatedAt = time.Now().UTC()
+		d.dirty = true
+	}
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// documentRequest is the body of the create request
+type documentRequest struct {
+	Title      string          `json:"title"`
+	Owner      string          `json:"owner"`
+	Tags       []string        `json:"tags"`
+	RoomID     string          `json:"roomId"`
+	Members    map[string]Role `json:"members"`
+	Suggesting bool            `json:"suggesting"`
+}
+
+// cleanTitle trims a title, defaulting an empty one
+func cleanTitle(title string) (string, error) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		title = defaultDocumentTitle
+	}
+	if len(title) > maxTitleLength {
+		return "", errBadRequest("title must be at most %d bytes", maxTitleLength)
+	}
+	return title, nil
+}
+
+// cleanOwner trims an owner, defaulting an empty one like snapshot authors
+func cleanOwner(owner string) (string, error) {
+	owner = strings.TrimSpace(owner)
+	if owner == "" {
+		owner = "anonymous"
+	}
+	if len(owner) > 200 {
+		return "", errBadRequest("owner must be at most 200 bytes")
+	}
+	return owner, nil
+}
+
+// cleanTags trims tags and drops empty and repeated ones
+func cleanTags(tags []string) ([]string, error) {
+	clean := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || containsString(clean, tag) {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, errBadRequest("tags must be at most %d bytes", maxTagLength)
+		}
+		clean = append(clean, tag)
+	}
+	if len(clean) > maxTags {
+		return nil, errBadRequest("at most %d tags are allowed", maxTags)
+	}
+	return clean, nil
+}
+
+// cleanMembers checks the roles granted to users
+func cleanMembers(members map[string]Role) (map[string]Role, error) {
+	if len(members) > maxMembers {
+		return nil, errBadRequest("at most %d members are allowed", maxMembers)
+	}
+	clean := make(map[string]Role, len(members))
+	for user, role := range members {
+		user = strings.TrimSpace(user)
+		if user == "" || len(user) > 200 {
+			return nil, errBadRequest("member names must be 1 to 200 bytes")
+		}
+		if !memberRoles[role] {
+			return nil, errBadRequest("member roles must be editor, commenter or viewer")
+		}
+		clean[user] = role
+	}
+	if len(clean) == 0 {
+		return nil, nil
+	}
+	return clean, nil
+}
+
+// decodeDocumentRequest reads and validates a create request
+func decodeDocumentRequest(r *http.Request) (Document, error) {
+	var req documentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return Document{}, errBadRequest("Invalid request body")
+	}
+	var doc Document
+	var err error
+	if doc.Title, err = cleanTitle(req.Title); err != nil {
+		return doc, err
+	}
+	if doc.Owner, err = cleanOwner(req.Owner); err != nil {
+		return doc, err
+	}
+	if doc.Tags, err = cleanTags(req.Tags); err != nil {
+		return doc, err
+	}
+	if doc.Members, err = cleanMembers(req.Members); err != nil {
+		return doc, err
+	}
+	doc.RoomID = strings.TrimSpace(req.RoomID)
+	if len(doc.RoomID) > maxRoomIDLength {
+		return doc, errBadRequest("roomId must be at most %d bytes", maxRoomIDLength)
+	}
+	doc.Suggesting = req.Suggesting
+	return doc, nil
+}
+
+// checkRoomClaim refuses a new document for a room that is open or has
+// content unless the caller is trusted. The document's owner decides who may
+// edit its room, so attaching one would take the room from its editors.
+func checkRoomClaim(hub *CollaborationHub, caller Caller, roomID string) error {
+	if caller.Trusted || roomID == "" {
+		return nil
+	}
+	const msg = "Only trusted callers can create a document for a room that is in use"
+	if _, open := hub.Room(roomID); open {
+		return errForbidden(msg)
+	}
+	state, ok := hub.LookupState(roomID)
+	if !ok {
+		return nil
+	}
+	defer hub.ReleaseState(state)
+	if !state.empty() {
+		return errForbidden(msg)
+	}
+	return nil
+}
+
+// decodeDocumentPatch reads and validates an update request
+func decodeDocumentPatch(r *http.Request) (DocumentPatch, error) {
+	var patch DocumentPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		return patch, errBadRequest("Invalid request body")
+	}
+	if patch.Title != nil {
+		title, err := cleanTitle(*patch.Title)
+		if err != nil {
+			return patch, err
+		}
+		patch.Title = &title
+	}
+	if patch.Owner != nil {
+		owner, err := cleanOwner(*patch.Owner)
+		if err != nil {
+			return patch, err
+		}
+		patch.Owner = &owner
+	}
+	if patch.Tags != nil {
+		tags, err := cleanTags(*patch.Tags)
+		if err != nil {
+			return patch, err
+		}
+		patch.Tags = &tags
+	}
+	if patch.Members != nil {
+		members, err := cleanMembers(*patch.Members)
+		if err != nil {
+			return patch, err
+		}
+		patch.Members = &members
+	}
+	return patch, nil
+}
+
+// queryInt reads a non-negative integer query parameter
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errBadRequest("%s must be a non-negative integer", name)
+	}
+	return n, nil
+}
+
+// DocumentRoutes returns the document API, mounted at /api/documents
+func DocumentRoutes(hub *CollaborationHub, docs *Documents) http.Handler {
+	r := chi.NewRouter()
+
+	// document resolves the {id} parameter for a caller with at least the
+	// given role, writing a 404 if it is unknown or hidden from the caller
+	document := func(w http.ResponseWriter, r *http.Request, min Role) (Document, bool) {
+		doc, ok := docs.Get(chi.URLParam(r, "id"))
+		if !ok {
+			writeError(w, r, errNotFound("Document not found"))
+			return doc, false
+		}
+		if err := requireRole(callerFrom(r), doc, min); err != nil {
+			writeError(w, r, err)
+			return doc, false
+		}
+		return doc, true
+	}
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if roomID := q.Get("room"); roomID != "" {
+			doc, ok := docs.ByRoom(roomID)
+			if !ok || !callerFrom(r).CanRead(doc) {
+				writeError(w, r, errNotFound("No document for this room"))
+				return
+			}
+			writeJSON(w, http.StatusOK, doc)
+			return
+		}
+		offset, err := queryInt(r, "offset", 0)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		limit, err := queryInt(r, "limit", defaultPageSize)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			writeError(w, r, errBadRequest("limit must be between 1 and %d", maxPageSize))
+			return
+		}
+		filter := DocumentFilter{Owner: q.Get("owner"), Tag: q.Get("tag"), Caller: callerFrom(r)}
+		page, total := docs.List(filter, offset, limit)
+		resp := map[string]interface{}{
+			"documents": page,
+			"total":     total,
+			"offset":    offset,
+			"limit":     limit,
+		}
+		if next := offset + len(page); next < total {
+			resp["nextOffset"] = next
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		caller := callerFrom(r)
+		if err := requireUser(caller); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		req, err := decodeDocumentRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if !caller.Trusted {
+			// Users create documents for themselves
+			req.Owner = caller.User
+		}
+		if err := checkRoomClaim(hub, caller, req.RoomID); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		doc, err := docs.Create(req)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		log.Printf("[INFO] Document %s (room %s) created by %s", doc.ID, doc.RoomID, doc.Owner)
+		w.Header().Set("Location", "/api/documents/"+doc.ID)
+		writeJSON(w, http.StatusCreated, doc)
+	})
+
+	r.Post("/import", func(w http.ResponseWriter, r *http.Request) {
+		importDocument(w, r, hub, docs)
+	})
+
+	r.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if doc, ok := document(w, r, RoleViewer); ok {
+			writeJSON(w, http.StatusOK, doc)
+		}
+	})
+
+	r.Get("/{id}/export", func(w http.ResponseWriter, r *http.Request) {
+		if doc, ok := document(w, r, RoleViewer); ok {
+			exportDocument(w, r, hub, doc)
+		}
+	})
+
+	r.Get("/{id}/attribution", func(w http.ResponseWriter, r *http.Request) {
+		if doc, ok := document(w, r, RoleViewer); ok {
+			documentAttribution(w, r, hub, doc)
+		}
+	})
+
+	r.Mount("/{id}/comments", CommentRoutes(hub, docs))
+	r.Mount("/{id}/suggestions", SuggestionRoutes(hub, docs))
+
+	r.Patch("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := document(w, r, RoleOwner); !ok {
+			return
+		}
+		patch, err := decodeDocumentPatch(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		doc, err := docs.Update(chi.URLParam(r, "id"), patch)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if patch.Suggesting != nil {
+			publishSuggestionEvent(hub, doc, SuggestionEvent{Type: "mode", Suggesting: &doc.Suggesting, By: callerName(callerFrom(r))})
+		}
+		writeJSON(w, http.StatusOK, doc)
+	})
+
+	r.Delete("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := document(w, r, RoleOwner); !ok {
+			return
+		}
+		doc, err := docs.Delete(chi.URLParam(r, "id"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := hub.DeleteRoom(doc.RoomID, "Document deleted"); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		log.Printf("[INFO] Document %s deleted with room %s", doc.ID, doc.RoomID)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return r
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// documentsRequest calls the document API as the router mounts it
+func documentsRequest(t *testing.T, h http.Handler, method, path, body string, v interface{}) int {
+	t.Helper()
+	r := chi.NewRouter()
+	r.Mount("/api/documents", h)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if v != nil && rec.Code < 300 {
+		if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: decode: %v", method, path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestDocumentRoutes(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	docs, _ := NewDocuments(nil)
+	hub.OnChange(docs.Touch)
+	h := DocumentRoutes(hub, docs)
+
+	var created Document
+	if code := documentsRequest(t, h, http.MethodPost, "/api/documents", `{"title":" Plan ","owner":"ada","tags":["q3","q3"," "],"roomId":"plan-room"}`, &created); code != http.StatusCreated {
+		t.Fatalf("create: status = %d", code)
+	}
+	if created.Title != "Plan" || created.Owner != "ada" || created.RoomID != "plan-room" || len(created.Tags) != 1 {
+		t.Errorf("created = %+v", created)
+	}
+	if code := documentsRequest(t, h, http.MethodPost, "/api/documents", `{"roomId":"plan-room"}`, nil); code != http.StatusConflict {
+		t.Errorf("second document for a room: status = %d, want 409", code)
+	}
+	var untitled Document
+	documentsRequest(t, h, http.MethodPost, "/api/documents", `{}`, &untitled)
+	if untitled.Title != defaultDocumentTitle || untitled.RoomID != untitled.ID || untitled.Owner != "anonymous" {
+		t.Errorf("defaults = %+v", untitled)
+	}
+
+	// Editing the room's content moves its document to the top
+	time.Sleep(time.Millisecond)
+	client := joinTestClient(t, hub, "plan-room", "WebSocket")
+	if err := client.Room.ApplyUpdate(insertText(NewYDoc(), "t", "hello"), client); err != nil {
+		t.Fatalf("ApplyUpdate: %v", err)
+	}
+	var page struct {
+		Documents  []Document
+		Total      int
+		NextOffset *int
+	}
+	documentsRequest(t, h, http.MethodGet, "/api/documents?limit=1", "", &page)
+	if page.Total != 2 || len(page.Documents) != 1 || page.Documents[0].ID != created.ID || page.NextOffset == nil || *page.NextOffset != 1 {
+		t.Fatalf("first page = %+v", page)
+	}
+	page.NextOffset = nil
+	documentsRequest(t, h, http.MethodGet, "/api/documents?limit=1&offset=1", "", &page)
+	if len(page.Documents) != 1 || page.Documents[0].ID != untitled.ID || page.NextOffset != nil {
+		t.Errorf("second page = %+v", page)
+	}
+	documentsRequest(t, h, http.MethodGet, "/api/documents?tag=q3", "", &page)
+	if page.Total != 1 {
+		t.Errorf("tag filter: total = %d", page.Total)
+	}
+
+	var renamed Document
+	if code := documentsRequest(t, h, http.MethodPatch, "/api/documents/"+created.ID, `{"title":"Roadmap"}`, &renamed); code != http.StatusOK {
+		t.Fatalf("patch: status = %d", code)
+	}
+	if renamed.Title != "Roadmap" || renamed.Tags[0] != "q3" {
+		t.Errorf("renamed = %+v", renamed)
+	}
+	var byRoom Document
+	documentsRequest(t, h, http.MethodGet, "/api/documents?room=plan-room", "", &byRoom)
+	if byRoom.ID != created.ID {
+		t.Errorf("lookup by room = %+v", byRoom)
+	}
+
+	// Deleting the document disconnects the room and drops its content
+	if code := documentsRequest(t, h, http.MethodDelete, "/api/documents/"+created.ID, "", nil); code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d", code)
+	}
+	if _, ok := hub.LookupState("plan-room"); ok {
+		t.Errorf("room content survived its document")
+	}
+	for _, req := range [][2]string{{http.MethodGet, created.ID}, {http.MethodPatch, created.ID}, {http.MethodDelete, created.ID}} {
+		if code := documentsRequest(t, h, req[0], "/api/documents/"+req[1], `{}`, nil); code != http.StatusNotFound {
+			t.Errorf("%s deleted document: status = %d, want 404", req[0], code)
+		}
+	}
+	for _, query := range []string{"limit=0", "limit=201", "offset=-1", "offset=x"} {
+		if code := documentsRequest(t, h, http.MethodGet, "/api/documents?"+query, "", nil); code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, code)
+		}
+	}
+	if code := documentsRequest(t, h, http.MethodPost, "/api/documents", fmt.Sprintf(`{"title":%q}`, strings.Repeat("x", 201)), nil); code != http.StatusBadRequest {
+		t.Errorf("long title: status = %d, want 400", code)
+	}
+}
+
+func TestDocumentsPersist(t *testing.T) {
+	store := testStore(t, 1000)
+	docs, err := NewDocuments(store)
+	if err != nil {
+		t.Fatalf("NewDocuments: %v", err)
+	}
+	doc, err := docs.Create(Document{Title: "Notes", Owner: "ada", Tags: []string{}})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	docs.Touch(doc.RoomID)
+	docs.Close()
+
+	reloaded, err := NewDocuments(store)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	got, ok := reloaded.ByRoom(doc.RoomID)
+	if !ok || got.Title != "Notes" || !got.UpdatedAt.After(doc.UpdatedAt) {
+		t.Errorf("reloaded = %+v, %v", got, ok)
+	}
+}
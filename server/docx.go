@@ -0,0 +1,434 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// A DOCX file is a zip of Office Open XML parts. The document is written
+// with a fixed set of styles (headings, code, hyperlink, table grid)
+// and one numbering definition per list, so ordered lists restart at their
+// own start number.
+
+const (
+	wordNamespace = "http://schemas.openxmlformats.org/wordprocessingml/2006/main"
+	relNamespace  = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	// twipsPerPoint converts points to twentieths of a point, Word's unit
+	twipsPerPoint = 20
+	// docxListIndent is the indentation of each list and quote level
+	docxListIndent = 720
+)
+
+// renderDOCX renders a document as a Word document on the given paper
+func renderDOCX(doc Document, content *PMNode, page paperSize) ([]byte, error) {
+	w := &docxWriter{width: int(math.Round((page.Width - 2*pageMargin) * twipsPerPoint))}
+	w.blocks(content.Content, docxContext{})
+	if w.body.Len() == 0 || w.endsWithTable {
+		// Word wants the body to end with a paragraph
+		w.body.WriteString("<w:p/>")
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", docxContentTypes},
+		{"_rels/.rels", docxRootRels},
+		{"docProps/core.xml", docxCoreProperties(doc)},
+		{"word/document.xml", w.document(page)},
+		{"word/styles.xml", docxStyles},
+		{"word/numbering.xml", w.numbering()},
+		{"word/_rels/document.xml.rels", w.relationships()},
+	}
+	for _, part := range parts {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: part.name, Method: zip.Deflate, Modified: doc.UpdatedAt})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// docxContext is what enclosing nodes contribute to a paragraph
+type docxContext struct {
+	indent int  // left indentation in twips from blockquotes
+	quote  bool // inside a blockquote, marked by a left border
+	inList bool
+	level  int  // list nesting depth
+	numID  int  // numbering of the innermost list
+	first  bool // the paragraph is the first of its list item
+	header bool // inside a table header cell
+}
+
+// docxList is a numbering instance: one per list
+type docxList struct {
+	ordered bool
+	level   int
+	start   int
+}
+
+type docxWriter struct {
+	width         int // text width in twips
+	body          strings.Builder
+	lists         []docxList
+	links         []string
+	endsWithTable bool
+}
+
+// blocks writes a sequence of blocks
+func (w *docxWriter) blocks(nodes []*PMNode, ctx docxContext) {
+	for i := 0; i < len(nodes); i++ {
+		n := nodes[i]
+		if n.isInline() {
+			j := i
+			for j < len(nodes) && nodes[j].isInline() {
+				j++
+			}
+			w.paragraph("", nodes[i:j], ctx, "")
+			i = j - 1
+			ctx.first = false
+			continue
+		}
+		w.block(n, ctx)
+		ctx.first = false
+	}
+}
+
+// block writes one block node
+func (w *docxWriter) block(n *PMNode, ctx docxContext) {
+	switch n.Type {
+	case "paragraph":
+		w.paragraph("", n.Content, ctx, n.attrString("textAlign"))
+	case "heading":
+		level := n.attrInt("level", 1)
+		if level < 1 || level > 6 {
+			level = 1
+		}
+		w.paragraph(fmt.Sprintf("Heading%d", level), n.Content, ctx, n.attrString("textAlign"))
+	case "blockquote":
+		ctx.indent += docxListIndent
+		ctx.quote = true
+		w.blocks(n.Content, ctx)
+	case "codeBlock":
+		var runs strings.Builder
+		for i, line := range strings.Split(strings.TrimSuffix(n.textContent(), "\n"), "\n") {
+			if i > 0 {
+				runs.WriteString("<w:r><w:br/></w:r>")
+			}
+			if line != "" {
+				fmt.Fprintf(&runs, `<w:r><w:t xml:space="preserve">%s</w:t></w:r>`, xmlText(line))
+			}
+		}
+		w.writeParagraph("Code", ctx, "", false, runs.String())
+	case "horizontalRule":
+		w.writeParagraph("", ctx, "", true, "")
+	case "bulletList", "orderedList", "taskList":
+		w.list(n, ctx)
+	case "table":
+		w.table(n, ctx)
+	case "image":
+		w.paragraph("", []*PMNode{n}, ctx, "")
+	default:
+		if len(n.Content) > 0 && n.Content[0].isInline() {
+			w.paragraph("", n.Content, ctx, "")
+			return
+		}
+		w.blocks(n.Content, ctx)
+	}
+}
+
+// list writes the items of a list, with a numbering instance of its own so
+// that numbers restart
+func (w *docxWriter) list(n *PMNode, ctx docxContext) {
+	level := 0
+	if ctx.inList {
+		level = ctx.level + 1
+	}
+	if level > 8 {
+		level = 8
+	}
+	w.lists = append(w.lists, docxList{ordered: n.Type == "orderedList", level: level, start: n.attrInt("start", 1)})
+	ctx.numID = len(w.lists)
+	ctx.level = level
+	ctx.inList = true
+	for _, item := range n.Content {
+		ctx.first = true
+		content := item.Content
+		if len(content) == 0 {
+			content = []*PMNode{{Type: "paragraph"}}
+		}
+		if n.Type == "taskList" {
+			box := "☐ "
+			if checked, _ := item.Attrs["checked"].(bool); checked {
+				box = "☒ "
+			}
+			if p := content[0]; p.Type == "paragraph" {
+				first := *p
+				first.Content = append([]*PMNode{{Type: "text", Text: box}}, p.Content...)
+				content = append([]*PMNode{&first}, content[1:]...)
+			}
+		}
+		w.blocks(content, ctx)
+	}
+}
+
+// table writes a table with columns of equal width
+func (w *docxWriter) table(n *PMNode, ctx docxContext) {
+	columns := 0
+	for _, row := range n.Content {
+		if len(row.Content) > columns {
+			columns = len(row.Content)
+		}
+	}
+	if columns == 0 {
+		return
+	}
+	width := (w.width - ctx.indent) / columns
+	fmt.Fprintf(&w.body, `<w:tbl><w:tblPr><w:tblStyle w:val="TableGrid"/><w:tblW w:w="%d" w:type="dxa"/>`, width*columns)
+	if ctx.indent > 0 {
+		fmt.Fprintf(&w.body, `<w:tblInd w:w="%d" w:type="dxa"/>`, ctx.indent)
+	}
+	w.body.WriteString(`</w:tblPr><w:tblGrid>`)
+	for i := 0; i < columns; i++ {
+		fmt.Fprintf(&w.body, `<w:gridCol w:w="%d"/>`, width)
+	}
+	w.body.WriteString(`</w:tblGrid>`)
+	for _, row := range n.Content {
+		w.body.WriteString("<w:tr>")
+		for i := 0; i < columns; i++ {
+			fmt.Fprintf(&w.body, `<w:tc><w:tcPr><w:tcW w:w="%d" w:type="dxa"/></w:tcPr>`, width)
+			var cellCtx docxContext
+			var content []*PMNode
+			if i < len(row.Content) {
+				cellCtx.header = row.Content[i].Type == "tableHeader"
+				content = row.Content[i].Content
+			}
+			mark := w.body.Len()
+			w.blocks(content, cellCtx)
+			if w.body.Len() == mark || w.endsWithTable {
+				w.body.WriteString("<w:p/>")
+			}
+			w.body.WriteString("</w:tc>")
+		}
+		w.body.WriteString("</w:tr>")
+	}
+	w.body.WriteString("</w:tbl>")
+	w.endsWithTable = true
+}
+
+// paragraph writes a paragraph of inline nodes
+func (w *docxWriter) paragraph(style string, nodes []*PMNode, ctx docxContext, align string) {
+	var runs strings.Builder
+	for _, n := range nodes {
+		w.inline(&runs, n, ctx)
+	}
+	w.writeParagraph(style, ctx, align, false, runs.String())
+}
+
+// writeParagraph writes a paragraph with its properties: style, list
+// numbering or indentation, borders and alignment. A rule is an empty
+// paragraph with a bottom border.
+func (w *docxWriter) writeParagraph(style string, ctx docxContext, align string, rule bool, runs string) {
+	w.endsWithTable = false
+	w.body.WriteString("<w:p><w:pPr>")
+	if style != "" {
+		fmt.Fprintf(&w.body, `<w:pStyle w:val="%s"/>`, style)
+	}
+	if ctx.inList && ctx.first {
+		fmt.Fprintf(&w.body, `<w:numPr><w:ilvl w:val="%d"/><w:numId w:val="%d"/></w:numPr>`, ctx.level, ctx.numID)
+	}
+	if ctx.quote || rule {
+		w.body.WriteString("<w:pBdr>")
+		if ctx.quote {
+			w.body.WriteString(`<w:left w:val="single" w:sz="18" w:space="8" w:color="D1D5DB"/>`)
+		}
+		if rule {
+			w.body.WriteString(`<w:bottom w:val="single" w:sz="6" w:space="1" w:color="auto"/>`)
+		}
+		w.body.WriteString("</w:pBdr>")
+	}
+	switch {
+	case ctx.inList && ctx.first:
+		fmt.Fprintf(&w.body, `<w:ind w:left="%d" w:hanging="360"/>`, ctx.indent+(ctx.level+1)*docxListIndent)
+	case ctx.inList:
+		fmt.Fprintf(&w.body, `<w:ind w:left="%d"/>`, ctx.indent+(ctx.level+1)*docxListIndent)
+	case ctx.indent > 0:
+		fmt.Fprintf(&w.body, `<w:ind w:left="%d"/>`, ctx.indent)
+	}
+	switch align {
+	case "center", "right":
+		fmt.Fprintf(&w.body, `<w:jc w:val="%s"/>`, align)
+	case "justify":
+		w.body.WriteString(`<w:jc w:val="both"/>`)
+	}
+	w.body.WriteString("</w:pPr>")
+	w.body.WriteString(runs)
+	w.body.WriteString("</w:p>")
+}
+
+// inline writes a text node, hard break or image as runs; links become
+// hyperlinks to an external relationship
+func (w *docxWriter) inline(b *strings.Builder, n *PMNode, ctx docxContext) {
+	switch n.Type {
+	case "hardBreak":
+		b.WriteString("<w:r><w:br/></w:r>")
+		return
+	case "image":
+		if alt := n.attrString("alt"); alt != "" {
+			fmt.Fprintf(b, `<w:r><w:t xml:space="preserve">%s</w:t></w:r>`, xmlText(alt))
+		}
+		return
+	case "text":
+	default:
+		fmt.Fprintf(b, `<w:r><w:t xml:space="preserve">%s</w:t></w:r>`, xmlText(n.textContent()))
+		return
+	}
+
+	var props strings.Builder
+	link, linked := n.mark("link")
+	href := ""
+	if linked {
+		href, linked = safeHref(fmt.Sprint(link.Attrs["href"]))
+		linked = linked && !strings.HasPrefix(href, "#")
+	}
+	if linked {
+		props.WriteString(`<w:rStyle w:val="Hyperlink"/>`)
+	}
+	if _, ok := n.mark("code"); ok {
+		props.WriteString(`<w:rFonts w:ascii="Courier New" w:hAnsi="Courier New" w:cs="Courier New"/>`)
+	}
+	if _, ok := n.mark("bold"); ok || ctx.header {
+		props.WriteString("<w:b/>")
+	}
+	if _, ok := n.mark("italic"); ok {
+		props.WriteString("<w:i/>")
+	}
+	if _, ok := n.mark("strike"); ok {
+		props.WriteString("<w:strike/>")
+	}
+	if _, ok := n.mark("underline"); ok {
+		props.WriteString(`<w:u w:val="single"/>`)
+	}
+	run := "<w:r>"
+	if props.Len() > 0 {
+		run += "<w:rPr>" + props.String() + "</w:rPr>"
+	}
+	run += fmt.Sprintf(`<w:t xml:space="preserve">%s</w:t></w:r>`, xmlText(n.Text))
+	if linked {
+		w.links = append(w.links, href)
+		fmt.Fprintf(b, `<w:hyperlink r:id="rIdLink%d">%s</w:hyperlink>`, len(w.links), run)
+		return
+	}
+	b.WriteString(run)
+}
+
+// document is word/document.xml: the body and the page setup
+func (w *docxWriter) document(page paperSize) string {
+	width := int(math.Round(page.Width * twipsPerPoint))
+	height := int(math.Round(page.Height * twipsPerPoint))
+	margin := int(math.Round(pageMargin * twipsPerPoint))
+	orient := ""
+	if width > height {
+		orient = ` w:orient="landscape"`
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="%s" xmlns:r="%s"><w:body>%s<w:sectPr><w:pgSz w:w="%d" w:h="%d"%s/><w:pgMar w:top="%d" w:right="%d" w:bottom="%d" w:left="%d" w:header="0" w:footer="0" w:gutter="0"/></w:sectPr></w:body></w:document>`,
+		wordNamespace, relNamespace, w.body.String(), width, height, orient, margin, margin, margin, margin)
+}
+
+// numbering is word/numbering.xml: a bullet and a decimal definition, and
+// an instance per list that starts its level at the list's start number
+func (w *docxWriter) numbering() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:numbering xmlns:w="%s">`, wordNamespace)
+	bullets := []string{"•", "◦", "▪"}
+	for id, ordered := range []bool{false, true} {
+		fmt.Fprintf(&b, `<w:abstractNum w:abstractNumId="%d"><w:multiLevelType w:val="hybridMultilevel"/>`, id+1)
+		for level := 0; level < 9; level++ {
+			format, text := "bullet", bullets[level%len(bullets)]
+			if ordered {
+				format, text = "decimal", fmt.Sprintf("%%%d.", level+1)
+			}
+			fmt.Fprintf(&b, `<w:lvl w:ilvl="%d"><w:start w:val="1"/><w:numFmt w:val="%s"/><w:lvlText w:val="%s"/><w:lvlJc w:val="left"/><w:pPr><w:ind w:left="%d" w:hanging="360"/></w:pPr></w:lvl>`,
+				level, format, text, (level+1)*docxListIndent)
+		}
+		b.WriteString("</w:abstractNum>")
+	}
+	for i, list := range w.lists {
+		abstract := 1
+		if list.ordered {
+			abstract = 2
+		}
+		fmt.Fprintf(&b, `<w:num w:numId="%d"><w:abstractNumId w:val="%d"/>`, i+1, abstract)
+		if list.ordered {
+			fmt.Fprintf(&b, `<w:lvlOverride w:ilvl="%d"><w:startOverride w:val="%d"/></w:lvlOverride>`, list.level, list.start)
+		}
+		b.WriteString("</w:num>")
+	}
+	b.WriteString("</w:numbering>")
+	return b.String()
+}
+
+// relationships is word/_rels/document.xml.rels: styles, numbering and
+// the targets of links
+func (w *docxWriter) relationships() string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	b.WriteString(`<Relationship Id="rIdStyles" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`)
+	b.WriteString(`<Relationship Id="rIdNumbering" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/numbering" Target="numbering.xml"/>`)
+	for i, href := range w.links {
+		fmt.Fprintf(&b, `<Relationship Id="rIdLink%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/hyperlink" Target="%s" TargetMode="External"/>`, i+1, xmlText(href))
+	}
+	b.WriteString("</Relationships>")
+	return b.String()
+}
+
+// docxCoreProperties is docProps/core.xml: title, author and dates
+func docxCoreProperties(doc Document) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"><dc:title>%s</dc:title><dc:creator>%s</dc:creator><dcterms:created xsi:type="dcterms:W3CDTF">%s</dcterms:created><dcterms:modified xsi:type="dcterms:W3CDTF">%s</dcterms:modified></cp:coreProperties>`,
+		xmlText(doc.Title), xmlText(doc.Owner), doc.CreatedAt.UTC().Format(time.RFC3339), doc.UpdatedAt.UTC().Format(time.RFC3339))
+}
+
+// xmlText escapes text for XML content and attribute values
+func xmlText(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+const docxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/><Override PartName="/word/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.styles+xml"/><Override PartName="/word/numbering.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.numbering+xml"/><Override PartName="/docProps/core.xml" ContentType="application/vnd.openxmlformats-package.core-properties+xml"/></Types>`
+
+const docxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/><Relationship Id="rId2" Type="http://schemas.openxmlformats.org/package/2006/relationships/metadata/core-properties" Target="docProps/core.xml"/></Relationships>`
+
+// docxStyles sizes are in half-points; headings follow the editor's scale
+var docxStyles = func() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:styles xmlns:w="%s">`, wordNamespace)
+	b.WriteString(`<w:docDefaults><w:rPrDefault><w:rPr><w:rFonts w:ascii="Calibri" w:hAnsi="Calibri" w:cs="Calibri"/><w:sz w:val="22"/></w:rPr></w:rPrDefault><w:pPrDefault><w:pPr><w:spacing w:after="160" w:line="276" w:lineRule="auto"/></w:pPr></w:pPrDefault></w:docDefaults>`)
+	b.WriteString(`<w:style w:type="paragraph" w:default="1" w:styleId="Normal"><w:name w:val="Normal"/></w:style>`)
+	for level, size := range []int{48, 40, 32, 28, 24, 22} {
+		fmt.Fprintf(&b, `<w:style w:type="paragraph" w:styleId="Heading%d"><w:name w:val="heading %d"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:pPr><w:keepNext/><w:spacing w:before="240" w:after="120"/><w:outlineLvl w:val="%d"/></w:pPr><w:rPr><w:b/><w:sz w:val="%d"/></w:rPr></w:style>`,
+			level+1, level+1, level, size)
+	}
+	b.WriteString(`<w:style w:type="paragraph" w:styleId="Code"><w:name w:val="Code"/><w:basedOn w:val="Normal"/><w:pPr><w:shd w:val="clear" w:color="auto" w:fill="F3F4F6"/><w:spacing w:line="240" w:lineRule="auto"/></w:pPr><w:rPr><w:rFonts w:ascii="Courier New" w:hAnsi="Courier New" w:cs="Courier New"/><w:sz w:val="20"/></w:rPr></w:style>`)
+	b.WriteString(`<w:style w:type="character" w:styleId="Hyperlink"><w:name w:val="Hyperlink"/><w:rPr><w:color w:val="2563EB"/><w:u w:val="single"/></w:rPr></w:style>`)
+	b.WriteString(`<w:style w:type="table" w:styleId="TableGrid"><w:name w:val="Table Grid"/><w:tblPr><w:tblBorders><w:top w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:left w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:bottom w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:right w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:insideH w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:insideV w:val="single" w:sz="4" w:space="0" w:color="auto"/></w:tblBorders><w:tblCellMar><w:left w:w="108" w:type="dxa"/><w:right w:w="108" w:type="dxa"/></w:tblCellMar></w:tblPr></w:style>`)
+	b.WriteString("</w:styles>")
+	return b.String()
+}()
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Error codes returned in the "code" field of the error envelope
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeOriginForbidden  = "origin_not_allowed"
+	CodeUnsupportedChars = "unsupported_characters"
+	CodeInternal         = "internal_error"
+	CodeAINotConfigured  = "ai_not_configured"
+	CodeAIUnauthorized   = "ai_unauthorized"
+	CodeAIRateLimited    = "ai_rate_limited"
+	CodeAITimeout        = "ai_timeout"
+	CodeAIUnavailable    = "ai_unavailable"
+	CodeAIInvalidOutput  = "ai_invalid_output"
+)
+
+// APIError is the error body returned by every REST endpoint:
+//
+//	{"error": {"code": "ai_rate_limited", "message": "...", "retryable": true, "requestId": "..."}}
+type APIError struct {
+	Status     int           `json:"-"`
+	Code       string        `json:"code"`
+	Message    string        `json:"message"`
+	Retryable  bool          `json:"retryable"`
+	RequestID  string        `json:"requestId,omitempty"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+type errorEnvelope struct {
+	Error *APIError `json:"error"`
+}
+
+// errBadRequest is the APIError for malformed or invalid input
+func errBadRequest(format string, args ...interface{}) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+// errNotFound is the APIError for a resource that does not exist
+func errNotFound(message string) *APIError {
+	return &APIError{Status: http.StatusNotFound, Code: CodeNotFound, Message: message}
+}
+
+// errConflict is the APIError for a request that clashes with existing state
+func errConflict(message string) *APIError {
+	return &APIError{Status: http.StatusConflict, Code: CodeConflict, Message: message}
+}
+
+// errUnauthorized is the APIError for missing or wrong credentials
+func errUnauthorized() *APIError {
+	return &APIError{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: "Missing or invalid credentials"}
+}
+
+// errForbidden is the APIError for a caller without the rights for a request
+func errForbidden(message string) *APIError {
+	return &APIError{Status: http.StatusForbidden, Code: CodeForbidden, Message: message}
+}
+
+// errOriginForbidden is the APIError for an upgrade from a disallowed origin
+func errOriginForbidden() *APIError {
+	return &APIError{Status: http.StatusForbidden, Code: CodeOriginForbidden, Message: "Origin not allowed"}
+}
+
+// errUnsupportedCharacters is the APIError for a document an export format
+// cannot represent without losing text; up to ten of the characters are
+// named
+func errUnsupportedCharacters(format string, chars []rune) *APIError {
+	shown := chars
+	if len(shown) > 10 {
+		shown = shown[:10]
+	}
+	quoted := make([]string, len(shown))
+	for i, r := range shown {
+		quoted[i] = fmt.Sprintf("%q (%U)", r, r)
+	}
+	more := ""
+	if len(chars) > len(shown) {
+		more = fmt.Sprintf(" and %d more", len(chars)-len(shown))
+	}
+	return &APIError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    CodeUnsupportedChars,
+		Message: fmt.Sprintf("%s export cannot show %s%s; export as DOCX or HTML instead", format, strings.Join(quoted, ", "), more),
+	}
+}
+
+// errInvalidOutput is the APIError for model output that cannot be used
+func errInvalidOutput(err error) *APIError {
+	return &APIError{Status: http.StatusBadGateway, Code: CodeAIInvalidOutput, Message: err.Error(), Retryable: true}
+}
+
+// ErrMissingAPIKey is returned by the Groq client when no key is configured
+var ErrMissingAPIKey = errors.New("GROQ_API_KEY not set")
+
+// UpstreamStatusError is returned by the Groq client for non-200 responses
+type UpstreamStatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (e *UpstreamStatusError) Error() string {
+	return fmt.Sprintf("groq API returned status: %s", e.Status)
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds
+func parseRetryAfter(value string) time.Duration {
+	secs, err := strconv.Atoi(value)
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// toAPIError maps any error to the envelope, classifying upstream failures
+// so the frontend can tell configuration problems from transient ones
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	if errors.Is(err, ErrMissingAPIKey) {
+		return &APIError{Status: http.StatusServiceUnavailable, Code: CodeAINotConfigured,
+			Message: "The AI service is not configured on this server"}
+	}
+
+	var statusErr *UpstreamStatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden:
+			return &APIError{Status: http.StatusBadGateway, Code: CodeAIUnauthorized,
+				Message: "The AI service rejected the server's credentials"}
+		case statusErr.StatusCode == http.StatusTooManyRequests:
+			return &APIError{Status: http.StatusTooManyRequests, Code: CodeAIRateLimited,
+				Message: "The AI service is rate limiting requests", Retryable: true, RetryAfter: statusErr.RetryAfter}
+		case statusErr.StatusCode >= 500:
+			return &APIError{Status: http.StatusBadGateway, Code: CodeAIUnavailable,
+				Message: "The AI service is temporarily unavailable", Retryable: true}
+		default:
+			return &APIError{Status: http.StatusBadGateway, Code: CodeAIUnavailable,
+				Message: statusErr.Error()}
+		}
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &APIError{Status: http.StatusGatewayTimeout, Code: CodeAITimeout,
+			Message: "The AI service did not respond in time", Retryable: true}
+	}
+
+	return &APIError{Status: http.StatusInternalServerError, Code: CodeInternal,
+		Message: "Internal server error", Retryable: true}
+}
+
+// writeError writes err as a JSON error envelope
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := *toAPIError(err)
+	apiErr.RequestID = middleware.GetReqID(r.Context())
+
+	if apiErr.Status >= 500 {
+		log.Printf("[WARN] %s %s failed (request %s): %v", r.Method, r.URL.Path, apiErr.RequestID, err)
+	}
+	if apiErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(apiErr.RetryAfter/time.Second)))
+	}
+	writeJSON(w, apiErr.Status, errorEnvelope{Error: &apiErr})
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[WARN] Failed to write response: %v", err)
+	}
+}
+
+// notFoundHandler and methodNotAllowedHandler give the router's own errors
+// the same envelope as the handlers
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, &APIError{Status: http.StatusNotFound, Code: CodeNotFound, Message: "No route for " + r.URL.Path})
+}
+
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, &APIError{Status: http.StatusMethodNotAllowed, Code: CodeMethodNotAllowed,
+		Message: r.Method + " is not allowed on " + r.URL.Path})
+}
@@ -0,0 +1,724 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// exportFormat renders a document for GET /api/documents/{id}/export
+type exportFormat struct {
+	contentType string
+	ext         string
+	render      func(doc Document, content *PMNode, page paperSize) ([]byte, error)
+}
+
+// exportFormats are the formats accepted by ?format=
+var exportFormats = map[string]exportFormat{
+	"md": {"text/markdown; charset=utf-8", "md", func(_ Document, content *PMNode, _ paperSize) ([]byte, error) {
+		return []byte(renderMarkdown(content)), nil
+	}},
+	"html": {"text/html; charset=utf-8", "html", func(doc Document, content *PMNode, _ paperSize) ([]byte, error) {
+		return []byte(renderHTMLPage(doc.Title, content)), nil
+	}},
+	"txt": {"text/plain; charset=utf-8", "txt", func(_ Document, content *PMNode, _ paperSize) ([]byte, error) {
+		return []byte(renderText(content)), nil
+	}},
+	"json": {"application/json", "json", func(_ Document, content *PMNode, _ paperSize) ([]byte, error) {
+		return json.MarshalIndent(content, "", "  ")
+	}},
+	"docx": {"application/vnd.openxmlformats-officedocument.wordprocessingml.document", "docx", renderDOCX},
+	"pdf":  {"application/pdf", "pdf", renderPDF},
+}
+
+// paperSize is a paper size in points (1/72 inch)
+type paperSize struct {
+	Name          string
+	Width, Height float64
+}
+
+// pageMargin is the margin on every side of a page, 1cm as the editor
+// prints
+const pageMargin = 72 / 2.54
+
+// defaultPaperSize is the editor's default paper size
+const defaultPaperSize = "A4"
+
+// mm and inch convert to points
+func mm(v float64) float64   { return v * 72 / 25.4 }
+func inch(v float64) float64 { return v * 72 }
+
+// paperSizes are the sizes the editor's DocumentSizing component offers,
+// under the same names
+var paperSizes = map[string]paperSize{}
+
+func init() {
+	for _, size := range []paperSize{
+		// ISO A series
+		{"A0", mm(841), mm(1189)}, {"A1", mm(594), mm(841)}, {"A2", mm(420), mm(594)},
+		{"A3", mm(297), mm(420)}, {"A4", mm(210), mm(297)}, {"A5", mm(148), mm(210)},
+		{"A6", mm(105), mm(148)}, {"A7", mm(74), mm(105)}, {"A8", mm(52), mm(74)},
+		{"A9", mm(37), mm(52)}, {"A10", mm(26), mm(37)},
+		// ISO B series
+		{"B0", mm(1000), mm(1414)}, {"B1", mm(707), mm(1000)}, {"B2", mm(500), mm(707)},
+		{"B3", mm(353), mm(500)}, {"B4", mm(250), mm(353)}, {"B5", mm(176), mm(250)},
+		{"B6", mm(125), mm(176)}, {"B7", mm(88), mm(125)}, {"B8", mm(62), mm(88)},
+		{"B9", mm(44), mm(62)}, {"B10", mm(31), mm(44)},
+		// ISO C series (envelopes) and DL
+		{"C0", mm(917), mm(1297)}, {"C1", mm(648), mm(917)}, {"C2", mm(458), mm(648)},
+		{"C3", mm(324), mm(458)}, {"C4", mm(229), mm(324)}, {"C5", mm(162), mm(229)},
+		{"C6", mm(114), mm(162)}, {"DL", mm(110), mm(220)},
+		// North American sizes
+		{"Letter", inch(8.5), inch(11)}, {"Legal", inch(8.5), inch(14)},
+		{"Tabloid", inch(11), inch(17)}, {"Ledger", inch(17), inch(11)},
+		{"Statement", inch(5.5), inch(8.5)}, {"Executive", inch(7.25), inch(10.5)},
+		{"Folio", inch(8.5), inch(13)}, {"Quarto", inch(8), inch(10)},
+		{"Junior Legal", inch(5), inch(8)},
+		// Architectural sizes
+		{"Arch A", inch(9), inch(12)}, {"Arch B", inch(12), inch(18)},
+		{"Arch C", inch(18), inch(24)}, {"Arch D", inch(24), inch(36)},
+		{"Arch E", inch(36), inch(48)}, {"Arch E1", inch(30), inch(42)},
+		// Photo sizes
+		{"Photo 4R (4x6)", inch(4), inch(6)}, {"Photo 5R (5x7)", inch(5), inch(7)},
+		{"Photo 8R (8x10)", inch(8), inch(10)}, {"Photo S8R (Super 8R / 8x12)", inch(8), inch(12)},
+		{"Photo A3+ (Super B)", inch(13), inch(19)},
+		// Other common sizes
+		{"Business Card (US)", inch(3.5), inch(2)}, {"Business Card (EU)", mm(85), mm(55)},
+		{"Index Card (3x5)", inch(3), inch(5)}, {"Index Card (4x6)", inch(4), inch(6)},
+		{"Index Card (5x8)", inch(5), inch(8)},
+	} {
+		paperSizes[strings.ToLower(size.Name)] = size
+	}
+}
+
+// lookupPaperSize finds a paper size by name, ignoring case; empty is A4
+func lookupPaperSize(name string) (paperSize, bool) {
+	if name = strings.TrimSpace(name); name == "" {
+		name = defaultPaperSize
+	}
+	size, ok := paperSizes[strings.ToLower(name)]
+	return size, ok
+}
+
+// documentContent decodes a document's content: the live document, or the
+// given snapshot of it. A room nobody has opened yet is an empty document.
+func documentContent(hub *CollaborationHub, doc Document, snapshotID string) (*PMNode, error) {
+	state, ok := hub.LookupState(doc.RoomID)
+	if !ok {
+		if snapshotID != "" {
+			return nil, errNotFound("Snapshot not found")
+		}
+		return &PMNode{Type: "doc"}, nil
+	}
+	defer hub.ReleaseState(state)
+	snap := state.Current()
+	if snapshotID != "" {
+		if snap, ok = state.Snapshot(snapshotID); !ok {
+			return nil, errNotFound("Snapshot not found")
+		}
+	}
+	ydoc, err := snap.load()
+	if err != nil {
+		return nil, err
+	}
+	return ydoc.ProseMirror(""), nil
+}
+
+// exportDocument writes a document in the format named by ?format= as an
+// attachment named after its title
+func exportDocument(w http.ResponseWriter, r *http.Request, hub *CollaborationHub, doc Document) {
+	name := r.URL.Query().Get("format")
+	format, ok := exportFormats[name]
+	if !ok {
+		names := sortedKeys(exportFormats)
+		writeError(w, r, errBadRequest("format must be one of %s", strings.Join(names, ", ")))
+		return
+	}
+	page, ok := lookupPaperSize(r.URL.Query().Get("size"))
+	if !ok {
+		writeError(w, r, errBadRequest("Unknown page size %q", r.URL.Query().Get("size")))
+		return
+	}
+	content, err := documentContent(hub, doc, r.URL.Query().Get("snapshot"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	body, err := format.render(doc, content, page)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": exportFileName(doc.Title) + "." + format.ext,
+	}))
+	_, _ = w.Write(body)
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[\x00-\x1f\x7f/\\:*?"<>|]+`)
+
+// exportFileName turns a title into a file name without the extension
+func exportFileName(title string) string {
+	name := strings.Trim(unsafeFileNameChars.ReplaceAllString(title, "_"), " ._")
+	if name == "" {
+		return "document"
+	}
+	return name
+}
+
+// safeHref keeps links to the web, mail and in-document anchors; anything
+// else (javascript: and friends) is dropped
+func safeHref(href string) (string, bool) {
+	href = strings.TrimSpace(href)
+	if strings.HasPrefix(href, "#") {
+		return href, true
+	}
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return href, true
+	case "":
+		return href, !strings.HasPrefix(href, "//") && !strings.Contains(href, ":")
+	}
+	return "", false
+}
+
+// markOrder is the nesting of marks, outermost first
+var markOrder = map[string]int{"link": 0, "bold": 1, "italic": 2, "strike": 3, "underline": 4, "code": 5}
+
+// orderedMarks sorts marks by markOrder; unknown marks go innermost
+func orderedMarks(marks []PMMark) []PMMark {
+	out := append([]PMMark{}, marks...)
+	rank := func(m PMMark) int {
+		if r, ok := markOrder[m.Type]; ok {
+			return r
+		}
+		return len(markOrder)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return rank(out[i]) < rank(out[j]) })
+	return out
+}
+
+// sameMark reports whether two marks are of the same type and attributes
+func sameMark(a, b PMMark) bool {
+	return a.Type == b.Type && sameAttributes(a.Attrs, b.Attrs)
+}
+
+// textRenderer renders a document as Markdown or as plain text. Each block
+// becomes a list of lines; containers prefix the lines of their children.
+type textRenderer struct {
+	markdown bool
+}
+
+// renderMarkdown renders a document as CommonMark with GitHub tables and
+// strikethrough. Underline has no Markdown syntax and is kept as <u>.
+func renderMarkdown(doc *PMNode) string {
+	return textRenderer{markdown: true}.render(doc)
+}
+
+// renderText renders a document as plain text: paragraphs separated by
+// blank lines, lists with their markers, no formatting
+func renderText(doc *PMNode) string {
+	return textRenderer{}.render(doc)
+}
+
+func (tr textRenderer) render(doc *PMNode) string {
+	lines := tr.blocks(doc.Content, true)
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// blocks renders a sequence of blocks, separated by blank lines unless they
+// are the items of a tight list
+func (tr textRenderer) blocks(nodes []*PMNode, loose bool) []string {
+	var lines []string
+	for i := 0; i < len(nodes); i++ {
+		n := nodes[i]
+		var block []string
+		if n.isInline() {
+			// Inline content outside a text block: gather it into one
+			j := i
+			for j < len(nodes) && nodes[j].isInline() {
+				j++
+			}
+			block = tr.paragraph(nodes[i:j])
+			i = j - 1
+		} else {
+			block = tr.block(n)
+		}
+		if block == nil {
+			continue
+		}
+		if loose && len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, block...)
+	}
+	return lines
+}
+
+// block renders one block node
+func (tr textRenderer) block(n *PMNode) []string {
+	switch n.Type {
+	case "paragraph":
+		return tr.paragraph(n.Content)
+	case "heading":
+		lines := tr.paragraph(n.Content)
+		if tr.markdown {
+			level := n.attrInt("level", 1)
+			if level < 1 || level > 6 {
+				level = 1
+			}
+			return []string{strings.Repeat("#", level) + " " + strings.Join(lines, " ")}
+		}
+		return lines
+	case "blockquote":
+		marker := "  "
+		if tr.markdown {
+			marker = "> "
+		}
+		return prefixLines(tr.blocks(n.Content, true), marker, marker)
+	case "codeBlock":
+		code := strings.Split(strings.TrimSuffix(n.textContent(), "\n"), "\n")
+		if !tr.markdown {
+			return code
+		}
+		fence := "```"
+		for strings.Contains(n.textContent(), fence) {
+			fence += "`"
+		}
+		lines := []string{fence + n.attrString("language")}
+		lines = append(lines, code...)
+		return append(lines, fence)
+	case "horizontalRule":
+		return []string{"---"}
+	case "bulletList", "orderedList", "taskList":
+		return tr.list(n)
+	case "table":
+		return tr.table(n)
+	case "image":
+		return tr.paragraph([]*PMNode{n})
+	default:
+		// Unknown nodes keep their content
+		if len(n.Content) > 0 && n.Content[0].isInline() {
+			return tr.paragraph(n.Content)
+		}
+		return tr.blocks(n.Content, true)
+	}
+}
+
+// list renders list items with their markers; continuation lines are
+// indented to line up with the item's text
+func (tr textRenderer) list(n *PMNode) []string {
+	var lines []string
+	number := n.attrInt("start", 1)
+	// A list is loose, with blank lines between items, when an item has
+	// more than one paragraph; a nested list alone keeps it tight
+	loose := false
+	for _, item := range n.Content {
+		blocks := 0
+		for _, child := range item.Content {
+			if child.Type != "bulletList" && child.Type != "orderedList" && child.Type != "taskList" {
+				blocks++
+			}
+		}
+		if blocks > 1 {
+			loose = true
+		}
+	}
+	for i, item := range n.Content {
+		marker := "- "
+		if n.Type == "orderedList" {
+			marker = fmt.Sprintf("%d. ", number+i)
+		} else if n.Type == "taskList" {
+			marker = "- [ ] "
+			if checked, _ := item.Attrs["checked"].(bool); checked {
+				marker = "- [x] "
+			}
+		}
+		if loose && i > 0 {
+			lines = append(lines, "")
+		}
+		body := tr.blocks(item.Content, loose)
+		if len(body) == 0 {
+			body = []string{""}
+		}
+		lines = append(lines, prefixLines(body, marker, strings.Repeat(" ", len(marker)))...)
+	}
+	return lines
+}
+
+// table renders a table as a GitHub pipe table, the first row as header;
+// as plain text, cells are separated by tabs
+func (tr textRenderer) table(n *PMNode) []string {
+	var rows [][]string
+	width := 0
+	for _, row := range n.Content {
+		var cells []string
+		for _, cell := range row.Content {
+			var parts []string
+			for _, block := range cell.Content {
+				parts = append(parts, strings.Join(tr.block(block), " "))
+			}
+			text := strings.Join(parts, " ")
+			if tr.markdown {
+				text = strings.ReplaceAll(text, "|", `\|`)
+			}
+			cells = append(cells, text)
+		}
+		if len(cells) > width {
+			width = len(cells)
+		}
+		rows = append(rows, cells)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	var lines []string
+	for i, cells := range rows {
+		for len(cells) < width {
+			cells = append(cells, "")
+		}
+		if !tr.markdown {
+			lines = append(lines, strings.Join(cells, "\t"))
+			continue
+		}
+		lines = append(lines, "| "+strings.Join(cells, " | ")+" |")
+		if i == 0 {
+			lines = append(lines, "|"+strings.Repeat(" --- |", width))
+		}
+	}
+	return lines
+}
+
+// prefixLines puts first in front of the first line and rest in front of
+// the others; blank lines stay blank
+func prefixLines(lines []string, first, rest string) []string {
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		prefix := rest
+		if i == 0 {
+			prefix = first
+		}
+		if line == "" {
+			out[i] = strings.TrimRight(prefix, " ")
+			continue
+		}
+		out[i] = prefix + line
+	}
+	return out
+}
+
+// markdownLineStart matches text at the start of a line that Markdown would
+// read as block syntax: ATX headings, list markers and setext underlines.
+// "*" and ">" are escaped everywhere already.
+var markdownLineStart = regexp.MustCompile(`^\s*(#{1,6}(\s|$)|[-+](\s|$)|\d{1,9}[.)](\s|$)|=+\s*$|-+\s*$)`)
+
+// paragraph renders inline content as lines; hard breaks end a line
+func (tr textRenderer) paragraph(nodes []*PMNode) []string {
+	if !tr.markdown {
+		var b strings.Builder
+		for _, n := range nodes {
+			if n.Type == "image" {
+				b.WriteString(n.attrString("alt"))
+				continue
+			}
+			n.writeText(&b)
+		}
+		text := strings.TrimRight(b.String(), " \t")
+		if strings.TrimSpace(text) == "" {
+			return nil
+		}
+		return strings.Split(text, "\n")
+	}
+
+	text := strings.TrimRight(markdownInline(nodes), " \t")
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if m := markdownLineStart.FindStringSubmatchIndex(line); m != nil {
+			// Escape the marker: "\#", "\-", "1\."
+			at := m[2]
+			for at < len(line) && line[at] >= '0' && line[at] <= '9' {
+				at++
+			}
+			lines[i] = line[:at] + `\` + line[at:]
+		}
+	}
+	return lines
+}
+
+// markdownInline renders inline nodes with their marks. Marks stay open
+// across nodes that share them, and whitespace is moved outside the
+// delimiters so that "**bold **" does not break emphasis.
+func markdownInline(nodes []*PMNode) string {
+	var b strings.Builder
+	var active []PMMark
+	pending := ""
+
+	closeTo := func(n int) {
+		for len(active) > n {
+			b.WriteString(markdownDelimiter(active[len(active)-1], false))
+			active = active[:len(active)-1]
+		}
+	}
+
+	for _, n := range nodes {
+		var marks []PMMark
+		var code bool
+		for _, m := range orderedMarks(n.Marks) {
+			if m.Type == "code" {
+				code = true
+				continue
+			}
+			if _, known := markOrder[m.Type]; known {
+				marks = append(marks, m)
+			}
+		}
+
+		// Keep the longest run of active marks the node still has
+		keep := 0
+		for keep < len(active) && keep < len(marks) && sameMark(active[keep], marks[keep]) {
+			keep++
+		}
+		closeTo(keep)
+
+		text, lead, trail := n.Text, "", ""
+		if n.Type == "text" {
+			core := strings.TrimSpace(text)
+			if core != "" {
+				lead = text[:strings.Index(text, core)]
+				trail = text[len(lead)+len(core):]
+				text = core
+			}
+		}
+		b.WriteString(pending)
+		pending = ""
+		if keep < len(marks) {
+			b.WriteString(lead)
+			lead = ""
+		}
+		for _, m := range marks[keep:] {
+			b.WriteString(markdownDelimiter(m, true))
+			active = append(active, m)
+		}
+		b.WriteString(lead)
+
+		switch n.Type {
+		case "text":
+			if code {
+				b.WriteString(markdownCode(text))
+			} else {
+				b.WriteString(escapeMarkdown(text))
+			}
+			pending = trail
+		case "hardBreak":
+			closeTo(0)
+			b.WriteString("\\\n")
+		case "image":
+			src, _ := safeHref(n.attrString("src"))
+			fmt.Fprintf(&b, "![%s](%s", escapeMarkdown(n.attrString("alt")), src)
+			if title := n.attrString("title"); title != "" {
+				fmt.Fprintf(&b, " %q", title)
+			}
+			b.WriteString(")")
+		default:
+			b.WriteString(escapeMarkdown(n.textContent()))
+		}
+	}
+	closeTo(0)
+	b.WriteString(pending)
+	return b.String()
+}
+
+// markdownDelimiter opens or closes a mark
+func markdownDelimiter(m PMMark, open bool) string {
+	switch m.Type {
+	case "bold":
+		return "**"
+	case "italic":
+		return "_"
+	case "strike":
+		return "~~"
+	case "underline":
+		if open {
+			return "<u>"
+		}
+		return "</u>"
+	case "link":
+		if open {
+			return "["
+		}
+		href, _ := safeHref(fmt.Sprint(m.Attrs["href"]))
+		return "](" + strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29").Replace(href) + ")"
+	}
+	return ""
+}
+
+// markdownCode wraps text in enough backticks to contain it
+func markdownCode(text string) string {
+	fence := "`"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	if strings.HasPrefix(text, "`") || strings.HasSuffix(text, "`") {
+		return fence + " " + text + " " + fence
+	}
+	return fence + text + fence
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`,
+	"<", `\<`, ">", `\>`, "~", `\~`,
+)
+
+// escapeMarkdown escapes characters Markdown would read as inline syntax
+func escapeMarkdown(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+// renderHTMLPage renders a document as a standalone HTML page
+func renderHTMLPage(title string, doc *PMNode) string {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&b, "<title>%s</title>\n</head>\n<body>\n", html.EscapeString(title))
+	for _, n := range doc.Content {
+		writeHTML(&b, n)
+		b.WriteString("\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+	return b.String()
+}
+
+// htmlBlockTags maps block node types to their elements, as TipTap's
+// getHTML renders them
+var htmlBlockTags = map[string]string{
+	"paragraph":   "p",
+	"blockquote":  "blockquote",
+	"bulletList":  "ul",
+	"orderedList": "ol",
+	"listItem":    "li",
+	"taskList":    "ul",
+	"taskItem":    "li",
+	"table":       "table",
+	"tableRow":    "tr",
+	"tableCell":   "td",
+	"tableHeader": "th",
+}
+
+// writeHTML renders a node and its content
+func writeHTML(b *strings.Builder, n *PMNode) {
+	switch n.Type {
+	case "text":
+		writeHTMLText(b, n)
+		return
+	case "hardBreak":
+		b.WriteString("<br>")
+		return
+	case "horizontalRule":
+		b.WriteString("<hr>")
+		return
+	case "image":
+		src, ok := safeHref(n.attrString("src"))
+		if !ok {
+			return
+		}
+		fmt.Fprintf(b, `<img src="%s" alt="%s"`, html.EscapeString(src), html.EscapeString(n.attrString("alt")))
+		if title := n.attrString("title"); title != "" {
+			fmt.Fprintf(b, ` title="%s"`, html.EscapeString(title))
+		}
+		b.WriteString(">")
+		return
+	case "codeBlock":
+		b.WriteString("<pre><code")
+		if lang := n.attrString("language"); lang != "" && codeLanguagePattern.MatchString("language-"+lang) {
+			fmt.Fprintf(b, ` class="language-%s"`, lang)
+		}
+		b.WriteString(">" + html.EscapeString(n.textContent()) + "</code></pre>")
+		return
+	}
+
+	tag, ok := htmlBlockTags[n.Type]
+	attrs := ""
+	switch {
+	case n.Type == "heading":
+		level := n.attrInt("level", 1)
+		if level < 1 || level > 6 {
+			level = 1
+		}
+		tag, ok = fmt.Sprintf("h%d", level), true
+	case n.Type == "orderedList" && n.attrInt("start", 1) != 1:
+		attrs = fmt.Sprintf(` start="%d"`, n.attrInt("start", 1))
+	case n.Type == "tableCell" || n.Type == "tableHeader":
+		for _, key := range []string{"colspan", "rowspan"} {
+			if span := n.attrInt(key, 1); span > 1 {
+				attrs += fmt.Sprintf(` %s="%d"`, key, span)
+			}
+		}
+	}
+	if align := n.attrString("textAlign"); align == "center" || align == "right" || align == "justify" {
+		attrs += fmt.Sprintf(` style="text-align: %s"`, align)
+	}
+	if !ok {
+		// Unknown nodes keep their content
+		for _, child := range n.Content {
+			writeHTML(b, child)
+		}
+		return
+	}
+	b.WriteString("<" + tag + attrs + ">")
+	if n.Type == "table" {
+		b.WriteString("<tbody>")
+	}
+	for _, child := range n.Content {
+		writeHTML(b, child)
+	}
+	if n.Type == "table" {
+		b.WriteString("</tbody>")
+	}
+	b.WriteString("</" + tag + ">")
+}
+
+// htmlMarkTags maps marks to their elements
+var htmlMarkTags = map[string]string{
+	"bold": "strong", "italic": "em", "strike": "s", "underline": "u", "code": "code",
+}
+
+// writeHTMLText renders a text node wrapped in its marks
+func writeHTMLText(b *strings.Builder, n *PMNode) {
+	marks := orderedMarks(n.Marks)
+	var closing []string
+	for _, m := range marks {
+		if m.Type == "link" {
+			href, ok := safeHref(fmt.Sprint(m.Attrs["href"]))
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(b, `<a href="%s">`, html.EscapeString(href))
+			closing = append(closing, "</a>")
+			continue
+		}
+		if tag, ok := htmlMarkTags[m.Type]; ok {
+			b.WriteString("<" + tag + ">")
+			closing = append(closing, "</"+tag+">")
+		}
+	}
+	b.WriteString(html.EscapeString(n.Text))
+	for i := len(closing) - 1; i >= 0; i-- {
+		b.WriteString(closing[i])
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/font/sfnt"
+)
+
+// pmUpdate writes nodes into the "default" fragment of d and returns the
+// update
+func pmUpdate(d *YDoc, nodes ...*PMNode) []byte {
+	return d.Transact(func(tx *yTransaction) {
+		tx.insertProseMirror(d.root(defaultFragment), nodes)
+	})
+}
+
+func pmText(text string, marks ...string) *PMNode {
+	n := &PMNode{Type: "text", Text: text}
+	for _, m := range marks {
+		n.Marks = append(n.Marks, PMMark{Type: m})
+	}
+	return n
+}
+
+func pmBlock(typ string, attrs map[string]interface{}, content ...*PMNode) *PMNode {
+	return &PMNode{Type: typ, Attrs: attrs, Content: content}
+}
+
+// sampleDocument covers the node and mark types of the editor schema
+func sampleDocument() []*PMNode {
+	link := pmText("the site")
+	link.Marks = []PMMark{{Type: "link", Attrs: map[string]interface{}{"href": "https://example.com/a b"}}}
+	return []*PMNode{
+		pmBlock("heading", map[string]interface{}{"level": int64(2)}, pmText("Release notes")),
+		pmBlock("paragraph", nil, pmText("Read "), pmText("all ", "bold"), pmText("of it", "bold", "italic"), pmText(" on "), link, pmText(". 2*3 ")),
+		pmBlock("paragraph", map[string]interface{}{"textAlign": "center"}, pmText("1. not a list"), pmBlock("hardBreak", nil), pmText("run "), pmText("go test", "code")),
+		pmBlock("bulletList", nil,
+			pmBlock("listItem", nil, pmBlock("paragraph", nil, pmText("first"))),
+			pmBlock("listItem", nil, pmBlock("paragraph", nil, pmText("second")),
+				pmBlock("orderedList", map[string]interface{}{"start": int64(3)},
+					pmBlock("listItem", nil, pmBlock("paragraph", nil, pmText("nested")))))),
+		pmBlock("blockquote", nil, pmBlock("paragraph", nil, pmText("quoted"))),
+		pmBlock("codeBlock", map[string]interface{}{"language": "go"}, pmText("fmt.Println(\"<hi>\")")),
+		pmBlock("horizontalRule", nil),
+		pmBlock("paragraph", nil),
+	}
+}
+
+func TestProseMirrorExport(t *testing.T) {
+	d := NewYDoc()
+	pmUpdate(d, sampleDocument()...)
+	doc := d.ProseMirror("")
+
+	wantMD := "## Release notes\n" +
+		"\n" +
+		"Read **all _of it_** on [the site](https://example.com/a%20b). 2\\*3\n" +
+		"\n" +
+		"1\\. not a list\\\n" +
+		"run `go test`\n" +
+		"\n" +
+		"- first\n" +
+		"- second\n" +
+		"  3. nested\n" +
+		"\n" +
+		"> quoted\n" +
+		"\n" +
+		"```go\n" +
+		"fmt.Println(\"<hi>\")\n" +
+		"```\n" +
+		"\n" +
+		"---\n"
+	if got := renderMarkdown(doc); got != wantMD {
+		t.Errorf("markdown =\n%s\nwant\n%s", got, wantMD)
+	}
+
+	html := renderHTMLPage("Notes <1>", doc)
+	for _, want := range []string{
+		"<title>Notes &lt;1&gt;</title>",
+		"<h2>Release notes</h2>",
+		"<strong>all </strong><strong><em>of it</em></strong>",
+		`<a href="https://example.com/a b">the site</a>`,
+		`<p style="text-align: center">1. not a list<br>run <code>go test</code></p>`,
+		`<ol start="3"><li><p>nested</p></li></ol>`,
+		`<pre><code class="language-go">fmt.Println(&#34;&lt;hi&gt;&#34;)</code></pre>`,
+		"<hr>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("html is missing %s:\n%s", want, html)
+		}
+	}
+
+	wantText := "Release notes\n\nRead all of it on the site. 2*3\n\n1. not a list\nrun go test\n\n- first\n- second\n  3. nested\n\n  quoted\n\nfmt.Println(\"<hi>\")\n\n---\n"
+	if got := renderText(doc); got != wantText {
+		t.Errorf("text = %q, want %q", got, wantText)
+	}
+
+	// The JSON is ProseMirror's, with numbers as the client sent them
+	data, _ := json.Marshal(doc)
+	var decoded PMNode
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.Type != "doc" || len(decoded.Content) != 8 || decoded.Content[0].attrInt("level", 0) != 2 {
+		t.Errorf("json = %s", data)
+	}
+
+	// Unsafe links are dropped
+	unsafe := pmText("click")
+	unsafe.Marks = []PMMark{{Type: "link", Attrs: map[string]interface{}{"href": "javascript:alert(1)"}}}
+	page := renderHTMLPage("", &PMNode{Type: "doc", Content: []*PMNode{pmBlock("paragraph", nil, unsafe)}})
+	if strings.Contains(page, "javascript") {
+		t.Errorf("unsafe link kept: %s", page)
+	}
+}
+
+func TestExportRoute(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	docs, _ := NewDocuments(nil)
+	h := DocumentRoutes(hub, docs)
+	doc, _ := docs.Create(Document{Title: "Q3: plan", Owner: "ada", Tags: []string{}})
+
+	// A document nobody has opened exports as empty
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+doc.ID+"/export?format=txt", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("empty export: status = %d, body = %q", rec.Code, rec.Body.String())
+	}
+
+	client := joinTestClient(t, hub, doc.RoomID, "WebSocket")
+	if err := client.Room.ApplyUpdate(pmUpdate(NewYDoc(), sampleDocument()...), client); err != nil {
+		t.Fatalf("ApplyUpdate: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+doc.ID+"/export?format=md", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "## Release notes") {
+		t.Fatalf("md export: status = %d, body = %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename="Q3_ plan.md"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/markdown; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+doc.ID+"/export?format=pdf&size=us+letter", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown size: status = %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+doc.ID+"/export?format=pdf&size=letter", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "/MediaBox [0 0 612 792]") {
+		t.Errorf("pdf export: status = %d", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename="Q3_ plan.pdf"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	for path, want := range map[string]int{
+		"/" + doc.ID + "/export":                      http.StatusBadRequest,
+		"/" + doc.ID + "/export?format=pdf1":          http.StatusBadRequest,
+		"/" + doc.ID + "/export?format=md&snapshot=x": http.StatusNotFound,
+		"/nope/export?format=md":                      http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("GET %s: status = %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+func TestDOCXExport(t *testing.T) {
+	d := NewYDoc()
+	pmUpdate(d, append(sampleDocument(), pmBlock("table", nil,
+		pmBlock("tableRow", nil, pmBlock("tableHeader", nil, pmBlock("paragraph", nil, pmText("Name"))), pmBlock("tableHeader", nil, pmBlock("paragraph", nil, pmText("Role")))),
+		pmBlock("tableRow", nil, pmBlock("tableCell", nil, pmBlock("paragraph", nil, pmText("Ada"))), pmBlock("tableCell", nil)),
+	))...)
+	letter, _ := lookupPaperSize("letter")
+	data, err := renderDOCX(Document{Title: "Notes & more", Owner: "ada"}, d.ProseMirror(""), letter)
+	if err != nil {
+		t.Fatalf("renderDOCX: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("not a zip: %v", err)
+	}
+	parts := make(map[string]string)
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		body, _ := io.ReadAll(rc)
+		rc.Close()
+		parts[f.Name] = string(body)
+		// Every part is well-formed XML
+		dec := xml.NewDecoder(bytes.NewReader(body))
+		for {
+			if _, err := dec.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: %v", f.Name, err)
+			}
+		}
+	}
+	for name, want := range map[string][]string{
+		"word/document.xml": {
+			`<w:pStyle w:val="Heading2"/></w:pPr><w:r><w:t xml:space="preserve">Release notes</w:t>`,
+			`<w:r><w:rPr><w:b/><w:i/></w:rPr><w:t xml:space="preserve">of it</w:t></w:r>`,
+			`<w:hyperlink r:id="rIdLink1"><w:r><w:rPr><w:rStyle w:val="Hyperlink"/></w:rPr><w:t xml:space="preserve">the site</w:t>`,
+			`<w:jc w:val="center"/>`,
+			`<w:numPr><w:ilvl w:val="1"/><w:numId w:val="2"/></w:numPr>`,
+			`<w:pStyle w:val="Code"/>`,
+			`<w:tblGrid><w:gridCol w:w="5553"/><w:gridCol w:w="5553"/></w:tblGrid>`,
+			`<w:pgSz w:w="12240" w:h="15840"/>`,
+		},
+		"word/numbering.xml":           {`<w:num w:numId="2"><w:abstractNumId w:val="2"/><w:lvlOverride w:ilvl="1"><w:startOverride w:val="3"/>`},
+		"word/_rels/document.xml.rels": {`Target="https://example.com/a b" TargetMode="External"`},
+		"docProps/core.xml":            {"<dc:title>Notes &amp; more</dc:title>"},
+		"[Content_Types].xml":          {"wordprocessingml.document.main+xml"},
+	} {
+		for _, w := range want {
+			if !strings.Contains(parts[name], w) {
+				t.Errorf("%s is missing %s:\n%s", name, w, parts[name])
+			}
+		}
+	}
+}
+
+func TestPDFExportUnsupportedCharacters(t *testing.T) {
+	a4, _ := lookupPaperSize("")
+	doc := &PMNode{Type: "doc", Content: []*PMNode{
+		pmBlock("paragraph", nil, pmText("Привет, мир! “Quotes” – fine")),
+		pmBlock("paragraph", nil, pmText("日本語 😀 日本 ok")),
+	}}
+	_, err := renderPDF(Document{Title: "Notes"}, doc, a4)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnprocessableEntity || apiErr.Code != CodeUnsupportedChars {
+		t.Fatalf("renderPDF: err = %v", err)
+	}
+	// Each character is named once
+	if want := "'日' (U+65E5), '本' (U+672C), '語' (U+8A9E), '😀' (U+1F600);"; !strings.Contains(apiErr.Message, want) {
+		t.Errorf("message %q does not name %s", apiErr.Message, want)
+	}
+	if strings.Contains(apiErr.Message, "П") || strings.Contains(apiErr.Message, "“") {
+		t.Errorf("message names characters the fonts have: %q", apiErr.Message)
+	}
+
+	// Image alt text is shown, so it is checked too
+	doc = &PMNode{Type: "doc", Content: []*PMNode{pmBlock("image", map[string]interface{}{"src": "a.png", "alt": "Chart 😀"})}}
+	if _, err := renderPDF(Document{Title: "Notes"}, doc, a4); err == nil || !strings.Contains(err.Error(), "U+1F600") {
+		t.Errorf("renderPDF with an emoji in alt text: err = %v", err)
+	}
+
+	// Latin, Greek and Cyrillic text with typographic punctuation renders
+	doc = &PMNode{Type: "doc", Content: []*PMNode{pmBlock("paragraph", nil, pmText("Café “naïve” — 50 € · Ωμέγα · Привет"))}}
+	if _, err := renderPDF(Document{Title: "Notes"}, doc, a4); err != nil {
+		t.Errorf("renderPDF of European text: %v", err)
+	}
+}
+
+func TestPDFExport(t *testing.T) {
+	d := NewYDoc()
+	nodes := sampleDocument()
+	// Enough paragraphs to need a second page
+	for i := 0; i < 60; i++ {
+		nodes = append(nodes, pmBlock("paragraph", map[string]interface{}{"textAlign": "justify"},
+			pmText(strings.Repeat("Lorem ipsum dolor sit amet, consectetur adipiscing elit. ", 3))))
+	}
+	pmUpdate(d, nodes...)
+	a4, _ := lookupPaperSize("")
+	data, err := renderPDF(Document{Title: "Café notes", Owner: "ada"}, d.ProseMirror(""), a4)
+	if err != nil {
+		t.Fatalf("renderPDF: %v", err)
+	}
+	pdf := string(data)
+	if !strings.HasPrefix(pdf, "%PDF-1.4\n") || !strings.HasSuffix(pdf, "%%EOF\n") {
+		t.Fatalf("not a PDF: %.40q", pdf)
+	}
+
+	// The cross-reference table points at every object
+	xref := regexp.MustCompile(`startxref\n(\d+)\n`).FindStringSubmatch(pdf)
+	start, _ := strconv.Atoi(xref[1])
+	lines := strings.Split(pdf[start:], "\n")
+	count, _ := strconv.Atoi(strings.Fields(lines[1])[1])
+	for i := 1; i < count; i++ {
+		offset, _ := strconv.Atoi(lines[2+i][:10])
+		if want := fmt.Sprintf("%d 0 obj\n", i); !strings.HasPrefix(pdf[offset:], want) {
+			t.Fatalf("xref entry %d points at %.20q", i, pdf[offset:])
+		}
+	}
+
+	if pages := strings.Count(pdf, "/Type /Page "); pages < 2 {
+		t.Errorf("pages = %d, want at least 2", pages)
+	}
+	for _, want := range []string{
+		"/MediaBox [0 0 595.28 841.89]",
+		"/Subtype /Type0 /BaseFont /",
+		"/Encoding /Identity-H",
+		"/FontFile2 ",
+		"/CIDToGIDMap /Identity",
+		"/ToUnicode ",
+		"/URI (https://example.com/a b)",
+		"/Title <FEFF00430061006600E9",
+	} {
+		if !strings.Contains(pdf, want) {
+			t.Errorf("PDF is missing %s", want)
+		}
+	}
+	// Only the fonts the pages use are embedded
+	if strings.Contains(pdf, "/F8 ") {
+		t.Errorf("PDF embeds the unused bold italic Go Mono")
+	}
+
+	var content strings.Builder
+	for _, m := range regexp.MustCompile(`(?s)stream\n(.*?)\nendstream`).FindAllStringSubmatch(pdf, -1) {
+		zr, err := zlib.NewReader(strings.NewReader(m[1]))
+		if err != nil {
+			t.Fatalf("content stream: %v", err)
+		}
+		body, _ := io.ReadAll(zr)
+		content.Write(body)
+	}
+	glyphs := func(f pdfFont, s string) string { return pdfGlyphString(f.encode(s)) }
+	for _, want := range []string{
+		"/F2 20 Tf", // heading 2 in bold
+		glyphs(fontSansBold, "Release notes") + " Tj",
+		"/F4 11 Tf", // bold italic
+		glyphs(fontSans, "•") + " Tj",
+		glyphs(fontSans, "3.") + " Tj", // the nested list's start
+		"/F5 9.5 Tf",                   // code in Go Mono
+		glyphs(fontMono, `fmt.Println("<hi>")`) + " Tj",
+		"[" + glyphs(fontSans, "Lorem ") + " -", // justified
+		// copied text maps back from the glyphs
+		fmt.Sprintf("<%04X> <2022>", fontSans.encode("•")[0].id),
+	} {
+		if !strings.Contains(content.String(), want) {
+			t.Errorf("content is missing %s", want)
+		}
+	}
+}
+
+func TestSubsetTrueType(t *testing.T) {
+	face := fontSans.face()
+	kept := fontSans.encode("Aé")
+	subset, err := subsetTrueType(face.data, []sfnt.GlyphIndex{kept[0].id, kept[1].id})
+	if err != nil {
+		t.Fatalf("subsetTrueType: %v", err)
+	}
+	if len(subset) >= len(face.data)/4 {
+		t.Errorf("subset is %d bytes of %d", len(subset), len(face.data))
+	}
+	if sum := trueTypeChecksum(subset); sum != 0xB1B0AFBA {
+		t.Errorf("font checksum = %#x", sum)
+	}
+	tables, err := trueTypeTables(subset)
+	if err != nil {
+		t.Fatalf("trueTypeTables: %v", err)
+	}
+	outline := func(id sfnt.GlyphIndex) []byte {
+		loca := tables["loca"]
+		start, end := binary.BigEndian.Uint32(loca[4*id:]), binary.BigEndian.Uint32(loca[4*id+4:])
+		return tables["glyf"][start:end]
+	}
+	// Glyph IDs are kept, with the outlines of the glyphs used only
+	for _, g := range kept {
+		if len(outline(g.id)) == 0 {
+			t.Errorf("glyph of %q has no outline", g.r)
+		}
+	}
+	if z := fontSans.encode("Z")[0]; len(outline(z.id)) != 0 {
+		t.Errorf("unused glyph of 'Z' kept its outline")
+	}
+
+	// The Go fonts have no composite glyphs, so components are read from a
+	// made-up one: glyph 5 at word offsets, then glyph 7 scaled
+	composite := []byte{
+		0xFF, 0xFF, 0, 0, 0, 0, 0, 0, 0, 0,
+		0x00, 0x21, 0, 5, 0, 1, 0, 2,
+		0x00, 0x08, 0, 7, 1, 2, 0x40, 0,
+	}
+	if got := compositeComponents(composite); !reflect.DeepEqual(got, []int{5, 7}) {
+		t.Errorf("compositeComponents = %v, want [5 7]", got)
+	}
+}
@@ -1,34 +1,33 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strings"
-
-	"github.com/joho/godotenv"
 )
 
 // Request/Response structures
 type GenerateTemplateRequest struct {
 	Prompt       string `json:"prompt"`
-	TemplateType string `json:"templateType"` // e.g., "blog-post", "meeting-notes", "project-plan"
+	TemplateType string `json:"templateType"` // ID of a kind in the template catalog, e.g. "academic"
 }
 
 type GenerateTemplateResponse struct {
-	Template string `json:"template,omitempty"`
-	Error    string `json:"error,omitempty"`
+	Template string `json:"template"`
+	Format   string `json:"format"` // Always "html"; Markdown output is converted
 }
 
 type AutocompleteRequest struct {
-	Text string `json:"text"`
+	Text     string `json:"text"`               // Text preceding the cursor (legacy clients)
+	Document string `json:"document,omitempty"` // Full document text
+	Cursor   *int   `json:"cursor,omitempty"`   // Cursor offset into Document, in UTF-16 code units as the editor counts
 }
 
 type AutocompleteResponse struct {
-	Suggestion string `json:"suggestion,omitempty"`
-	Error      string `json:"error,omitempty"`
+	Suggestion string `json:"suggestion"`
 }
 
 // Groq API structures
@@ -54,101 +53,126 @@ type GroqResponse struct {
 }
 
 // GenerateTemplateHandler handles AI template generation
-func GenerateTemplateHandler(w http.ResponseWriter, r *http.Request) {
-	var req GenerateTemplateRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
+func GenerateTemplateHandler(catalog *TemplateCatalog, groq *GroqClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req GenerateTemplateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, errBadRequest("Invalid request body"))
+			return
+		}
 
-	if req.Prompt == "" {
-		http.Error(w, "Prompt is required", http.StatusBadRequest)
-		if err := json.NewEncoder(w).Encode(GenerateTemplateResponse{Error: "Prompt is required"}); err != nil {
-			log.Printf("[WARN] Failed to write response: %v", err)
+		if req.Prompt == "" {
+			writeError(w, r, errBadRequest("Prompt is required"))
+			return
 		}
-		return
-	}
 
-	// Call Groq API
-	templateContent, err := callGroqAPI(req.Prompt, req.TemplateType, "template")
-	if err != nil {
-		log.Printf("Error calling Groq API: %v", err)
-		http.Error(w, "Failed to generate template", http.StatusInternalServerError)
-		if err := json.NewEncoder(w).Encode(GenerateTemplateResponse{Error: err.Error()}); err != nil {
-			log.Printf("[WARN] Failed to write response: %v", err)
+		kind, ok := catalog.Get(req.TemplateType)
+		if !ok {
+			writeError(w, r, errBadRequest("Unknown template type %q", req.TemplateType))
+			return
 		}
-		return
-	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(GenerateTemplateResponse{Template: templateContent}); err != nil {
-		log.Printf("[WARN] Failed to write response: %v", err)
+		// Call Groq API, retrying once if the output does not match the kind
+		var templateContent string
+		var err error
+		for attempt := 1; attempt <= 2; attempt++ {
+			templateContent, err = groq.Complete(r.Context(), kind.SystemPrompt(), req.Prompt, kind.MaxTokens)
+			if err != nil {
+				break
+			}
+			// Never hand unsanitized model output to the editor
+			templateContent, err = RenderTemplateHTML(stripCodeFences(templateContent), kind.Format)
+			if err != nil {
+				err = errInvalidOutput(err)
+				break
+			}
+			if err = kind.Validate(templateContent); err == nil {
+				break
+			}
+			log.Printf("[WARN] Generated %s template failed validation (attempt %d): %v", kind.ID, attempt, err)
+			err = errInvalidOutput(err)
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, GenerateTemplateResponse{Template: templateContent, Format: FormatHTML})
 	}
 }
 
 // AutocompleteHandler handles AI text completion
-func AutocompleteHandler(w http.ResponseWriter, r *http.Request) {
-	var req AutocompleteRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
+func AutocompleteHandler(groq *GroqClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req AutocompleteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, errBadRequest("Invalid request body"))
+			return
+		}
 
-	if req.Text == "" {
-		http.Error(w, "Text is required", http.StatusBadRequest)
-		if err := json.NewEncoder(w).Encode(AutocompleteResponse{Error: "Text is required"}); err != nil {
-			log.Printf("[WARN] Failed to write response: %v", err)
+		// Legacy clients send only the text before the cursor
+		document := req.Document
+		cursor := -1
+		if document == "" {
+			document = req.Text
+		} else if req.Cursor != nil {
+			offset, ok := utf16Offset(document, *req.Cursor)
+			if !ok {
+				writeError(w, r, errBadRequest("Cursor is out of range"))
+				return
+			}
+			cursor = offset
 		}
-		return
-	}
 
-	// Call Groq API
-	suggestion, err := callGroqAPI(req.Text, "", "autocomplete")
-	if err != nil {
-		log.Printf("Error calling Groq API: %v", err)
-		http.Error(w, "Failed to generate suggestion", http.StatusInternalServerError)
-		if err := json.NewEncoder(w).Encode(AutocompleteResponse{Error: err.Error()}); err != nil {
-			log.Printf("[WARN] Failed to write response: %v", err)
+		if document == "" {
+			writeError(w, r, errBadRequest("Text is required"))
+			return
 		}
-		return
-	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(AutocompleteResponse{Suggestion: suggestion}); err != nil {
-		log.Printf("[WARN] Failed to write response: %v", err)
-	}
-}
+		// Only send the part of the document that fits the context budget
+		window := buildAutocompleteWindow(document, cursor, autocompleteContextTokens)
 
-func callGroqAPI(input, contextType, mode string) (string, error) {
-	apiKey := os.Getenv("GROQ_API_KEY")
-	if apiKey == "" {
-		// Try loading from .env if not set
-		_ = godotenv.Load()
-		apiKey = os.Getenv("GROQ_API_KEY")
-		if apiKey == "" {
-			return "", fmt.Errorf("GROQ_API_KEY not set")
+		// Call Groq API
+		suggestion, err := groq.Complete(r.Context(), autocompleteSystemPrompt, buildAutocompletePrompt(window), 1024)
+		if err != nil {
+			writeError(w, r, err)
+			return
 		}
+
+		writeJSON(w, http.StatusOK, AutocompleteResponse{Suggestion: suggestion})
 	}
+}
+
+const autocompleteSystemPrompt = "You are a helpful AI writing assistant. Continue the writer's text at the cursor naturally, matching the tone and topic of the section they are in. Output ONLY the text to insert at the cursor."
 
-	var systemPrompt string
-	var userPrompt string
+// GroqClient calls the Groq chat completions API
+type GroqClient struct {
+	cfg  GroqConfig
+	http *http.Client
+}
+
+// NewGroqClient creates a client for the given configuration
+func NewGroqClient(cfg GroqConfig) *GroqClient {
+	return &GroqClient{cfg: cfg, http: &http.Client{}}
+}
 
-	if mode == "template" {
-		systemPrompt = "You are a helpful AI assistant that generates document templates. Output ONLY the markdown content for the template. Do not include any conversational text."
-		userPrompt = fmt.Sprintf("Create a %s template based on this description: %s", contextType, input)
-	} else {
-		systemPrompt = "You are a helpful AI writing assistant. Complete the following text naturally. Output ONLY the completion text."
-		userPrompt = fmt.Sprintf("Complete this text: %s", input)
+// Complete sends a system and user prompt and returns the model's reply
+func (g *GroqClient) Complete(ctx context.Context, systemPrompt, userPrompt string, maxTokens int) (string, error) {
+	if g.cfg.APIKey == "" {
+		return "", ErrMissingAPIKey
 	}
 
+	ctx, cancel := context.WithTimeout(ctx, g.cfg.Timeout)
+	defer cancel()
+
 	groqReq := GroqRequest{
 		Messages: []GroqMessage{
 			{Role: "system", Content: systemPrompt},
 			{Role: "user", Content: userPrompt},
 		},
-		Model:       "llama-3.3-70b-versatile",
+		Model:       g.cfg.Model,
 		Temperature: 0.7,
-		MaxTokens:   1024,
+		MaxTokens:   maxTokens,
 	}
 
 	reqBody, err := json.Marshal(groqReq)
@@ -156,16 +180,15 @@ func callGroqAPI(input, contextType, mode string) (string, error) {
 		return "", err
 	}
 
-	req, err := http.NewRequest("POST", "https://api.groq.com/openai/v1/chat/completions", strings.NewReader(string(reqBody)))
+	req, err := http.NewRequestWithContext(ctx, "POST", g.cfg.Endpoint, strings.NewReader(string(reqBody)))
 	if err != nil {
 		return "", err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Authorization", "Bearer "+g.cfg.APIKey)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := g.http.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -176,22 +199,36 @@ func callGroqAPI(input, contextType, mode string) (string, error) {
 	}()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("groq API returned status: %s", resp.Status)
+		return "", &UpstreamStatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
 	}
 
 	var groqResp GroqResponse
 	if err := json.NewDecoder(resp.Body).Decode(&groqResp); err != nil {
-		return "", err
+		return "", errInvalidOutput(fmt.Errorf("decode Groq response: %w", err))
 	}
 
 	if len(groqResp.Choices) > 0 {
-		content := groqResp.Choices[0].Message.Content
-		// Clean up markdown code blocks if present
-		content = strings.TrimPrefix(content, "```markdown")
-		content = strings.TrimPrefix(content, "```")
-		content = strings.TrimSuffix(content, "```")
-		return strings.TrimSpace(content), nil
+		return strings.TrimSpace(groqResp.Choices[0].Message.Content), nil
 	}
 
-	return "", fmt.Errorf("no response from Groq API")
+	return "", errInvalidOutput(fmt.Errorf("no response from Groq API"))
+}
+
+// stripCodeFences removes a markdown code block wrapped around model output
+func stripCodeFences(content string) string {
+	content = strings.TrimSpace(content)
+	if strings.HasPrefix(content, "```") {
+		// Drop the opening fence together with its language tag
+		if idx := strings.Index(content, "\n"); idx >= 0 {
+			content = content[idx+1:]
+		} else {
+			content = strings.TrimPrefix(content, "```")
+		}
+		content = strings.TrimSuffix(strings.TrimSpace(content), "```")
+	}
+	return strings.TrimSpace(content)
 }
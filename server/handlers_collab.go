@@ -1,69 +1,89 @@
 package main
 
 import (
-	"io"
-	"log"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
-	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
+	"github.com/go-chi/chi/v5"
 )
 
-// HandleWebSocket handles WebSocket connections (zero-copy)
-func (h *CollaborationHub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	roomID := r.URL.Path[len("/collab/"):]
-	room := h.GetOrCreateRoom(roomID)
-
-	// Upgrade to WebSocket
-	conn, _, _, err := ws.UpgradeHTTP(r, w)
-	if err != nil {
-		log.Printf("[WARN] WebSocket upgrade failed: %v", err)
-		return
+// altSvcMiddleware advertises the HTTP/3 server so browsers can switch to
+// it. Browsers ignore Alt-Svc on cleartext HTTP, so only responses to TLS
+// requests carry it.
+func altSvcMiddleware(http3Port int) func(http.Handler) http.Handler {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=86400`, http3Port)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil {
+				w.Header().Set("Alt-Svc", altSvc)
+			}
+			next.ServeHTTP(w, r)
+		})
 	}
+}
 
-	client := NewClient(room, "WebSocket")
-	room.Register <- client
+// CollabDiscovery tells a client where it can join a room
+type CollabDiscovery struct {
+	RoomID       string                `json:"roomId"`
+	WebTransport WebTransportDiscovery `json:"webTransport"`
+	WebSocket    WebSocketDiscovery    `json:"webSocket"`
+}
 
-	// Goroutine to read from WebSocket and broadcast
-	go func() {
-		defer func() {
-			room.Unregister <- client
-			_ = conn.Close()
-		}()
+// WebTransportDiscovery is the HTTP/3 endpoint of a room
+type WebTransportDiscovery struct {
+	URL string `json:"url"`
+	// CertificateHashes are the values for serverCertificateHashes
+	CertificateHashes []string `json:"certificateHashes"`
+}
 
-		for {
-			msg, op, err := wsutil.ReadClientData(conn)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("[WARN] WebSocket read error: %v", err)
-				}
-				return
-			}
+// WebSocketDiscovery is the WebSocket endpoint of a room
+type WebSocketDiscovery struct {
+	URL string `json:"url"`
+}
 
-			// Only handle binary messages (Y.js updates)
-			if op == ws.OpBinary {
-				room.BroadcastMessage(msg, client)
-			}
-		}
-	}()
+// NewCollabDiscovery builds the endpoints for roomID as reachable from the
+// host the request was sent to
+func NewCollabDiscovery(cfg *Config, certs *CertManager, r *http.Request, roomID string) CollabDiscovery {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	path := "/collab/" + url.PathEscape(roomID)
 
-	// Goroutine to write to WebSocket from client.Send channel
-	go func() {
-		for msg := range client.Send {
-			err := wsutil.WriteServerBinary(conn, msg)
-			if err != nil {
-				log.Printf("[WARN] WebSocket write error: %v", err)
-				return
-			}
-		}
-	}()
+	wsScheme := "ws"
+	if cfg.TLS.ServeHTTP {
+		wsScheme = "wss"
+	}
+
+	return CollabDiscovery{
+		RoomID: roomID,
+		WebTransport: WebTransportDiscovery{
+			URL:               fmt.Sprintf("https://%s%s", net.JoinHostPort(host, strconv.Itoa(cfg.HTTP3Port)), path),
+			CertificateHashes: certs.Hashes(),
+		},
+		WebSocket: WebSocketDiscovery{
+			URL: fmt.Sprintf("%s://%s%s", wsScheme, net.JoinHostPort(host, strconv.Itoa(cfg.Port)), path),
+		},
+	}
 }
 
-// HandleWebTransport is a placeholder for WebTransport connections
-// Phase 1: We'll implement the multi-stream DocSync protocol here
-func (h *CollaborationHub) HandleWebTransport(w http.ResponseWriter, r *http.Request) {
-	// TODO: Implement WebTransport multi-stream protocol
-	// For now, return 501 Not Implemented
-	http.Error(w, "WebTransport not yet implemented", http.StatusNotImplemented)
-	log.Printf("[INFO] WebTransport connection attempted (not implemented yet)")
+// CollabHandler serves /collab/{roomID} on the TCP listener: WebSocket
+// upgrades join the room, anything else is redirected to the room's
+// WebTransport URL with the discovery info in the body
+func (h *CollaborationHub) CollabHandler(cfg *Config, certs *CertManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Negotiate protocol based on headers
+		if r.Header.Get("Sec-WebSocket-Protocol") != "" || strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			h.HandleWebSocket(w, r)
+			return
+		}
+
+		discovery := NewCollabDiscovery(cfg, certs, r, chi.URLParam(r, "roomID"))
+		w.Header().Set("Location", discovery.WebTransport.URL)
+		writeJSON(w, http.StatusTemporaryRedirect, discovery)
+	}
 }
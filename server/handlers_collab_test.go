@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAltSvcMiddleware(t *testing.T) {
+	h := altSvcMiddleware(4433)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if got := rec.Header().Get("Alt-Svc"); got != "" {
+		t.Errorf("cleartext: Alt-Svc = %q, want none", got)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.TLS = &tls.ConnectionState{}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Alt-Svc"); got != `h3=":4433"; ma=86400` {
+		t.Errorf("TLS: Alt-Svc = %q", got)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// fakeGroq starts a local stand-in for the Groq API and returns a config
+// pointing at it
+func fakeGroq(t *testing.T, handler http.HandlerFunc) GroqConfig {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	cfg := DefaultConfig().Groq
+	cfg.Endpoint = srv.URL
+	cfg.APIKey = "test-key"
+	return cfg
+}
+
+func newTestRouter(t *testing.T, groqCfg GroqConfig) http.Handler {
+	t.Helper()
+	groq := NewGroqClient(groqCfg)
+	catalog, err := NewTemplateCatalog("")
+	if err != nil {
+		t.Fatalf("NewTemplateCatalog: %v", err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.NotFound(notFoundHandler)
+	r.MethodNotAllowed(methodNotAllowedHandler)
+	r.Post("/api/generate-template", GenerateTemplateHandler(catalog, groq))
+	r.Post("/api/autocomplete", AutocompleteHandler(groq))
+	r.Post("/api/transform", TransformHandler(groq))
+	return r
+}
+
+// doRequest posts body to path and decodes the error envelope, if any
+func doRequest(t *testing.T, h http.Handler, path, body string) (*httptest.ResponseRecorder, *APIError) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type = %q, want application/json", ct)
+	}
+	if rec.Code < 400 {
+		return rec, nil
+	}
+
+	// The body must be exactly one JSON document
+	var env errorEnvelope
+	dec := json.NewDecoder(rec.Body)
+	if err := dec.Decode(&env); err != nil {
+		t.Fatalf("decode error body: %v", err)
+	}
+	if dec.More() {
+		t.Fatalf("trailing data after error envelope")
+	}
+	if env.Error == nil {
+		t.Fatalf("error envelope has no error")
+	}
+	return rec, env.Error
+}
+
+func TestAIHandlerErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstream  http.HandlerFunc
+		status    int
+		code      string
+		retryable bool
+	}{
+		{
+			name:     "unauthorized",
+			upstream: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusUnauthorized) },
+			status:   http.StatusBadGateway,
+			code:     CodeAIUnauthorized,
+		},
+		{
+			name: "rate limited",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "7")
+				w.WriteHeader(http.StatusTooManyRequests)
+			},
+			status:    http.StatusTooManyRequests,
+			code:      CodeAIRateLimited,
+			retryable: true,
+		},
+		{
+			name:      "upstream down",
+			upstream:  func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+			status:    http.StatusBadGateway,
+			code:      CodeAIUnavailable,
+			retryable: true,
+		},
+		{
+			name:      "garbage response",
+			upstream:  func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("not json")) },
+			status:    http.StatusBadGateway,
+			code:      CodeAIInvalidOutput,
+			retryable: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := fakeGroq(t, tt.upstream)
+			rec, apiErr := doRequest(t, newTestRouter(t, cfg), "/api/autocomplete", `{"text":"Hello"}`)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if apiErr.Code != tt.code || apiErr.Retryable != tt.retryable {
+				t.Errorf("error = %+v, want code %s retryable %v", apiErr, tt.code, tt.retryable)
+			}
+			if apiErr.RequestID == "" {
+				t.Errorf("error has no request ID")
+			}
+		})
+	}
+}
+
+func TestAIHandlerRetryAfter(t *testing.T) {
+	cfg := fakeGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	rec, _ := doRequest(t, newTestRouter(t, cfg), "/api/transform", `{"operation":"grammar","selection":"teh cat"}`)
+	if got := rec.Header().Get("Retry-After"); got != "7" {
+		t.Errorf("Retry-After = %q, want 7", got)
+	}
+}
+
+func TestAIHandlerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	cfg := fakeGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(release)
+	cfg.Timeout = 50 * time.Millisecond
+
+	rec, apiErr := doRequest(t, newTestRouter(t, cfg), "/api/autocomplete", `{"text":"Hello"}`)
+	if rec.Code != http.StatusGatewayTimeout || apiErr.Code != CodeAITimeout || !apiErr.Retryable {
+		t.Errorf("got %d %+v, want 504 %s retryable", rec.Code, apiErr, CodeAITimeout)
+	}
+}
+
+func TestAIHandlerMissingKey(t *testing.T) {
+	rec, apiErr := doRequest(t, newTestRouter(t, DefaultConfig().Groq), "/api/generate-template", `{"prompt":"A report"}`)
+	if rec.Code != http.StatusServiceUnavailable || apiErr.Code != CodeAINotConfigured || apiErr.Retryable {
+		t.Errorf("got %d %+v, want 503 %s", rec.Code, apiErr, CodeAINotConfigured)
+	}
+}
+
+func TestAIHandlerBadRequests(t *testing.T) {
+	h := newTestRouter(t, DefaultConfig().Groq)
+	for path, body := range map[string]string{
+		"/api/generate-template": `{"prompt":""}`,
+		"/api/autocomplete":      `{"document":"abc","cursor":10}`,
+		"/api/transform":         `{"operation":"dance","selection":"x"}`,
+	} {
+		rec, apiErr := doRequest(t, h, path, body)
+		if rec.Code != http.StatusBadRequest || apiErr.Code != CodeInvalidRequest {
+			t.Errorf("%s: got %d %+v, want 400 %s", path, rec.Code, apiErr, CodeInvalidRequest)
+		}
+	}
+
+	rec, apiErr := doRequest(t, h, "/api/nope", `{}`)
+	if rec.Code != http.StatusNotFound || apiErr.Code != CodeNotFound {
+		t.Errorf("unknown route: got %d %+v", rec.Code, apiErr)
+	}
+}
+
+func TestAutocompleteSuccess(t *testing.T) {
+	cfg := fakeGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(GroqResponse{Choices: []GroqChoice{{Message: GroqMessage{Content: " world"}}}})
+	})
+
+	rec, _ := doRequest(t, newTestRouter(t, cfg), "/api/autocomplete", `{"document":"Hello","cursor":5}`)
+	var resp AutocompleteResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if rec.Code != http.StatusOK || resp.Suggestion != "world" {
+		t.Errorf("got %d %+v, want 200 with suggestion", rec.Code, resp)
+	}
+}
+
+func TestAutocompleteCursorUTF16(t *testing.T) {
+	prompts := make(chan string, 1)
+	cfg := fakeGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		var req GroqRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		prompts <- req.Messages[len(req.Messages)-1].Content
+		_ = json.NewEncoder(w).Encode(GroqResponse{Choices: []GroqChoice{{Message: GroqMessage{Content: "ok"}}}})
+	})
+	h := newTestRouter(t, cfg)
+
+	// The editor counts 😀 as two code units, so 5 is after "Hi"
+	if rec, _ := doRequest(t, h, "/api/autocomplete", `{"document":"😀 Hi there","cursor":5}`); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	if prompt := <-prompts; !strings.Contains(prompt, "<before>😀 Hi</before>") || !strings.Contains(prompt, "<after> there</after>") {
+		t.Errorf("prompt does not split at the cursor:\n%s", prompt)
+	}
+
+	for _, cursor := range []string{"1", "12", "-1"} {
+		rec, apiErr := doRequest(t, h, "/api/autocomplete", `{"document":"😀 Hi there","cursor":`+cursor+`}`)
+		if rec.Code != http.StatusBadRequest || apiErr.Code != CodeInvalidRequest {
+			t.Errorf("cursor %s: got %d %+v, want 400", cursor, rec.Code, apiErr)
+		}
+	}
+}
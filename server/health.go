@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a single readiness check may take before it counts as failed
+const readinessCheckTimeout = 2 * time.Second
+
+// Health tracks what /readyz reports: which listeners are serving, named
+// dependency checks (certificates, persistence, ...) and whether the server
+// is draining for shutdown
+type Health struct {
+	mu        sync.RWMutex
+	listeners map[string]bool
+	checks    map[string]func(context.Context) error
+
+	draining atomic.Bool
+}
+
+// NewHealth creates a Health expecting the named listeners. The server is
+// not ready until each of them has been marked up.
+func NewHealth(listeners ...string) *Health {
+	h := &Health{
+		listeners: make(map[string]bool),
+		checks:    make(map[string]func(context.Context) error),
+	}
+	for _, name := range listeners {
+		h.listeners[name] = false
+	}
+	return h
+}
+
+// SetListener records whether a listener is accepting connections
+func (h *Health) SetListener(name string, up bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners[name] = up
+}
+
+// AddCheck registers a dependency check; a non-nil error makes the server
+// unready
+func (h *Health) AddCheck(name string, check func(context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// SetDraining makes /readyz fail so load balancers stop sending new traffic
+// while in-flight requests finish
+func (h *Health) SetDraining() {
+	h.draining.Store(true)
+}
+
+// ReadinessReport is the body of /readyz
+type ReadinessReport struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Check runs every check and reports the result of each, "ok" or the reason
+// it failed
+func (h *Health) Check(ctx context.Context) ReadinessReport {
+	report := ReadinessReport{Ready: true, Checks: make(map[string]string)}
+	fail := func(name, reason string) {
+		report.Ready = false
+		report.Checks[name] = reason
+	}
+
+	if h.draining.Load() {
+		fail("shutdown", "draining")
+	}
+
+	h.mu.RLock()
+	for name, up := range h.listeners {
+		if up {
+			report.Checks["listener."+name] = "ok"
+		} else {
+			fail("listener."+name, "not listening")
+		}
+	}
+	checks := make(map[string]func(context.Context) error, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+	}
+	h.mu.RUnlock()
+
+	// Checks may do I/O, so they run concurrently with a shared deadline
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+	defer cancel()
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(checks))
+	for name, check := range checks {
+		go func(name string, check func(context.Context) error) {
+			results <- result{name, check(ctx)}
+		}(name, check)
+	}
+	for range checks {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				fail(res.name, res.err.Error())
+			} else {
+				report.Checks[res.name] = "ok"
+			}
+		case <-ctx.Done():
+			// Report the checks that did not answer in time
+			for name := range checks {
+				if _, done := report.Checks[name]; !done {
+					fail(name, "timed out")
+				}
+			}
+			return report
+		}
+	}
+	return report
+}
+
+// certificateCheck fails when the served certificate has expired
+func certificateCheck(certs *CertManager) func(context.Context) error {
+	return func(context.Context) error {
+		if notAfter := certs.NotAfter(); time.Now().After(notAfter) {
+			return fmt.Errorf("certificate expired at %s", notAfter.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
+
+// HealthzHandler reports that the process is alive. It does not look at
+// dependencies, so an orchestrator only restarts the server when it is
+// truly stuck.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ReadyzHandler reports whether the server should receive traffic
+func ReadyzHandler(health *Health) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := health.Check(r.Context())
+		status := http.StatusOK
+		if !report.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	}
+}
+
+// VersionInfo is the body of /version
+type VersionInfo struct {
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	Platform  string `json:"platform"`
+}
+
+// readVersionInfo collects the build information embedded by the Go
+// toolchain, including the VCS revision when built from a checkout
+func readVersionInfo() VersionInfo {
+	info := VersionInfo{
+		Version:   "(devel)",
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.Module = bi.Main.Path
+	if bi.Main.Version != "" {
+		info.Version = bi.Main.Version
+	}
+	info.GoVersion = bi.GoVersion
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Revision = s.Value
+		case "vcs.time":
+			info.Time = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+// VersionHandler reports the build information
+func VersionHandler() http.HandlerFunc {
+	info := readVersionInfo()
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, info)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	health := NewHealth("http", "http3")
+	handler := ReadyzHandler(health)
+
+	probe := func() (int, ReadinessReport) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var report ReadinessReport
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatalf("decode report: %v", err)
+		}
+		return rec.Code, report
+	}
+
+	if code, report := probe(); code != http.StatusServiceUnavailable || report.Checks["listener.http3"] != "not listening" {
+		t.Errorf("before listening: got %d %+v, want 503", code, report)
+	}
+
+	health.SetListener("http", true)
+	health.SetListener("http3", true)
+	health.AddCheck("persistence", func(context.Context) error { return nil })
+	if code, report := probe(); code != http.StatusOK || !report.Ready {
+		t.Errorf("all up: got %d %+v, want 200", code, report)
+	}
+
+	health.AddCheck("certificate", func(context.Context) error { return errors.New("expired") })
+	if code, report := probe(); code != http.StatusServiceUnavailable || report.Checks["certificate"] != "expired" {
+		t.Errorf("failing check: got %d %+v, want 503", code, report)
+	}
+
+	health.AddCheck("certificate", func(context.Context) error { return nil })
+	health.SetDraining()
+	if code, report := probe(); code != http.StatusServiceUnavailable || report.Checks["shutdown"] != "draining" {
+		t.Errorf("draining: got %d %+v, want 503", code, report)
+	}
+}
+
+func TestReadinessCheckTimeout(t *testing.T) {
+	health := NewHealth()
+	health.AddCheck("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if report := health.Check(ctx); report.Ready {
+		t.Errorf("slow check: got %+v, want not ready", report)
+	}
+}
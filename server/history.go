@@ -0,0 +1,662 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// errSnapshotNotFound is returned for an unknown snapshot ID
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+// DocState is the server's replica of a room's document together with its
+// snapshots. Rooms come and go as clients join and leave; the hub keeps one
+// DocState per room ID while it is in use, and with a store reloads it from
+// disk when it is needed again.
+type DocState struct {
+	RoomID string
+	// refs counts the rooms and requests using the state; the hub's mu
+	// guards it
+	refs int
+
+	mu  sync.Mutex
+	doc *YDoc
+	// replica mirrors doc for trying out suggestions before they are
+	// applied; nil until a commenter suggests something
+	replica *YDoc
+	// version counts applied updates; snapshotVersion is its value at the
+	// latest snapshot, so unchanged documents are not snapshotted again
+	version         uint64
+	snapshotVersion uint64
+	snapshots       []*Snapshot
+	maxSnapshots    int
+	// threads are the comment threads on the document, oldest first
+	threads []*CommentThread
+	// authors maps the Y.js client IDs in the document to the users who
+	// sent their first updates
+	authors map[uint64]string
+
+	// log persists updates and snapshots; nil keeps the document in memory
+	log *RoomLog
+	// onChange is called without s.mu after an update or restore
+	onChange func()
+}
+
+// Snapshot is a saved copy of a room's document
+type Snapshot struct {
+	ID        string    `json:"id"`
+	RoomID    string    `json:"roomId"`
+	Author    string    `json:"author"`
+	Label     string    `json:"label,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Automatic is set for the periodic snapshots, which are pruned first
+	Automatic bool `json:"automatic"`
+	// Size is the length of the encoded document in bytes
+	Size int `json:"size"`
+
+	state []byte
+}
+
+// newDocState returns an empty document keeping up to maxSnapshots snapshots
+func newDocState(roomID string, maxSnapshots int) *DocState {
+	return &DocState{RoomID: roomID, doc: NewYDoc(), maxSnapshots: maxSnapshots, authors: make(map[uint64]string)}
+}
+
+// Apply applies a Y.js update from origin (a client ID or API caller) and
+// appends it to the room's log. The session's Y.js client ID is attributed
+// to its user if no one owns it yet. A failed write is logged and reported
+// by the persistence readiness check; the update is still applied.
+func (s *DocState) Apply(update []byte, origin string, author Author) error {
+	s.mu.Lock()
+	if err := s.doc.Apply(update); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.version++
+	s.mirror(update)
+	s.persist(update, origin, s.claim(author, update))
+	s.mu.Unlock()
+
+	s.changed()
+	return nil
+}
+
+// changed notifies the hub of a new version
+func (s *DocState) changed() {
+	if s.onChange != nil {
+		s.onChange()
+	}
+}
+
+// persist logs an applied update with the client IDs it attributed,
+// compacting when the log is due; s.mu must be held
+func (s *DocState) persist(update []byte, origin string, authors map[uint64]string) {
+	if s.log == nil {
+		return
+	}
+	if err := s.log.Append(LogEntry{Time: time.Now().UTC(), Origin: origin, Update: update, Authors: authors}); err == nil && s.log.NeedsCompaction() {
+		s.compact()
+	}
+}
+
+// Compact folds the log into the saved document now
+func (s *DocState) Compact() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.log != nil {
+		s.compact()
+	}
+}
+
+// compact folds the log into the saved document; s.mu must be held
+func (s *DocState) compact() {
+	if s.log.entries == 0 {
+		return
+	}
+	start := time.Now()
+	state := s.doc.EncodeStateAsUpdate(nil)
+	if err := s.log.Compact(state, s.authors); err == nil {
+		log.Printf("[DEBUG] Room %s: compacted log into %d bytes in %s", s.RoomID, len(state), time.Since(start))
+	}
+}
+
+// Close compacts the log and closes it; the DocState must not be used
+// afterwards
+func (s *DocState) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		return
+	}
+	s.compact()
+	if err := s.log.Close(); err != nil {
+		log.Printf("[WARN] Room %s: closing log: %v", s.RoomID, err)
+	}
+	s.log = nil
+}
+
+// Discard closes the log without compacting it, for a room whose files are
+// about to be deleted
+func (s *DocState) Discard() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log != nil {
+		_ = s.log.Close()
+		s.log = nil
+	}
+}
+
+// empty reports whether the document has never had content, snapshots or
+// comments
+func (s *DocState) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.doc.clients) == 0 && len(s.doc.pending) == 0 && len(s.doc.pendingDeletes) == 0 &&
+		len(s.snapshots) == 0 && len(s.threads) == 0
+}
+
+// StateVector is the encoded state vector, the payload of sync step 1
+func (s *DocState) StateVector() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.doc.StateVector().encode()
+}
+
+// Diff encodes what a peer with the encoded state vector sv is missing, the
+// payload of sync step 2. A nil sv gets the whole document.
+func (s *DocState) Diff(sv []byte) ([]byte, error) {
+	var vector yStateVector
+	if sv != nil {
+		var err error
+		if vector, err = decodeStateVector(sv); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.doc.EncodeStateAsUpdate(vector), nil
+}
+
+// TakeSnapshot saves the current document. Automatic snapshots are skipped
+// (returning nil) when nothing changed since the previous snapshot.
+func (s *DocState) TakeSnapshot(author, label string, automatic bool) *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if automatic && s.version == s.snapshotVersion {
+		return nil
+	}
+	return s.takeSnapshot(author, label, automatic)
+}
+
+// takeSnapshot records a snapshot and prunes old ones; s.mu must be held
+func (s *DocState) takeSnapshot(author, label string, automatic bool) *Snapshot {
+	state := s.doc.EncodeStateAsUpdate(nil)
+	snap := &Snapshot{
+		ID:        uuid.New().String(),
+		RoomID:    s.RoomID,
+		Author:    author,
+		Label:     label,
+		CreatedAt: time.Now().UTC(),
+		Automatic: automatic,
+		Size:      len(state),
+		state:     state,
+	}
+	s.snapshots = append(s.snapshots, snap)
+	s.snapshotVersion = s.version
+	if s.log != nil {
+		_ = s.log.SaveSnapshot(snap)
+	}
+
+	// Over the limit, the oldest automatic snapshot goes first
+	for len(s.snapshots) > s.maxSnapshots {
+		drop := 0
+		for i, old := range s.snapshots {
+			if old.Automatic {
+				drop = i
+				break
+			}
+		}
+		if s.log != nil {
+			_ = s.log.DeleteSnapshot(s.snapshots[drop].ID)
+		}
+		s.snapshots = append(s.snapshots[:drop], s.snapshots[drop+1:]...)
+	}
+	return snap
+}
+
+// Snapshots lists the snapshots, oldest first
+func (s *DocState) Snapshots() []Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Snapshot, len(s.snapshots))
+	for i, snap := range s.snapshots {
+		list[i] = *snap
+	}
+	return list
+}
+
+// Snapshot returns the snapshot with the given ID
+func (s *DocState) Snapshot(id string) (*Snapshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot(id)
+}
+
+// snapshot finds a snapshot by ID; s.mu must be held
+func (s *DocState) snapshot(id string) (*Snapshot, bool) {
+	for _, snap := range s.snapshots {
+		if snap.ID == id {
+			return snap, true
+		}
+	}
+	return nil, false
+}
+
+// Current is a snapshot-like copy of the live document, not recorded
+func (s *DocState) Current() *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.doc.EncodeStateAsUpdate(nil)
+	return &Snapshot{RoomID: s.RoomID, CreatedAt: time.Now().UTC(), Size: len(state), state: state}
+}
+
+// Restore makes the document's content equal to the snapshot's and returns
+// the update doing so. The current content is snapshotted first, so the
+// restore can itself be undone.
+func (s *DocState) Restore(id, author string) (update []byte, backup *Snapshot, err error) {
+	defer func() {
+		if err == nil {
+			s.changed()
+		}
+	}()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap, ok := s.snapshot(id)
+	if !ok {
+		return nil, nil, errSnapshotNotFound
+	}
+	src, err := snap.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	label := "Before restoring " + snap.CreatedAt.Format(time.RFC3339)
+	if snap.Label != "" {
+		label = fmt.Sprintf("Before restoring %q", snap.Label)
+	}
+	backup = s.takeSnapshot(author, label, false)
+	return s.replace(src, author), backup, nil
+}
+
+// Replace makes the document's content equal to src, like a restore from
+// outside the history. The current content, if any, is snapshotted first
+// with the given label.
+func (s *DocState) Replace(src *YDoc, author, label string) (update []byte, backup *Snapshot) {
+	s.mu.Lock()
+	if len(s.doc.RootNames()) > 0 {
+		backup = s.takeSnapshot(author, label, false)
+	}
+	update = s.replace(src, author)
+	s.mu.Unlock()
+
+	s.changed()
+	return update, backup
+}
+
+// replace swaps in the content of src as a new version; s.mu must be held.
+// The server writes it under a new Y.js client ID attributed to author.
+func (s *DocState) replace(src *YDoc, author string) []byte {
+	s.doc.renewClientID()
+	update := s.doc.RestoreFrom(src)
+	s.version++
+	s.mirror(update)
+	s.persist(update, author, s.attribute(s.doc.clientID, author))
+	return update
+}
+
+// load decodes the snapshot into a document of its own
+func (snap *Snapshot) load() (*YDoc, error) {
+	doc := NewYDoc()
+	if err := doc.Apply(snap.state); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", snap.ID, err)
+	}
+	return doc, nil
+}
+
+// SnapshotContent is a snapshot with its document: every root type as
+// Y.Doc.toJSON renders it, and as plain text
+type SnapshotContent struct {
+	Snapshot
+	Content map[string]interface{} `json:"content"`
+	Text    map[string]string      `json:"text"`
+}
+
+// Content decodes the snapshot's document
+func (snap *Snapshot) Content() (*SnapshotContent, error) {
+	doc, err := snap.load()
+	if err != nil {
+		return nil, err
+	}
+	c := &SnapshotContent{Snapshot: *snap, Content: map[string]interface{}{}, Text: map[string]string{}}
+	for _, name := range doc.RootNames() {
+		root := doc.root(name)
+		c.Content[name] = root.toJSON()
+		c.Text[name] = strings.Join(root.textLines(), "\n")
+	}
+	return c, nil
+}
+
+// LineChange is a line added to or removed from a root type. Line counts
+// from 1 in the old version for deletions and in the new one for insertions.
+type LineChange struct {
+	Root string `json:"root"`
+	Op   string `json:"op"` // "insert" or "delete"
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+// SnapshotDiff compares two versions of a document line by line
+type SnapshotDiff struct {
+	From    string       `json:"from"`
+	To      string       `json:"to"`
+	Added   int          `json:"added"`
+	Removed int          `json:"removed"`
+	Changes []LineChange `json:"changes"`
+}
+
+// diffSnapshots compares the text of every root type in from and to
+func diffSnapshots(from, to *Snapshot) (*SnapshotDiff, error) {
+	a, err := from.load()
+	if err != nil {
+		return nil, err
+	}
+	b, err := to.load()
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, name := range append(a.RootNames(), b.RootNames()...) {
+		names[name] = true
+	}
+	diff := &SnapshotDiff{Changes: []LineChange{}}
+	for _, name := range sortedKeys(names) {
+		var old, cur []string
+		if t, ok := a.roots[name]; ok {
+			old = t.textLines()
+		}
+		if t, ok := b.roots[name]; ok {
+			cur = t.textLines()
+		}
+		for _, change := range diffLines(old, cur) {
+			change.Root = name
+			if change.Op == "insert" {
+				diff.Added++
+			} else {
+				diff.Removed++
+			}
+			diff.Changes = append(diff.Changes, change)
+		}
+	}
+	return diff, nil
+}
+
+// maxDiffCells bounds the table of the line diff; larger changes are
+// reported as replacing every line between the common prefix and suffix
+const maxDiffCells = 4 << 20
+
+// diffLines lists the deletions and insertions turning a into b, using the
+// longest common subsequence of lines
+func diffLines(a, b []string) []LineChange {
+	// Trim the common prefix and suffix
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	a, b = a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	var changes []LineChange
+	del := func(i int) { changes = append(changes, LineChange{Op: "delete", Line: pre + i + 1, Text: a[i]}) }
+	ins := func(j int) { changes = append(changes, LineChange{Op: "insert", Line: pre + j + 1, Text: b[j]}) }
+
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		for i := range a {
+			del(i)
+		}
+		for j := range b {
+			ins(j)
+		}
+		return changes
+	}
+
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			ins(j)
+			j++
+		default:
+			del(i)
+			i++
+		}
+	}
+	return changes
+}
+
+// RestoreSnapshot rolls a room's document back to a snapshot. Connected
+// clients receive the change as an ordinary update, so nobody has to
+// reload. It returns the snapshot taken of the content before the restore.
+func (h *CollaborationHub) RestoreSnapshot(roomID, snapshotID, author string) (*Snapshot, error) {
+	state, ok := h.LookupState(roomID)
+	if !ok {
+		return nil, errNotFound("Room not found")
+	}
+	defer h.ReleaseState(state)
+	update, backup, err := state.Restore(snapshotID, author)
+	if err != nil {
+		return nil, err
+	}
+	if room, ok := h.Room(roomID); ok {
+		room.BroadcastUpdate(update, nil)
+	}
+	log.Printf("[INFO] Restored snapshot %s in room %s for %s", snapshotID, roomID, author)
+	return backup, nil
+}
+
+// ReplaceContent makes a room's document equal to src, creating the room's
+// document if needed. Existing content is snapshotted first and returned as
+// the backup; connected clients receive the change as an update.
+func (h *CollaborationHub) ReplaceContent(roomID string, src *YDoc, author, label string) (*Snapshot, error) {
+	h.mu.Lock()
+	state, err := h.state(roomID)
+	h.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer h.ReleaseState(state)
+	update, backup := state.Replace(src, author, label)
+	if room, ok := h.Room(roomID); ok {
+		room.BroadcastUpdate(update, nil)
+	}
+	log.Printf("[INFO] Replaced the content of room %s for %s", roomID, author)
+	return backup, nil
+}
+
+// snapshotRequest is the optional body of the create and restore requests
+type snapshotRequest struct {
+	Label string `json:"label"`
+}
+
+// decodeSnapshotRequest reads a snapshotRequest; an empty body is allowed
+func decodeSnapshotRequest(r *http.Request) (snapshotRequest, error) {
+	var req snapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return req, errBadRequest("Invalid request body")
+	}
+	req.Label = strings.TrimSpace(req.Label)
+	if len(req.Label) > 200 {
+		return req, errBadRequest("label must be at most 200 bytes")
+	}
+	return req, nil
+}
+
+// HistoryRoutes returns the version history API, mounted at
+// /api/rooms/{roomID}/snapshots. Access follows the caller's role on the
+// room's document.
+func HistoryRoutes(hub *CollaborationHub, docs *Documents) http.Handler {
+	r := chi.NewRouter()
+
+	// state resolves the room for a caller with at least min, writing a 404
+	// if it has never been opened; the caller releases it
+	state := func(w http.ResponseWriter, r *http.Request, min Role) (*DocState, bool) {
+		roomID := chi.URLParam(r, "roomID")
+		if err := requireRoomRole(callerFrom(r), docs, roomID, min); err != nil {
+			writeError(w, r, err)
+			return nil, false
+		}
+		s, ok := hub.LookupState(roomID)
+		if !ok {
+			writeError(w, r, errNotFound("Room not found"))
+		}
+		return s, ok
+	}
+	// snapshot resolves a snapshot ID; "current" is the live document
+	snapshot := func(w http.ResponseWriter, r *http.Request, s *DocState, id string) (*Snapshot, bool) {
+		if id == "current" {
+			return s.Current(), true
+		}
+		snap, ok := s.Snapshot(id)
+		if !ok {
+			writeError(w, r, errNotFound("Snapshot not found"))
+		}
+		return snap, ok
+	}
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		s, ok := state(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		defer hub.ReleaseState(s)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"snapshots": s.Snapshots()})
+	})
+
+	r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeSnapshotRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		s, ok := state(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		defer hub.ReleaseState(s)
+		snap := s.TakeSnapshot(callerName(callerFrom(r)), req.Label, false)
+		log.Printf("[INFO] Snapshot %s of room %s taken by %s", snap.ID, s.RoomID, snap.Author)
+		writeJSON(w, http.StatusCreated, snap)
+	})
+
+	r.Get("/diff", func(w http.ResponseWriter, r *http.Request) {
+		from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+		if from == "" {
+			writeError(w, r, errBadRequest("from is required"))
+			return
+		}
+		if to == "" {
+			to = "current"
+		}
+		s, ok := state(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		defer hub.ReleaseState(s)
+		a, ok := snapshot(w, r, s, from)
+		if !ok {
+			return
+		}
+		b, ok := snapshot(w, r, s, to)
+		if !ok {
+			return
+		}
+		diff, err := diffSnapshots(a, b)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		diff.From, diff.To = from, to
+		writeJSON(w, http.StatusOK, diff)
+	})
+
+	r.Get("/{snapshotID}", func(w http.ResponseWriter, r *http.Request) {
+		s, ok := state(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		defer hub.ReleaseState(s)
+		snap, ok := snapshot(w, r, s, chi.URLParam(r, "snapshotID"))
+		if !ok {
+			return
+		}
+		content, err := snap.Content()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, content)
+	})
+
+	r.Post("/{snapshotID}/restore", func(w http.ResponseWriter, r *http.Request) {
+		s, ok := state(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		defer hub.ReleaseState(s)
+		backup, err := hub.RestoreSnapshot(chi.URLParam(r, "roomID"), chi.URLParam(r, "snapshotID"), callerName(callerFrom(r)))
+		if errors.Is(err, errSnapshotNotFound) {
+			err = errNotFound("Snapshot not found")
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"backup": backup})
+	})
+
+	return r
+}
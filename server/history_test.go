@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestDocStateSnapshots(t *testing.T) {
+	s := newDocState("doc", 3)
+	editor := NewYDoc()
+	if err := s.Apply(insertText(editor, "t", "one"), "ada", Author{}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	manual := s.TakeSnapshot("ada", "Draft", false)
+	if s.TakeSnapshot("server", "", true) != nil {
+		t.Errorf("automatic snapshot taken of an unchanged document")
+	}
+	for _, text := range []string{" two", " three", " four"} {
+		if err := s.Apply(insertText(editor, "t", text), "ada", Author{}); err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+		if s.TakeSnapshot("server", "", true) == nil {
+			t.Fatalf("no automatic snapshot after %q", text)
+		}
+	}
+
+	// The oldest automatic snapshot was pruned; the labelled one stays
+	list := s.Snapshots()
+	if len(list) != 3 || list[0].ID != manual.ID || list[0].Label != "Draft" {
+		t.Fatalf("snapshots = %+v", list)
+	}
+	content, err := list[1].Content()
+	if err != nil {
+		t.Fatalf("Content: %v", err)
+	}
+	if got := content.Text["t"]; got != "one two three" {
+		t.Errorf("second snapshot text = %q", got)
+	}
+
+	if err := s.Apply([]byte{0xff}, "ada", Author{}); err == nil {
+		t.Errorf("malformed update was accepted")
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	old := []string{"title", "kept", "removed", "end"}
+	cur := []string{"title", "added", "kept", "end", "tail"}
+	got := diffLines(old, cur)
+	want := []LineChange{
+		{Op: "insert", Line: 2, Text: "added"},
+		{Op: "delete", Line: 3, Text: "removed"},
+		{Op: "insert", Line: 5, Text: "tail"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("changes = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("change %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if got := diffLines(old, old); len(got) != 0 {
+		t.Errorf("identical versions differ: %+v", got)
+	}
+}
+
+// historyRouter serves the history API of hub as main.go mounts it, for
+// the users ada, grace and linus
+func historyRouter(hub *CollaborationHub, docs *Documents) http.Handler {
+	auth := NewAuthenticator(AuthConfig{Users: []UserConfig{
+		{Name: "ada", Token: "ada-token-0123456789"},
+		{Name: "grace", Token: "grace-token-0123456789"},
+		{Name: "linus", Token: "linus-token-0123456789"},
+	}})
+	r := chi.NewRouter()
+	r.Use(auth.Middleware)
+	r.Mount("/api/rooms/{roomID}/snapshots", HistoryRoutes(hub, docs))
+	return r
+}
+
+func TestHistoryRoutes(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	docs, _ := NewDocuments(nil)
+	r := historyRouter(hub, docs)
+	const ada, grace = "ada-token-0123456789", "grace-token-0123456789"
+	editor := joinTestClient(t, hub, "doc", "WebSocket")
+	viewer := joinTestClient(t, hub, "doc", "WebSocket")
+	room := editor.Room
+	local := NewYDoc()
+
+	if err := room.ApplyUpdate(insertText(local, "t", "keep this paragraph"), editor); err != nil {
+		t.Fatalf("ApplyUpdate: %v", err)
+	}
+	var snap Snapshot
+	if code := authRequest(t, r, ada, http.MethodPost, "/api/rooms/doc/snapshots", `{"label":"Before cleanup"}`, &snap); code != http.StatusCreated {
+		t.Fatalf("create: status = %d", code)
+	}
+	if snap.Author != "ada" || snap.Label != "Before cleanup" || snap.Automatic {
+		t.Errorf("snapshot = %+v", snap)
+	}
+
+	// A collaborator deletes the paragraph
+	if err := room.ApplyUpdate(textEdit(local, "t", 0, "", len("keep this paragraph")), editor); err != nil {
+		t.Fatalf("ApplyUpdate: %v", err)
+	}
+
+	var list struct{ Snapshots []Snapshot }
+	if code := authRequest(t, r, ada, http.MethodGet, "/api/rooms/doc/snapshots", "", &list); code != http.StatusOK || len(list.Snapshots) != 1 {
+		t.Fatalf("list: status = %d, snapshots = %+v", code, list.Snapshots)
+	}
+	var content SnapshotContent
+	authRequest(t, r, ada, http.MethodGet, "/api/rooms/doc/snapshots/"+snap.ID, "", &content)
+	if content.Content["t"] != "keep this paragraph" {
+		t.Errorf("snapshot content = %v", content.Content)
+	}
+	var diff SnapshotDiff
+	authRequest(t, r, ada, http.MethodGet, "/api/rooms/doc/snapshots/diff?from="+snap.ID, "", &diff)
+	if diff.Removed != 1 || diff.Added != 0 || diff.Changes[0].Text != "keep this paragraph" || diff.To != "current" {
+		t.Errorf("diff = %+v", diff)
+	}
+
+	// Restoring reaches connected clients as an update
+	replica := NewYDoc()
+	drain := func(c *Client) {
+		for {
+			select {
+			case msg := <-c.Send:
+				if step, payload, ok, _ := parseSyncMessage(msg); ok && step == syncUpdate {
+					mustApply(t, replica, payload)
+				}
+			case <-time.After(100 * time.Millisecond):
+				return
+			}
+		}
+	}
+	drain(viewer)
+	var restored struct{ Backup Snapshot }
+	if code := authRequest(t, r, grace, http.MethodPost, "/api/rooms/doc/snapshots/"+snap.ID+"/restore", "", &restored); code != http.StatusOK {
+		t.Fatalf("restore: status = %d", code)
+	}
+	drain(viewer)
+	if got := replica.root("t").text(); got != "keep this paragraph" {
+		t.Errorf("client text after restore = %q", got)
+	}
+	if restored.Backup.Author != "grace" || !strings.HasPrefix(restored.Backup.Label, "Before restoring") {
+		t.Errorf("backup = %+v", restored.Backup)
+	}
+
+	for _, path := range []string{"/api/rooms/nope/snapshots", "/api/rooms/doc/snapshots/nope"} {
+		if code := authRequest(t, r, ada, http.MethodGet, path, "", nil); code != http.StatusNotFound {
+			t.Errorf("GET %s: status = %d, want 404", path, code)
+		}
+	}
+	if code := authRequest(t, r, ada, http.MethodPost, "/api/rooms/doc/snapshots/nope/restore", "", nil); code != http.StatusNotFound {
+		t.Errorf("restore unknown snapshot: status = %d, want 404", code)
+	}
+}
+
+func TestHistoryAccess(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	docs, _ := NewDocuments(nil)
+	r := historyRouter(hub, docs)
+	const ada, grace, linus = "ada-token-0123456789", "grace-token-0123456789", "linus-token-0123456789"
+
+	doc, _ := docs.Create(Document{Title: "Plan", Owner: "ada", Tags: []string{}, Members: map[string]Role{"linus": RoleViewer}})
+	state, err := hub.OpenState(doc.RoomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Apply(insertText(NewYDoc(), "t", "secret"), "ada", Author{}); err != nil {
+		t.Fatal(err)
+	}
+	snap := state.TakeSnapshot("ada", "", false)
+	base := "/api/rooms/" + doc.RoomID + "/snapshots"
+
+	for _, tc := range []struct {
+		name, token, method, path string
+		want                      int
+	}{
+		{"anonymous reads", "", http.MethodGet, base + "/current", http.StatusNotFound},
+		{"anonymous lists", "", http.MethodGet, base, http.StatusNotFound},
+		{"anonymous snapshots", "", http.MethodPost, base, http.StatusNotFound},
+		{"non-member reads", grace, http.MethodGet, base + "/current", http.StatusNotFound},
+		{"non-member diffs", grace, http.MethodGet, base + "/diff?from=" + snap.ID, http.StatusNotFound},
+		{"non-member snapshots", grace, http.MethodPost, base, http.StatusNotFound},
+		{"non-member restores", grace, http.MethodPost, base + "/" + snap.ID + "/restore", http.StatusNotFound},
+		{"viewer reads", linus, http.MethodGet, base + "/current", http.StatusOK},
+		{"viewer snapshots", linus, http.MethodPost, base, http.StatusForbidden},
+		{"viewer restores", linus, http.MethodPost, base + "/" + snap.ID + "/restore", http.StatusForbidden},
+		{"owner snapshots", ada, http.MethodPost, base, http.StatusCreated},
+		{"anonymous in a room without a document", "", http.MethodGet, "/api/rooms/loose/snapshots", http.StatusUnauthorized},
+	} {
+		if code := authRequest(t, r, tc.token, tc.method, tc.path, "", nil); code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, code, tc.want)
+		}
+	}
+	if list := state.Snapshots(); len(list) != 2 || list[1].Author != "ada" {
+		t.Errorf("snapshots = %+v", list)
+	}
+}
@@ -1,43 +1,373 @@
 package main
 
 import (
+	"errors"
 	"log"
+	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
+
+	"github.com/gobwas/ws"
+)
+
+// JoinError explains why a client could not join a room. Code is the close
+// code the client is disconnected with.
+type JoinError struct {
+	Code   int
+	Reason string
+	kind   string // Label for the rejected-joins metric
+}
+
+func (e *JoinError) Error() string {
+	return e.Reason
+}
+
+// Reasons a join is refused
+var (
+	ErrRoomFull     = &JoinError{Code: CloseRoomFull, Reason: "Room is full", kind: "room_full"}
+	ErrTooManyRooms = &JoinError{Code: CloseServerFull, Reason: "Server has too many open rooms", kind: "max_rooms"}
+	ErrServerFull   = &JoinError{Code: CloseServerFull, Reason: "Server is at its connection limit", kind: "max_connections"}
 )
 
+// maxRoomIDLength keeps a room's directory, named after the base64 of its
+// ID, within the 255 bytes file systems allow in a name
+const maxRoomIDLength = 180
+
+// checkRoomID rejects IDs that cannot name a room
+func checkRoomID(id string) error {
+	if id == "" || len(id) > maxRoomIDLength {
+		return errBadRequest("Room IDs must be 1 to %d bytes", maxRoomIDLength)
+	}
+	return nil
+}
+
+// errRoomStopped is returned by Room.Join once the room has been closed or
+// retired; the hub then retries with a fresh room
+var errRoomStopped = errors.New("room stopped")
+
 // CollaborationHub manages all active rooms
 type CollaborationHub struct {
-	Rooms map[string]*Room
-	mu    sync.RWMutex
+	Rooms  map[string]*Room
+	config CollabConfig
+	// origins guards the WebSocket and WebTransport upgrades
+	origins *OriginPolicy
+	mu      sync.RWMutex
+
+	// connections counts clients across all rooms
+	connections atomic.Int64
+	// rejected counts refused joins by JoinError kind
+	rejected map[string]*atomic.Int64
+	// violations counts clients disconnected by the inbound limits
+	violations map[string]*atomic.Int64
+
+	// states holds the documents in use by open rooms and requests, and
+	// without a store every document that has content
+	states map[string]*DocState
+	// store persists the documents; nil keeps them in memory only
+	store *Store
+	// listeners are told which room's document changed
+	listeners []func(roomID string)
+	// access decides who may join rooms; nil lets everyone in as an owner
+	access *RoomAccess
 }
 
 // NewCollaborationHub creates a new collaboration hub
-func NewCollaborationHub() *CollaborationHub {
-	return &CollaborationHub{
-		Rooms: make(map[string]*Room),
+func NewCollaborationHub(cfg CollabConfig, origins *OriginPolicy) *CollaborationHub {
+	h := &CollaborationHub{
+		Rooms:      make(map[string]*Room),
+		config:     cfg,
+		origins:    origins,
+		rejected:   make(map[string]*atomic.Int64),
+		violations: make(map[string]*atomic.Int64),
+		states:     make(map[string]*DocState),
+	}
+	for _, err := range []*JoinError{ErrRoomFull, ErrTooManyRooms, ErrServerFull} {
+		h.rejected[err.kind] = new(atomic.Int64)
+	}
+	for _, violation := range []string{violationMessageTooLarge, violationRateLimited} {
+		h.violations[violation] = new(atomic.Int64)
+	}
+	return h
+}
+
+// UseStore persists room documents in store. It must be called before any
+// room is opened.
+func (h *CollaborationHub) UseStore(store *Store) {
+	h.store = store
+}
+
+// OnChange registers fn to be called after a room's document changes by an
+// update or a restore. It runs on the caller's goroutine without hub or
+// document locks held, so it must not block. It must be called before any
+// room is opened.
+func (h *CollaborationHub) OnChange(fn func(roomID string)) {
+	h.listeners = append(h.listeners, fn)
+}
+
+// UseAccess checks who may join rooms, and with which role, against the
+// document registry. Without it every client joins as an owner. It must be
+// called before any room is opened.
+func (h *CollaborationHub) UseAccess(access *RoomAccess) {
+	h.access = access
+}
+
+// joinRole identifies who is joining a room over WebSocket or WebTransport
+// and with which role. Without access checks everyone joins as an owner.
+func (h *CollaborationHub) joinRole(r *http.Request, roomID string) (Caller, Role, error) {
+	if h.access == nil {
+		return Caller{Trusted: true}, RoleOwner, nil
+	}
+	return h.access.Role(r, roomID)
+}
+
+// Join adds a new client to the room with the given ID, creating the room if
+// needed. A *JoinError reports which limit was reached.
+func (h *CollaborationHub) Join(roomID, protocol string) (*Client, error) {
+	return h.JoinAs(roomID, protocol, "", RoleOwner)
+}
+
+// JoinAs is Join for a client acting as user with the given role
+func (h *CollaborationHub) JoinAs(roomID, protocol, user string, role Role) (*Client, error) {
+	for {
+		room, err := h.GetOrCreateRoom(roomID)
+		if err != nil {
+			return nil, h.reject(roomID, err)
+		}
+		client := NewClient(room, protocol)
+		client.User, client.Role = user, role
+		err = room.Join(client)
+		if errors.Is(err, errRoomStopped) {
+			// The room emptied or was closed since we looked it up
+			continue
+		}
+		if err != nil {
+			// A room opened for a refused client must not stay open
+			room.retireIfEmpty()
+			return nil, h.reject(roomID, err)
+		}
+		return client, nil
+	}
+}
+
+// joinCloseStatus is the close code and reason for a failed Join
+func joinCloseStatus(err error) (int, string) {
+	var joinErr *JoinError
+	if errors.As(err, &joinErr) {
+		return joinErr.Code, joinErr.Reason
 	}
+	return int(ws.StatusInternalServerError), err.Error()
 }
 
-// GetOrCreateRoom returns an existing room or creates a new one
-func (h *CollaborationHub) GetOrCreateRoom(id string) *Room {
+// reject counts and logs a refused join
+func (h *CollaborationHub) reject(roomID string, err error) error {
+	var joinErr *JoinError
+	if errors.As(err, &joinErr) {
+		h.rejected[joinErr.kind].Add(1)
+	}
+	log.Printf("[WARN] Refused client for room %s: %v", roomID, err)
+	return err
+}
+
+// GetOrCreateRoom returns an existing room or creates a new one, unless
+// collab.maxRooms rooms are already open
+func (h *CollaborationHub) GetOrCreateRoom(id string) (*Room, error) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	if room, exists := h.Rooms[id]; exists {
-		return room
+		return room, nil
+	}
+	if h.config.MaxRooms > 0 && len(h.Rooms) >= h.config.MaxRooms {
+		return nil, ErrTooManyRooms
+	}
+	state, err := h.state(id)
+	if err != nil {
+		return nil, err
 	}
 
 	room := &Room{
-		ID:         id,
-		Hub:        h,
-		Clients:    make(map[*Client]bool),
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
-		Broadcast:  make(chan []byte, 256),
+		ID:        id,
+		Hub:       h,
+		Clients:   make(map[*Client]bool),
+		Broadcast: make(chan []byte, h.config.SendBuffer),
+		State:     state,
+		stopped:   make(chan struct{}),
 	}
 
 	h.Rooms[id] = room
 	go room.Run()
 	log.Printf("[INFO] Created new room: %s", id)
-	return room
+	return room, nil
+}
+
+// state returns the document for a room ID, recovering it from the store
+// or creating it on first use, and takes a reference to it that
+// ReleaseState drops; h.mu must be held
+func (h *CollaborationHub) state(id string) (*DocState, error) {
+	if s, ok := h.states[id]; ok {
+		s.refs++
+		return s, nil
+	}
+	if err := checkRoomID(id); err != nil {
+		return nil, err
+	}
+	s, err := loadDocState(id, h.config.MaxSnapshots, h.store)
+	if err != nil {
+		return nil, err
+	}
+	s.onChange = func() {
+		for _, fn := range h.listeners {
+			fn(id)
+		}
+	}
+	s.refs = 1
+	h.states[id] = s
+	return s, nil
+}
+
+// LookupState returns the document of a room that has been opened before,
+// in this process or (with a store) any earlier one. The caller releases
+// it with ReleaseState.
+func (h *CollaborationHub) LookupState(id string) (*DocState, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.states[id]; !ok && (h.store == nil || !h.store.Exists(id)) {
+		return nil, false
+	}
+	s, err := h.state(id)
+	if err != nil {
+		log.Printf("[ERROR] Could not load room %s: %v", id, err)
+		return nil, false
+	}
+	return s, true
+}
+
+// OpenState returns the document of a room, loading or creating it. The
+// caller releases it with ReleaseState.
+func (h *CollaborationHub) OpenState(id string) (*DocState, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state(id)
+}
+
+// ReleaseState drops a reference to a document. Once neither a room nor a
+// request uses it, it is compacted and unloaded if the store has it; without
+// a store memory is its only copy, so only an empty document is dropped. An
+// empty document leaves nothing on disk either.
+func (h *CollaborationHub) ReleaseState(s *DocState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s.refs--
+	if s.refs > 0 || h.states[s.RoomID] != s {
+		return
+	}
+	switch {
+	case s.empty():
+		s.Discard()
+		if h.store != nil {
+			if err := h.store.Remove(s.RoomID); err != nil {
+				log.Printf("[WARN] Room %s: removing empty room: %v", s.RoomID, err)
+			}
+		}
+	case h.store != nil:
+		s.Close()
+	default:
+		return
+	}
+	delete(h.states, s.RoomID)
+}
+
+// CloseStates compacts and closes every room's log at shutdown
+func (h *CollaborationHub) CloseStates() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.states {
+		s.Close()
+	}
+}
+
+// forget removes room from the hub unless it has already been replaced
+func (h *CollaborationHub) forget(room *Room) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.Rooms[room.ID] == room {
+		delete(h.Rooms, room.ID)
+	}
+}
+
+// Room returns the room with the given ID, if it exists
+func (h *CollaborationHub) Room(id string) (*Room, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	room, ok := h.Rooms[id]
+	return room, ok
+}
+
+// CloseRoom disconnects everyone in a room and forgets it; the next client
+// to join that ID gets a fresh room
+func (h *CollaborationHub) CloseRoom(id, reason string) bool {
+	h.mu.Lock()
+	room, ok := h.Rooms[id]
+	delete(h.Rooms, id)
+	h.mu.Unlock()
+
+	if ok {
+		room.Close(reason)
+	}
+	return ok
+}
+
+// DeleteRoom disconnects everyone in a room and deletes its document,
+// snapshots and files. The next client to join that ID starts from an empty
+// document.
+func (h *CollaborationHub) DeleteRoom(id, reason string) error {
+	h.mu.Lock()
+	room, open := h.Rooms[id]
+	delete(h.Rooms, id)
+	if s, ok := h.states[id]; ok {
+		s.Discard()
+		delete(h.states, id)
+	}
+	var err error
+	if h.store != nil {
+		err = h.store.Remove(id)
+	}
+	h.mu.Unlock()
+
+	if open {
+		room.Close(reason)
+	}
+	return err
+}
+
+// RoomInfo summarizes a room for the admin API
+type RoomInfo struct {
+	ID        string         `json:"id"`
+	Clients   int            `json:"clients"`
+	Protocols map[string]int `json:"protocols"`
+}
+
+// RoomInfos lists every room with its client count per protocol
+func (h *CollaborationHub) RoomInfos() []RoomInfo {
+	h.mu.RLock()
+	rooms := make([]*Room, 0, len(h.Rooms))
+	for _, room := range h.Rooms {
+		rooms = append(rooms, room)
+	}
+	h.mu.RUnlock()
+
+	infos := make([]RoomInfo, 0, len(rooms))
+	for _, room := range rooms {
+		info := RoomInfo{ID: room.ID, Protocols: make(map[string]int)}
+		room.mu.RLock()
+		for client := range room.Clients {
+			info.Clients++
+			info.Protocols[client.Protocol]++
+		}
+		room.mu.RUnlock()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHubCapacity(t *testing.T) {
+	cfg := DefaultConfig().Collab
+	cfg.MaxClientsPerRoom = 2
+	cfg.MaxRooms = 2
+	cfg.MaxConnections = 3
+	hub := NewCollaborationHub(cfg, nil)
+
+	join := func(roomID string) (*Client, error) { return hub.Join(roomID, "WebSocket") }
+
+	a, _ := join("a")
+	if _, err := join("a"); err != nil {
+		t.Fatalf("second client: %v", err)
+	}
+	if _, err := join("a"); err != ErrRoomFull {
+		t.Errorf("third client in a room of 2: err = %v, want ErrRoomFull", err)
+	}
+	if _, err := join("b"); err != nil {
+		t.Fatalf("room b: %v", err)
+	}
+	if _, err := join("c"); err != ErrTooManyRooms {
+		t.Errorf("third room: err = %v, want ErrTooManyRooms", err)
+	}
+	if _, err := join("b"); err != ErrServerFull {
+		t.Errorf("fourth connection: err = %v, want ErrServerFull", err)
+	}
+
+	// Leaving frees the connection slot
+	a.Room.Leave(a)
+	if _, err := join("b"); err != nil {
+		t.Errorf("join after a client left: %v", err)
+	}
+
+	if code, _ := joinCloseStatus(ErrRoomFull); code != CloseRoomFull {
+		t.Errorf("close code for a full room = %d, want %d", code, CloseRoomFull)
+	}
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(hub, "").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		"writepad_rooms 2\n",
+		`writepad_connections{protocol="WebSocket"} 3`,
+		`writepad_joins_rejected_total{reason="room_full"} 1`,
+		`writepad_joins_rejected_total{reason="max_rooms"} 1`,
+		`writepad_joins_rejected_total{reason="max_connections"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, rec.Body)
+		}
+	}
+
+	// With an admin token, scrapers need it
+	metrics := MetricsHandler(hub, testAdminToken)
+	for token, want := range map[string]int{"": http.StatusUnauthorized, "wrong-token": http.StatusUnauthorized, testAdminToken: http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		metrics.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("metrics with token %q: status = %d, want %d", token, rec.Code, want)
+		}
+	}
+}
+
+func TestEmptyRoomIsRetired(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+
+	client, err := hub.Join("doc", "WebSocket")
+	if err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+	old := client.Room
+	old.Leave(client)
+	if _, ok := hub.Room("doc"); ok {
+		t.Errorf("empty room is still open")
+	}
+
+	// Joining again starts a fresh room
+	client, err = hub.Join("doc", "WebSocket")
+	if err != nil || client.Room == old {
+		t.Errorf("rejoin: room %p (old %p), err %v", client.Room, old, err)
+	}
+	if n := hub.connections.Load(); n != 1 {
+		t.Errorf("connections = %d, want 1", n)
+	}
+}
+
+func TestRefusedJoinRetiresNewRoom(t *testing.T) {
+	cfg := DefaultConfig().Collab
+	cfg.MaxRooms = 2
+	cfg.MaxConnections = 1
+	hub := NewCollaborationHub(cfg, nil)
+
+	a, err := hub.Join("a", "WebSocket")
+	if err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+	for _, id := range []string{"b", "c", "d"} {
+		if _, err := hub.Join(id, "WebSocket"); err != ErrServerFull {
+			t.Errorf("room %s on a full server: err = %v, want ErrServerFull", id, err)
+		}
+		if _, ok := hub.Room(id); ok {
+			t.Errorf("room %s stayed open for a refused client", id)
+		}
+	}
+
+	// Once the spike is over, new rooms open again
+	a.Room.Leave(a)
+	for _, id := range []string{"b", "c"} {
+		client, err := hub.Join(id, "WebSocket")
+		if err != nil {
+			t.Fatalf("room %s after the server emptied: %v", id, err)
+		}
+		client.Room.Leave(client)
+	}
+	if infos := hub.RoomInfos(); len(infos) != 0 {
+		t.Errorf("rooms left open: %+v", infos)
+	}
+}
+
+// resident reports whether the hub holds a room's document in memory
+func resident(hub *CollaborationHub, roomID string) bool {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	_, ok := hub.states[roomID]
+	return ok
+}
+
+// waitUnloaded waits for the closing room to release its document
+func waitUnloaded(t *testing.T, hub *CollaborationHub, roomID string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for resident(hub, roomID) {
+		if time.Now().After(deadline) {
+			t.Fatalf("room %s: document still in memory", roomID)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestIdleStatesAreUnloaded(t *testing.T) {
+	store := testStore(t, 0)
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	hub.UseStore(store)
+
+	client := joinTestClient(t, hub, "doc", "WebSocket")
+	if err := client.Room.ApplyUpdate(insertText(NewYDoc(), "notes", "hello"), client); err != nil {
+		t.Fatalf("ApplyUpdate: %v", err)
+	}
+	client.Room.Leave(client)
+	waitUnloaded(t, hub, "doc")
+
+	state, ok := hub.LookupState("doc")
+	if !ok {
+		t.Fatal("unloaded room not found on disk")
+	}
+	if got := replica(t, state).root("notes").text(); got != "hello" {
+		t.Errorf("reloaded text = %q, want hello", got)
+	}
+	hub.ReleaseState(state)
+	if resident(hub, "doc") {
+		t.Error("document kept after its last request")
+	}
+
+	// A room nobody wrote to leaves nothing behind
+	probe := joinTestClient(t, hub, "probe", "WebSocket")
+	probe.Room.Leave(probe)
+	waitUnloaded(t, hub, "probe")
+	if store.Exists("probe") {
+		t.Error("empty room left on disk")
+	}
+}
+
+func TestInMemoryStatesKeepContent(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+
+	client := joinTestClient(t, hub, "doc", "WebSocket")
+	if err := client.Room.ApplyUpdate(insertText(NewYDoc(), "notes", "hello"), client); err != nil {
+		t.Fatalf("ApplyUpdate: %v", err)
+	}
+	probe := joinTestClient(t, hub, "probe", "WebSocket")
+	probe.Room.Leave(probe)
+	waitUnloaded(t, hub, "probe")
+
+	// Without a store memory is the only copy
+	client.Room.Leave(client)
+	time.Sleep(50 * time.Millisecond)
+	state, ok := hub.LookupState("doc")
+	if !ok {
+		t.Fatal("in-memory document dropped")
+	}
+	defer hub.ReleaseState(state)
+	if got := replica(t, state).root("notes").text(); got != "hello" {
+		t.Errorf("text = %q, want hello", got)
+	}
+}
+
+func TestRoomIDLength(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	hub.UseStore(testStore(t, 0))
+
+	long := strings.Repeat("x", maxRoomIDLength+1)
+	if _, err := hub.Join(long, "WebSocket"); err == nil {
+		t.Error("joined a room with an overlong ID")
+	}
+	if _, err := hub.OpenState(long); err == nil {
+		t.Error("opened a room with an overlong ID")
+	}
+	client := joinTestClient(t, hub, strings.Repeat("x", maxRoomIDLength), "WebSocket")
+	client.Room.Leave(client)
+}
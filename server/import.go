@@ -0,0 +1,555 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// maxImportSize bounds the body of an import request
+const maxImportSize = 8 << 20
+
+// importFormats maps ?format= values and media types to an import format
+var importFormats = map[string]string{
+	"md":            "md",
+	"markdown":      "md",
+	"text/markdown": "md",
+	"html":          "html",
+	"text/html":     "html",
+	"txt":           "txt",
+	"text":          "txt",
+	"text/plain":    "txt",
+}
+
+// parseImport converts source in format ("md", "html" or "txt") to a
+// ProseMirror document in the editor's schema
+func parseImport(format, source string) (*PMNode, error) {
+	switch format {
+	case "md":
+		converted, err := MarkdownToHTML(source)
+		if err != nil {
+			return nil, fmt.Errorf("convert markdown: %w", err)
+		}
+		return htmlToProseMirror(converted)
+	case "html":
+		return htmlToProseMirror(source)
+	case "txt":
+		return textToProseMirror(source), nil
+	}
+	return nil, fmt.Errorf("unknown import format %q", format)
+}
+
+var blankLines = regexp.MustCompile(`\n[ \t]*\n\s*`)
+
+// textToProseMirror makes a paragraph of each run of lines separated by
+// blank lines; single newlines become hard breaks
+func textToProseMirror(source string) *PMNode {
+	doc := &PMNode{Type: "doc"}
+	source = strings.TrimSpace(strings.ReplaceAll(source, "\r\n", "\n"))
+	if source == "" {
+		return doc
+	}
+	for _, para := range blankLines.Split(source, -1) {
+		p := &PMNode{Type: "paragraph"}
+		for i, line := range strings.Split(para, "\n") {
+			if i > 0 {
+				p.Content = append(p.Content, &PMNode{Type: "hardBreak"})
+			}
+			if line != "" {
+				p.Content = append(p.Content, &PMNode{Type: "text", Text: line})
+			}
+		}
+		doc.Content = append(doc.Content, p)
+	}
+	return doc
+}
+
+// htmlMarks maps elements to the marks they apply
+var htmlMarks = map[atom.Atom]string{
+	atom.Strong: "bold", atom.B: "bold",
+	atom.Em: "italic", atom.I: "italic",
+	atom.U: "underline", atom.Ins: "underline",
+	atom.S: "strike", atom.Strike: "strike", atom.Del: "strike",
+	atom.Code: "code",
+}
+
+// htmlBlockContainers are elements without a node of their own whose
+// content is a sequence of blocks
+var htmlBlockContainers = map[atom.Atom]bool{
+	atom.Html: true, atom.Body: true, atom.Div: true, atom.Section: true, atom.Article: true,
+	atom.Main: true, atom.Header: true, atom.Footer: true, atom.Aside: true, atom.Nav: true,
+	atom.Figure: true, atom.Figcaption: true, atom.Dl: true, atom.Dt: true, atom.Dd: true,
+	atom.Address: true, atom.Details: true, atom.Summary: true, atom.Center: true,
+}
+
+var htmlSpace = regexp.MustCompile(`[ \t\r\n\f]+`)
+
+// htmlToProseMirror converts HTML to the nodes of the editor's schema:
+// paragraphs, headings, lists, blockquotes, code blocks, rules and hard
+// breaks, with bold, italic, underline, strikethrough and code marks. The
+// editor has no links, tables or images: a link becomes its text followed by
+// the URL, each table row a paragraph of its cells, and images are dropped.
+func htmlToProseMirror(source string) (*PMNode, error) {
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(source), body)
+	if err != nil {
+		return nil, err
+	}
+	b := &blockBuilder{}
+	for _, n := range nodes {
+		b.walk(n, nil)
+	}
+	return &PMNode{Type: "doc", Content: b.finish()}, nil
+}
+
+// blockBuilder collects block nodes, wrapping loose inline content in
+// paragraphs
+type blockBuilder struct {
+	blocks []*PMNode
+	inline []*PMNode
+}
+
+// finish returns the blocks, with pending inline content as a last paragraph
+func (b *blockBuilder) finish() []*PMNode {
+	b.flush()
+	return b.blocks
+}
+
+// flush turns pending inline content into a paragraph, unless it is only
+// whitespace
+func (b *blockBuilder) flush() {
+	inline := trimInline(b.inline)
+	b.inline = nil
+	if len(inline) > 0 {
+		b.blocks = append(b.blocks, &PMNode{Type: "paragraph", Content: inline})
+	}
+}
+
+// block adds a block node after any pending inline content
+func (b *blockBuilder) block(n *PMNode) {
+	b.flush()
+	b.blocks = append(b.blocks, n)
+}
+
+// children converts the children of n into blocks of their own
+func (b *blockBuilder) children(n *html.Node, marks []PMMark) []*PMNode {
+	inner := &blockBuilder{}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		inner.walk(c, marks)
+	}
+	return inner.finish()
+}
+
+// walk converts an HTML node and its descendants
+func (b *blockBuilder) walk(n *html.Node, marks []PMMark) {
+	switch n.Type {
+	case html.TextNode:
+		text := htmlSpace.ReplaceAllString(n.Data, " ")
+		if text != "" {
+			b.inline = append(b.inline, &PMNode{Type: "text", Text: text, Marks: marks})
+		}
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+	if droppedElements[n.Data] {
+		return
+	}
+
+	switch a := n.DataAtom; {
+	case a == atom.P:
+		for _, block := range b.children(n, marks) {
+			b.block(withAlign(block, n))
+		}
+	case a == atom.H1 || a == atom.H2 || a == atom.H3 || a == atom.H4 || a == atom.H5 || a == atom.H6:
+		for _, block := range b.children(n, marks) {
+			if block.Type == "paragraph" {
+				block.Type = "heading"
+				block.Attrs = map[string]interface{}{"level": int64(n.Data[1] - '0')}
+			}
+			b.block(withAlign(block, n))
+		}
+	case a == atom.Ul || a == atom.Ol:
+		list := &PMNode{Type: "bulletList"}
+		if a == atom.Ol {
+			list.Type = "orderedList"
+			if start := attr(n, "start"); start != "" && start != "1" {
+				list.Attrs = map[string]interface{}{"start": int64(parsePositive(start, 1))}
+			}
+		}
+		loose := &blockBuilder{}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.DataAtom == atom.Li {
+				loose.flush()
+				if len(loose.blocks) > 0 {
+					list.Content = append(list.Content, listItem(loose.blocks))
+					loose.blocks = nil
+				}
+				list.Content = append(list.Content, listItem(b.children(c, marks)))
+				continue
+			}
+			// Stray content between items gets an item of its own
+			loose.walk(c, marks)
+		}
+		if blocks := loose.finish(); len(blocks) > 0 {
+			list.Content = append(list.Content, listItem(blocks))
+		}
+		if len(list.Content) > 0 {
+			b.block(list)
+		}
+	case a == atom.Blockquote:
+		content := b.children(n, marks)
+		if len(content) == 0 {
+			content = []*PMNode{{Type: "paragraph"}}
+		}
+		b.block(&PMNode{Type: "blockquote", Content: content})
+	case a == atom.Pre:
+		code := &PMNode{Type: "codeBlock"}
+		text := strings.TrimSuffix(htmlText(n), "\n")
+		if text != "" {
+			code.Content = []*PMNode{{Type: "text", Text: text}}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if class := attr(c, "class"); c.DataAtom == atom.Code && codeLanguagePattern.MatchString(class) {
+				code.Attrs = map[string]interface{}{"language": strings.TrimPrefix(class, "language-")}
+			}
+		}
+		b.block(code)
+	case a == atom.Hr:
+		b.block(&PMNode{Type: "horizontalRule"})
+	case a == atom.Br:
+		b.inline = append(b.inline, &PMNode{Type: "hardBreak"})
+	case a == atom.Table:
+		b.flush()
+		for _, row := range tableRows(n) {
+			var content []*PMNode
+			for i, cell := range row {
+				if i > 0 {
+					content = append(content, &PMNode{Type: "text", Text: " | ", Marks: marks})
+				}
+				for _, block := range b.children(cell, marks) {
+					content = append(content, block.Content...)
+				}
+			}
+			if content = trimInline(content); len(content) > 0 {
+				b.block(&PMNode{Type: "paragraph", Content: content})
+			}
+		}
+	case a == atom.A:
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			b.walk(c, marks)
+		}
+		href, ok := safeHref(attr(n, "href"))
+		if ok && !strings.HasPrefix(href, "#") && strings.TrimSpace(htmlText(n)) != href {
+			b.inline = append(b.inline, &PMNode{Type: "text", Text: " (" + href + ")", Marks: marks})
+		}
+	case htmlMarks[a] != "":
+		marks = withMark(marks, htmlMarks[a])
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			b.walk(c, marks)
+		}
+	case htmlBlockContainers[a]:
+		b.flush()
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			b.walk(c, marks)
+		}
+		b.flush()
+	default:
+		// Unknown inline elements such as span are unwrapped
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			b.walk(c, marks)
+		}
+	}
+}
+
+// listItem wraps blocks in a list item, which must hold at least one
+func listItem(blocks []*PMNode) *PMNode {
+	if len(blocks) == 0 {
+		blocks = []*PMNode{{Type: "paragraph"}}
+	}
+	return &PMNode{Type: "listItem", Content: blocks}
+}
+
+// withAlign copies a text-align style of n onto a paragraph or heading
+func withAlign(block *PMNode, n *html.Node) *PMNode {
+	if block.Type != "paragraph" && block.Type != "heading" {
+		return block
+	}
+	m := textAlignPattern.FindStringSubmatch(strings.ToLower(attr(n, "style")))
+	if m == nil || m[1] == "left" {
+		return block
+	}
+	if block.Attrs == nil {
+		block.Attrs = make(map[string]interface{})
+	}
+	block.Attrs["textAlign"] = m[1]
+	return block
+}
+
+// withMark adds a mark to a set, keeping the set sorted and unique
+func withMark(marks []PMMark, typ string) []PMMark {
+	out := make([]PMMark, 0, len(marks)+1)
+	for _, m := range marks {
+		if m.Type == typ {
+			return marks
+		}
+		out = append(out, m)
+	}
+	return orderedMarks(append(out, PMMark{Type: typ}))
+}
+
+// trimInline merges adjacent text with the same marks and trims whitespace
+// at both ends and around hard breaks
+func trimInline(nodes []*PMNode) []*PMNode {
+	var out []*PMNode
+	for _, n := range nodes {
+		if last := len(out) - 1; last >= 0 && n.Type == "text" && out[last].Type == "text" && sameMarks(out[last].Marks, n.Marks) {
+			merged := *out[last]
+			merged.Text += n.Text
+			out[last] = &merged
+			continue
+		}
+		out = append(out, n)
+	}
+	for i, n := range out {
+		if n.Type != "text" {
+			continue
+		}
+		text := n.Text
+		if i == 0 || out[i-1].Type == "hardBreak" {
+			text = strings.TrimLeft(text, " ")
+		}
+		if i == len(out)-1 || out[i+1].Type == "hardBreak" {
+			text = strings.TrimRight(text, " ")
+		}
+		if i > 0 && out[i-1].Type == "text" && strings.HasSuffix(out[i-1].Text, " ") {
+			text = strings.TrimLeft(text, " ")
+		}
+		if text != n.Text {
+			trimmed := *n
+			trimmed.Text = text
+			out[i] = &trimmed
+		}
+	}
+	clean := out[:0]
+	for _, n := range out {
+		if n.Type != "text" || n.Text != "" {
+			clean = append(clean, n)
+		}
+	}
+	// A trailing hard break adds nothing
+	for len(clean) > 0 && clean[len(clean)-1].Type == "hardBreak" {
+		clean = clean[:len(clean)-1]
+	}
+	return clean
+}
+
+// sameMarks reports whether two mark sets are equal
+func sameMarks(a, b []PMMark) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameMark(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// tableRows returns the cells of each row of a table, header rows included
+func tableRows(table *html.Node) [][]*html.Node {
+	var rows [][]*html.Node
+	var visit func(n *html.Node)
+	visit = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch c.DataAtom {
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				visit(c)
+			case atom.Tr:
+				var cells []*html.Node
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.DataAtom == atom.Td || cell.DataAtom == atom.Th {
+						cells = append(cells, cell)
+					}
+				}
+				rows = append(rows, cells)
+			}
+		}
+	}
+	visit(table)
+	return rows
+}
+
+// htmlText is the raw text inside n
+func htmlText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.DataAtom == atom.Br {
+			b.WriteString("\n")
+			continue
+		}
+		b.WriteString(htmlText(c))
+	}
+	return b.String()
+}
+
+// attr returns an attribute of n, or ""
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// parsePositive parses a positive integer, or returns def
+func parsePositive(s string, def int) int {
+	n := 0
+	for _, c := range strings.TrimSpace(s) {
+		if c < '0' || c > '9' || n > 1e6 {
+			return def
+		}
+		n = n*10 + int(c-'0')
+	}
+	if n < 1 {
+		return def
+	}
+	return n
+}
+
+// documentTitle is the text of the first heading of doc, if any
+func documentTitle(doc *PMNode) string {
+	for _, n := range doc.Content {
+		if n.Type == "heading" {
+			if title := strings.TrimSpace(n.textContent()); title != "" {
+				return strings.ReplaceAll(title, "\n", " ")
+			}
+		}
+	}
+	return ""
+}
+
+// importFormat picks the format from ?format=, else from the Content-Type
+func importFormat(r *http.Request) (string, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		if format, ok := importFormats[strings.ToLower(name)]; ok {
+			return format, nil
+		}
+		return "", errBadRequest("format must be one of md, html, txt")
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if format, ok := importFormats[mediaType]; ok {
+		return format, nil
+	}
+	return "", errBadRequest("Set format to md, html or txt, or send a text/markdown, text/html or text/plain body")
+}
+
+// importDocument handles POST /api/documents/import: the body is converted
+// into a new document, or replaces the content of ?document= as a new
+// version
+func importDocument(w http.ResponseWriter, r *http.Request, hub *CollaborationHub, docs *Documents) {
+	format, err := importFormat(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		writeError(w, r, errBadRequest("Body must be at most %d bytes", maxImportSize))
+		return
+	}
+	content, err := parseImport(format, string(body))
+	if err != nil {
+		writeError(w, r, errBadRequest("Could not read the %s: %v", format, err))
+		return
+	}
+
+	q := r.URL.Query()
+	caller := callerFrom(r)
+	if err := requireUser(caller); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	owner, err := cleanOwner(q.Get("owner"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !caller.Trusted {
+		owner = caller.User
+	}
+
+	status := http.StatusOK
+	doc, ok := docs.Get(q.Get("document"))
+	if q.Get("document") != "" && !ok {
+		writeError(w, r, errNotFound("Document not found"))
+		return
+	}
+	if ok {
+		if err := requireRole(caller, doc, RoleEditor); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	if !ok {
+		title := q.Get("title")
+		if title == "" {
+			title = documentTitle(content)
+		}
+		if title, err = cleanTitle(title); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		var tags []string
+		if q.Get("tags") != "" {
+			tags = strings.Split(q.Get("tags"), ",")
+		}
+		if tags, err = cleanTags(tags); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		roomID := strings.TrimSpace(q.Get("roomId"))
+		if err := checkRoomClaim(hub, caller, roomID); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		doc, err = docs.Create(Document{Title: title, Owner: owner, Tags: tags, RoomID: roomID})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		status = http.StatusCreated
+	}
+
+	backup, err := hub.ReplaceContent(doc.RoomID, NewYDocFromProseMirror(content), owner, "Before importing "+format)
+	if err != nil {
+		if status == http.StatusCreated {
+			_, _ = docs.Delete(doc.ID)
+		}
+		writeError(w, r, err)
+		return
+	}
+	log.Printf("[INFO] Imported %d bytes of %s into document %s by %s", len(body), format, doc.ID, owner)
+
+	resp := map[string]interface{}{"document": doc}
+	if backup != nil {
+		resp["backup"] = backup
+	}
+	if status == http.StatusCreated {
+		w.Header().Set("Location", "/api/documents/"+doc.ID)
+	}
+	writeJSON(w, status, resp)
+}
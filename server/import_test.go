@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestImportMarkdown(t *testing.T) {
+	source := "# Migration *plan*\n" +
+		"\n" +
+		"Move **all** docs, see [the wiki](https://wiki.example.com).\n" +
+		"\n" +
+		"- one\n" +
+		"- two\n" +
+		"  1. nested\n" +
+		"\n" +
+		"> quoted  \n" +
+		"> line\n" +
+		"\n" +
+		"```go\n" +
+		"fmt.Println(1)\n" +
+		"```\n" +
+		"\n" +
+		"| a | b |\n" +
+		"|---|---|\n" +
+		"| 1 | 2 |\n" +
+		"\n" +
+		"***\n" +
+		"\n" +
+		"![logo](logo.png) ~~old~~ `code`\n"
+	doc, err := parseImport("md", source)
+	if err != nil {
+		t.Fatalf("parseImport: %v", err)
+	}
+	if got := documentTitle(doc); got != "Migration plan" {
+		t.Errorf("title = %q", got)
+	}
+
+	// Rendering the import back gives the source in the export's style, with
+	// the nodes the editor lacks flattened
+	want := "# Migration _plan_\n" +
+		"\n" +
+		"Move **all** docs, see the wiki (https://wiki.example.com).\n" +
+		"\n" +
+		"- one\n" +
+		"- two\n" +
+		"  1. nested\n" +
+		"\n" +
+		"> quoted\\\n" +
+		"> line\n" +
+		"\n" +
+		"```go\n" +
+		"fmt.Println(1)\n" +
+		"```\n" +
+		"\n" +
+		"a | b\n" +
+		"\n" +
+		"1 | 2\n" +
+		"\n" +
+		"---\n" +
+		"\n" +
+		"~~old~~ `code`\n"
+	if got := renderMarkdown(doc); got != want {
+		t.Errorf("markdown =\n%s\nwant\n%s", got, want)
+	}
+
+	// The Y.js document decodes to the same nodes
+	if got := renderMarkdown(NewYDocFromProseMirror(doc).ProseMirror("")); got != want {
+		t.Errorf("markdown from Y.js =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestImportHTMLAndText(t *testing.T) {
+	doc, err := parseImport("html", `<div><h2 style="text-align: center">Title</h2>loose <b>bold <i>both</i></b>
+	<span>text</span><script>alert(1)</script></div><ol start="4"><li>four</li></ol><p>a<br>b</p>`)
+	if err != nil {
+		t.Fatalf("parseImport: %v", err)
+	}
+	want := "## Title\n\nloose **bold _both_** text\n\n4. four\n\na\\\nb\n"
+	if got := renderMarkdown(doc); got != want {
+		t.Errorf("markdown = %q, want %q", got, want)
+	}
+	if align := doc.Content[0].attrString("textAlign"); align != "center" {
+		t.Errorf("textAlign = %q", align)
+	}
+
+	doc = textToProseMirror("first line\r\nsecond line\n\n\n  next paragraph\n")
+	if got := renderText(doc); got != "first line\nsecond line\n\nnext paragraph\n" {
+		t.Errorf("text = %q", got)
+	}
+}
+
+func TestImportRoute(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	docs, _ := NewDocuments(nil)
+	h := DocumentRoutes(hub, docs)
+
+	var created struct {
+		Document Document
+		Backup   *Snapshot
+	}
+	code := documentsRequest(t, h, http.MethodPost, "/api/documents/import?format=md&owner=ada&tags=wiki,migrated", "# Runbook\n\nRestart it.", &created)
+	if code != http.StatusCreated {
+		t.Fatalf("import: status = %d", code)
+	}
+	doc := created.Document
+	if doc.Title != "Runbook" || doc.Owner != "ada" || len(doc.Tags) != 2 || created.Backup != nil {
+		t.Errorf("import = %+v", created)
+	}
+	state, ok := hub.LookupState(doc.RoomID)
+	if !ok {
+		t.Fatal("imported document has no content")
+	}
+	if got := renderText(state.Current().mustContentDoc(t)); got != "Runbook\n\nRestart it.\n" {
+		t.Errorf("content = %q", got)
+	}
+
+	// Importing into an open document replaces its content as a new version
+	// and keeps the old one as a snapshot
+	client := joinTestClient(t, hub, doc.RoomID, "WebSocket")
+	for len(client.Send) > 0 {
+		<-client.Send
+	}
+	var replaced struct {
+		Document Document
+		Backup   *Snapshot
+	}
+	code = documentsRequest(t, h, http.MethodPost, "/api/documents/import?format=txt&document="+doc.ID, "Rewritten.", &replaced)
+	if code != http.StatusOK || replaced.Backup == nil || replaced.Document.ID != doc.ID {
+		t.Fatalf("replace: status = %d, %+v", code, replaced)
+	}
+	if got := renderText(state.Current().mustContentDoc(t)); got != "Rewritten.\n" {
+		t.Errorf("content = %q", got)
+	}
+	if snap, ok := state.Snapshot(replaced.Backup.ID); !ok || renderText(snap.mustContentDoc(t)) != "Runbook\n\nRestart it.\n" {
+		t.Error("backup does not hold the old content")
+	}
+	select {
+	case <-client.Send:
+	default:
+		t.Error("connected client did not receive the replacement")
+	}
+
+	for path, want := range map[string]int{
+		"/api/documents/import":                        http.StatusBadRequest,
+		"/api/documents/import?format=docx":            http.StatusBadRequest,
+		"/api/documents/import?format=md&document=nop": http.StatusNotFound,
+	} {
+		if code := documentsRequest(t, h, http.MethodPost, path, "text", nil); code != want {
+			t.Errorf("POST %s: status = %d, want %d", path, code, want)
+		}
+	}
+}
+
+// mustContentDoc decodes a snapshot's editor document
+func (snap *Snapshot) mustContentDoc(t *testing.T) *PMNode {
+	t.Helper()
+	d, err := snap.load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	return d.ProseMirror("")
+}
@@ -1,20 +1,15 @@
 package main
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/sha256"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/base64"
-	"encoding/json"
-	"encoding/pem"
+	"context"
+	"errors"
+	"fmt"
 	"log"
-	"math/big"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -32,140 +27,212 @@ func main() {
 		_ = godotenv.Load() // Ignore error if .env also doesn't exist
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	cfg, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
 	r := chi.NewRouter()
 
 	// Middleware
+	r.Use(middleware.RequestID)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	if cfg.TLS.ServeHTTP {
+		r.Use(altSvcMiddleware(cfg.HTTP3Port))
+	}
+
+	// One origin policy covers CORS and the collaboration upgrades
+	origins, err := NewOriginPolicy(cfg.AllowedOrigins)
+	if err != nil {
+		log.Fatalf("Invalid allowed origins: %v", err)
+	}
 
 	// CORS configuration
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:3000", "https://localhost:3000"}, // Allow Next.js frontend
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowOriginFunc:  origins.AllowOriginFunc,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Sec-WebSocket-Protocol"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	}))
 
+	// Router-level errors use the same JSON envelope as the handlers
+	r.NotFound(notFoundHandler)
+	r.MethodNotAllowed(methodNotAllowedHandler)
+
 	// Initialize Collaboration Hub
-	hub := NewCollaborationHub()
+	hub := NewCollaborationHub(cfg.Collab, origins)
 
-	// Routes
-	r.Post("/api/generate-template", GenerateTemplateHandler)
-	r.Post("/api/autocomplete", AutocompleteHandler)
-
-	// Collaboration Routes
-	r.Get("/collab/{roomID}", func(w http.ResponseWriter, r *http.Request) {
-		// Negotiate protocol based on headers
-		if r.Header.Get("Sec-WebSocket-Protocol") != "" || r.Header.Get("Upgrade") == "websocket" {
-			hub.HandleWebSocket(w, r)
-		} else {
-			// For WebTransport, the client should connect to the HTTP/3 port (4433) directly.
-			// Or we can inform them to switch ports.
-			// Since we are running two separate servers, this endpoint on the HTTP/2 server
-			// handles WebSockets. The WebTransport endpoint is on the HTTP/3 server.
-			http.Error(w, "For WebTransport, connect to port 4433", http.StatusUpgradeRequired)
+	// Room documents survive restarts when a data directory is configured
+	var store *Store
+	if cfg.Persistence.Dir != "" {
+		if store, err = OpenStore(cfg.Persistence); err != nil {
+			log.Fatalf("Failed to open persistence directory: %v", err)
 		}
-	})
+		hub.UseStore(store)
+		log.Printf("[INFO] Persisting room documents in %s", cfg.Persistence.Dir)
+	}
 
-	// Generate self-signed certs for WebTransport (QUIC requires TLS)
-	certFile := "localhost.pem"
-	keyFile := "localhost-key.pem"
-	if _, err := os.Stat(certFile); os.IsNotExist(err) {
-		log.Println("Generating self-signed certificates for WebTransport...")
-		generateCert(certFile, keyFile)
+	// Document metadata, saved with the rooms when they are persisted
+	documents, err := NewDocuments(store)
+	if err != nil {
+		log.Fatalf("Failed to load documents: %v", err)
 	}
+	hub.OnChange(documents.Touch)
+	go documents.Run()
 
-	// Calculate Certificate Hash for WebTransport
-	// This allows the frontend to connect without browser flags if we pass this hash
-	certPEM, err := os.ReadFile(certFile)
+	// Full-text index over the documents, kept in step with the registry
+	index, err := NewSearchIndex(hub, documents, store)
 	if err != nil {
-		log.Fatalf("Failed to read cert file: %v", err)
+		log.Fatalf("Failed to load search index: %v", err)
 	}
-	block, _ := pem.Decode(certPEM)
-	if block == nil {
-		log.Fatal("Failed to decode cert PEM")
+	go index.Run()
+
+	// Users and their tokens; without any, every caller is trusted
+	auth := NewAuthenticator(cfg.Auth)
+	if auth.Enabled() {
+		log.Printf("[INFO] Authentication on for %d users", len(cfg.Auth.Users))
 	}
-	cert, err := x509.ParseCertificate(block.Bytes)
+	// Collaboration clients join with their role on the room's document
+	hub.UseAccess(NewRoomAccess(auth, documents))
+
+	// Template catalog: embedded kinds plus optional custom ones from disk
+	catalog, err := NewTemplateCatalog(cfg.TemplateDir)
 	if err != nil {
-		log.Fatal("Failed to parse cert")
+		log.Fatalf("Failed to load template catalog: %v", err)
 	}
-	sha256Hash := sha256.Sum256(cert.Raw)
-	// WebTransport expects the hash as a byte array, but we'll send it as base64 or hex to frontend
-	// Actually, the API expects Uint8Array. We'll send a JSON array of numbers or hex string.
-	// Let's send the raw bytes as base64.
-	certHashBase64 := base64.StdEncoding.EncodeToString(sha256Hash[:])
 
-	log.Printf("Server Certificate Hash (SHA-256): %x", sha256Hash)
+	groq := NewGroqClient(cfg.Groq)
 
-	// Add endpoint to serve the hash
-	r.Get("/api/cert-hash", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"hash": certHashBase64,
-		})
+	// Routes
+	r.Get("/api/templates", TemplatesHandler(catalog))
+	r.Get("/api/templates/{id}", TemplateHandler(catalog))
+	r.Post("/api/generate-template", GenerateTemplateHandler(catalog, groq))
+	r.Post("/api/autocomplete", AutocompleteHandler(groq))
+	r.Get("/api/transform", TransformOperationsHandler)
+	r.Post("/api/transform", TransformHandler(groq))
+
+	// Certificates for WebTransport (QUIC requires TLS). Self-signed dev certs
+	// are generated and renewed automatically; all certs are hot-reloaded.
+	certs, err := NewCertManager(cfg.TLS)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificate: %v", err)
+	}
+	go certs.Watch()
+
+	// Probes for load balancers and orchestrators
+	health := NewHealth("http", "http3")
+	health.AddCheck("certificate", certificateCheck(certs))
+	if store != nil {
+		health.AddCheck("persistence", store.Check)
+	}
+	r.Get("/healthz", HealthzHandler)
+	r.Get("/readyz", ReadyzHandler(health))
+	r.Get("/version", VersionHandler())
+	r.Method(http.MethodGet, "/metrics", MetricsHandler(hub, cfg.Admin.Token))
+
+	// Admin API for inspecting and managing rooms, only with a token set
+	if cfg.Admin.Token != "" {
+		r.Mount("/api/admin", AdminRoutes(hub, cfg.Admin.Token))
+	}
+
+	// Documents, their search and the version history of each room's
+	// document. Access to documents follows the caller's role.
+	r.Group(func(r chi.Router) {
+		r.Use(auth.Middleware)
+		r.Mount("/api/documents", DocumentRoutes(hub, documents))
+		r.Get("/api/search", SearchHandler(index))
+		r.Mount("/api/rooms/{roomID}/snapshots", HistoryRoutes(hub, documents))
 	})
 
-	log.Printf("Server starting on ports %s (HTTP + WebSocket) and 4433 (HTTP/3 + WebTransport)", port)
+	// Collaboration Routes. WebSockets are served here; WebTransport lives on
+	// the HTTP/3 server, and other requests are redirected to it.
+	r.Get("/collab/{roomID}", hub.CollabHandler(cfg, certs))
 
-	// Start HTTP/3 server for WebTransport on port 4433
-	go func() {
-		if err := StartWebTransportServer("4433", hub, certFile, keyFile); err != nil {
-			log.Printf("[ERROR] HTTP/3 server error: %v", err)
-		}
-	}()
+	// Serve the certificate hashes so the frontend can connect without browser
+	// flags. During a rotation every still-valid hash is listed, current first.
+	r.Get("/api/cert-hash", func(w http.ResponseWriter, r *http.Request) {
+		hashes := certs.Hashes()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"hash":   hashes[0],
+			"hashes": hashes,
+		})
+	})
 
-	// Start HTTP server for WebSocket and API routes (No TLS for signaling/API to avoid cert issues)
-	// WebTransport on port 4433 will still use TLS as required.
-	if err := http.ListenAndServe(":"+port, r); err != nil {
-		log.Fatal(err)
+	if cfg.SinglePort {
+		log.Printf("Server starting on port %d (TCP: HTTPS + WebSocket, UDP: HTTP/3 + WebTransport)", cfg.Port)
+	} else {
+		log.Printf("Server starting on ports %d (HTTP + WebSocket) and %d (HTTP/3 + WebTransport)", cfg.Port, cfg.HTTP3Port)
 	}
-}
 
-// Helper to generate self-signed certs
-func generateCert(certFile, keyFile string) {
-	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	// Bind both listeners before serving so readiness reflects sockets that
+	// are actually open
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
 	if err != nil {
-		log.Fatalf("Failed to generate private key: %v", err)
-	}
-
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			Organization: []string{"WritePad Dev"},
-		},
-		NotBefore: time.Now(),
-		// WebTransport with serverCertificateHashes requires short-lived certs (max 14 days)
-		NotAfter: time.Now().Add(time.Hour * 24 * 10),
-
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
-		DNSNames:              []string{"localhost"},
+		log.Fatalf("Failed to listen on TCP port %d: %v", cfg.Port, err)
 	}
-
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	udpConn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", cfg.HTTP3Port))
 	if err != nil {
-		log.Fatalf("Failed to create certificate: %v", err)
+		log.Fatalf("Failed to listen on UDP port %d: %v", cfg.HTTP3Port, err)
 	}
 
-	outFile, _ := os.Create(certFile)
-	if err := pem.Encode(outFile, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
-		log.Fatalf("Failed to write cert: %v", err)
-	}
-	_ = outFile.Close()
+	// Start HTTP/3 server for WebTransport
+	wt := NewWebTransportServer(cfg, hub, certs, r)
+	go func() {
+		log.Printf("[INFO] Starting HTTP/3 (QUIC) server on port %d for WebTransport", cfg.HTTP3Port)
+		health.SetListener("http3", true)
+		err := wt.Serve(udpConn)
+		health.SetListener("http3", false)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("[ERROR] HTTP/3 server error: %v", err)
+		}
+	}()
 
-	outKey, _ := os.Create(keyFile)
-	b, _ := x509.MarshalECPrivateKey(priv)
-	if err := pem.Encode(outKey, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}); err != nil {
-		log.Fatalf("Failed to write key: %v", err)
+	// Start HTTP server for WebSocket and API routes. Without tls.serveHttp it
+	// runs without TLS to avoid cert issues; WebTransport on the HTTP/3 port
+	// always uses TLS as required.
+	srv := &http.Server{Handler: r}
+	go func() {
+		var err error
+		health.SetListener("http", true)
+		if cfg.TLS.ServeHTTP {
+			srv.TLSConfig = certs.TLSConfig()
+			srv.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		health.SetListener("http", false)
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// Graceful shutdown: fail readiness first so load balancers stop routing
+	// new traffic here, then let in-flight requests finish. A second signal
+	// exits immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	log.Printf("[INFO] Shutting down: draining for %s", cfg.Shutdown.Delay)
+	health.SetDraining()
+	time.Sleep(cfg.Shutdown.Delay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown.Timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("[WARN] HTTP server did not shut down cleanly: %v", err)
+	}
+	if err := wt.Close(); err != nil {
+		log.Printf("[WARN] HTTP/3 server did not shut down cleanly: %v", err)
 	}
-	_ = outKey.Close()
+	_ = udpConn.Close()
+	hub.CloseStates()
+	documents.Close()
+	index.Close()
+	certs.Close()
+	log.Printf("[INFO] Server stopped")
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// MetricsHandler serves the collaboration hub's gauges and counters in the
+// Prometheus text exposition format. With an admin token set, scrapers must
+// send it like admin requests.
+func MetricsHandler(hub *CollaborationHub, token string) http.Handler {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rooms := hub.RoomInfos()
+
+		protocols := map[string]int{"WebSocket": 0, "WebTransport": 0}
+		largest := 0
+		for _, room := range rooms {
+			for protocol, n := range room.Protocols {
+				protocols[protocol] += n
+			}
+			if room.Clients > largest {
+				largest = room.Clients
+			}
+		}
+
+		var b strings.Builder
+		metric := func(name, kind, help string) {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		}
+
+		metric("writepad_rooms", "gauge", "Open collaboration rooms.")
+		fmt.Fprintf(&b, "writepad_rooms %d\n", len(rooms))
+
+		metric("writepad_connections", "gauge", "Connected collaboration clients by protocol.")
+		for _, protocol := range sortedKeys(protocols) {
+			fmt.Fprintf(&b, "writepad_connections{protocol=%q} %d\n", protocol, protocols[protocol])
+		}
+
+		metric("writepad_room_clients_max", "gauge", "Clients in the fullest room.")
+		fmt.Fprintf(&b, "writepad_room_clients_max %d\n", largest)
+
+		metric("writepad_joins_rejected_total", "counter", "Joins refused because a capacity limit was reached.")
+		for _, kind := range sortedKeys(hub.rejected) {
+			fmt.Fprintf(&b, "writepad_joins_rejected_total{reason=%q} %d\n", kind, hub.rejected[kind].Load())
+		}
+
+		metric("writepad_clients_disconnected_total", "counter", "Clients disconnected for breaking the message size or rate limits.")
+		for _, violation := range sortedKeys(hub.violations) {
+			fmt.Fprintf(&b, "writepad_clients_disconnected_total{reason=%q} %d\n", violation, hub.violations[violation].Load())
+		}
+
+		metric("writepad_limit", "gauge", "Configured capacity limits; 0 means unlimited.")
+		fmt.Fprintf(&b, "writepad_limit{limit=\"max_clients_per_room\"} %d\n", hub.config.MaxClientsPerRoom)
+		fmt.Fprintf(&b, "writepad_limit{limit=\"max_rooms\"} %d\n", hub.config.MaxRooms)
+		fmt.Fprintf(&b, "writepad_limit{limit=\"max_connections\"} %d\n", hub.config.MaxConnections)
+		fmt.Fprintf(&b, "writepad_limit{limit=\"max_message_size\"} %d\n", hub.config.MaxMessageSize)
+
+		if store := hub.store; store != nil {
+			metric("writepad_log_appends_total", "counter", "Updates appended to room logs.")
+			fmt.Fprintf(&b, "writepad_log_appends_total %d\n", store.appends.Load())
+			metric("writepad_log_compactions_total", "counter", "Room logs compacted into their documents.")
+			fmt.Fprintf(&b, "writepad_log_compactions_total %d\n", store.compactions.Load())
+			metric("writepad_persistence_errors_total", "counter", "Failed writes to the persistence directory.")
+			fmt.Fprintf(&b, "writepad_persistence_errors_total %d\n", store.failures.Load())
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write([]byte(b.String()))
+	})
+	if token == "" {
+		return h
+	}
+	return adminAuth(token)(h)
+}
+
+// sortedKeys returns the keys of m in order, for stable output
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
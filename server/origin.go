@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginPolicy decides which browser origins may use the server. The same
+// policy is applied to CORS on the REST API, the WebSocket upgrade and the
+// WebTransport upgrade, so a page that cannot call the API cannot join a room
+// either.
+//
+// Entries are exact origins ("https://app.example.com"), wildcard subdomains
+// ("https://*.example.com", which matches any subdomain but not the apex), or
+// "*" to allow everything.
+type OriginPolicy struct {
+	allowAll  bool
+	exact     map[string]bool
+	wildcards []wildcardOrigin
+}
+
+type wildcardOrigin struct {
+	scheme string
+	suffix string // ".example.com", including the port if one was given
+}
+
+// NewOriginPolicy parses the configured origins
+func NewOriginPolicy(origins []string) (*OriginPolicy, error) {
+	p := &OriginPolicy{exact: make(map[string]bool)}
+
+	for _, origin := range origins {
+		if origin == "*" {
+			p.allowAll = true
+			continue
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			(u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return nil, fmt.Errorf("allowed origin %q must be a scheme://host URL", origin)
+		}
+		host := strings.ToLower(u.Host)
+
+		if strings.HasPrefix(host, "*.") {
+			suffix := host[1:]
+			if strings.Contains(suffix, "*") || strings.HasPrefix(suffix, "..") || strings.HasPrefix(suffix, ".:") || suffix == "." {
+				return nil, fmt.Errorf("allowed origin %q has an invalid wildcard", origin)
+			}
+			p.wildcards = append(p.wildcards, wildcardOrigin{scheme: u.Scheme, suffix: suffix})
+			continue
+		}
+		if strings.Contains(host, "*") {
+			return nil, fmt.Errorf("allowed origin %q may only use a wildcard as the first label", origin)
+		}
+		p.exact[u.Scheme+"://"+host] = true
+	}
+	return p, nil
+}
+
+// Allowed reports whether a browser at origin may use the server
+func (p *OriginPolicy) Allowed(origin string) bool {
+	if p.allowAll {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	if p.exact[u.Scheme+"://"+host] {
+		return true
+	}
+	for _, w := range p.wildcards {
+		if u.Scheme == w.scheme && strings.HasSuffix(host, w.suffix) && len(host) > len(w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckRequest applies the policy to a connection upgrade. Requests without
+// an Origin header come from non-browser clients (scripts, benchmarks) and
+// are not subject to cross-site attacks, so they are allowed. Rejections are
+// logged.
+func (p *OriginPolicy) CheckRequest(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.Allowed(origin) {
+		return true
+	}
+	log.Printf("[WARN] Rejected %s %s from origin %q (remote %s)", r.Method, r.URL.Path, origin, r.RemoteAddr)
+	return false
+}
+
+// AllowOriginFunc adapts the policy for the CORS middleware
+func (p *OriginPolicy) AllowOriginFunc(r *http.Request, origin string) bool {
+	if p.Allowed(origin) {
+		return true
+	}
+	log.Printf("[WARN] Rejected CORS request %s %s from origin %q", r.Method, r.URL.Path, origin)
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	p, err := NewOriginPolicy([]string{"https://app.example.com", "https://*.writepad.dev", "http://localhost:3000"})
+	if err != nil {
+		t.Fatalf("NewOriginPolicy: %v", err)
+	}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"http://app.example.com", false},
+		{"https://evil.example.com", false},
+		{"https://a.writepad.dev", true},
+		{"https://a.b.writepad.dev", true},
+		{"https://writepad.dev", false},
+		{"https://evilwritepad.dev", false},
+		{"https://a.writepad.dev:8443", false},
+		{"http://localhost:3000", true},
+		{"http://localhost:3001", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		if got := p.Allowed(tt.origin); got != tt.want {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestOriginPolicyCheckRequest(t *testing.T) {
+	p, _ := NewOriginPolicy([]string{"https://app.example.com"})
+
+	req := httptest.NewRequest("GET", "/collab/room", nil)
+	if !p.CheckRequest(req) {
+		t.Errorf("request without Origin was rejected")
+	}
+	req.Header.Set("Origin", "https://evil.example.com")
+	if p.CheckRequest(req) {
+		t.Errorf("request from a disallowed origin was accepted")
+	}
+
+	all, _ := NewOriginPolicy([]string{"*"})
+	if !all.CheckRequest(req) {
+		t.Errorf("wildcard policy rejected a request")
+	}
+}
+
+func TestOriginPolicyInvalid(t *testing.T) {
+	for _, origin := range []string{"example.com", "https://*", "https://a.*.example.com", "https://example.com/path", "ftp://example.com"} {
+		if _, err := NewOriginPolicy([]string{origin}); err == nil {
+			t.Errorf("NewOriginPolicy(%q) succeeded, want an error", origin)
+		}
+	}
+}
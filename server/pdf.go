@@ -0,0 +1,783 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/image/font/sfnt"
+)
+
+// The PDF export lays the document out itself: text is broken into lines
+// with the metrics of the fonts in pdf_fonts.go and flowed onto pages of the
+// chosen paper size, breaking pages between lines. Links become link
+// annotations.
+
+const (
+	pdfBodySize = 11.0
+	pdfCodeSize = 9.5
+	// pdfLineHeight is the line height as a multiple of the font size
+	pdfLineHeight = 1.4
+	// pdfIndent is the indentation of each list and quote level
+	pdfIndent = 20.0
+	// pdfCellPadding is the padding inside table cells
+	pdfCellPadding = 4.0
+)
+
+// pdfHeadingSizes are the font sizes of heading levels 1 to 6
+var pdfHeadingSizes = [6]float64{24, 20, 16, 14, 12, 11}
+
+var (
+	pdfBlack = [3]float64{0.07, 0.09, 0.15}
+	pdfBlue  = [3]float64{0.15, 0.39, 0.92}
+	pdfGray  = [3]float64{0.82, 0.84, 0.86}
+	pdfShade = [3]float64{0.95, 0.96, 0.96}
+)
+
+// pdfStyle is the look of a run of text
+type pdfStyle struct {
+	font      pdfFont
+	size      float64
+	color     [3]float64
+	underline bool
+	strike    bool
+	href      string
+}
+
+// pdfRun is a piece of a line in one style: a word, the spaces between
+// words, or a hard break
+type pdfRun struct {
+	text  []pdfGlyph
+	style pdfStyle
+	space bool
+	brk   bool
+}
+
+func (r pdfRun) width() float64 {
+	return r.style.font.textWidth(r.text, r.style.size)
+}
+
+// spaces counts the spaces justification stretches
+func (r pdfRun) spaces() int {
+	if !r.space {
+		return 0
+	}
+	return len(r.text)
+}
+
+// pdfLine is a laid out line of text
+type pdfLine struct {
+	runs   []pdfRun
+	width  float64
+	size   float64 // the largest font size on the line
+	spaces int
+	// last is set on the last line of a paragraph and lines ended by a
+	// hard break, which justified text does not stretch
+	last bool
+}
+
+func (l pdfLine) height() float64 { return l.size * pdfLineHeight }
+
+// pdfLink is a link annotation on a page
+type pdfLink struct {
+	x1, y1, x2, y2 float64
+	href           string
+}
+
+// pdfPage is a page's content stream and links
+type pdfPage struct {
+	content bytes.Buffer
+	links   []pdfLink
+}
+
+// pdfMarker is a list marker waiting for the first line of its item
+type pdfMarker struct {
+	text  []pdfGlyph
+	right float64 // the marker ends here
+	style pdfStyle
+}
+
+// pdfRenderer flows blocks onto pages. y is the top of the next line,
+// measured down from the top of the page.
+type pdfRenderer struct {
+	paper  paperSize
+	pages  []*pdfPage
+	page   *pdfPage
+	y      float64
+	bars   []float64 // x of the bar of each enclosing blockquote
+	marker *pdfMarker
+	lists  int // list nesting depth
+
+	// used maps the glyphs drawn in each font to the characters they show
+	used map[pdfFont]map[sfnt.GlyphIndex]rune
+	// missing are the characters drawn that the fonts lack, in order
+	missing []rune
+}
+
+// renderPDF renders a document as a PDF on the given paper. Documents with
+// characters the fonts cannot show, in their text, image alt text or
+// anywhere else, are refused with errUnsupportedCharacters.
+func renderPDF(doc Document, content *PMNode, paper paperSize) ([]byte, error) {
+	p := &pdfRenderer{paper: paper, used: make(map[pdfFont]map[sfnt.GlyphIndex]rune)}
+	p.newPage()
+	p.blocks(content.Content, pageMargin, paper.Width-2*pageMargin)
+	if len(p.missing) > 0 {
+		return nil, errUnsupportedCharacters("PDF", p.missing)
+	}
+	return p.encode(doc)
+}
+
+// newPage starts a page
+func (p *pdfRenderer) newPage() {
+	p.page = &pdfPage{}
+	p.pages = append(p.pages, p.page)
+	p.y = pageMargin
+}
+
+// atTop reports whether nothing has been drawn on the page yet
+func (p *pdfRenderer) atTop() bool {
+	return p.y <= pageMargin
+}
+
+// ensure starts a new page unless h fits below y. A block taller than a
+// page is drawn from the top of a page and cut off.
+func (p *pdfRenderer) ensure(h float64) {
+	if !p.atTop() && p.y+h > p.paper.Height-pageMargin {
+		p.newPage()
+	}
+}
+
+// gap adds vertical space between blocks, except at the top of a page
+func (p *pdfRenderer) gap(h float64) {
+	if p.atTop() {
+		return
+	}
+	if p.y+h > p.paper.Height-pageMargin {
+		p.newPage()
+		return
+	}
+	p.drawBars(h)
+	p.y += h
+}
+
+// blocks draws a sequence of blocks in the column from x, width wide
+func (p *pdfRenderer) blocks(nodes []*PMNode, x, width float64) {
+	for i := 0; i < len(nodes); i++ {
+		n := nodes[i]
+		if n.isInline() {
+			j := i
+			for j < len(nodes) && nodes[j].isInline() {
+				j++
+			}
+			p.paragraph(nodes[i:j], p.bodyStyle(), x, width, "")
+			i = j - 1
+			continue
+		}
+		p.block(n, x, width)
+	}
+}
+
+func (p *pdfRenderer) bodyStyle() pdfStyle {
+	return pdfStyle{font: fontSans, size: pdfBodySize, color: pdfBlack}
+}
+
+// block draws one block node
+func (p *pdfRenderer) block(n *PMNode, x, width float64) {
+	switch n.Type {
+	case "paragraph":
+		p.paragraph(n.Content, p.bodyStyle(), x, width, n.attrString("textAlign"))
+	case "heading":
+		level := n.attrInt("level", 1)
+		if level < 1 || level > 6 {
+			level = 1
+		}
+		style := p.bodyStyle()
+		style.font = fontSansBold
+		style.size = pdfHeadingSizes[level-1]
+		p.gap(style.size * 0.5)
+		p.paragraph(n.Content, style, x, width, n.attrString("textAlign"))
+	case "blockquote":
+		p.gap(pdfBodySize * 0.5)
+		p.bars = append(p.bars, x+2)
+		p.blocks(n.Content, x+pdfIndent, width-pdfIndent)
+		p.bars = p.bars[:len(p.bars)-1]
+	case "codeBlock":
+		p.code(n, x, width)
+	case "horizontalRule":
+		p.gap(pdfBodySize * 0.5)
+		p.ensure(pdfBodySize)
+		y := p.y + pdfBodySize/2
+		p.strokeLine(x, y, x+width, y, 0.75, pdfGray)
+		p.y += pdfBodySize
+	case "bulletList", "orderedList", "taskList":
+		p.list(n, x, width)
+	case "table":
+		p.table(n, x, width)
+	case "image":
+		p.paragraph([]*PMNode{n}, p.bodyStyle(), x, width, "")
+	default:
+		if len(n.Content) > 0 && n.Content[0].isInline() {
+			p.paragraph(n.Content, p.bodyStyle(), x, width, "")
+			return
+		}
+		p.blocks(n.Content, x, width)
+	}
+}
+
+// paragraph lays out and draws inline content
+func (p *pdfRenderer) paragraph(nodes []*PMNode, style pdfStyle, x, width float64, align string) {
+	if p.lists > 0 {
+		p.gap(style.size * 0.25)
+	} else {
+		p.gap(style.size * 0.6)
+	}
+	for _, line := range layoutPDFLines(nodes, style, width) {
+		p.line(line, x, width, align)
+	}
+}
+
+// line draws a line at y and moves below it, starting a page if needed
+func (p *pdfRenderer) line(line pdfLine, x, width float64, align string) {
+	h := line.height()
+	p.ensure(h)
+	p.drawBars(h)
+	baseline := p.y + line.size*1.05
+	if m := p.marker; m != nil {
+		p.text(m.right-m.style.font.textWidth(m.text, m.style.size), baseline, m.text, m.style, 0)
+		p.marker = nil
+	}
+	p.drawLine(line, x, baseline, width, align)
+	p.y += h
+}
+
+// drawLine draws the runs of a line on the baseline, aligned in the column
+func (p *pdfRenderer) drawLine(line pdfLine, x, baseline, width float64, align string) {
+	extra := 0.0
+	switch align {
+	case "center":
+		x += (width - line.width) / 2
+	case "right":
+		x += width - line.width
+	case "justify":
+		if !line.last && line.spaces > 0 {
+			extra = (width - line.width) / float64(line.spaces)
+		}
+	}
+	for i := 0; i < len(line.runs); {
+		// Draw runs of the same style together
+		j := i + 1
+		text := append([]pdfGlyph{}, line.runs[i].text...)
+		spaces := line.runs[i].spaces()
+		for j < len(line.runs) && line.runs[j].style == line.runs[i].style {
+			text = append(text, line.runs[j].text...)
+			spaces += line.runs[j].spaces()
+			j++
+		}
+		style := line.runs[i].style
+		w := style.font.textWidth(text, style.size) + float64(spaces)*extra
+		p.text(x, baseline, text, style, extra)
+		if style.underline {
+			p.fillRect(x, baseline+style.size*0.1, w, style.size*0.06, style.color)
+		}
+		if style.strike {
+			p.fillRect(x, baseline-style.size*0.3, w, style.size*0.06, style.color)
+		}
+		if style.href != "" {
+			p.page.links = append(p.page.links, pdfLink{
+				x1: x, y1: p.paper.Height - baseline - style.size*0.25,
+				x2: x + w, y2: p.paper.Height - baseline + style.size*0.9,
+				href: style.href,
+			})
+		}
+		x += w
+		i = j
+	}
+}
+
+// list draws the items of a list with their markers in the indentation
+func (p *pdfRenderer) list(n *PMNode, x, width float64) {
+	number := n.attrInt("start", 1)
+	p.lists++
+	defer func() { p.lists-- }()
+	for i, item := range n.Content {
+		marker := "•"
+		switch n.Type {
+		case "orderedList":
+			marker = strconv.Itoa(number+i) + "."
+		case "taskList":
+			marker = "[ ]"
+			if checked, _ := item.Attrs["checked"].(bool); checked {
+				marker = "[x]"
+			}
+		}
+		p.marker = &pdfMarker{text: fontSans.encode(marker), right: x + pdfIndent - 5, style: p.bodyStyle()}
+		p.blocks(item.Content, x+pdfIndent, width-pdfIndent)
+		if p.marker != nil {
+			// An empty item still shows its marker
+			p.line(pdfLine{size: pdfBodySize}, x+pdfIndent, width-pdfIndent, "")
+		}
+	}
+}
+
+// code draws a code block on a shaded background, wrapping long lines
+func (p *pdfRenderer) code(n *PMNode, x, width float64) {
+	p.gap(pdfBodySize * 0.6)
+	style := pdfStyle{font: fontMono, size: pdfCodeSize, color: pdfBlack}
+	pad := 6.0
+	perLine := int((width - 2*pad) / style.font.textWidth(style.font.encode("m"), style.size))
+	if perLine < 1 {
+		perLine = 1
+	}
+	var lines [][]pdfGlyph
+	for _, text := range strings.Split(strings.TrimSuffix(n.textContent(), "\n"), "\n") {
+		encoded := style.font.encode(strings.ReplaceAll(text, "\t", "    "))
+		for len(encoded) > perLine {
+			lines = append(lines, encoded[:perLine])
+			encoded = encoded[perLine:]
+		}
+		lines = append(lines, encoded)
+	}
+	h := style.size * pdfLineHeight
+	for i, text := range lines {
+		top, bottom := 0.0, 0.0
+		if i == 0 {
+			top = pad / 2
+		}
+		if i == len(lines)-1 {
+			bottom = pad / 2
+		}
+		p.ensure(top + h + bottom)
+		p.drawBars(top + h + bottom)
+		p.fillRect(x, p.y, width, top+h+bottom, pdfShade)
+		p.text(x+pad, p.y+top+style.size*1.05, text, style, 0)
+		p.y += top + h + bottom
+	}
+}
+
+// pdfCell is a laid out table cell
+type pdfCell struct {
+	lines  []pdfLine
+	aligns []string
+	header bool
+}
+
+// table draws a table with columns of equal width and a grid, keeping each
+// row on one page
+func (p *pdfRenderer) table(n *PMNode, x, width float64) {
+	columns := 0
+	for _, row := range n.Content {
+		if len(row.Content) > columns {
+			columns = len(row.Content)
+		}
+	}
+	if columns == 0 {
+		return
+	}
+	p.gap(pdfBodySize * 0.6)
+	colWidth := width / float64(columns)
+	for _, row := range n.Content {
+		cells := make([]pdfCell, columns)
+		height := 0.0
+		for i, node := range row.Content {
+			style := p.bodyStyle()
+			if node.Type == "tableHeader" {
+				style.font = fontSansBold
+				cells[i].header = true
+			}
+			for _, block := range node.Content {
+				content := block.Content
+				if !block.isInline() && (len(content) == 0 || !content[0].isInline()) {
+					content = []*PMNode{{Type: "text", Text: block.textContent()}}
+				} else if block.isInline() {
+					content = []*PMNode{block}
+				}
+				for _, line := range layoutPDFLines(content, style, colWidth-2*pdfCellPadding) {
+					cells[i].lines = append(cells[i].lines, line)
+					cells[i].aligns = append(cells[i].aligns, block.attrString("textAlign"))
+				}
+			}
+			h := 2 * pdfCellPadding
+			for _, line := range cells[i].lines {
+				h += line.height()
+			}
+			if h > height {
+				height = h
+			}
+		}
+		if height == 0 {
+			height = pdfBodySize*pdfLineHeight + 2*pdfCellPadding
+		}
+		p.ensure(height)
+		p.drawBars(height)
+		for i, cell := range cells {
+			cx := x + float64(i)*colWidth
+			if cell.header {
+				p.fillRect(cx, p.y, colWidth, height, pdfShade)
+			}
+			p.strokeRect(cx, p.y, colWidth, height, 0.5, pdfGray)
+			y := p.y + pdfCellPadding
+			for j, line := range cell.lines {
+				p.drawLine(line, cx+pdfCellPadding, y+line.size*1.05, colWidth-2*pdfCellPadding, cell.aligns[j])
+				y += line.height()
+			}
+		}
+		p.y += height
+	}
+}
+
+// drawBars draws the bars of enclosing blockquotes next to the next h
+// points below y
+func (p *pdfRenderer) drawBars(h float64) {
+	for _, x := range p.bars {
+		p.fillRect(x, p.y, 2, h, pdfGray)
+	}
+}
+
+// text shows encoded text with its baseline at y, measured from the top;
+// wordSpacing stretches the spaces. It notes the glyphs the font must embed
+// and the characters it has none for.
+func (p *pdfRenderer) text(x, y float64, text []pdfGlyph, style pdfStyle, wordSpacing float64) {
+	if len(text) == 0 {
+		return
+	}
+	used := p.used[style.font]
+	if used == nil {
+		used = make(map[sfnt.GlyphIndex]rune)
+		p.used[style.font] = used
+	}
+	for _, g := range text {
+		if g.id == 0 {
+			if !slices.Contains(p.missing, g.r) {
+				p.missing = append(p.missing, g.r)
+			}
+			continue
+		}
+		if _, ok := used[g.id]; !ok {
+			used[g.id] = g.r
+		}
+	}
+
+	c := &p.page.content
+	fmt.Fprintf(c, "BT /F%d %s Tf %s %s %s rg ", style.font+1, pdfNum(style.size), pdfNum(style.color[0]), pdfNum(style.color[1]), pdfNum(style.color[2]))
+	fmt.Fprintf(c, "%s %s Td ", pdfNum(x), pdfNum(p.paper.Height-y))
+	if wordSpacing == 0 {
+		fmt.Fprintf(c, "%s Tj ET\n", pdfGlyphString(text))
+		return
+	}
+	// Tw only stretches the single-byte code 32, so two-byte glyph codes are
+	// spaced by moving back after each space, in thousandths of the size
+	adjust := pdfNum(-wordSpacing * 1000 / style.size)
+	c.WriteString("[")
+	start := 0
+	for i, g := range text {
+		if g.r == ' ' {
+			fmt.Fprintf(c, "%s %s ", pdfGlyphString(text[start:i+1]), adjust)
+			start = i + 1
+		}
+	}
+	if start < len(text) {
+		c.WriteString(pdfGlyphString(text[start:]))
+	}
+	c.WriteString("] TJ ET\n")
+}
+
+// fillRect fills a rectangle whose top left corner is (x, y) from the top
+func (p *pdfRenderer) fillRect(x, y, w, h float64, color [3]float64) {
+	fmt.Fprintf(&p.page.content, "%s %s %s rg %s %s %s %s re f\n",
+		pdfNum(color[0]), pdfNum(color[1]), pdfNum(color[2]),
+		pdfNum(x), pdfNum(p.paper.Height-y-h), pdfNum(w), pdfNum(h))
+}
+
+// strokeRect outlines a rectangle whose top left corner is (x, y)
+func (p *pdfRenderer) strokeRect(x, y, w, h, lineWidth float64, color [3]float64) {
+	fmt.Fprintf(&p.page.content, "%s w %s %s %s RG %s %s %s %s re S\n",
+		pdfNum(lineWidth), pdfNum(color[0]), pdfNum(color[1]), pdfNum(color[2]),
+		pdfNum(x), pdfNum(p.paper.Height-y-h), pdfNum(w), pdfNum(h))
+}
+
+// strokeLine draws a line between two points measured from the top
+func (p *pdfRenderer) strokeLine(x1, y1, x2, y2, lineWidth float64, color [3]float64) {
+	fmt.Fprintf(&p.page.content, "%s w %s %s %s RG %s %s m %s %s l S\n",
+		pdfNum(lineWidth), pdfNum(color[0]), pdfNum(color[1]), pdfNum(color[2]),
+		pdfNum(x1), pdfNum(p.paper.Height-y1), pdfNum(x2), pdfNum(p.paper.Height-y2))
+}
+
+// layoutPDFLines breaks inline content into lines at most width wide.
+// Lines break at spaces; a word wider than a line is split.
+func layoutPDFLines(nodes []*PMNode, base pdfStyle, width float64) []pdfLine {
+	var lines []pdfLine
+	line := pdfLine{size: base.size}
+	finish := func(last bool) {
+		// Trailing spaces take no room
+		for n := len(line.runs); n > 0 && line.runs[n-1].space; n = len(line.runs) {
+			line.width -= line.runs[n-1].width()
+			line.spaces -= line.runs[n-1].spaces()
+			line.runs = line.runs[:n-1]
+		}
+		line.last = last
+		lines = append(lines, line)
+		line = pdfLine{size: base.size}
+	}
+	add := func(r pdfRun) {
+		line.runs = append(line.runs, r)
+		line.width += r.width()
+		line.spaces += r.spaces()
+		if r.style.size > line.size {
+			line.size = r.style.size
+		}
+	}
+
+	runs := pdfRuns(nodes, base)
+	for i := 0; i < len(runs); {
+		r := runs[i]
+		switch {
+		case r.brk:
+			finish(true)
+			i++
+			continue
+		case r.space:
+			if len(line.runs) > 0 {
+				add(r)
+			}
+			i++
+			continue
+		}
+		// A word is the runs up to the next space or break
+		j := i
+		wordWidth := 0.0
+		for j < len(runs) && !runs[j].space && !runs[j].brk {
+			wordWidth += runs[j].width()
+			j++
+		}
+		if len(line.runs) > 0 && line.width+wordWidth > width {
+			finish(false)
+		}
+		for _, part := range runs[i:j] {
+			for line.width+part.width() > width && len(part.text) > 1 {
+				// Split what does not fit, at least one character per line
+				n := 1
+				for n < len(part.text) && line.width+part.style.font.textWidth(part.text[:n+1], part.style.size) <= width {
+					n++
+				}
+				head := part
+				head.text = part.text[:n]
+				add(head)
+				finish(false)
+				part.text = part.text[n:]
+			}
+			add(part)
+		}
+		i = j
+	}
+	if len(line.runs) > 0 || len(lines) == 0 || lines[len(lines)-1].last {
+		finish(true)
+	}
+	return lines
+}
+
+// pdfRuns splits inline nodes into words, spaces and breaks with the style
+// of their marks
+func pdfRuns(nodes []*PMNode, base pdfStyle) []pdfRun {
+	var runs []pdfRun
+	for _, n := range nodes {
+		style := base
+		var text string
+		switch n.Type {
+		case "hardBreak":
+			runs = append(runs, pdfRun{brk: true, style: base})
+			continue
+		case "text":
+			text = n.Text
+			bold, italic := base.font.bold(), base.font.italic()
+			for _, m := range n.Marks {
+				switch m.Type {
+				case "bold":
+					bold = true
+				case "italic":
+					italic = true
+				case "code":
+					style.font = fontMono
+				case "underline":
+					style.underline = true
+				case "strike":
+					style.strike = true
+				case "link":
+					if href, ok := safeHref(fmt.Sprint(m.Attrs["href"])); ok && !strings.HasPrefix(href, "#") {
+						style.href = href
+						style.color = pdfBlue
+						style.underline = true
+					}
+				}
+			}
+			style.font = style.font.with(bold, italic)
+		case "image":
+			text = n.attrString("alt")
+		default:
+			text = n.textContent()
+		}
+		encoded := style.font.encode(text)
+		for start := 0; start < len(encoded); {
+			end := start + 1
+			space := encoded[start].r == ' '
+			for end < len(encoded) && (encoded[end].r == ' ') == space {
+				end++
+			}
+			runs = append(runs, pdfRun{text: encoded[start:end], style: style, space: space})
+			start = end
+		}
+	}
+	return runs
+}
+
+// encode writes the pages as a PDF file
+func (p *pdfRenderer) encode(doc Document) ([]byte, error) {
+	var objects [][]byte
+	add := func(format string, args ...interface{}) int {
+		objects = append(objects, []byte(fmt.Sprintf(format, args...)))
+		return len(objects)
+	}
+	reserve := func() int {
+		objects = append(objects, nil)
+		return len(objects)
+	}
+
+	catalog := reserve()
+	pages := reserve()
+	info := add("<< /Title %s /Author %s /Producer (WritePad) /CreationDate %s /ModDate %s >>",
+		pdfTextString(doc.Title), pdfTextString(doc.Owner), pdfDate(doc.CreatedAt), pdfDate(doc.UpdatedAt))
+	// Only the fonts the pages use are embedded, each with the glyphs drawn
+	var fonts strings.Builder
+	for f := fontSans; f <= fontMonoBoldItalic; f++ {
+		used, ok := p.used[f]
+		if !ok {
+			continue
+		}
+		refs := [4]int{reserve(), reserve(), reserve(), reserve()}
+		objs, err := f.objects(used, refs)
+		if err != nil {
+			return nil, err
+		}
+		for i, obj := range []string{objs.file, objs.descriptor, objs.cidFont, objs.toUnicode} {
+			objects[refs[i]-1] = []byte(obj)
+		}
+		fmt.Fprintf(&fonts, "/F%d %d 0 R ", f+1, add("%s", objs.font))
+	}
+
+	var kids []string
+	for _, page := range p.pages {
+		stream, err := pdfStream("", page.content.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		content := add("%s", stream)
+		var annots []string
+		for _, link := range page.links {
+			id := add("<< /Type /Annot /Subtype /Link /Rect [%s %s %s %s] /Border [0 0 0] /A << /S /URI /URI %s >> >>",
+				pdfNum(link.x1), pdfNum(link.y1), pdfNum(link.x2), pdfNum(link.y2), pdfString([]byte(link.href)))
+			annots = append(annots, fmt.Sprintf("%d 0 R", id))
+		}
+		annotRefs := ""
+		if len(annots) > 0 {
+			annotRefs = " /Annots [" + strings.Join(annots, " ") + "]"
+		}
+		id := add("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %s %s] /Resources << /Font << %s>> >> /Contents %d 0 R%s >>",
+			pages, pdfNum(p.paper.Width), pdfNum(p.paper.Height), fonts.String(), content, annotRefs)
+		kids = append(kids, fmt.Sprintf("%d 0 R", id))
+	}
+	objects[catalog-1] = []byte(fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages))
+	objects[pages-1] = []byte(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n", i+1)
+		out.Write(obj)
+		out.WriteString("\nendobj\n")
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, catalog, info, xref)
+	return out.Bytes(), nil
+}
+
+// pdfStream is a compressed stream of data, with extra entries for its
+// dictionary
+func pdfStream(extra string, data []byte) (string, error) {
+	var stream bytes.Buffer
+	zw := zlib.NewWriter(&stream)
+	if _, err := zw.Write(data); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if extra != "" {
+		extra = " " + extra
+	}
+	return fmt.Sprintf("<< /Length %d /Filter /FlateDecode%s >>\nstream\n%s\nendstream", stream.Len(), extra, stream.Bytes()), nil
+}
+
+// pdfNum formats a number with at most two decimals
+func pdfNum(v float64) string {
+	s := strings.TrimSuffix(strings.TrimRight(strconv.FormatFloat(v, 'f', 2, 64), "0"), ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+// pdfString is a literal string of encoded bytes
+func pdfString(b []byte) string {
+	var out strings.Builder
+	out.WriteByte('(')
+	for _, c := range b {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			out.WriteByte('\\')
+			out.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&out, "\\%03o", c)
+		default:
+			out.WriteByte(c)
+		}
+	}
+	out.WriteByte(')')
+	return out.String()
+}
+
+// pdfTextString encodes document metadata: ASCII as is, anything else as
+// UTF-16 with a byte order mark
+func pdfTextString(s string) string {
+	ascii := true
+	for _, r := range s {
+		if r >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return pdfString([]byte(s))
+	}
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, unit := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", unit)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// pdfDate formats a time as a PDF date
+func pdfDate(t time.Time) string {
+	return "(D:" + t.UTC().Format("20060102150405") + "Z)"
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf16"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/gomonobolditalic"
+	"golang.org/x/image/font/gofont/gomonoitalic"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// The PDF export embeds the Go fonts: Go for text and Go Mono for code, in
+// four faces each. Only the faces a document uses are written, each as a
+// CIDFontType2 font subset to the glyphs it shows (see subsetTrueType).
+// Text is shown by glyph ID through Identity-H, and a ToUnicode CMap maps
+// the glyphs back to text for copying and search. Documents with characters
+// the fonts lack are refused rather than printed with gaps.
+
+// pdfFont is one of the faces, numbered as its /F resource
+type pdfFont int
+
+const (
+	fontSans pdfFont = iota
+	fontSansBold
+	fontSansItalic
+	fontSansBoldItalic
+	fontMono
+	fontMonoBold
+	fontMonoItalic
+	fontMonoBoldItalic
+)
+
+// pdfFontData are the TrueType files of the faces, in pdfFont order
+var pdfFontData = [...][]byte{
+	goregular.TTF, gobold.TTF, goitalic.TTF, gobolditalic.TTF,
+	gomono.TTF, gomonobold.TTF, gomonoitalic.TTF, gomonobolditalic.TTF,
+}
+
+// with returns the font of the same family with bold and italic set
+func (f pdfFont) with(bold, italic bool) pdfFont {
+	base := fontSans
+	if f >= fontMono {
+		base = fontMono
+	}
+	if bold {
+		base++
+	}
+	if italic {
+		base += 2
+	}
+	return base
+}
+
+// bold and italic report the face within the family: regular, bold,
+// italic, bold italic
+func (f pdfFont) bold() bool   { return (f-fontSans)%4&1 != 0 }
+func (f pdfFont) italic() bool { return (f-fontSans)%4&2 != 0 }
+
+// pdfFace is a parsed face with the metrics the PDF needs, in 1/1000 em
+type pdfFace struct {
+	data []byte
+	name string // PostScript name
+	// widths are the advance widths by glyph ID
+	widths                     []int
+	bbox                       [4]int
+	ascent, descent, capHeight int
+	italicAngle                float64
+
+	mu     sync.Mutex
+	font   *sfnt.Font
+	buf    sfnt.Buffer
+	glyphs map[rune]sfnt.GlyphIndex
+}
+
+// pdfFaces parses the faces on first use. They are compiled in, so one that
+// does not parse is a bug.
+var pdfFaces = sync.OnceValue(func() []*pdfFace {
+	faces := make([]*pdfFace, len(pdfFontData))
+	for i, data := range pdfFontData {
+		face, err := parsePDFFace(data)
+		if err != nil {
+			panic(fmt.Sprintf("pdf: font %d: %v", i, err))
+		}
+		faces[i] = face
+	}
+	return faces
+})
+
+// parsePDFFace reads a TrueType face's name and metrics
+func parsePDFFace(data []byte) (*pdfFace, error) {
+	f, err := sfnt.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	face := &pdfFace{data: data, font: f, glyphs: make(map[rune]sfnt.GlyphIndex)}
+	b := &face.buf
+	if face.name, err = f.Name(b, sfnt.NameIDPostScript); err != nil {
+		return nil, err
+	}
+	// At one pixel per unit the metrics come in font units
+	upem := int(f.UnitsPerEm())
+	ppem := fixed.I(upem)
+	scale := func(v fixed.Int26_6) int { return int(math.Round(float64(v) / 64 * 1000 / float64(upem))) }
+
+	face.widths = make([]int, f.NumGlyphs())
+	for i := range face.widths {
+		adv, err := f.GlyphAdvance(b, sfnt.GlyphIndex(i), ppem, font.HintingNone)
+		if err != nil {
+			return nil, err
+		}
+		face.widths[i] = scale(adv)
+	}
+	m, err := f.Metrics(b, ppem, font.HintingNone)
+	if err != nil {
+		return nil, err
+	}
+	face.ascent, face.descent, face.capHeight = scale(m.Ascent), -scale(m.Descent), scale(m.CapHeight)
+	if m.CaretSlope.X != 0 && m.CaretSlope.Y != 0 {
+		face.italicAngle = -math.Atan2(float64(m.CaretSlope.X), float64(m.CaretSlope.Y)) * 180 / math.Pi
+	}
+	bounds, err := f.Bounds(b, ppem, font.HintingNone)
+	if err != nil {
+		return nil, err
+	}
+	// sfnt measures y down, PDF up
+	face.bbox = [4]int{scale(bounds.Min.X), -scale(bounds.Max.Y), scale(bounds.Max.X), -scale(bounds.Min.Y)}
+	return face, nil
+}
+
+// glyph returns the face's glyph for r, 0 (the missing glyph) if it has none
+func (face *pdfFace) glyph(r rune) sfnt.GlyphIndex {
+	face.mu.Lock()
+	defer face.mu.Unlock()
+	if g, ok := face.glyphs[r]; ok {
+		return g
+	}
+	g, err := face.font.GlyphIndex(&face.buf, r)
+	if err != nil {
+		g = 0
+	}
+	face.glyphs[r] = g
+	return g
+}
+
+func (f pdfFont) face() *pdfFace {
+	return pdfFaces()[f]
+}
+
+// pdfGlyph is a character as a glyph of a face
+type pdfGlyph struct {
+	id sfnt.GlyphIndex
+	r  rune
+}
+
+// encode maps text to the font's glyphs. Control characters become spaces;
+// characters the face lacks get glyph 0, and renderPDF refuses documents
+// that have any.
+func (f pdfFont) encode(s string) []pdfGlyph {
+	face := f.face()
+	out := make([]pdfGlyph, 0, len(s))
+	for _, r := range s {
+		if r < ' ' {
+			r = ' '
+		}
+		out = append(out, pdfGlyph{id: face.glyph(r), r: r})
+	}
+	return out
+}
+
+// textWidth is the width of encoded text in points
+func (f pdfFont) textWidth(text []pdfGlyph, size float64) float64 {
+	widths := f.face().widths
+	total := 0
+	for _, g := range text {
+		if int(g.id) < len(widths) {
+			total += widths[g.id]
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// pdfGlyphString is a hex string of glyph IDs, the codes of Identity-H
+func pdfGlyphString(text []pdfGlyph) string {
+	var b strings.Builder
+	b.WriteByte('<')
+	for _, g := range text {
+		fmt.Fprintf(&b, "%04X", uint16(g.id))
+	}
+	b.WriteByte('>')
+	return b.String()
+}
+
+// pdfFontObjects are the objects of an embedded font, in the order they
+// reference each other: the font file, its descriptor, the CID font, the
+// ToUnicode CMap and the Type 0 font the pages use
+type pdfFontObjects struct {
+	file, descriptor, cidFont, toUnicode, font string
+}
+
+// objects writes the face subset to the glyphs used, which map to the text
+// they show. refs are the object numbers the font file, descriptor, CID font
+// and ToUnicode CMap will get.
+func (f pdfFont) objects(used map[sfnt.GlyphIndex]rune, refs [4]int) (pdfFontObjects, error) {
+	face := f.face()
+	ids := make([]sfnt.GlyphIndex, 0, len(used))
+	for id := range used {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	subset, err := subsetTrueType(face.data, ids)
+	if err != nil {
+		return pdfFontObjects{}, err
+	}
+	file, err := pdfStream(fmt.Sprintf("/Length1 %d", len(subset)), subset)
+	if err != nil {
+		return pdfFontObjects{}, err
+	}
+
+	// Subsets are named with a tag of six capitals derived from their glyphs
+	h := fnv.New32a()
+	fmt.Fprint(h, face.name, ids)
+	sum := h.Sum32()
+	tag := make([]byte, 6)
+	for i := range tag {
+		tag[i] = 'A' + byte(sum%26)
+		sum /= 26
+	}
+	name := string(tag) + "+" + face.name
+
+	flags := 32 // Nonsymbolic
+	stemV := 80
+	if f >= fontMono {
+		flags |= 1 // FixedPitch
+	}
+	if f.italic() {
+		flags |= 64
+	}
+	if f.bold() {
+		stemV = 140
+	}
+	descriptor := fmt.Sprintf("<< /Type /FontDescriptor /FontName /%s /Flags %d /FontBBox [%d %d %d %d] /ItalicAngle %s /Ascent %d /Descent %d /CapHeight %d /StemV %d /FontFile2 %d 0 R >>",
+		name, flags, face.bbox[0], face.bbox[1], face.bbox[2], face.bbox[3], pdfNum(face.italicAngle),
+		face.ascent, face.descent, face.capHeight, stemV, refs[0])
+
+	// Widths in runs of consecutive glyphs: first [w1 w2 ...]
+	var w strings.Builder
+	for i := 0; i < len(ids); {
+		j := i + 1
+		for j < len(ids) && ids[j] == ids[j-1]+1 {
+			j++
+		}
+		fmt.Fprintf(&w, "%d [", ids[i])
+		for k, id := range ids[i:j] {
+			if k > 0 {
+				w.WriteByte(' ')
+			}
+			fmt.Fprint(&w, face.widths[id])
+		}
+		w.WriteString("] ")
+		i = j
+	}
+	cidFont := fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType2 /BaseFont /%s /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /FontDescriptor %d 0 R /W [%s] /CIDToGIDMap /Identity >>",
+		name, refs[1], strings.TrimSpace(w.String()))
+
+	toUnicode, err := pdfStream("", pdfToUnicode(ids, used))
+	if err != nil {
+		return pdfFontObjects{}, err
+	}
+	return pdfFontObjects{
+		file:       file,
+		descriptor: descriptor,
+		cidFont:    cidFont,
+		toUnicode:  toUnicode,
+		font: fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /Identity-H /DescendantFonts [%d 0 R] /ToUnicode %d 0 R >>",
+			name, refs[2], refs[3]),
+	}, nil
+}
+
+// pdfToUnicode is a CMap from the glyph IDs to the text they show
+func pdfToUnicode(ids []sfnt.GlyphIndex, used map[sfnt.GlyphIndex]rune) []byte {
+	var b bytes.Buffer
+	b.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n" +
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n" +
+		"/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n" +
+		"1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+	// At most 100 mappings per block
+	for start := 0; start < len(ids); start += 100 {
+		end := min(start+100, len(ids))
+		fmt.Fprintf(&b, "%d beginbfchar\n", end-start)
+		for _, id := range ids[start:end] {
+			fmt.Fprintf(&b, "<%04X> <", uint16(id))
+			for _, unit := range utf16.Encode([]rune{used[id]}) {
+				fmt.Fprintf(&b, "%04X", unit)
+			}
+			b.WriteString(">\n")
+		}
+		b.WriteString("endbfchar\n")
+	}
+	b.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+	return b.Bytes()
+}
+
+// subsetTrueType returns the font with only the outlines of the given
+// glyphs, the glyphs their composites are built from and the missing
+// glyph. Glyph IDs are kept, so Identity maps CIDs to the same glyphs; the
+// other glyphs are left empty. Only the tables a PDF reader needs for an
+// embedded TrueType font are written.
+func subsetTrueType(data []byte, ids []sfnt.GlyphIndex) ([]byte, error) {
+	tables, err := trueTypeTables(data)
+	if err != nil {
+		return nil, err
+	}
+	head, maxp, loca, glyf := tables["head"], tables["maxp"], tables["loca"], tables["glyf"]
+	if len(head) < 54 || len(maxp) < 6 || glyf == nil {
+		return nil, errors.New("truetype: missing tables")
+	}
+	numGlyphs := int(binary.BigEndian.Uint16(maxp[4:]))
+	long := binary.BigEndian.Uint16(head[50:]) != 0
+	offsets := make([]int, numGlyphs+1)
+	for i := range offsets {
+		if long && len(loca) >= 4*(i+1) {
+			offsets[i] = int(binary.BigEndian.Uint32(loca[4*i:]))
+		} else if !long && len(loca) >= 2*(i+1) {
+			offsets[i] = 2 * int(binary.BigEndian.Uint16(loca[2*i:]))
+		} else {
+			return nil, errors.New("truetype: short loca table")
+		}
+	}
+	outline := func(id int) []byte {
+		if id >= numGlyphs || offsets[id] >= offsets[id+1] || offsets[id+1] > len(glyf) {
+			return nil
+		}
+		return glyf[offsets[id]:offsets[id+1]]
+	}
+
+	keep := map[int]bool{0: true}
+	queue := []int{0}
+	for _, id := range ids {
+		queue = append(queue, int(id))
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		keep[id] = true
+		for _, c := range compositeComponents(outline(id)) {
+			if !keep[c] {
+				keep[c] = true
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	var newGlyf []byte
+	newLoca := make([]byte, 4*(numGlyphs+1))
+	for id := 0; id < numGlyphs; id++ {
+		binary.BigEndian.PutUint32(newLoca[4*id:], uint32(len(newGlyf)))
+		if keep[id] {
+			newGlyf = append(newGlyf, outline(id)...)
+			for len(newGlyf)%4 != 0 {
+				newGlyf = append(newGlyf, 0)
+			}
+		}
+	}
+	binary.BigEndian.PutUint32(newLoca[4*numGlyphs:], uint32(len(newGlyf)))
+
+	newHead := append([]byte{}, head...)
+	binary.BigEndian.PutUint32(newHead[8:], 0)  // checkSumAdjustment, set below
+	binary.BigEndian.PutUint16(newHead[50:], 1) // long loca offsets
+	out := map[string][]byte{"head": newHead, "maxp": maxp, "loca": newLoca, "glyf": newGlyf}
+	for _, tag := range []string{"hhea", "hmtx", "cvt ", "fpgm", "prep"} {
+		if t, ok := tables[tag]; ok {
+			out[tag] = t
+		}
+	}
+	file := writeTrueType(out)
+	// The whole font sums to 0xB1B0AFBA with the adjustment in place
+	written, err := trueTypeTables(file)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(written["head"][8:], 0xB1B0AFBA-trueTypeChecksum(file))
+	return file, nil
+}
+
+// trueTypeTables splits a TrueType file into its tables by tag
+func trueTypeTables(data []byte) (map[string][]byte, error) {
+	if len(data) < 12 {
+		return nil, errors.New("truetype: short file")
+	}
+	n := int(binary.BigEndian.Uint16(data[4:]))
+	if len(data) < 12+16*n {
+		return nil, errors.New("truetype: short table directory")
+	}
+	tables := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		rec := data[12+16*i:]
+		offset, length := int(binary.BigEndian.Uint32(rec[8:])), int(binary.BigEndian.Uint32(rec[12:]))
+		if offset+length > len(data) {
+			return nil, fmt.Errorf("truetype: table %q out of bounds", rec[:4])
+		}
+		tables[string(rec[:4])] = data[offset : offset+length]
+	}
+	return tables, nil
+}
+
+// compositeComponents lists the glyphs a composite glyph is built from; a
+// simple glyph has none
+func compositeComponents(outline []byte) []int {
+	if len(outline) < 10 || int16(binary.BigEndian.Uint16(outline)) >= 0 {
+		return nil
+	}
+	const (
+		argsAreWords  = 0x0001
+		haveScale     = 0x0008
+		moreComponent = 0x0020
+		haveXYScale   = 0x0040
+		haveTwoByTwo  = 0x0080
+	)
+	var ids []int
+	for p := 10; p+4 <= len(outline); {
+		flags := binary.BigEndian.Uint16(outline[p:])
+		ids = append(ids, int(binary.BigEndian.Uint16(outline[p+2:])))
+		p += 4
+		if flags&argsAreWords != 0 {
+			p += 4
+		} else {
+			p += 2
+		}
+		switch {
+		case flags&haveScale != 0:
+			p += 2
+		case flags&haveXYScale != 0:
+			p += 4
+		case flags&haveTwoByTwo != 0:
+			p += 8
+		}
+		if flags&moreComponent == 0 {
+			break
+		}
+	}
+	return ids
+}
+
+// writeTrueType assembles tables into a TrueType file
+func writeTrueType(tables map[string][]byte) []byte {
+	tags := make([]string, 0, len(tables))
+	for tag := range tables {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	n := len(tags)
+	entrySelector := 0
+	for 1<<(entrySelector+1) <= n {
+		entrySelector++
+	}
+	searchRange := 16 << entrySelector
+	out := make([]byte, 12+16*n)
+	binary.BigEndian.PutUint32(out, 0x00010000)
+	binary.BigEndian.PutUint16(out[4:], uint16(n))
+	binary.BigEndian.PutUint16(out[6:], uint16(searchRange))
+	binary.BigEndian.PutUint16(out[8:], uint16(entrySelector))
+	binary.BigEndian.PutUint16(out[10:], uint16(16*n-searchRange))
+	for i, tag := range tags {
+		t := tables[tag]
+		rec := out[12+16*i:]
+		copy(rec, tag)
+		binary.BigEndian.PutUint32(rec[4:], trueTypeChecksum(t))
+		binary.BigEndian.PutUint32(rec[8:], uint32(len(out)))
+		binary.BigEndian.PutUint32(rec[12:], uint32(len(t)))
+		out = append(out, t...)
+		for len(out)%4 != 0 {
+			out = append(out, 0)
+		}
+	}
+	return out
+}
+
+// trueTypeChecksum sums data as big-endian 32-bit words, zero padded
+func trueTypeChecksum(data []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(data); i += 4 {
+		var word [4]byte
+		copy(word[:], data[i:])
+		sum += binary.BigEndian.Uint32(word[:])
+	}
+	return sum
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Each room has a directory under persistence.dir holding:
+//
+//	state.bin       the document as of the last compaction, one record,
+//	                followed by a record of the Y.js client IDs' users
+//	wal.log         records of the updates applied since, appended in order
+//	snapshots/*.snap  the version history, one record per snapshot
+//	comments.json   the comment threads, rewritten on every change
+//
+// A record is a four-byte big-endian payload length, the payload's CRC-32
+// and the payload, whose first byte is its kind. A torn record at the end of
+// the log (a crash mid-write) is cut off on recovery.
+const (
+	recordUpdate   = 1 // time, origin, a Y.js update and the users of its new client IDs
+	recordState    = 2 // a whole document as a Y.js update
+	recordSnapshot = 3 // snapshot metadata as JSON and the document
+	recordAuthors  = 4 // the user of each Y.js client ID in the document
+)
+
+const (
+	stateFile    = "state.bin"
+	walFile      = "wal.log"
+	snapshotsDir = "snapshots"
+	commentsFile = "comments.json"
+	// recordHeader is the length and checksum in front of each payload
+	recordHeader = 8
+	// maxRecord guards against reading a garbage length
+	maxRecord = 1 << 30
+)
+
+// errCorruptRecord is returned for a record whose checksum does not match
+var errCorruptRecord = errors.New("corrupt record")
+
+// Store keeps room documents on disk
+type Store struct {
+	dir string
+	cfg PersistenceConfig
+
+	appends     atomic.Int64
+	compactions atomic.Int64
+	failures    atomic.Int64
+	// lastErr is the most recent write failure, cleared by a later success
+	mu      sync.Mutex
+	lastErr error
+}
+
+// OpenStore creates the data directory if needed
+func OpenStore(cfg PersistenceConfig) (*Store, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create persistence directory: %w", err)
+	}
+	return &Store{dir: cfg.Dir, cfg: cfg}, nil
+}
+
+// roomDir is the directory of a room; IDs are encoded so any ID is a safe
+// file name
+func (s *Store) roomDir(roomID string) string {
+	return filepath.Join(s.dir, base64.RawURLEncoding.EncodeToString([]byte(roomID)))
+}
+
+// Exists reports whether a room has anything on disk
+func (s *Store) Exists(roomID string) bool {
+	_, err := os.Stat(s.roomDir(roomID))
+	return err == nil
+}
+
+// Remove deletes everything stored for a room
+func (s *Store) Remove(roomID string) error {
+	return s.record(os.RemoveAll(s.roomDir(roomID)))
+}
+
+// Rooms lists the IDs of the rooms on disk, sorted
+func (s *Store) Rooms() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if id, err := base64.RawURLEncoding.DecodeString(e.Name()); err == nil && e.IsDir() {
+			ids = append(ids, string(id))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// record notes the outcome of a write for the readiness check
+func (s *Store) record(err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.failures.Add(1)
+		log.Printf("[ERROR] Persistence: %v", err)
+	}
+	s.lastErr = err
+	return err
+}
+
+// Check is the "persistence" readiness check: the directory must be
+// writable and the last write must have succeeded
+func (s *Store) Check(context.Context) error {
+	s.mu.Lock()
+	lastErr := s.lastErr
+	s.mu.Unlock()
+	if lastErr != nil {
+		return fmt.Errorf("last write failed: %v", lastErr)
+	}
+	f, err := os.CreateTemp(s.dir, ".probe-*")
+	if err != nil {
+		return fmt.Errorf("data directory is not writable: %v", err)
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// LogEntry is an update as it was applied: when, from whom (the client or
+// the API caller) and the update itself
+type LogEntry struct {
+	Time   time.Time
+	Origin string
+	Update []byte
+	// Authors maps the Y.js client IDs first seen in this update to the
+	// user who sent them
+	Authors map[uint64]string
+}
+
+// RecoveredRoom is what a room directory held
+type RecoveredRoom struct {
+	// State is the compacted document (nil if never compacted) and Entries
+	// the updates logged after it
+	State   []byte
+	Entries []LogEntry
+	// Authors are the client IDs' users as of the compaction
+	Authors   map[uint64]string
+	Snapshots []*Snapshot
+	Comments  []*CommentThread
+}
+
+// RoomLog appends a room's updates to its write-ahead log and compacts it.
+// It is not safe for concurrent use; DocState serializes access.
+type RoomLog struct {
+	store *Store
+	dir   string
+	wal   *os.File
+	// entries and size describe the log since the last compaction
+	entries int
+	size    int64
+}
+
+// Open recovers a room from disk and opens its log for appending. A room
+// that does not exist yet starts empty.
+func (s *Store) Open(roomID string) (*RoomLog, *RecoveredRoom, error) {
+	if roomID == "" || len(roomID) > maxRoomIDLength {
+		return nil, nil, fmt.Errorf("room ID must be 1 to %d bytes", maxRoomIDLength)
+	}
+	dir := s.roomDir(roomID)
+	if err := os.MkdirAll(filepath.Join(dir, snapshotsDir), 0o755); err != nil {
+		return nil, nil, err
+	}
+	rec := &RecoveredRoom{}
+
+	if data, err := os.ReadFile(filepath.Join(dir, stateFile)); err == nil {
+		payload, n, err := readRecord(data)
+		if err != nil || len(payload) == 0 || payload[0] != recordState {
+			return nil, nil, fmt.Errorf("room %s: unreadable %s: %v", roomID, stateFile, err)
+		}
+		rec.State = payload[1:]
+		// Rooms compacted before authors were kept have no second record
+		if n < len(data) {
+			payload, _, err := readRecord(data[n:])
+			if err == nil {
+				rec.Authors, err = decodeAuthors(payload)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("room %s: unreadable authors in %s: %v", roomID, stateFile, err)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := io.ReadAll(wal)
+	if err != nil {
+		_ = wal.Close()
+		return nil, nil, err
+	}
+	good := 0
+	for good < len(data) {
+		payload, n, err := readRecord(data[good:])
+		if err == nil {
+			var entry LogEntry
+			if entry, err = decodeLogEntry(payload); err == nil {
+				rec.Entries = append(rec.Entries, entry)
+				good += n
+				continue
+			}
+		}
+		// Everything after a bad record was written after it, so the tail
+		// is dropped
+		log.Printf("[WARN] Room %s: dropping %d bytes after offset %d of %s: %v", roomID, len(data)-good, good, walFile, err)
+		break
+	}
+	if good < len(data) {
+		if err := wal.Truncate(int64(good)); err != nil {
+			_ = wal.Close()
+			return nil, nil, err
+		}
+	}
+	if _, err := wal.Seek(int64(good), io.SeekStart); err != nil {
+		_ = wal.Close()
+		return nil, nil, err
+	}
+
+	if rec.Snapshots, err = readSnapshots(filepath.Join(dir, snapshotsDir)); err != nil {
+		_ = wal.Close()
+		return nil, nil, err
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, commentsFile)); err == nil {
+		if err := json.Unmarshal(data, &rec.Comments); err != nil {
+			_ = wal.Close()
+			return nil, nil, fmt.Errorf("room %s: %s: %w", roomID, commentsFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		_ = wal.Close()
+		return nil, nil, err
+	}
+	l := &RoomLog{store: s, dir: dir, wal: wal, entries: len(rec.Entries), size: int64(good)}
+	return l, rec, nil
+}
+
+// Append writes an entry to the log
+func (l *RoomLog) Append(entry LogEntry) error {
+	var e yEncoder
+	e.writeUint8(recordUpdate)
+	e.writeVarUint(uint64(entry.Time.UnixNano()))
+	e.writeVarString(entry.Origin)
+	e.writeVarBytes(entry.Update)
+	writeAuthors(&e, entry.Authors)
+	rec := encodeRecord(e.bytes())
+
+	if _, err := l.wal.Write(rec); err != nil {
+		// Cut a partial record so later appends stay readable
+		_ = l.wal.Truncate(l.size)
+		_, _ = l.wal.Seek(l.size, io.SeekStart)
+		return l.store.record(fmt.Errorf("append to %s: %w", l.wal.Name(), err))
+	}
+	if l.store.cfg.Fsync {
+		if err := l.wal.Sync(); err != nil {
+			return l.store.record(fmt.Errorf("sync %s: %w", l.wal.Name(), err))
+		}
+	}
+	l.entries++
+	l.size += int64(len(rec))
+	l.store.appends.Add(1)
+	return l.store.record(nil)
+}
+
+// NeedsCompaction reports whether the log has grown past
+// persistence.compactUpdates or persistence.compactBytes
+func (l *RoomLog) NeedsCompaction() bool {
+	return l.entries >= l.store.cfg.CompactUpdates || l.size >= int64(l.store.cfg.CompactBytes)
+}
+
+// Compact replaces the saved state with state, the whole document, and the
+// users of its client IDs, and empties the log. The new state is in place
+// before the log is cut, so a crash in between only replays updates the
+// state already contains, which Y.js ignores.
+func (l *RoomLog) Compact(state []byte, authors map[uint64]string) error {
+	if l.entries == 0 {
+		return nil
+	}
+	data := encodeRecord(append([]byte{recordState}, state...))
+	var e yEncoder
+	e.writeUint8(recordAuthors)
+	writeAuthors(&e, authors)
+	data = append(data, encodeRecord(e.bytes())...)
+	if err := writeFileAtomic(filepath.Join(l.dir, stateFile), data); err != nil {
+		return l.store.record(fmt.Errorf("compact %s: %w", l.dir, err))
+	}
+	if err := l.wal.Truncate(0); err != nil {
+		return l.store.record(fmt.Errorf("truncate %s: %w", l.wal.Name(), err))
+	}
+	if _, err := l.wal.Seek(0, io.SeekStart); err != nil {
+		return l.store.record(err)
+	}
+	l.entries, l.size = 0, 0
+	l.store.compactions.Add(1)
+	return l.store.record(nil)
+}
+
+// SaveSnapshot writes a version history snapshot
+func (l *RoomLog) SaveSnapshot(snap *Snapshot) error {
+	meta, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	var e yEncoder
+	e.writeUint8(recordSnapshot)
+	e.writeVarBytes(meta)
+	e.writeVarBytes(snap.state)
+	path := filepath.Join(l.dir, snapshotsDir, snap.ID+".snap")
+	return l.store.record(writeFileAtomic(path, encodeRecord(e.bytes())))
+}
+
+// DeleteSnapshot removes a pruned snapshot
+func (l *RoomLog) DeleteSnapshot(id string) error {
+	err := os.Remove(filepath.Join(l.dir, snapshotsDir, id+".snap"))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return l.store.record(err)
+}
+
+// SaveComments writes the room's comment threads
+func (l *RoomLog) SaveComments(threads []*CommentThread) error {
+	data, err := json.Marshal(threads)
+	if err != nil {
+		return err
+	}
+	return l.store.record(writeFileAtomic(filepath.Join(l.dir, commentsFile), data))
+}
+
+// Close closes the log file
+func (l *RoomLog) Close() error {
+	return l.wal.Close()
+}
+
+// readSnapshots loads the snapshots in dir, oldest first
+func readSnapshots(dir string) ([]*Snapshot, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.snap"))
+	if err != nil {
+		return nil, err
+	}
+	var snaps []*Snapshot
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		snap, err := decodeSnapshotRecord(data)
+		if err != nil {
+			// One damaged snapshot should not keep the room closed
+			log.Printf("[WARN] Skipping snapshot %s: %v", file, err)
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].CreatedAt.Before(snaps[j].CreatedAt) })
+	return snaps, nil
+}
+
+func decodeSnapshotRecord(data []byte) (*Snapshot, error) {
+	payload, _, err := readRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) == 0 || payload[0] != recordSnapshot {
+		return nil, errCorruptRecord
+	}
+	d := newYDecoder(payload[1:])
+	meta, err := d.readVarBytes()
+	if err != nil {
+		return nil, err
+	}
+	state, err := d.readVarBytes()
+	if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{}
+	if err := json.Unmarshal(meta, snap); err != nil {
+		return nil, err
+	}
+	snap.state = append([]byte(nil), state...)
+	return snap, nil
+}
+
+func decodeLogEntry(payload []byte) (LogEntry, error) {
+	if len(payload) == 0 || payload[0] != recordUpdate {
+		return LogEntry{}, errCorruptRecord
+	}
+	d := newYDecoder(payload[1:])
+	nanos, err := d.readVarUint()
+	if err != nil {
+		return LogEntry{}, err
+	}
+	origin, err := d.readVarString()
+	if err != nil {
+		return LogEntry{}, err
+	}
+	update, err := d.readVarBytes()
+	if err != nil {
+		return LogEntry{}, err
+	}
+	entry := LogEntry{Time: time.Unix(0, int64(nanos)).UTC(), Origin: origin, Update: update}
+	// Entries logged before authors were kept end here
+	if d.more() {
+		if entry.Authors, err = readAuthors(d); err != nil {
+			return LogEntry{}, err
+		}
+	}
+	return entry, nil
+}
+
+// writeAuthors writes client IDs and their users, in client order
+func writeAuthors(e *yEncoder, authors map[uint64]string) {
+	clients := make([]uint64, 0, len(authors))
+	for client := range authors {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] < clients[j] })
+	e.writeLen(len(clients))
+	for _, client := range clients {
+		e.writeVarUint(client)
+		e.writeVarString(authors[client])
+	}
+}
+
+// readAuthors reads what writeAuthors wrote
+func readAuthors(d *yDecoder) (map[uint64]string, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	authors := make(map[uint64]string, n)
+	for i := 0; i < n; i++ {
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		if authors[client], err = d.readVarString(); err != nil {
+			return nil, err
+		}
+	}
+	return authors, nil
+}
+
+// decodeAuthors reads an authors record
+func decodeAuthors(payload []byte) (map[uint64]string, error) {
+	if len(payload) == 0 || payload[0] != recordAuthors {
+		return nil, errCorruptRecord
+	}
+	return readAuthors(newYDecoder(payload[1:]))
+}
+
+// encodeRecord frames a payload with its length and checksum
+func encodeRecord(payload []byte) []byte {
+	rec := make([]byte, recordHeader, recordHeader+len(payload))
+	binary.BigEndian.PutUint32(rec, uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(payload))
+	return append(rec, payload...)
+}
+
+// readRecord returns the first record's payload and the bytes it took
+func readRecord(data []byte) ([]byte, int, error) {
+	if len(data) < recordHeader {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	n := int(binary.BigEndian.Uint32(data))
+	if n > maxRecord || len(data)-recordHeader < n {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	payload := data[recordHeader : recordHeader+n]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4:]) {
+		return nil, 0, errCorruptRecord
+	}
+	return payload, recordHeader + n, nil
+}
+
+// writeFileAtomic replaces path with data so that a crash leaves either the
+// old or the new file
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// Make the rename itself durable
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
+
+// loadDocState recovers a room's document from the store: the compacted
+// state, then the log tail in order
+func loadDocState(roomID string, maxSnapshots int, store *Store) (*DocState, error) {
+	s := newDocState(roomID, maxSnapshots)
+	if store == nil {
+		return s, nil
+	}
+	start := time.Now()
+	roomLog, rec, err := store.Open(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if rec.State != nil {
+		if err := s.doc.Apply(rec.State); err != nil {
+			_ = roomLog.Close()
+			return nil, fmt.Errorf("room %s: %s: %w", roomID, stateFile, err)
+		}
+	}
+	for client, user := range rec.Authors {
+		s.authors[client] = user
+	}
+	for i, entry := range rec.Entries {
+		if err := s.doc.Apply(entry.Update); err != nil {
+			log.Printf("[WARN] Room %s: skipping logged update %d: %v", roomID, i, err)
+		}
+		for client, user := range entry.Authors {
+			s.authors[client] = user
+		}
+	}
+	s.version = uint64(len(rec.Entries))
+	s.snapshots = rec.Snapshots
+	s.threads = rec.Comments
+	s.log = roomLog
+	if len(rec.State) > 0 || len(rec.Entries) > 0 {
+		log.Printf("[INFO] Recovered room %s: %d byte state, %d logged updates, %d snapshots in %s",
+			roomID, len(rec.State), len(rec.Entries), len(rec.Snapshots), time.Since(start).Round(time.Millisecond))
+	}
+	if roomLog.NeedsCompaction() {
+		s.compact()
+	}
+	return s, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStore opens a store in a temporary directory
+func testStore(t testing.TB, compactUpdates int) *Store {
+	t.Helper()
+	cfg := DefaultConfig().Persistence
+	cfg.Dir = t.TempDir()
+	cfg.CompactUpdates = compactUpdates
+	store, err := OpenStore(cfg)
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	return store
+}
+
+func TestStoreRecovery(t *testing.T) {
+	store := testStore(t, 5)
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	hub.UseStore(store)
+	client := joinTestClient(t, hub, "notes/1", "WebSocket")
+
+	editor := NewYDoc()
+	for _, word := range []string{"one", " two", " three", " four", " five", " six", " seven"} {
+		if err := client.Room.ApplyUpdate(insertText(editor, "t", word), client); err != nil {
+			t.Fatalf("ApplyUpdate: %v", err)
+		}
+	}
+	snap := client.Room.State.TakeSnapshot("ada", "Seven", false)
+	if store.compactions.Load() != 1 {
+		t.Errorf("compactions = %d, want 1 after 7 updates", store.compactions.Load())
+	}
+
+	// A new process recovers the compacted state, the log tail and the
+	// snapshots without the old one closing anything
+	restarted := NewCollaborationHub(DefaultConfig().Collab, nil)
+	restarted.UseStore(store)
+	state, ok := restarted.LookupState("notes/1")
+	if !ok {
+		t.Fatalf("room not found after restart")
+	}
+	if got := state.Current().mustContent(t).Text["t"]; got != "one two three four five six seven" {
+		t.Errorf("recovered text = %q", got)
+	}
+	if list := state.Snapshots(); len(list) != 1 || list[0].ID != snap.ID || list[0].Label != "Seven" {
+		t.Errorf("recovered snapshots = %+v", list)
+	}
+	if rooms, _ := store.Rooms(); len(rooms) != 1 || rooms[0] != "notes/1" {
+		t.Errorf("rooms on disk = %v", rooms)
+	}
+	if _, ok := restarted.LookupState("never-opened"); ok {
+		t.Errorf("found a room that was never opened")
+	}
+
+	// Edits after recovery continue from the recovered state
+	if err := state.Apply(insertText(editor, "t", " eight"), "ada", Author{}); err != nil {
+		t.Fatalf("Apply after recovery: %v", err)
+	}
+	restarted.CloseStates()
+	again := NewCollaborationHub(DefaultConfig().Collab, nil)
+	again.UseStore(store)
+	state, _ = again.LookupState("notes/1")
+	if got := state.Current().mustContent(t).Text["t"]; got != "one two three four five six seven eight" {
+		t.Errorf("text after second restart = %q", got)
+	}
+}
+
+func (snap *Snapshot) mustContent(t *testing.T) *SnapshotContent {
+	t.Helper()
+	c, err := snap.Content()
+	if err != nil {
+		t.Fatalf("Content: %v", err)
+	}
+	return c
+}
+
+func TestStoreTornLog(t *testing.T) {
+	store := testStore(t, 1000)
+	roomLog, _, err := store.Open("doc")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	editor := NewYDoc()
+	for _, word := range []string{"a", "b", "c"} {
+		entry := LogEntry{Time: time.Now(), Origin: "client-1", Update: insertText(editor, "t", word)}
+		if err := roomLog.Append(entry); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	_ = roomLog.Close()
+
+	// A crash in the middle of the fourth append
+	wal := filepath.Join(store.roomDir("doc"), walFile)
+	f, err := os.OpenFile(wal, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write(encodeRecord([]byte{recordUpdate, 1, 2, 3})[:6])
+	_ = f.Close()
+
+	roomLog, rec, err := store.Open("doc")
+	if err != nil {
+		t.Fatalf("Open after crash: %v", err)
+	}
+	defer func() { _ = roomLog.Close() }()
+	if len(rec.Entries) != 3 || rec.Entries[2].Origin != "client-1" {
+		t.Fatalf("recovered %d entries: %+v", len(rec.Entries), rec.Entries)
+	}
+	// The torn record is gone, so new appends are readable
+	if err := roomLog.Append(LogEntry{Time: time.Now(), Update: insertText(editor, "t", "d")}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	_, rec, err = store.Open("doc")
+	if err != nil || len(rec.Entries) != 4 {
+		t.Errorf("after append: %d entries, %v", len(rec.Entries), err)
+	}
+	if err := store.Check(context.Background()); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+}
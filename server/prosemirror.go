@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// The editor (TipTap) binds its ProseMirror document to a Y.js XML fragment
+// through y-prosemirror: every node is an XmlElement named after the node
+// type, with the node's attributes as XML attributes, and text lives in
+// XmlText whose formatting attributes are the marks, each holding the mark's
+// attributes. Marks that may overlap themselves get a "--<hash>" suffix.
+
+// defaultFragment is the fragment TipTap's Collaboration extension uses
+// unless configured with another field
+const defaultFragment = "default"
+
+// PMNode is a ProseMirror node, encoded like ProseMirror's Node.toJSON so
+// an export can be loaded into the editor with setContent
+type PMNode struct {
+	Type    string                 `json:"type"`
+	Attrs   map[string]interface{} `json:"attrs,omitempty"`
+	Content []*PMNode              `json:"content,omitempty"`
+	Text    string                 `json:"text,omitempty"`
+	Marks   []PMMark               `json:"marks,omitempty"`
+}
+
+// PMMark is an inline mark such as bold or link
+type PMMark struct {
+	Type  string                 `json:"type"`
+	Attrs map[string]interface{} `json:"attrs,omitempty"`
+}
+
+// ProseMirror decodes the editor's document from the XML fragment named
+// field. With field empty it uses "default", or the first XML fragment with
+// content if the editor was configured with another field.
+func (d *YDoc) ProseMirror(field string) *PMNode {
+	doc := &PMNode{Type: "doc"}
+	if field == "" {
+		field = defaultFragment
+		if t, ok := d.roots[field]; !ok || t.start == nil {
+			for _, name := range d.RootNames() {
+				if d.roots[name].effectiveKind() == yXmlFragmentRef {
+					field = name
+					break
+				}
+			}
+		}
+	}
+	if t, ok := d.roots[field]; ok {
+		doc.Content = t.pmNodes()
+	}
+	return doc
+}
+
+// pmNodes converts the children of an XML type to nodes
+func (t *yType) pmNodes() []*PMNode {
+	var nodes []*PMNode
+	for _, it := range t.visible() {
+		ct, ok := it.content.(*contentType)
+		if !ok {
+			continue
+		}
+		switch child := ct.t; child.kind {
+		case yXmlElementRef:
+			node := &PMNode{Type: child.nodeName, Content: child.pmNodes()}
+			for key, v := range child.attributes() {
+				if v == nil || v == yUndefined {
+					continue
+				}
+				if node.Attrs == nil {
+					node.Attrs = make(map[string]interface{})
+				}
+				node.Attrs[key] = v
+			}
+			nodes = append(nodes, node)
+		case yXmlTextRef:
+			for _, run := range child.delta() {
+				if run.Insert != "" {
+					nodes = append(nodes, &PMNode{Type: "text", Text: run.Insert, Marks: pmMarks(run.Attributes)})
+				}
+			}
+		}
+	}
+	return nodes
+}
+
+// pmMarks turns XmlText formatting attributes into marks, in a stable order
+func pmMarks(attrs map[string]interface{}) []PMMark {
+	var marks []PMMark
+	for _, key := range sortedKeys(attrs) {
+		mark := PMMark{Type: key}
+		if i := strings.Index(key, "--"); i > 0 {
+			mark.Type = key[:i]
+		}
+		if a, ok := attrs[key].(map[string]interface{}); ok && len(a) > 0 {
+			mark.Attrs = a
+		}
+		marks = append(marks, mark)
+	}
+	return marks
+}
+
+// attrString returns a string attribute, or "" if it is missing
+func (n *PMNode) attrString(key string) string {
+	switch v := n.Attrs[key].(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return jsString(v)
+	}
+}
+
+// attrInt returns a numeric attribute, or def if it is missing or not a
+// number. Y.js decodes numbers as int64 or float64 depending on how the
+// client encoded them.
+func (n *PMNode) attrInt(key string, def int) int {
+	switch v := n.Attrs[key].(type) {
+	case int64:
+		return int(v)
+	case int:
+		return v
+	case float64:
+		return int(v)
+	case string:
+		if i, err := strconv.Atoi(v); err == nil {
+			return i
+		}
+	}
+	return def
+}
+
+// mark returns the node's mark of the given type
+func (n *PMNode) mark(typ string) (PMMark, bool) {
+	for _, m := range n.Marks {
+		if m.Type == typ {
+			return m, true
+		}
+	}
+	return PMMark{}, false
+}
+
+// textContent is the text of a node and its descendants; hard breaks become
+// newlines
+func (n *PMNode) textContent() string {
+	var b strings.Builder
+	n.writeText(&b)
+	return b.String()
+}
+
+func (n *PMNode) writeText(b *strings.Builder) {
+	switch n.Type {
+	case "text":
+		b.WriteString(n.Text)
+	case "hardBreak":
+		b.WriteString("\n")
+	default:
+		for _, child := range n.Content {
+			child.writeText(b)
+		}
+	}
+}
+
+// isInline reports whether a node is inline content of a text block
+func (n *PMNode) isInline() bool {
+	switch n.Type {
+	case "text", "hardBreak", "image", "mention":
+		return true
+	}
+	return false
+}
+
+// insertProseMirror appends nodes to an empty XML type the way y-prosemirror
+// writes them: elements with their non-null attributes, and each run of text
+// nodes as one XmlText with the marks as formatting
+func (tx *yTransaction) insertProseMirror(parent *yType, nodes []*PMNode) {
+	var text *yType
+	var left, last *yItem
+	for _, n := range nodes {
+		if n.Type != "text" {
+			el := &yType{kind: yXmlElementRef, nodeName: n.Type}
+			left = tx.insert(parent, left, &contentType{t: el})
+			text = nil
+			for _, key := range sortedKeys(n.Attrs) {
+				if v := n.Attrs[key]; v != nil {
+					tx.set(el, key, &contentAny{values: []interface{}{v}})
+				}
+			}
+			tx.insertProseMirror(el, n.Content)
+			continue
+		}
+		if text == nil {
+			text = &yType{kind: yXmlTextRef}
+			left = tx.insert(parent, left, &contentType{t: text})
+			last = nil
+		}
+		// Y.Text.insert with attributes: formats around the string
+		for _, m := range n.Marks {
+			attrs := []byte("{}")
+			if len(m.Attrs) > 0 {
+				attrs, _ = json.Marshal(m.Attrs)
+			}
+			last = tx.insert(text, last, &contentFormat{key: m.Type, value: string(attrs)})
+		}
+		last = tx.insert(text, last, newContentString(n.Text))
+		for _, m := range n.Marks {
+			last = tx.insert(text, last, &contentFormat{key: m.Type, value: "null"})
+		}
+	}
+}
+
+// NewYDocFromProseMirror returns a document holding doc in the "default"
+// fragment, written by a client of its own
+func NewYDocFromProseMirror(doc *PMNode) *YDoc {
+	d := NewYDoc()
+	d.Transact(func(tx *yTransaction) {
+		tx.insertProseMirror(d.root(defaultFragment), doc.Content)
+	})
+	return d
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Reasons a client is disconnected by the inbound limits, used as metric
+// labels
+const (
+	violationMessageTooLarge = "message_too_large"
+	violationRateLimited     = "rate_limited"
+)
+
+// tokenBucket refills at rate tokens per second up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int, now time.Time) tokenBucket {
+	return tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// take removes n tokens if they are available. A bucket with a zero rate is
+// unlimited.
+func (b *tokenBucket) take(n float64, now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// inboundLimiter enforces collab.maxMessageSize and the per-client message
+// and byte rates. It is shared by every stream of a WebTransport session,
+// so it is safe for concurrent use.
+type inboundLimiter struct {
+	maxMessageSize int
+
+	mu       sync.Mutex
+	messages tokenBucket
+	bytes    tokenBucket
+}
+
+func newInboundLimiter(cfg CollabConfig) *inboundLimiter {
+	now := time.Now()
+	return &inboundLimiter{
+		maxMessageSize: cfg.MaxMessageSize,
+		messages:       newTokenBucket(cfg.MessagesPerSecond, cfg.MessageBurst, now),
+		bytes:          newTokenBucket(cfg.BytesPerSecond, cfg.ByteBurst, now),
+	}
+}
+
+// tooLarge reports whether a message of size bytes exceeds the size limit.
+// Transports check it before reading the payload.
+func (l *inboundLimiter) tooLarge(size int) bool {
+	return l.maxMessageSize > 0 && size > l.maxMessageSize
+}
+
+// allow charges one message of size bytes against the rate limits and
+// returns the violation, if any
+func (l *inboundLimiter) allow(size int) string {
+	if l.tooLarge(size) {
+		return violationMessageTooLarge
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if !l.messages.take(1, now) {
+		return violationRateLimited
+	}
+	if !l.bytes.take(float64(size), now) {
+		// Refund the message token; the refused message costs nothing
+		l.messages.tokens++
+		return violationRateLimited
+	}
+	return ""
+}
+
+// Admit checks an inbound message of size bytes against the limits. A client
+// that exceeds them is closed with ClosePolicyViolation and Admit returns
+// false; the caller must stop reading from it.
+func (c *Client) Admit(size int) bool {
+	violation := c.limiter.allow(size)
+	if violation == "" {
+		c.bytesIn.Add(int64(size))
+		return true
+	}
+	c.violate(violation, size)
+	return false
+}
+
+// AdmitSize checks a message length announced before its payload is read,
+// so oversized payloads are never allocated
+func (c *Client) AdmitSize(size int) bool {
+	if !c.limiter.tooLarge(size) {
+		return true
+	}
+	c.violate(violationMessageTooLarge, size)
+	return false
+}
+
+// violate disconnects the client for breaking an inbound limit
+func (c *Client) violate(violation string, size int) {
+	c.Room.Hub.violations[violation].Add(1)
+
+	reason := "Rate limit exceeded"
+	if violation == violationMessageTooLarge {
+		reason = fmt.Sprintf("Message larger than %d bytes", c.limiter.maxMessageSize)
+	}
+	log.Printf("[WARN] Disconnecting client %s in room %s (%s): %s, message of %d bytes",
+		c.ID, c.Room.ID, c.Protocol, violation, size)
+	c.Close(ClosePolicyViolation, reason)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws/wsutil"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 5, now)
+
+	for i := 0; i < 5; i++ {
+		if !b.take(1, now) {
+			t.Fatalf("take %d of the burst failed", i)
+		}
+	}
+	if b.take(1, now) {
+		t.Errorf("take past the burst succeeded")
+	}
+	// 10 tokens per second refill one token every 100ms
+	if !b.take(1, now.Add(100*time.Millisecond)) {
+		t.Errorf("take after refill failed")
+	}
+	if b.take(1, now.Add(100*time.Millisecond)) {
+		t.Errorf("refill added more than one token")
+	}
+	// Refill never exceeds the burst
+	if !b.take(5, now.Add(time.Hour)) || b.take(1, now.Add(time.Hour)) {
+		t.Errorf("refill exceeded the burst")
+	}
+
+	unlimited := newTokenBucket(0, 0, now)
+	if !unlimited.take(1e9, now) {
+		t.Errorf("unlimited bucket refused")
+	}
+}
+
+func TestInboundLimiter(t *testing.T) {
+	cfg := DefaultConfig().Collab
+	cfg.MaxMessageSize = 100
+	cfg.MessagesPerSecond, cfg.MessageBurst = 1, 3
+	cfg.BytesPerSecond, cfg.ByteBurst = 1, 150
+	l := newInboundLimiter(cfg)
+
+	if v := l.allow(101); v != violationMessageTooLarge {
+		t.Errorf("oversized message: %q, want %q", v, violationMessageTooLarge)
+	}
+	if v := l.allow(100); v != "" {
+		t.Errorf("first message: %q", v)
+	}
+	// 50 bytes left in the byte bucket
+	if v := l.allow(60); v != violationRateLimited {
+		t.Errorf("over the byte burst: %q, want %q", v, violationRateLimited)
+	}
+	// The refused message did not use up a message token
+	if v := l.allow(10); v != "" {
+		t.Errorf("second message: %q", v)
+	}
+	if v := l.allow(10); v != "" {
+		t.Errorf("third message: %q", v)
+	}
+	if v := l.allow(1); v != violationRateLimited {
+		t.Errorf("over the message burst: %q, want %q", v, violationRateLimited)
+	}
+}
+
+func TestWebSocketPolicyViolation(t *testing.T) {
+	cfg := DefaultConfig().Collab
+	cfg.MaxMessageSize = 64
+	hub := NewCollaborationHub(cfg, &OriginPolicy{allowAll: true})
+
+	conn := dialTestWebSocket(t, hub, "doc")
+	if err := wsutil.WriteClientBinary(conn, make([]byte, 65)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if code := conn.readCloseCode(); code != ClosePolicyViolation {
+		t.Errorf("close code = %d, want %d", code, ClosePolicyViolation)
+	}
+	if v := hub.violations[violationMessageTooLarge].Load(); v != 1 {
+		t.Errorf("violations = %d, want 1", v)
+	}
+}
+
+func TestWebSocketRateLimit(t *testing.T) {
+	cfg := DefaultConfig().Collab
+	cfg.MessagesPerSecond, cfg.MessageBurst = 1, 5
+	hub := NewCollaborationHub(cfg, &OriginPolicy{allowAll: true})
+
+	conn := dialTestWebSocket(t, hub, "doc")
+	for i := 0; i < 10; i++ {
+		if err := wsutil.WriteClientBinary(conn, []byte("update")); err != nil {
+			break // The server may already have closed the connection
+		}
+	}
+	if code := conn.readCloseCode(); code != ClosePolicyViolation {
+		t.Errorf("close code = %d, want %d", code, ClosePolicyViolation)
+	}
+}
@@ -2,19 +2,27 @@ package main
 
 import (
 	"log"
+	"sort"
 	"sync"
 	"time"
 )
 
 // Room represents a collaboration room
 type Room struct {
-	ID         string
-	Hub        *CollaborationHub
-	Clients    map[*Client]bool
-	Register   chan *Client
-	Unregister chan *Client
-	Broadcast  chan []byte
-	mu         sync.RWMutex
+	ID        string
+	Hub       *CollaborationHub
+	Clients   map[*Client]bool
+	Broadcast chan []byte
+	// State is the room's document, shared with later rooms of the same ID
+	State *DocState
+	mu    sync.RWMutex
+
+	// closed is set by Close or when the last client leaves; once the room is
+	// empty, stopped is closed and Run exits
+	closed      bool
+	closeReason string
+	stopped     chan struct{}
+	stopOnce    sync.Once
 }
 
 // Run starts the room's event loop
@@ -22,42 +30,49 @@ func (r *Room) Run() {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
+	// Periodic snapshots; a nil channel never fires when they are disabled
+	var snapshots <-chan time.Time
+	if interval := r.Hub.config.SnapshotInterval; interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		snapshots = t.C
+	}
+
 	for {
 		select {
-		case client := <-r.Register:
-			r.mu.Lock()
-			r.Clients[client] = true
-			r.mu.Unlock()
-			log.Printf("[INFO] Client (ID: %s) joined room %s via %s. Total clients: %d",
-				client.ID, r.ID, client.Protocol, len(r.Clients))
-
-		case client := <-r.Unregister:
-			r.mu.Lock()
-			if _, ok := r.Clients[client]; ok {
-				delete(r.Clients, client)
-				close(client.Send)
-				log.Printf("[INFO] Client (ID: %s) left room %s. Remaining clients: %d",
-					client.ID, r.ID, len(r.Clients))
-			}
-			r.mu.Unlock()
-
 		case message := <-r.Broadcast:
-			r.mu.RLock()
+			r.mu.Lock()
 			for client := range r.Clients {
 				select {
 				case client.Send <- message:
 				default:
-					close(client.Send)
-					delete(r.Clients, client)
+					r.remove(client)
 				}
 			}
-			r.mu.RUnlock()
+			r.mu.Unlock()
 
 		case <-ticker.C:
 			// Periodic debug log for active rooms
-			if len(r.Clients) > 0 {
-				log.Printf("[DEBUG] Room %s: %d clients active", r.ID, len(r.Clients))
+			r.mu.RLock()
+			count := len(r.Clients)
+			r.mu.RUnlock()
+			if count > 0 {
+				log.Printf("[DEBUG] Room %s: %d clients active", r.ID, count)
+			}
+
+		case <-snapshots:
+			if snap := r.State.TakeSnapshot("server", "", true); snap != nil {
+				log.Printf("[DEBUG] Room %s: automatic snapshot %s (%d bytes)", r.ID, snap.ID, snap.Size)
 			}
+
+		case <-r.stopped:
+			// Keep the last edits of the session, and start the next one
+			// from a compacted log
+			r.State.TakeSnapshot("server", "", true)
+			r.State.Compact()
+			r.Hub.ReleaseState(r.State)
+			log.Printf("[INFO] Room %s closed", r.ID)
+			return
 		}
 	}
 }
@@ -78,3 +93,243 @@ func (r *Room) BroadcastMessage(message []byte, sender *Client) {
 		}
 	}
 }
+
+// ApplyUpdate applies a Y.js update from sender to the room's document and
+// relays it to the other clients. Updates the document rejects are dropped.
+// Clients below the editor role only get their updates applied while the
+// document is in suggesting mode, and only if the updates are commenters'
+// suggestions.
+func (r *Room) ApplyUpdate(update []byte, sender *Client) error {
+	origin, author := "", Author{}
+	if sender != nil {
+		r.identify(update, sender, false)
+		origin, author = sender.ID, sender.Author()
+	}
+	if sender != nil && !sender.Role.AtLeast(RoleEditor) {
+		suggest := sender.Role == RoleCommenter && r.Hub.access != nil && r.Hub.access.Suggesting(r.ID)
+		applied, err := r.State.ApplyRestricted(update, origin, author, suggest)
+		if applied {
+			r.BroadcastUpdate(update, sender)
+		}
+		return err
+	}
+	if err := r.State.Apply(update, origin, author); err != nil {
+		return err
+	}
+	r.BroadcastUpdate(update, sender)
+	return nil
+}
+
+// ApplyEdit applies an update sender made itself, as opposed to one that
+// syncs what it received from elsewhere. A session that has not declared its
+// Y.js client ID is taken to edit with the client ID of its first edit.
+func (r *Room) ApplyEdit(update []byte, sender *Client) error {
+	r.identify(update, sender, true)
+	return r.ApplyUpdate(update, sender)
+}
+
+// identify learns the Y.js client ID sender edits with from update, if it
+// is not known yet: the declared one once update has structs from it, or
+// for an edit of sender's own the only client it has structs from
+func (r *Room) identify(update []byte, sender *Client, own bool) {
+	if _, ok := sender.DocClient(); ok {
+		return
+	}
+	declared, hasDeclared := sender.declaredDocClient()
+	if !hasDeclared && !own {
+		return
+	}
+	if id, ok := r.State.editClient(update, sender.User, declared, hasDeclared, own); ok {
+		sender.setDocClient(id)
+	}
+}
+
+// BroadcastUpdate sends a Y.js update to every client but sender, framed
+// for each client's protocol
+func (r *Room) BroadcastUpdate(update []byte, sender *Client) {
+	wsMsg := encodeSyncMessage(syncUpdate, update)
+	wtMsgs, err := encodeWebTransportUpdate(update)
+	if err != nil {
+		log.Printf("[WARN] Room %s: update not sent to WebTransport clients: %v", r.ID, err)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for client := range r.Clients {
+		if client == sender {
+			continue
+		}
+		if client.Protocol == "WebSocket" {
+			r.queue(client, wsMsg)
+			continue
+		}
+		for _, msg := range wtMsgs {
+			r.queue(client, msg)
+		}
+	}
+}
+
+// SendTo queues messages for one client, unless it has left the room
+func (r *Room) SendTo(client *Client, msgs ...[]byte) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if !r.Clients[client] {
+		return
+	}
+	for _, msg := range msgs {
+		r.queue(client, msg)
+	}
+}
+
+// queue sends msg to client without blocking; r.mu must be held
+func (r *Room) queue(client *Client, msg []byte) {
+	select {
+	case client.Send <- msg:
+	default:
+		// Client send buffer full, drop message
+	}
+}
+
+// Join registers client with the room. It fails with errRoomStopped once the
+// room has been closed or retired, and with a *JoinError when the room or
+// the server is full.
+func (r *Room) Join(client *Client) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return errRoomStopped
+	}
+	limits := r.Hub.config
+	if limits.MaxClientsPerRoom > 0 && len(r.Clients) >= limits.MaxClientsPerRoom {
+		return ErrRoomFull
+	}
+	if n := r.Hub.connections.Add(1); limits.MaxConnections > 0 && n > int64(limits.MaxConnections) {
+		r.Hub.connections.Add(-1)
+		return ErrServerFull
+	}
+
+	r.Clients[client] = true
+	log.Printf("[INFO] Client (ID: %s) joined room %s via %s. Total clients: %d",
+		client.ID, r.ID, client.Protocol, len(r.Clients))
+	return nil
+}
+
+// Leave unregisters client and closes its Send channel. Calling it more
+// than once, or for a client the room already dropped, is harmless. The
+// last client to leave retires the room.
+func (r *Room) Leave(client *Client) {
+	r.mu.Lock()
+	if _, ok := r.Clients[client]; ok {
+		r.remove(client)
+		log.Printf("[INFO] Client (ID: %s) left room %s. Remaining clients: %d",
+			client.ID, r.ID, len(r.Clients))
+	}
+	r.mu.Unlock()
+	r.retireIfEmpty()
+}
+
+// retireIfEmpty stops the room and removes it from the hub if no client is
+// in it, as after the last client left or the first one was refused
+func (r *Room) retireIfEmpty() {
+	r.mu.Lock()
+	empty := len(r.Clients) == 0
+	if empty {
+		r.closed = true
+		r.stop()
+	}
+	r.mu.Unlock()
+
+	if empty {
+		r.Hub.forget(r)
+	}
+}
+
+// remove drops client and closes its Send channel; r.mu must be held
+func (r *Room) remove(client *Client) {
+	delete(r.Clients, client)
+	close(client.Send)
+	r.Hub.connections.Add(-1)
+}
+
+// Close disconnects every client with CloseRoomClosed and stops the room
+// once they have left. The hub must already have forgotten the room so no
+// new clients find it.
+func (r *Room) Close(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.closeReason = reason
+	for client := range r.Clients {
+		client.Close(CloseRoomClosed, reason)
+	}
+	if len(r.Clients) == 0 {
+		r.stop()
+	}
+}
+
+// stop ends Run; r.mu must be held
+func (r *Room) stop() {
+	r.stopOnce.Do(func() { close(r.stopped) })
+}
+
+// Client returns the connected client with the given ID
+func (r *Room) Client(id string) (*Client, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for client := range r.Clients {
+		if client.ID == id {
+			return client, true
+		}
+	}
+	return nil, false
+}
+
+// ClientInfos reports every connected client, oldest first
+func (r *Room) ClientInfos() []ClientInfo {
+	r.mu.RLock()
+	infos := make([]ClientInfo, 0, len(r.Clients))
+	for client := range r.Clients {
+		infos = append(infos, client.Info())
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ConnectedAt.Before(infos[j].ConnectedAt) })
+	return infos
+}
+
+// Notify queues a system notice for every client in the room, encoded for
+// each client's protocol. It returns the number of clients it was queued for.
+func (r *Room) Notify(notice SystemNotice) int {
+	return r.Deliver(notice.encode())
+}
+
+// Deliver queues a message for every client in the room: wsMsg for
+// WebSocket clients and wtMsg for WebTransport clients. It returns the
+// number of clients it was queued for.
+func (r *Room) Deliver(wsMsg, wtMsg []byte) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	queued := 0
+	for client := range r.Clients {
+		msg := wtMsg
+		if client.Protocol == "WebSocket" {
+			msg = wsMsg
+		}
+		select {
+		case client.Send <- msg:
+			queued++
+		default:
+			// Client send buffer full, drop the message
+		}
+	}
+	return queued
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// allowedElements maps each element the editor schema supports to the
+// attributes it may keep. Everything else is unwrapped (children kept) or,
+// for the elements in droppedElements, removed with its content.
+var allowedElements = map[string]map[string]bool{
+	"p":          {"style": true},
+	"h1":         {"style": true},
+	"h2":         {"style": true},
+	"h3":         {"style": true},
+	"h4":         {"style": true},
+	"h5":         {"style": true},
+	"h6":         {"style": true},
+	"ul":         {},
+	"ol":         {"start": true},
+	"li":         {},
+	"blockquote": {},
+	"pre":        {},
+	"code":       {"class": true},
+	"hr":         {},
+	"br":         {},
+	"strong":     {},
+	"b":          {},
+	"em":         {},
+	"i":          {},
+	"u":          {},
+	"s":          {},
+	"strike":     {},
+	"del":        {},
+	"a":          {"href": true},
+	"table":      {},
+	"thead":      {},
+	"tbody":      {},
+	"tr":         {},
+	"th":         {"colspan": true, "rowspan": true},
+	"td":         {"colspan": true, "rowspan": true},
+	"figure":     {},
+	"figcaption": {},
+	"img":        {"src": true, "alt": true, "title": true, "width": true, "height": true},
+}
+
+// inlineElements is the subset of allowedElements that maps to inline marks;
+// text transforms may only return these
+var inlineElements = map[string]map[string]bool{
+	"strong": {}, "b": {}, "em": {}, "i": {}, "u": {}, "s": {}, "strike": {},
+	"del": {}, "code": {}, "a": {"href": true}, "br": {},
+}
+
+// blockElements start a new line when rendered; when one is unwrapped its
+// content is kept apart from the text around it
+var blockElements = map[string]bool{
+	"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"ul": true, "ol": true, "li": true, "dl": true, "dt": true, "dd": true,
+	"blockquote": true, "pre": true, "hr": true, "table": true, "thead": true,
+	"tbody": true, "tfoot": true, "tr": true, "th": true, "td": true, "caption": true,
+	"figure": true, "figcaption": true, "div": true, "section": true, "article": true,
+	"header": true, "footer": true, "aside": true, "nav": true, "main": true,
+	"address": true, "details": true, "summary": true,
+}
+
+// droppedElements are removed together with everything inside them
+var droppedElements = map[string]bool{
+	"script": true, "style": true, "iframe": true, "frame": true, "frameset": true,
+	"object": true, "embed": true, "applet": true, "template": true, "noscript": true,
+	"svg": true, "math": true, "head": true, "title": true, "meta": true, "link": true,
+	"base": true, "form": true, "input": true, "button": true, "select": true,
+	"textarea": true, "audio": true, "video": true, "source": true, "track": true,
+}
+
+// approvedImagePrefixes are the only image sources kept in generated output;
+// they are the placeholder services the template prompts ask for
+var approvedImagePrefixes = []string{
+	"https://placehold.co/",
+	"https://via.placeholder.com/",
+}
+
+var (
+	textAlignPattern     = regexp.MustCompile(`^\s*text-align\s*:\s*(left|center|right|justify)\s*;?\s*$`)
+	codeLanguagePattern  = regexp.MustCompile(`^language-[A-Za-z0-9_+-]+$`)
+	markdownBlockPattern = regexp.MustCompile(`(?m)^(#{1,6}\s|[-*+]\s|\d+\.\s|>\s|\x60\x60\x60|\|)`)
+	htmlBlockTagPattern  = regexp.MustCompile(`(?i)<(h[1-6]|p|ul|ol|table|div|blockquote|pre|figure)[\s>]`)
+)
+
+var markdownRenderer = goldmark.New(
+	goldmark.WithExtensions(extension.Table, extension.Strikethrough),
+)
+
+// looksLikeMarkdown reports whether model output is Markdown rather than HTML
+func looksLikeMarkdown(content string) bool {
+	return !htmlBlockTagPattern.MatchString(content) && markdownBlockPattern.MatchString(content)
+}
+
+// MarkdownToHTML converts CommonMark (with GFM tables and strikethrough) to
+// HTML. Raw HTML in the source is not passed through.
+func MarkdownToHTML(source string) (string, error) {
+	var buf bytes.Buffer
+	if err := markdownRenderer.Convert([]byte(source), &buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// RenderTemplateHTML turns model output in the given format into sanitized
+// HTML the editor can insert. HTML kinds that come back as Markdown anyway are
+// converted too.
+func RenderTemplateHTML(content, format string) (string, error) {
+	if format == FormatMarkdown || looksLikeMarkdown(content) {
+		converted, err := MarkdownToHTML(content)
+		if err != nil {
+			return "", fmt.Errorf("convert markdown: %w", err)
+		}
+		content = converted
+	}
+	return SanitizeHTML(content)
+}
+
+// SanitizeHTML filters an HTML fragment down to the editor schema: unknown
+// elements are unwrapped, scripts and embedded content are removed, event
+// handlers and any attribute not on the allowlist are dropped, and URLs are
+// restricted to in-document links and approved image placeholders.
+func SanitizeHTML(fragment string) (string, error) {
+	return sanitizeWith(fragment, allowedElements)
+}
+
+// SanitizeInlineHTML is SanitizeHTML restricted to inline marks; block
+// elements are unwrapped so the result can replace a text selection
+func SanitizeInlineHTML(fragment string) (string, error) {
+	return sanitizeWith(fragment, inlineElements)
+}
+
+func sanitizeWith(fragment string, allowed map[string]map[string]bool) (string, error) {
+	context := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(fragment), context)
+	if err != nil {
+		return "", err
+	}
+
+	var clean []*html.Node
+	for _, n := range nodes {
+		clean = append(clean, sanitizeNode(n, allowed)...)
+	}
+	var buf bytes.Buffer
+	for _, n := range joinBlocks(clean) {
+		if err := html.Render(&buf, n); err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// sanitizeNode returns the sanitized replacement for n, which may be zero,
+// one or several nodes (when n is unwrapped). An unwrapped block element is
+// bracketed by blockBreak marks, which joinBlocks resolves.
+func sanitizeNode(n *html.Node, allowed map[string]map[string]bool) []*html.Node {
+	switch n.Type {
+	case html.TextNode:
+		return []*html.Node{{Type: html.TextNode, Data: n.Data}}
+	case html.ElementNode:
+		// handled below
+	default:
+		// Comments, doctypes and the like never reach the editor
+		return nil
+	}
+
+	tag := strings.ToLower(n.Data)
+	if droppedElements[tag] {
+		return nil
+	}
+
+	var children []*html.Node
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		children = append(children, sanitizeNode(c, allowed)...)
+	}
+	children = joinBlocks(children)
+
+	allowedAttrs, ok := allowed[tag]
+	if !ok {
+		if blockElements[tag] {
+			return append(append([]*html.Node{blockBreak()}, children...), blockBreak())
+		}
+		return children
+	}
+
+	clean := &html.Node{Type: html.ElementNode, Data: tag, DataAtom: atom.Lookup([]byte(tag))}
+	for _, attr := range n.Attr {
+		key := strings.ToLower(attr.Key)
+		if attr.Namespace != "" || !allowedAttrs[key] {
+			continue
+		}
+		if value, ok := sanitizeAttr(tag, key, attr.Val); ok {
+			clean.Attr = append(clean.Attr, html.Attribute{Key: key, Val: value})
+		}
+	}
+
+	switch tag {
+	case "img":
+		// Images without an approved source are dropped entirely
+		if !hasAttr(clean, "src") {
+			return nil
+		}
+	case "a":
+		// Links to anywhere outside the document become plain text
+		if !hasAttr(clean, "href") {
+			return children
+		}
+	}
+
+	for _, c := range children {
+		clean.AppendChild(c)
+	}
+	return []*html.Node{clean}
+}
+
+// blockBreak marks the edge of an unwrapped block element. The parser never
+// hands ErrorNodes to sanitizeNode, so the type is free to use as a mark.
+func blockBreak() *html.Node {
+	return &html.Node{Type: html.ErrorNode}
+}
+
+// joinBlocks replaces the blockBreak marks in a list of sibling nodes: a
+// mark between two pieces of content becomes a <br>, so "<p>a</p><p>b</p>"
+// unwrapped reads "a<br>b" rather than "ab". Marks at either end are dropped
+// (the parent list places them), as are marks next to a kept block element
+// or <br>, which already separate the text. Whitespace at a mark is dropped
+// like whitespace between blocks is when rendering.
+func joinBlocks(nodes []*html.Node) []*html.Node {
+	var out []*html.Node
+	pending := false
+	for _, n := range nodes {
+		if n.Type == html.ErrorNode {
+			for len(out) > 0 && isBlankText(out[len(out)-1]) {
+				out = out[:len(out)-1]
+			}
+			pending = len(out) > 0
+			continue
+		}
+		if pending {
+			if isBlankText(n) {
+				continue
+			}
+			if !separatesText(out[len(out)-1]) && !separatesText(n) {
+				out = append(out, &html.Node{Type: html.ElementNode, Data: "br", DataAtom: atom.Br})
+			}
+			pending = false
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+func isBlankText(n *html.Node) bool {
+	return n.Type == html.TextNode && strings.TrimSpace(n.Data) == ""
+}
+
+// separatesText reports whether n already starts a new line
+func separatesText(n *html.Node) bool {
+	return n.Type == html.ElementNode && (n.Data == "br" || blockElements[n.Data])
+}
+
+// sanitizeAttr validates a single allowlisted attribute value
+func sanitizeAttr(tag, key, value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	switch key {
+	case "style":
+		m := textAlignPattern.FindStringSubmatch(strings.ToLower(value))
+		if m == nil {
+			return "", false
+		}
+		return "text-align: " + m[1], true
+	case "class":
+		if tag == "code" && codeLanguagePattern.MatchString(value) {
+			return value, true
+		}
+		return "", false
+	case "src":
+		for _, prefix := range approvedImagePrefixes {
+			if strings.HasPrefix(value, prefix) && !strings.ContainsAny(value, "\"'<> ") {
+				return value, true
+			}
+		}
+		return "", false
+	case "href":
+		if strings.HasPrefix(value, "#") && !strings.ContainsAny(value, "\"'<> ") {
+			return value, true
+		}
+		return "", false
+	case "start", "colspan", "rowspan", "width", "height":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 10000 {
+			return "", false
+		}
+		return strconv.Itoa(n), true
+	default:
+		return value, true
+	}
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
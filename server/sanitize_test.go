@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"keeps schema elements", `<h1>Title</h1><p>Hello <strong>world</strong></p>`, `<h1>Title</h1><p>Hello <strong>world</strong></p>`},
+		{"drops scripts", `<p>a</p><script>alert(1)</script>`, `<p>a</p>`},
+		{"drops event handlers", `<p onclick="alert(1)">a</p>`, `<p>a</p>`},
+		{"unwraps unknown elements", `<div><span>text</span></div>`, `text`},
+		{"separates unwrapped blocks", `<div>a</div><div>b</div>`, `a<br/>b`},
+		{"no break next to kept blocks", `<div><p>a</p></div><div><p>b</p></div>`, `<p>a</p><p>b</p>`},
+		{"keeps text alignment", `<p style="text-align: center">a</p>`, `<p style="text-align: center">a</p>`},
+		{"drops other styles", `<p style="background:url(javascript:alert(1))">a</p>`, `<p>a</p>`},
+		{"keeps placeholder images", `<img src="https://placehold.co/600x400/png" alt="x">`, `<img src="https://placehold.co/600x400/png" alt="x"/>`},
+		{"drops remote images", `<img src="https://evil.example/track.png">`, ``},
+		{"unwraps remote links", `<a href="javascript:alert(1)">click</a>`, `click`},
+		{"keeps anchors", `<a href="#intro">intro</a>`, `<a href="#intro">intro</a>`},
+		{"keeps code language", `<pre><code class="language-go">x</code></pre>`, `<pre><code class="language-go">x</code></pre>`},
+		{"drops iframes with content", `<iframe src="https://evil.example"><p>x</p></iframe>`, ``},
+		{"drops comments", `<!-- hi --><p>a</p>`, `<p>a</p>`},
+		{"escapes text", `<p>&lt;script&gt;</p>`, `<p>&lt;script&gt;</p>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SanitizeHTML(tt.in)
+			if err != nil {
+				t.Fatalf("SanitizeHTML returned error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("SanitizeHTML(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeInlineHTML(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"keeps marks", `Hello <strong>big</strong> <a href="#x">world</a>`, `Hello <strong>big</strong> <a href="#x">world</a>`},
+		{"separates paragraphs", `<p>a</p><p>b</p>`, `a<br/>b`},
+		{"ignores whitespace between blocks", "<p>a</p>\n  <p>b</p>\n", `a<br/>b`},
+		{"separates blocks from text", `x<h2>a</h2>y`, `x<br/>a<br/>y`},
+		{"one break for nested blocks", `<div><p>a</p></div><div><p><em>b</em></p></div>`, `a<br/><em>b</em>`},
+		{"separates list items", `<ul><li>a</li><li>b</li></ul>`, `a<br/>b`},
+		{"keeps existing breaks", `a<br><p>b</p>`, `a<br/>b`},
+		{"unwraps inline elements without a break", `<span>a</span><span>b</span>`, `ab`},
+		{"blocks inside marks", `<strong><p>a</p><p>b</p></strong>`, `<strong>a<br/>b</strong>`},
+		{"drops empty blocks", `<p>a</p><p></p><hr><p>b</p>`, `a<br/>b`},
+	} {
+		got, err := SanitizeInlineHTML(tt.in)
+		if err != nil {
+			t.Fatalf("%s: SanitizeInlineHTML returned error: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: SanitizeInlineHTML(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRenderTemplateHTMLConvertsMarkdown(t *testing.T) {
+	md := "# Plan\n\n## Goals\n\n- one\n- two\n\n| a | b |\n|---|---|\n| 1 | 2 |\n\n<script>alert(1)</script>\n"
+
+	got, err := RenderTemplateHTML(md, FormatHTML)
+	if err != nil {
+		t.Fatalf("RenderTemplateHTML returned error: %v", err)
+	}
+
+	for _, want := range []string{"<h1>Plan</h1>", "<h2>Goals</h2>", "<li>one</li>", "<td>1</td>"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output %q does not contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, "script") {
+		t.Errorf("output %q still contains a script", got)
+	}
+}
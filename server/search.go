@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// searchFile holds the indexed text of every document in the persistence
+// directory, so a restart does not have to open every room
+const searchFile = "search.json"
+
+// searchRefreshInterval is how often changed documents are reindexed
+const searchRefreshInterval = 2 * time.Second
+
+// BM25 parameters, and the weight of title matches over body matches
+const (
+	bm25K1      = 1.2
+	bm25B       = 0.75
+	titleWeight = 2.0
+)
+
+// snippetLength is the length of a result snippet in bytes, roughly
+const snippetLength = 200
+
+// indexedDoc is a document as the index saw it
+type indexedDoc struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Text  string `json:"text"`
+	// Version is the document's UpdatedAt when it was indexed
+	Version time.Time `json:"version"`
+
+	title map[string]int // term -> occurrences
+	body  map[string]int
+	// titleLen and bodyLen are the number of terms
+	titleLen int
+	bodyLen  int
+}
+
+// SearchIndex is an inverted index over the title and plain text of every
+// document. It follows the registry: documents whose UpdatedAt changed
+// (content edits, restores, imports, metadata changes) are reindexed by
+// Refresh, and deleted ones are dropped.
+type SearchIndex struct {
+	hub   *CollaborationHub
+	docs  *Documents
+	store *Store
+
+	mu       sync.Mutex
+	indexed  map[string]*indexedDoc
+	postings map[string]map[string]bool // term -> document IDs
+	titleLen int                        // total terms, for the averages
+	bodyLen  int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSearchIndex loads the saved index from store, if any. Documents that
+// changed since are picked up by the first Refresh.
+func NewSearchIndex(hub *CollaborationHub, docs *Documents, store *Store) (*SearchIndex, error) {
+	s := &SearchIndex{
+		hub:      hub,
+		docs:     docs,
+		store:    store,
+		indexed:  make(map[string]*indexedDoc),
+		postings: make(map[string]map[string]bool),
+		done:     make(chan struct{}),
+	}
+	if store == nil {
+		return s, nil
+	}
+	data, err := os.ReadFile(filepath.Join(store.dir, searchFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*indexedDoc
+	if err := json.Unmarshal(data, &list); err != nil {
+		// The index can always be rebuilt from the documents
+		log.Printf("[WARN] Rebuilding the search index: %s: %v", searchFile, err)
+		return s, nil
+	}
+	for _, doc := range list {
+		s.add(doc)
+	}
+	return s, nil
+}
+
+// Run refreshes the index every searchRefreshInterval until Close is called
+func (s *SearchIndex) Run() {
+	s.Refresh()
+	ticker := time.NewTicker(searchRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Refresh()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Close stops Run and saves the index
+func (s *SearchIndex) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if err := s.save(); err != nil {
+			log.Printf("[WARN] Search: saving the index failed: %v", err)
+		}
+	})
+}
+
+// Refresh reindexes the documents that changed since they were indexed and
+// drops deleted ones, then saves the index if anything changed
+func (s *SearchIndex) Refresh() {
+	current := s.docs.All()
+	live := make(map[string]bool, len(current))
+	var stale []Document
+	s.mu.Lock()
+	for _, doc := range current {
+		live[doc.ID] = true
+		if old, ok := s.indexed[doc.ID]; !ok || !old.Version.Equal(doc.UpdatedAt) {
+			stale = append(stale, doc)
+		}
+	}
+	var deleted []string
+	for id := range s.indexed {
+		if !live[id] {
+			deleted = append(deleted, id)
+		}
+	}
+	for _, id := range deleted {
+		s.remove(id)
+	}
+	s.mu.Unlock()
+
+	// Decode outside the lock; searches go on meanwhile. documentContent
+	// releases the room's document, so one nobody has open is unloaded again
+	// once it is indexed.
+	for _, doc := range stale {
+		content, err := documentContent(s.hub, doc, "")
+		if err != nil {
+			log.Printf("[WARN] Search: document %s not indexed: %v", doc.ID, err)
+			continue
+		}
+		entry := &indexedDoc{ID: doc.ID, Title: doc.Title, Text: renderText(content), Version: doc.UpdatedAt}
+		s.mu.Lock()
+		s.remove(doc.ID)
+		s.add(entry)
+		s.mu.Unlock()
+	}
+
+	if len(stale) > 0 || len(deleted) > 0 {
+		log.Printf("[DEBUG] Search: reindexed %d documents, dropped %d", len(stale), len(deleted))
+		if err := s.save(); err != nil {
+			log.Printf("[WARN] Search: saving the index failed: %v", err)
+		}
+	}
+}
+
+// add indexes a document; s.mu must be held
+func (s *SearchIndex) add(doc *indexedDoc) {
+	doc.title, doc.titleLen = termCounts(doc.Title)
+	doc.body, doc.bodyLen = termCounts(doc.Text)
+	s.indexed[doc.ID] = doc
+	s.titleLen += doc.titleLen
+	s.bodyLen += doc.bodyLen
+	for _, counts := range []map[string]int{doc.title, doc.body} {
+		for term := range counts {
+			if s.postings[term] == nil {
+				s.postings[term] = make(map[string]bool)
+			}
+			s.postings[term][doc.ID] = true
+		}
+	}
+}
+
+// remove drops a document from the index; s.mu must be held
+func (s *SearchIndex) remove(id string) {
+	doc, ok := s.indexed[id]
+	if !ok {
+		return
+	}
+	delete(s.indexed, id)
+	s.titleLen -= doc.titleLen
+	s.bodyLen -= doc.bodyLen
+	for _, counts := range []map[string]int{doc.title, doc.body} {
+		for term := range counts {
+			delete(s.postings[term], id)
+			if len(s.postings[term]) == 0 {
+				delete(s.postings, term)
+			}
+		}
+	}
+}
+
+// save writes the indexed text of every document
+func (s *SearchIndex) save() error {
+	if s.store == nil {
+		return nil
+	}
+	s.mu.Lock()
+	list := make([]*indexedDoc, 0, len(s.indexed))
+	for _, doc := range s.indexed {
+		list = append(list, doc)
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return s.store.record(writeFileAtomic(filepath.Join(s.store.dir, searchFile), data))
+}
+
+// SearchHit is a ranked match with the matching terms highlighted
+type SearchHit struct {
+	Document Document `json:"document"`
+	Score    float64  `json:"score"`
+	// Title and Snippet are HTML: the text is escaped and matches are
+	// wrapped in <mark>
+	Title   string `json:"title"`
+	Snippet string `json:"snippet"`
+}
+
+// Search returns the documents the caller can read that contain every term
+// of query, best first. The last term also matches as a prefix, so results
+// follow the query as it is typed.
+func (s *SearchIndex) Search(query string, caller Caller) []SearchHit {
+	var terms []string
+	for _, tok := range tokenize(query) {
+		if !containsString(terms, tok.term) {
+			terms = append(terms, tok.term)
+		}
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	// Each query term matches a set of index terms
+	expansions := make([][]string, len(terms))
+	for i, term := range terms {
+		if s.postings[term] != nil {
+			expansions[i] = append(expansions[i], term)
+		}
+		if i == len(terms)-1 {
+			for indexed := range s.postings {
+				if indexed != term && strings.HasPrefix(indexed, term) {
+					expansions[i] = append(expansions[i], indexed)
+				}
+			}
+		}
+	}
+
+	var candidates map[string]bool
+	for _, expanded := range expansions {
+		matches := make(map[string]bool)
+		for _, term := range expanded {
+			for id := range s.postings[term] {
+				if candidates == nil || candidates[id] {
+					matches[id] = true
+				}
+			}
+		}
+		candidates = matches
+	}
+
+	n := float64(len(s.indexed))
+	avgTitle := math.Max(1, float64(s.titleLen)/math.Max(1, n))
+	avgBody := math.Max(1, float64(s.bodyLen)/math.Max(1, n))
+	highlight := make(map[string]bool)
+	for _, expanded := range expansions {
+		for _, term := range expanded {
+			highlight[term] = true
+		}
+	}
+
+	var hits []SearchHit
+	for id := range candidates {
+		// The registry is authoritative: deleted documents and documents
+		// the caller cannot see are skipped even before the next refresh
+		doc, ok := s.docs.Get(id)
+		if !ok || !caller.CanRead(doc) {
+			continue
+		}
+		entry := s.indexed[id]
+		score := 0.0
+		for _, expanded := range expansions {
+			for _, term := range expanded {
+				idf := math.Log(1 + (n-float64(len(s.postings[term]))+0.5)/(float64(len(s.postings[term]))+0.5))
+				score += idf * bm25(entry.body[term], entry.bodyLen, avgBody)
+				score += titleWeight * idf * bm25(entry.title[term], entry.titleLen, avgTitle)
+			}
+		}
+		hits = append(hits, SearchHit{
+			Document: doc,
+			Score:    math.Round(score*1000) / 1000,
+			Title:    highlightText(entry.Title, highlight, false),
+			Snippet:  highlightText(entry.Text, highlight, true),
+		})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Document.UpdatedAt.After(hits[j].Document.UpdatedAt)
+	})
+	return hits
+}
+
+// bm25 is the BM25 term frequency component for a field
+func bm25(tf, length int, avgLength float64) float64 {
+	if tf == 0 {
+		return 0
+	}
+	f := float64(tf)
+	return f * (bm25K1 + 1) / (f + bm25K1*(1-bm25B+bm25B*float64(length)/avgLength))
+}
+
+// searchToken is a term and where it appears in the original text
+type searchToken struct {
+	term       string
+	start, end int // byte offsets
+}
+
+// tokenize splits text into terms: runs of letters and digits, lowercased
+// and with accents removed, so "Café" matches "cafe"
+func tokenize(text string) []searchToken {
+	var tokens []searchToken
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			tokens = append(tokens, searchToken{foldTerm(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, searchToken{foldTerm(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+// foldTerm lowercases a word and strips its combining marks
+func foldTerm(word string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(strings.ToLower(word)) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// termCounts counts the terms of text
+func termCounts(text string) (map[string]int, int) {
+	tokens := tokenize(text)
+	counts := make(map[string]int)
+	for _, tok := range tokens {
+		counts[tok.term]++
+	}
+	return counts, len(tokens)
+}
+
+// highlightText escapes text as HTML and marks the tokens in terms. As a
+// snippet, only about snippetLength bytes around the first match are kept,
+// with whitespace collapsed.
+func highlightText(text string, terms map[string]bool, snippet bool) string {
+	tokens := tokenize(text)
+	start, end := 0, len(text)
+	if snippet {
+		first := 0
+		for _, tok := range tokens {
+			if terms[tok.term] {
+				first = tok.start
+				break
+			}
+		}
+		start = max(0, first-snippetLength/3)
+		end = min(len(text), start+snippetLength)
+		// Cut at whitespace so no word is split
+		if start > 0 {
+			if i := strings.IndexAny(text[start:first], " \n\t"); i >= 0 {
+				start += i + 1
+			} else {
+				start = first
+			}
+		}
+		if end < len(text) {
+			if i := strings.LastIndexAny(text[start:end], " \n\t"); i > 0 {
+				end = start + i
+			}
+			for end < len(text) && !utf8.RuneStart(text[end]) {
+				end++
+			}
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	at := start
+	for _, tok := range tokens {
+		if tok.start < start || tok.end > end || !terms[tok.term] {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[at:tok.start]))
+		b.WriteString("<mark>" + html.EscapeString(text[tok.start:tok.end]) + "</mark>")
+		at = tok.end
+	}
+	b.WriteString(html.EscapeString(text[at:end]))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	out := b.String()
+	if snippet {
+		out = strings.Join(strings.Fields(out), " ")
+	}
+	return out
+}
+
+// maxSearchQuery bounds the query string
+const maxSearchQuery = 500
+
+// SearchHandler serves GET /api/search?q=: the caller's matching
+// documents, best first, paginated like the document list
+func SearchHandler(index *SearchIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller := callerFrom(r)
+		if err := requireUser(caller); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		if q == "" || len(q) > maxSearchQuery {
+			writeError(w, r, errBadRequest("q must be 1 to %d bytes", maxSearchQuery))
+			return
+		}
+		offset, err := queryInt(r, "offset", 0)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		limit, err := queryInt(r, "limit", defaultPageSize)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			writeError(w, r, errBadRequest("limit must be between 1 and %d", maxPageSize))
+			return
+		}
+
+		hits := index.Search(q, caller)
+		page := hits[min(offset, len(hits)):min(offset+limit, len(hits))]
+		resp := map[string]interface{}{
+			"query":   q,
+			"results": append([]SearchHit{}, page...),
+			"total":   len(hits),
+			"offset":  offset,
+			"limit":   limit,
+		}
+		if next := offset + len(page); next < len(hits) {
+			resp["nextOffset"] = next
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
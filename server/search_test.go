@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// setContent replaces a document's content with paragraphs of text
+func setContent(t *testing.T, hub *CollaborationHub, doc Document, paragraphs ...string) *Snapshot {
+	t.Helper()
+	root := &PMNode{Type: "doc"}
+	for _, p := range paragraphs {
+		root.Content = append(root.Content, pmBlock("paragraph", nil, pmText(p)))
+	}
+	backup, err := hub.ReplaceContent(doc.RoomID, NewYDocFromProseMirror(root), "ada", "")
+	if err != nil {
+		t.Fatalf("ReplaceContent: %v", err)
+	}
+	return backup
+}
+
+// searchIDs returns the IDs of the hits, in order
+func searchIDs(hits []SearchHit) []string {
+	var ids []string
+	for _, hit := range hits {
+		ids = append(ids, hit.Document.ID)
+	}
+	return ids
+}
+
+func TestSearchIndex(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	docs, _ := NewDocuments(nil)
+	hub.OnChange(docs.Touch)
+	index, _ := NewSearchIndex(hub, docs, nil)
+	everyone := Caller{Trusted: true}
+
+	roadmap, _ := docs.Create(Document{Title: "Roadmap", Owner: "ada", Tags: []string{}})
+	notes, _ := docs.Create(Document{Title: "Café notes", Owner: "grace", Tags: []string{}})
+	setContent(t, hub, roadmap, "Ship the search feature in Q3.", strings.Repeat("Unrelated filler text. ", 20)+"Search again.")
+	setContent(t, hub, notes, "The café <search> team met on Tuesday.")
+	index.Refresh()
+
+	// Title matches weigh more; the last term matches as a prefix
+	if got := searchIDs(index.Search("cafe", everyone)); len(got) != 1 || got[0] != notes.ID {
+		t.Errorf("cafe = %v, want the notes", got)
+	}
+	if got := searchIDs(index.Search("search roadm", everyone)); len(got) != 1 || got[0] != roadmap.ID {
+		t.Errorf("search roadm = %v, want the roadmap", got)
+	}
+	if got := searchIDs(index.Search("SEARCH", everyone)); len(got) != 2 {
+		t.Errorf("SEARCH = %v, want both documents", got)
+	}
+	if hits := index.Search("missing search", everyone); len(hits) != 0 {
+		t.Errorf("every term must match: %v", searchIDs(hits))
+	}
+
+	hits := index.Search("search team", everyone)
+	if len(hits) != 1 {
+		t.Fatalf("search team = %v", searchIDs(hits))
+	}
+	if want := "The café &lt;<mark>search</mark>&gt; <mark>team</mark> met on Tuesday."; hits[0].Snippet != want {
+		t.Errorf("snippet = %q, want %q", hits[0].Snippet, want)
+	}
+	if hits := index.Search("cafe", everyone); len(hits) != 1 || hits[0].Title != "<mark>Café</mark> notes" {
+		t.Errorf("title highlight = %+v", hits)
+	}
+	hits = index.Search("again", everyone)
+	if len(hits) != 1 || !strings.HasPrefix(hits[0].Snippet, "…text. Unrelated") || !strings.HasSuffix(hits[0].Snippet, "Search <mark>again</mark>.") {
+		t.Errorf("long snippet = %+v", hits)
+	}
+
+	// Results are limited to documents the caller can read
+	if got := searchIDs(index.Search("search", Caller{User: "grace"})); len(got) != 1 || got[0] != notes.ID {
+		t.Errorf("grace sees %v, want only her notes", got)
+	}
+	if got := index.Search("search", Caller{}); len(got) != 0 {
+		t.Errorf("anonymous caller sees %v", searchIDs(got))
+	}
+
+	// Edits and restores are picked up by the next refresh
+	backup := setContent(t, hub, roadmap, "Ship the editor in Q4.")
+	index.Refresh()
+	if got := searchIDs(index.Search("feature", everyone)); len(got) != 0 {
+		t.Errorf("replaced content still found: %v", got)
+	}
+	if _, err := hub.RestoreSnapshot(roadmap.RoomID, backup.ID, "ada"); err != nil {
+		t.Fatalf("RestoreSnapshot: %v", err)
+	}
+	index.Refresh()
+	if got := searchIDs(index.Search("feature", everyone)); len(got) != 1 || got[0] != roadmap.ID {
+		t.Errorf("restored content = %v, want the roadmap", got)
+	}
+
+	// Deleted documents disappear at once, and from the index on refresh
+	docs.Delete(notes.ID)
+	if got := searchIDs(index.Search("cafe", everyone)); len(got) != 0 {
+		t.Errorf("deleted document found: %v", got)
+	}
+	index.Refresh()
+	if _, ok := index.indexed[notes.ID]; ok {
+		t.Errorf("deleted document still indexed")
+	}
+}
+
+func TestSearchIndexPersists(t *testing.T) {
+	store := testStore(t, 1000)
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	hub.UseStore(store)
+	docs, _ := NewDocuments(store)
+	hub.OnChange(docs.Touch)
+	doc, _ := docs.Create(Document{Title: "Minutes", Owner: "ada", Tags: []string{}})
+	setContent(t, hub, doc, "Budget approved.")
+	index, _ := NewSearchIndex(hub, docs, store)
+	index.Refresh()
+	index.Close()
+
+	// A new index starts from the saved text without decoding the room
+	reloaded, err := NewSearchIndex(nil, docs, store)
+	if err != nil {
+		t.Fatalf("NewSearchIndex: %v", err)
+	}
+	reloaded.Refresh()
+	if got := searchIDs(reloaded.Search("budget", Caller{Trusted: true})); len(got) != 1 || got[0] != doc.ID {
+		t.Errorf("reloaded search = %v", got)
+	}
+}
+
+func TestSearchRefreshUnloadsDocuments(t *testing.T) {
+	store := testStore(t, 1000)
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	hub.UseStore(store)
+	docs, _ := NewDocuments(store)
+	hub.OnChange(docs.Touch)
+	index, _ := NewSearchIndex(hub, docs, store)
+
+	var rooms []string
+	for _, title := range []string{"Minutes", "Agenda", "Budget"} {
+		doc, _ := docs.Create(Document{Title: title, Owner: "ada", Tags: []string{}})
+		setContent(t, hub, doc, title+" for the quarterly review.")
+		rooms = append(rooms, doc.RoomID)
+	}
+	index.Refresh()
+
+	// Indexing reads documents nobody has open without keeping them
+	for _, id := range rooms {
+		if resident(hub, id) {
+			t.Errorf("room %s kept in memory after indexing", id)
+		}
+	}
+	if got := index.Search("quarterly", Caller{Trusted: true}); len(got) != 3 {
+		t.Errorf("quarterly = %v, want every document", searchIDs(got))
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	docs, _ := NewDocuments(nil)
+	hub.OnChange(docs.Touch)
+	index, _ := NewSearchIndex(hub, docs, nil)
+	for _, title := range []string{"Plan A", "Plan B", "Plan C"} {
+		docs.Create(Document{Title: title, Owner: "ada", Tags: []string{}})
+	}
+	index.Refresh()
+	auth := NewAuthenticator(AuthConfig{Users: []UserConfig{{Name: "ada", Token: "ada-token-0123456789"}}})
+	r := chi.NewRouter()
+	r.Use(auth.Middleware)
+	r.Get("/api/search", SearchHandler(index))
+
+	var page struct {
+		Total      int
+		NextOffset *int
+		Results    []SearchHit
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/search?q=plan&limit=2&access_token=ada-token-0123456789", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || len(page.Results) != 2 || page.NextOffset == nil || *page.NextOffset != 2 {
+		t.Errorf("page = %+v", page)
+	}
+	for target, want := range map[string]int{
+		"/api/search?q=plan": http.StatusUnauthorized,
+		"/api/search?q=%20&access_token=ada-token-0123456789":       http.StatusBadRequest,
+		"/api/search?q=a&limit=0&access_token=ada-token-0123456789": http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != want {
+			t.Errorf("%s: status = %d, want %d", target, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// messageSuggestion is the y-websocket message type for suggestions: events
+// from the server, framed like a system notice, and accept or reject
+// actions from owners, framed the same way
+const messageSuggestion = 102
+
+// streamSuggestions is the type of the WebTransport streams for
+// suggestions: the server opens a unidirectional one on the first event,
+// and owners open a bidirectional one for their actions. Both carry JSON
+// messages after a two-byte length.
+const streamSuggestions = 0x07
+
+// Suggestion is a tracked change in a document: text its author suggested
+// inserting or deleting, waiting for the owner to accept or reject it
+type Suggestion struct {
+	ID     string `json:"id"`
+	Author string `json:"author"`
+	// Inserted and Deleted are the text the suggestion inserts and
+	// deletes, with a newline between paragraphs
+	Inserted string `json:"inserted,omitempty"`
+	Deleted  string `json:"deleted,omitempty"`
+}
+
+// Suggestions lists the document's open suggestions in document order
+func (s *DocState) Suggestions() []Suggestion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.doc.suggestions()
+}
+
+// ApplyRestricted applies an update from a client below the editor role.
+// Updates that change nothing are ignored, and so is everything else from
+// viewers. With suggest set the update may only make suggestions by the
+// author's user. It reports whether the update was applied.
+func (s *DocState) ApplyRestricted(update []byte, origin string, author Author, suggest bool) (bool, error) {
+	s.mu.Lock()
+	adds, err := s.doc.adds(update)
+	if err == nil && adds {
+		if !suggest || author.User == "" {
+			err = errReadOnly
+		} else if err = s.checkSuggestion(update, author.User); err == nil {
+			if err = s.doc.Apply(update); err != nil {
+				s.replica = nil
+			}
+		}
+	}
+	if err != nil || !adds {
+		s.mu.Unlock()
+		return false, err
+	}
+	s.version++
+	s.persist(update, origin, s.claim(author, update))
+	s.mu.Unlock()
+
+	s.changed()
+	return true, nil
+}
+
+// checkSuggestion reports why update is more than suggestions by user by
+// applying it to the replica, which then has the update the document is
+// about to apply. The replica is dropped if the update is refused, and
+// rebuilt from the document when next needed. s.mu must be held.
+func (s *DocState) checkSuggestion(update []byte, user string) error {
+	if s.replica == nil {
+		replica := NewYDoc()
+		if err := replica.Apply(s.doc.EncodeStateAsUpdate(nil)); err != nil {
+			return err
+		}
+		s.replica = replica
+	}
+	err := s.doc.checkSuggestion(s.replica, update, user)
+	if err != nil {
+		s.replica = nil
+	}
+	return err
+}
+
+// mirror applies an update the document took to the replica; s.mu must be
+// held
+func (s *DocState) mirror(update []byte) {
+	if s.replica != nil && s.replica.Apply(update) != nil {
+		s.replica = nil
+	}
+}
+
+// ResolveSuggestion accepts or rejects a suggestion for author and returns
+// it with the update that resolved it
+func (s *DocState) ResolveSuggestion(id string, accept bool, author string) (Suggestion, []byte, error) {
+	s.mu.Lock()
+	var found *Suggestion
+	for _, sg := range s.doc.suggestions() {
+		if sg.ID == id {
+			found = &sg
+			break
+		}
+	}
+	if found == nil {
+		s.mu.Unlock()
+		return Suggestion{}, nil, errNotFound("Suggestion not found")
+	}
+	update := s.doc.resolveSuggestion(id, accept)
+	s.version++
+	s.mirror(update)
+	s.persist(update, author, nil)
+	s.mu.Unlock()
+
+	s.changed()
+	return *found, update, nil
+}
+
+// SuggestionEvent is delivered live to the clients of a room when a
+// suggestion is resolved or the document's suggesting mode changes
+type SuggestionEvent struct {
+	// Type is suggestion.accepted, suggestion.rejected or mode
+	Type     string `json:"type"`
+	Document string `json:"document"`
+	// Suggestion comes with the suggestion events
+	Suggestion *Suggestion `json:"suggestion,omitempty"`
+	// Suggesting comes with mode
+	Suggesting *bool     `json:"suggesting,omitempty"`
+	By         string    `json:"by"`
+	Time       time.Time `json:"time"`
+}
+
+// encode returns the event framed for WebSocket and WebTransport, like a
+// comment event
+func (ev SuggestionEvent) encode() (wsMsg, wtMsg []byte) {
+	payload, _ := json.Marshal(ev)
+
+	wsMsg = binary.AppendUvarint(nil, messageSuggestion)
+	wsMsg = binary.AppendUvarint(wsMsg, uint64(len(payload)))
+	wsMsg = append(wsMsg, payload...)
+
+	wtMsg = append([]byte{streamSuggestions}, payload...)
+	return wsMsg, wtMsg
+}
+
+// publishSuggestionEvent sends an event to everyone in the document's room
+func publishSuggestionEvent(hub *CollaborationHub, doc Document, ev SuggestionEvent) {
+	ev.Document = doc.ID
+	ev.Time = time.Now().UTC()
+	if room, ok := hub.Room(doc.RoomID); ok {
+		room.Deliver(ev.encode())
+	}
+}
+
+// ResolveSuggestion accepts or rejects a suggestion in a document and sends
+// the change and a SuggestionEvent to the clients in its room
+func (h *CollaborationHub) ResolveSuggestion(doc Document, id string, accept bool, by string) (Suggestion, error) {
+	state, err := h.OpenState(doc.RoomID)
+	if err != nil {
+		return Suggestion{}, err
+	}
+	defer h.ReleaseState(state)
+	suggestion, update, err := state.ResolveSuggestion(id, accept, by)
+	if err != nil {
+		return Suggestion{}, err
+	}
+	if room, ok := h.Room(doc.RoomID); ok {
+		room.BroadcastUpdate(update, nil)
+	}
+	event := "suggestion.rejected"
+	if accept {
+		event = "suggestion.accepted"
+	}
+	publishSuggestionEvent(h, doc, SuggestionEvent{Type: event, Suggestion: &suggestion, By: by})
+	log.Printf("[INFO] Suggestion %s on document %s %s by %s", id, doc.ID, event[len("suggestion."):], by)
+	return suggestion, nil
+}
+
+// suggestionAction is what owners send over the collaboration protocol to
+// resolve a suggestion
+type suggestionAction struct {
+	// Action is accept or reject
+	Action string `json:"action"`
+	ID     string `json:"id"`
+}
+
+// HandleSuggestionAction carries out an action a client sent as JSON. Only
+// owners may resolve suggestions, and only in rooms that belong to a
+// document.
+func (r *Room) HandleSuggestionAction(client *Client, payload []byte) error {
+	var action suggestionAction
+	if err := json.Unmarshal(payload, &action); err != nil {
+		return fmt.Errorf("invalid suggestion action: %v", err)
+	}
+	if action.Action != "accept" && action.Action != "reject" {
+		return fmt.Errorf("unknown suggestion action %q", action.Action)
+	}
+	if client.Role != RoleOwner {
+		return errReadOnly
+	}
+	if r.Hub.access == nil {
+		return errNotFound("No document for this room")
+	}
+	doc, ok := r.Hub.access.docs.ByRoom(r.ID)
+	if !ok {
+		return errNotFound("No document for this room")
+	}
+	by := client.User
+	if by == "" {
+		by = client.ID
+	}
+	_, err := r.Hub.ResolveSuggestion(doc, action.ID, action.Action == "accept", by)
+	return err
+}
+
+// parseSuggestionMessage reads the JSON of a y-websocket suggestion message
+func parseSuggestionMessage(msg []byte) ([]byte, bool) {
+	kind, n := binary.Uvarint(msg)
+	if n <= 0 || kind != messageSuggestion {
+		return nil, false
+	}
+	size, m := binary.Uvarint(msg[n:])
+	if m <= 0 || uint64(len(msg)-n-m) != size {
+		return nil, false
+	}
+	return msg[n+m:], true
+}
+
+// SuggestionRoutes returns the suggestion API of a document, mounted at
+// /api/documents/{id}/suggestions
+func SuggestionRoutes(hub *CollaborationHub, docs *Documents) http.Handler {
+	r := chi.NewRouter()
+
+	// document resolves the {id} parameter for a caller with at least min
+	document := func(w http.ResponseWriter, r *http.Request, min Role) (Document, bool) {
+		doc, ok := docs.Get(chi.URLParam(r, "id"))
+		if !ok {
+			writeError(w, r, errNotFound("Document not found"))
+			return doc, false
+		}
+		if err := requireRole(callerFrom(r), doc, min); err != nil {
+			writeError(w, r, err)
+			return doc, false
+		}
+		return doc, true
+	}
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		doc, ok := document(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		state, err := hub.OpenState(doc.RoomID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer hub.ReleaseState(state)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"suggesting":  doc.Suggesting,
+			"suggestions": state.Suggestions(),
+		})
+	})
+
+	resolve := func(accept bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			doc, ok := document(w, r, RoleOwner)
+			if !ok {
+				return
+			}
+			by := callerName(callerFrom(r))
+			suggestion, err := hub.ResolveSuggestion(doc, chi.URLParam(r, "suggestionID"), accept, by)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, suggestion)
+		}
+	}
+	r.Post("/{suggestionID}/accept", resolve(true))
+	r.Post("/{suggestionID}/reject", resolve(false))
+
+	return r
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// replica returns a client's copy of a room's document
+func replica(t *testing.T, state *DocState) *YDoc {
+	t.Helper()
+	update, err := state.Diff(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewYDoc()
+	mustApply(t, d, update)
+	return d
+}
+
+// suggestionMarkValue is the JSON of a suggestion mark
+func suggestionMarkValue(id, author string) string {
+	b, _ := json.Marshal(map[string]string{"id": id, "author": author})
+	return string(b)
+}
+
+// suggestionEvent reads the next suggestion event queued for a WebSocket
+// client
+func suggestionEvent(t *testing.T, client *Client) SuggestionEvent {
+	t.Helper()
+	for {
+		select {
+		case msg := <-client.Send:
+			payload, ok := parseSuggestionMessage(msg)
+			if !ok {
+				continue
+			}
+			var ev SuggestionEvent
+			if err := json.Unmarshal(payload, &ev); err != nil {
+				t.Fatalf("suggestion event: %v", err)
+			}
+			return ev
+		default:
+			t.Fatalf("no suggestion event queued")
+		}
+	}
+}
+
+func TestSuggestions(t *testing.T) {
+	store := testStore(t, 1000)
+	hub := NewCollaborationHub(DefaultConfig().Collab, nil)
+	hub.UseStore(store)
+	docs, _ := NewDocuments(store)
+	auth := NewAuthenticator(AuthConfig{Users: []UserConfig{
+		{Name: "ada", Token: "ada-token-0123456789"},
+		{Name: "grace", Token: "grace-token-0123456789"},
+		{Name: "linus", Token: "linus-token-0123456789"},
+	}})
+	hub.UseAccess(NewRoomAccess(auth, docs))
+	r := chi.NewRouter()
+	r.Use(auth.Middleware)
+	r.Mount("/api/documents", DocumentRoutes(hub, docs))
+	const ada, grace = "ada-token-0123456789", "grace-token-0123456789"
+
+	doc, _ := docs.Create(Document{Title: "Plan", Owner: "ada", Tags: []string{}, Members: map[string]Role{"grace": RoleCommenter, "linus": RoleViewer}})
+	root := &PMNode{Type: "doc", Content: []*PMNode{pmBlock("paragraph", nil, pmText("hello "), pmText("world", "bold"))}}
+	if _, err := hub.ReplaceContent(doc.RoomID, NewYDocFromProseMirror(root), "ada", ""); err != nil {
+		t.Fatal(err)
+	}
+	state, _ := hub.LookupState(doc.RoomID)
+
+	owner := joinTestClient(t, hub, doc.RoomID, "WebSocket")
+	owner.User = "ada"
+	commenter := joinTestClient(t, hub, doc.RoomID, "WebSocket")
+	commenter.User, commenter.Role = "grace", RoleCommenter
+	viewer := joinTestClient(t, hub, doc.RoomID, "WebSocket")
+	viewer.User, viewer.Role = "linus", RoleViewer
+	room := owner.Room
+
+	// Edits on a fresh copy of the document
+	appendText := func(s, mark string) []byte {
+		d := replica(t, state)
+		text := firstText(d)
+		return d.Transact(func(tx *yTransaction) {
+			left := text.start
+			for left.right != nil {
+				left = left.right
+			}
+			if mark != "" {
+				left = tx.insert(text, left, &contentFormat{key: markInsertion, value: mark})
+			}
+			left = tx.insert(text, left, newContentString(s))
+			if mark != "" {
+				tx.insert(text, left, &contentFormat{key: markInsertion, value: "null"})
+			}
+		})
+	}
+	formatHello := func(key, value string) []byte {
+		d := replica(t, state)
+		text := firstText(d)
+		hello := text.start
+		return d.Transact(func(tx *yTransaction) {
+			tx.insert(text, nil, &contentFormat{key: key, value: value})
+			tx.insert(text, hello, &contentFormat{key: key, value: "null"})
+		})
+	}
+	deleteWorld := func() []byte {
+		d := replica(t, state)
+		text := firstText(d)
+		return d.Transact(func(tx *yTransaction) {
+			for it := text.start; it != nil; it = it.right {
+				if c, ok := it.content.(*contentString); ok && c.String() == "world" {
+					tx.delete(it)
+				}
+			}
+		})
+	}
+
+	// Without suggesting mode commenters and viewers are read-only
+	if err := room.ApplyUpdate(appendText("!", suggestionMarkValue("s1", "grace")), commenter); !errors.Is(err, errReadOnly) {
+		t.Errorf("commenter edits outside suggesting mode: err = %v", err)
+	}
+	if err := room.ApplyUpdate(state.doc.EncodeStateAsUpdate(nil), viewer); err != nil {
+		t.Errorf("viewer sends what the server has: err = %v", err)
+	}
+
+	if code := authRequest(t, r, grace, http.MethodPatch, "/api/documents/"+doc.ID, `{"suggesting":true}`, nil); code != http.StatusForbidden {
+		t.Errorf("commenter turns on suggesting: status = %d, want 403", code)
+	}
+	if code := authRequest(t, r, ada, http.MethodPatch, "/api/documents/"+doc.ID, `{"suggesting":true}`, nil); code != http.StatusOK {
+		t.Fatalf("owner turns on suggesting: status = %d", code)
+	}
+	if ev := suggestionEvent(t, owner); ev.Type != "mode" || ev.Suggesting == nil || !*ev.Suggesting || ev.By != "ada" {
+		t.Errorf("mode event = %+v", ev)
+	}
+
+	for name, update := range map[string][]byte{
+		"unmarked insertion":       appendText("!", ""),
+		"someone else's insertion": appendText("!", suggestionMarkValue("s1", "ada")),
+		"deletion":                 deleteWorld(),
+		"formatting":               formatHello("italic", "{}"),
+		"someone else's deletion":  formatHello(markDeletion, suggestionMarkValue("s2", "ada")),
+	} {
+		if err := room.ApplyUpdate(update, commenter); err == nil {
+			t.Errorf("%s applied", name)
+		}
+	}
+	if err := room.ApplyUpdate(appendText("!", suggestionMarkValue("s1", "grace")), viewer); !errors.Is(err, errReadOnly) {
+		t.Errorf("viewer suggests: err = %v", err)
+	}
+	if got := firstText(state.doc).text(); got != "hello world" {
+		t.Fatalf("text after refused edits = %q", got)
+	}
+
+	if err := room.ApplyUpdate(appendText("!", suggestionMarkValue("s1", "grace")), commenter); err != nil {
+		t.Fatalf("suggest an insertion: %v", err)
+	}
+	if err := room.ApplyUpdate(formatHello(markDeletion, suggestionMarkValue("s2", "grace")), commenter); err != nil {
+		t.Fatalf("suggest a deletion: %v", err)
+	}
+	var list struct {
+		Suggesting  bool         `json:"suggesting"`
+		Suggestions []Suggestion `json:"suggestions"`
+	}
+	if code := authRequest(t, r, ada, http.MethodGet, "/api/documents/"+doc.ID+"/suggestions", "", &list); code != http.StatusOK {
+		t.Fatalf("list: status = %d", code)
+	}
+	want := []Suggestion{{ID: "s2", Author: "grace", Deleted: "hello "}, {ID: "s1", Author: "grace", Inserted: "!"}}
+	if !list.Suggesting || len(list.Suggestions) != 2 || list.Suggestions[0] != want[0] || list.Suggestions[1] != want[1] {
+		t.Fatalf("suggestions = %+v", list)
+	}
+
+	// Only owners resolve suggestions
+	base := "/api/documents/" + doc.ID + "/suggestions/"
+	if code := authRequest(t, r, grace, http.MethodPost, base+"s1/accept", "", nil); code != http.StatusForbidden {
+		t.Errorf("commenter accepts: status = %d, want 403", code)
+	}
+	if code := authRequest(t, r, ada, http.MethodPost, base+"nope/accept", "", nil); code != http.StatusNotFound {
+		t.Errorf("unknown suggestion: status = %d, want 404", code)
+	}
+	var accepted Suggestion
+	if code := authRequest(t, r, ada, http.MethodPost, base+"s1/accept", "", &accepted); code != http.StatusOK || accepted != want[1] {
+		t.Fatalf("accept: status = %d, suggestion = %+v", code, accepted)
+	}
+	if ev := suggestionEvent(t, owner); ev.Type != "suggestion.accepted" || ev.Suggestion == nil || ev.Suggestion.ID != "s1" || ev.By != "ada" {
+		t.Errorf("accept event = %+v", ev)
+	}
+
+	// Over the collaboration protocol
+	action := func(json string) []byte {
+		msg := binary.AppendUvarint(nil, messageSuggestion)
+		msg = binary.AppendUvarint(msg, uint64(len(json)))
+		return append(msg, json...)
+	}
+	payload, _ := parseSuggestionMessage(action(`{"action":"reject","id":"s2"}`))
+	if err := room.HandleSuggestionAction(commenter, payload); !errors.Is(err, errReadOnly) {
+		t.Errorf("commenter rejects: err = %v", err)
+	}
+	if err := room.HandleSuggestionAction(owner, payload); err != nil {
+		t.Fatalf("reject: %v", err)
+	}
+
+	// Rejected insertions are deleted; commenters may also withdraw their
+	// own text themselves
+	for _, id := range []string{"s3", "s4"} {
+		if err := room.ApplyUpdate(appendText("?", suggestionMarkValue(id, "grace")), commenter); err != nil {
+			t.Fatalf("suggest %s: %v", id, err)
+		}
+	}
+	if code := authRequest(t, r, ada, http.MethodPost, base+"s3/reject", "", nil); code != http.StatusOK {
+		t.Fatalf("reject: status = %d", code)
+	}
+	d := replica(t, state)
+	update := d.Transact(func(tx *yTransaction) {
+		for it := firstText(d).start; it != nil; it = it.right {
+			if c, ok := it.content.(*contentString); ok && !it.deleted && c.String() == "?" {
+				tx.delete(it)
+			}
+		}
+	})
+	if err := room.ApplyUpdate(update, commenter); err != nil {
+		t.Fatalf("withdraw own suggestion: %v", err)
+	}
+
+	runs := firstText(state.doc).delta()
+	if len(runs) != 3 || runs[0].Insert != "hello " || runs[0].Attributes != nil || runs[1].Insert != "world" || runs[2].Insert != "!" || runs[2].Attributes != nil {
+		t.Errorf("text after resolving = %+v", runs)
+	}
+	if got := state.Suggestions(); len(got) != 0 {
+		t.Errorf("suggestions after resolving = %+v", got)
+	}
+
+}
+
+func TestSuggestionReplica(t *testing.T) {
+	state := newDocState("notes", 0)
+	root := &PMNode{Type: "doc", Content: []*PMNode{pmBlock("paragraph", nil, pmText("hello"))}}
+	if err := state.Apply(NewYDocFromProseMirror(root).EncodeStateAsUpdate(nil), "ada", Author{}); err != nil {
+		t.Fatal(err)
+	}
+	appendText := func(s, mark string) []byte {
+		d := replica(t, state)
+		text := firstText(d)
+		return d.Transact(func(tx *yTransaction) {
+			left := text.start
+			for left.right != nil {
+				left = left.right
+			}
+			if mark != "" {
+				left = tx.insert(text, left, &contentFormat{key: markInsertion, value: mark})
+			}
+			left = tx.insert(text, left, newContentString(s))
+			if mark != "" {
+				tx.insert(text, left, &contentFormat{key: markInsertion, value: "null"})
+			}
+		})
+	}
+	suggest := func(update []byte) error {
+		_, err := state.ApplyRestricted(update, "grace", Author{User: "grace"}, true)
+		return err
+	}
+	inStep := func(when string) {
+		t.Helper()
+		if state.replica == nil {
+			t.Fatalf("%s: no replica", when)
+		}
+		if got, want := firstText(state.replica).text(), firstText(state.doc).text(); got != want {
+			t.Errorf("%s: replica text = %q, document %q", when, got, want)
+		}
+		if got, want := state.replica.StateVector().encode(), state.doc.StateVector().encode(); string(got) != string(want) {
+			t.Errorf("%s: replica state vector differs", when)
+		}
+	}
+
+	if err := suggest(appendText(" there", suggestionMarkValue("s1", "grace"))); err != nil {
+		t.Fatalf("suggestion: %v", err)
+	}
+	inStep("after a suggestion")
+
+	// Other changes reach the replica as they are applied
+	if err := state.Apply(appendText("!", ""), "ada", Author{}); err != nil {
+		t.Fatal(err)
+	}
+	inStep("after an edit")
+	if _, _, err := state.ResolveSuggestion("s1", true, "ada"); err != nil {
+		t.Fatal(err)
+	}
+	inStep("after a resolved suggestion")
+
+	// A refused suggestion leaves the replica out of step, so it is rebuilt
+	if err := suggest(appendText("?", "")); err == nil {
+		t.Fatal("unmarked insertion applied")
+	}
+	if state.replica != nil {
+		t.Error("replica kept after a refused suggestion")
+	}
+	if err := suggest(appendText("?", suggestionMarkValue("s2", "grace"))); err != nil {
+		t.Fatalf("suggestion after a refused one: %v", err)
+	}
+	inStep("after a rebuild")
+}
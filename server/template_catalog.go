@@ -0,0 +1,253 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed templates
+var builtinTemplates embed.FS
+
+// Output formats a template kind can produce
+const (
+	FormatHTML     = "html"
+	FormatMarkdown = "markdown"
+)
+
+const defaultTemplateKind = "standard"
+
+// TemplateValidation describes the checks generated output must pass
+type TemplateValidation struct {
+	MinLength        int      `yaml:"minLength" json:"minLength,omitempty"`
+	RequiredSections []string `yaml:"requiredSections" json:"requiredSections,omitempty"`
+}
+
+// TemplateKind is one entry of the template catalog
+type TemplateKind struct {
+	ID          string             `yaml:"-" json:"id"`
+	Name        string             `yaml:"name" json:"name"`
+	Description string             `yaml:"description" json:"description"`
+	Format      string             `yaml:"format" json:"format"`
+	Prompt      string             `yaml:"prompt" json:"-"`
+	MaxTokens   int                `yaml:"maxTokens" json:"-"`
+	Validation  TemplateValidation `yaml:"validation" json:"validation"`
+	Custom      bool               `yaml:"-" json:"custom"`
+
+	systemPrompt string
+}
+
+// SystemPrompt returns the full system prompt for this kind
+func (k *TemplateKind) SystemPrompt() string {
+	return k.systemPrompt
+}
+
+// TemplateCatalog holds all known template kinds
+type TemplateCatalog struct {
+	kinds       map[string]*TemplateKind
+	basePrompts map[string]string
+	mu          sync.RWMutex
+}
+
+// builtinKinds are the kinds shipped with the server; everything else is custom
+var builtinKinds = map[string]bool{
+	"standard": true, "academic": true, "business": true, "creative": true, "technical": true,
+}
+
+var templateIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// NewTemplateCatalog loads the embedded catalog, then any *.yaml kinds from
+// extraDir (if set). Kinds in extraDir override embedded ones with the same ID.
+func NewTemplateCatalog(extraDir string) (*TemplateCatalog, error) {
+	c := &TemplateCatalog{
+		kinds:       make(map[string]*TemplateKind),
+		basePrompts: make(map[string]string),
+	}
+
+	sub, err := fs.Sub(builtinTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+	for format, file := range map[string]string{FormatHTML: "base-html.txt", FormatMarkdown: "base-markdown.txt"} {
+		data, err := fs.ReadFile(sub, file)
+		if err != nil {
+			return nil, fmt.Errorf("read base prompt %s: %w", file, err)
+		}
+		c.basePrompts[format] = strings.TrimSpace(string(data))
+	}
+
+	if err := c.loadDir(sub); err != nil {
+		return nil, err
+	}
+	if extraDir != "" {
+		if err := c.loadDir(os.DirFS(extraDir)); err != nil {
+			return nil, fmt.Errorf("load templates from %s: %w", extraDir, err)
+		}
+	}
+
+	if _, ok := c.kinds[defaultTemplateKind]; !ok {
+		return nil, fmt.Errorf("template catalog has no %q kind", defaultTemplateKind)
+	}
+	return c, nil
+}
+
+// loadDir parses every *.yaml file in fsys as a template kind
+func (c *TemplateCatalog) loadDir(fsys fs.FS) error {
+	files, err := fs.Glob(fsys, "*.yaml")
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+
+		var kind TemplateKind
+		if err := yaml.Unmarshal(data, &kind); err != nil {
+			return fmt.Errorf("parse %s: %w", file, err)
+		}
+		kind.ID = strings.TrimSuffix(path.Base(file), ".yaml")
+		kind.Custom = !builtinKinds[kind.ID]
+		if err := c.prepare(&kind); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		c.kinds[kind.ID] = &kind
+	}
+	return nil
+}
+
+// prepare validates a kind definition and fills in defaults
+func (c *TemplateCatalog) prepare(kind *TemplateKind) error {
+	if !templateIDPattern.MatchString(kind.ID) {
+		return fmt.Errorf("invalid template ID %q", kind.ID)
+	}
+	if kind.Name == "" {
+		kind.Name = kind.ID
+	}
+	if kind.Format == "" {
+		kind.Format = FormatHTML
+	}
+	base, ok := c.basePrompts[kind.Format]
+	if !ok {
+		return fmt.Errorf("unknown format %q", kind.Format)
+	}
+	if kind.MaxTokens <= 0 {
+		kind.MaxTokens = 4000
+	}
+	if kind.Validation.MinLength < 0 {
+		return fmt.Errorf("minLength must not be negative")
+	}
+
+	kind.systemPrompt = base
+	if p := strings.TrimSpace(kind.Prompt); p != "" {
+		kind.systemPrompt += "\n\n" + p
+	}
+	return nil
+}
+
+// Get returns the kind with the given ID, falling back to the default kind
+// when id is empty
+func (c *TemplateCatalog) Get(id string) (*TemplateKind, bool) {
+	if id == "" {
+		id = defaultTemplateKind
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	kind, ok := c.kinds[id]
+	return kind, ok
+}
+
+// List returns all kinds, built-in ones first, each group sorted by ID
+func (c *TemplateCatalog) List() []*TemplateKind {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	kinds := make([]*TemplateKind, 0, len(c.kinds))
+	for _, kind := range c.kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if kinds[i].Custom != kinds[j].Custom {
+			return !kinds[i].Custom
+		}
+		return kinds[i].ID < kinds[j].ID
+	})
+	return kinds
+}
+
+var (
+	htmlHeadingPattern = regexp.MustCompile(`(?is)<h([1-6])[^>]*>(.*?)</h[1-6]>`)
+	htmlTagPattern     = regexp.MustCompile(`<[^>]+>`)
+)
+
+// Validate checks generated output, already converted to sanitized HTML,
+// against the kind's rules
+func (k *TemplateKind) Validate(output string) error {
+	if strings.TrimSpace(output) == "" {
+		return fmt.Errorf("output is empty")
+	}
+	if len(output) < k.Validation.MinLength {
+		return fmt.Errorf("output is %d bytes, expected at least %d", len(output), k.Validation.MinLength)
+	}
+
+	var headings []string
+	for _, m := range htmlHeadingPattern.FindAllStringSubmatch(output, -1) {
+		headings = append(headings, htmlTagPattern.ReplaceAllString(m[2], ""))
+	}
+	if len(headings) == 0 {
+		return fmt.Errorf("output has no headings")
+	}
+
+	for _, section := range k.Validation.RequiredSections {
+		found := false
+		for _, h := range headings {
+			if strings.Contains(strings.ToLower(h), strings.ToLower(section)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("output is missing the %q section", section)
+		}
+	}
+	return nil
+}
+
+// TemplatesHandler serves the template catalog
+func TemplatesHandler(catalog *TemplateCatalog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"templates": catalog.List(),
+			"default":   defaultTemplateKind,
+		})
+	}
+}
+
+// TemplateHandler serves one kind of the catalog, named by {id}
+func TemplateHandler(catalog *TemplateCatalog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		kind, ok := catalog.Get(id)
+		if !ok || id == "" {
+			writeError(w, r, errNotFound("Template kind not found"))
+			return
+		}
+		writeJSON(w, http.StatusOK, kind)
+	}
+}
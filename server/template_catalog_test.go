@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// templateDir writes YAML template kinds into a temporary directory
+func templateDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestTemplateCatalogLoad(t *testing.T) {
+	catalog, err := NewTemplateCatalog("")
+	if err != nil {
+		t.Fatalf("NewTemplateCatalog: %v", err)
+	}
+	for id := range builtinKinds {
+		kind, ok := catalog.Get(id)
+		if !ok || kind.Custom || kind.Name == "" {
+			t.Errorf("built-in kind %s = %+v, %v", id, kind, ok)
+		}
+	}
+	if kind, ok := catalog.Get(""); !ok || kind.ID != defaultTemplateKind {
+		t.Errorf("default kind = %+v, %v", kind, ok)
+	}
+	if _, ok := catalog.Get("nope"); ok {
+		t.Errorf("found an unknown kind")
+	}
+
+	dir := templateDir(t, map[string]string{
+		"standard.yaml": "name: House style\nprompt: Always add a summary.\nvalidation:\n  requiredSections: [Summary]\n",
+		"memo.yaml":     "description: A short memo.\nformat: markdown\n",
+		"notes.txt":     "not a template",
+	})
+	catalog, err = NewTemplateCatalog(dir)
+	if err != nil {
+		t.Fatalf("NewTemplateCatalog(%s): %v", dir, err)
+	}
+
+	// A custom file overrides the built-in kind of the same ID
+	standard, _ := catalog.Get("standard")
+	if standard.Name != "House style" || standard.Custom || standard.Format != FormatHTML {
+		t.Errorf("overridden standard = %+v", standard)
+	}
+	if p := standard.SystemPrompt(); !strings.HasPrefix(p, catalog.basePrompts[FormatHTML]) || !strings.HasSuffix(p, "\n\nAlways add a summary.") {
+		t.Errorf("overridden standard prompt = %q", p)
+	}
+
+	// New kinds get defaults and are custom
+	memo, ok := catalog.Get("memo")
+	if !ok || !memo.Custom || memo.Name != "memo" || memo.Format != FormatMarkdown || memo.MaxTokens != 4000 {
+		t.Errorf("memo = %+v, %v", memo, ok)
+	}
+	if memo.SystemPrompt() != catalog.basePrompts[FormatMarkdown] {
+		t.Errorf("memo prompt = %q", memo.SystemPrompt())
+	}
+	if _, ok := catalog.Get("notes"); ok {
+		t.Errorf("loaded a file that is not YAML")
+	}
+
+	// Built-in kinds come first
+	list := catalog.List()
+	if last := list[len(list)-1]; !last.Custom {
+		t.Errorf("last kind %s is built in", last.ID)
+	}
+	for i := 1; i < len(list); i++ {
+		a, b := list[i-1], list[i]
+		if a.Custom == b.Custom && a.ID > b.ID || a.Custom && !b.Custom {
+			t.Errorf("kinds out of order: %s before %s", a.ID, b.ID)
+		}
+	}
+}
+
+func TestTemplateCatalogRejectsMalformed(t *testing.T) {
+	for name, files := range map[string]map[string]string{
+		"invalid YAML":      {"broken.yaml": "name: [unclosed\n"},
+		"unknown format":    {"memo.yaml": "format: latex\n"},
+		"negative length":   {"memo.yaml": "validation:\n  minLength: -1\n"},
+		"invalid ID":        {"Bad_Name.yaml": "name: Bad\n"},
+		"wrong field types": {"memo.yaml": "maxTokens: lots\n"},
+	} {
+		if _, err := NewTemplateCatalog(templateDir(t, files)); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
+
+func TestTemplateValidate(t *testing.T) {
+	kind := &TemplateKind{Validation: TemplateValidation{MinLength: 40, RequiredSections: []string{"Summary", "Next steps"}}}
+	for _, tc := range []struct {
+		name   string
+		output string
+		ok     bool
+	}{
+		{"valid", "<h1>Plan</h1><h2>Summary</h2><p>text</p><h2>Next <em>steps</em></h2>", true},
+		{"case-insensitive sections", "<h1>Plan</h1><h2>SUMMARY</h2><h3 class=\"x\">next steps</h3>", true},
+		{"empty", "  \n", false},
+		{"too short", "<h1>Summary</h1><h2>Next steps</h2>", false},
+		{"no headings", "<p>" + strings.Repeat("Summary and next steps. ", 3) + "</p>", false},
+		{"missing section", "<h1>Plan</h1><h2>Summary</h2><p>" + strings.Repeat("text ", 10) + "</p>", false},
+	} {
+		if err := kind.Validate(tc.output); (err == nil) != tc.ok {
+			t.Errorf("%s: Validate = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestTemplatesHandler(t *testing.T) {
+	catalog, err := NewTemplateCatalog(templateDir(t, map[string]string{"memo.yaml": "name: Memo\nvalidation:\n  minLength: 10\n"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := chi.NewRouter()
+	r.Get("/api/templates", TemplatesHandler(catalog))
+	r.Get("/api/templates/{id}", TemplateHandler(catalog))
+	get := func(path string, v interface{}) int {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if v != nil && rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+				t.Fatalf("GET %s: decode: %v", path, err)
+			}
+		}
+		return rec.Code
+	}
+
+	var list struct {
+		Templates []map[string]interface{} `json:"templates"`
+		Default   string                   `json:"default"`
+	}
+	if code := get("/api/templates", &list); code != http.StatusOK || list.Default != defaultTemplateKind || len(list.Templates) != len(catalog.List()) {
+		t.Fatalf("list: status = %d, body = %+v", code, list)
+	}
+	for _, kind := range list.Templates {
+		if _, ok := kind["prompt"]; ok {
+			t.Errorf("list exposes the prompt of %v", kind["id"])
+		}
+	}
+
+	var memo map[string]interface{}
+	if code := get("/api/templates/memo", &memo); code != http.StatusOK {
+		t.Fatalf("get: status = %d", code)
+	}
+	if memo["id"] != "memo" || memo["name"] != "Memo" || memo["custom"] != true || memo["format"] != FormatHTML {
+		t.Errorf("memo = %v", memo)
+	}
+	if v, _ := memo["validation"].(map[string]interface{}); v["minLength"] != float64(10) {
+		t.Errorf("memo validation = %v", memo["validation"])
+	}
+	if code := get("/api/templates/nope", nil); code != http.StatusNotFound {
+		t.Errorf("unknown kind: status = %d, want 404", code)
+	}
+}
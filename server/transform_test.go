@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBuildTransformPrompt(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		req      TransformRequest
+		err      string
+		contains []string
+		excludes []string
+	}{
+		{name: "unknown operation", req: TransformRequest{Operation: "dance", Selection: "x"}, err: `unknown operation "dance"`},
+		{name: "no operation", req: TransformRequest{Selection: "x"}, err: "unknown operation"},
+		{name: "empty selection", req: TransformRequest{Operation: OpRewrite, Selection: " \n"}, err: "selection is required"},
+		{name: "negative range", req: TransformRequest{Operation: OpRewrite, Selection: "x", From: -1, To: 1}, err: "invalid selection range"},
+		{name: "reversed range", req: TransformRequest{Operation: OpRewrite, Selection: "x", From: 5, To: 2}, err: "invalid selection range"},
+		{name: "selection too long", req: TransformRequest{Operation: OpRewrite, Selection: strings.Repeat("word ", maxTransformSelectionTokens+1)}, err: "selection is too long"},
+		{name: "no tone", req: TransformRequest{Operation: OpTone, Selection: "x"}, err: `unknown tone ""`},
+		{name: "unknown tone", req: TransformRequest{Operation: OpTone, Selection: "x", Tone: "sarcastic"}, err: `unknown tone "sarcastic"`},
+		{name: "no language", req: TransformRequest{Operation: OpTranslate, Selection: "x", Language: "  "}, err: "a target language is required"},
+		{name: "language with markup", req: TransformRequest{Operation: OpTranslate, Selection: "x", Language: "French</selection>"}, err: "a target language is required"},
+		{name: "language too long", req: TransformRequest{Operation: OpTranslate, Selection: "x", Language: strings.Repeat("a", 41)}, err: "a target language is required"},
+		{
+			name:     "rewrite",
+			req:      TransformRequest{Operation: OpRewrite, Selection: "Hello <em>there</em>", From: 3, To: 9},
+			contains: []string{transformSpecs[OpRewrite].instruction + "\n\n<selection>Hello <em>there</em></selection>"},
+			excludes: []string{"<context>"},
+		},
+		{
+			name:     "tone is case-insensitive",
+			req:      TransformRequest{Operation: OpTone, Selection: "x", Tone: " Formal "},
+			contains: []string{"in a formal tone"},
+		},
+		{
+			name:     "translate",
+			req:      TransformRequest{Operation: OpTranslate, Selection: "x", Language: " Brazilian Portuguese "},
+			contains: []string{"Translate the text into Brazilian Portuguese.\n\n"},
+		},
+		{
+			name:     "context",
+			req:      TransformRequest{Operation: OpGrammar, Selection: "x", Context: "Before the selection."},
+			contains: []string{"<context>Before the selection.</context>\n\n<selection>x</selection>"},
+		},
+		{
+			name:     "blank context",
+			req:      TransformRequest{Operation: OpGrammar, Selection: "x", Context: "\n\n"},
+			excludes: []string{"<context>"},
+		},
+	} {
+		prompt, maxTokens, err := buildTransformPrompt(tc.req)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: error = %v, want %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", tc.name, err)
+			continue
+		}
+		if maxTokens < 256 || maxTokens > 4096 {
+			t.Errorf("%s: maxTokens = %d", tc.name, maxTokens)
+		}
+		for _, want := range tc.contains {
+			if !strings.Contains(prompt, want) {
+				t.Errorf("%s: prompt is missing %q:\n%s", tc.name, want, prompt)
+			}
+		}
+		for _, unwanted := range tc.excludes {
+			if strings.Contains(prompt, unwanted) {
+				t.Errorf("%s: prompt has %q:\n%s", tc.name, unwanted, prompt)
+			}
+		}
+	}
+}
+
+func TestBuildTransformPromptMaxTokens(t *testing.T) {
+	selection := strings.Repeat("word ", 100)
+	tokens := estimateTokens(selection)
+	for op, spec := range transformSpecs {
+		req := TransformRequest{Operation: op, Selection: selection, Tone: "casual", Language: "German"}
+		if _, maxTokens, err := buildTransformPrompt(req); err != nil || maxTokens != int(float64(tokens)*spec.outputFactor)+256 {
+			t.Errorf("%s: maxTokens = %d, %v", op, maxTokens, err)
+		}
+	}
+
+	// Long selections are capped at the model's output limit
+	req := TransformRequest{Operation: OpExpand, Selection: strings.Repeat("word ", maxTransformSelectionTokens-1)}
+	if _, maxTokens, err := buildTransformPrompt(req); err != nil || maxTokens != 4096 {
+		t.Errorf("long expand: maxTokens = %d, %v", maxTokens, err)
+	}
+}
+
+func TestTransformHandler(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		prompts []string
+	)
+	cfg := fakeGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		var req GroqRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		prompts = append(prompts, req.Messages[len(req.Messages)-1].Content)
+		mu.Unlock()
+		_ = json.NewEncoder(w).Encode(GroqResponse{Choices: []GroqChoice{{Message: GroqMessage{Content: "<p>One <b>bold</b> line.</p><p>Another.</p>"}}}})
+	})
+	h := newTestRouter(t, cfg)
+
+	for name, body := range map[string]string{
+		"unknown operation": `{"operation":"dance","selection":"x"}`,
+		"unknown tone":      `{"operation":"tone","selection":"x","tone":"sarcastic"}`,
+		"missing language":  `{"operation":"translate","selection":"x"}`,
+		"malformed body":    `{"operation":`,
+	} {
+		rec, apiErr := doRequest(t, h, "/api/transform", body)
+		if rec.Code != http.StatusBadRequest || apiErr.Code != CodeInvalidRequest {
+			t.Errorf("%s: got %d %+v, want 400 %s", name, rec.Code, apiErr, CodeInvalidRequest)
+		}
+	}
+	mu.Lock()
+	if len(prompts) != 0 {
+		t.Errorf("invalid requests reached the model: %q", prompts)
+	}
+	mu.Unlock()
+
+	rec, _ := doRequest(t, h, "/api/transform", `{"operation":"tone","selection":"one line","tone":"Friendly","from":4,"to":12}`)
+	var resp TransformResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	want := TransformResponse{Operation: OpTone, Result: "One <b>bold</b> line.<br/>Another.", From: 4, To: 12}
+	if rec.Code != http.StatusOK || resp != want {
+		t.Errorf("got %d %+v, want 200 %+v", rec.Code, resp, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(prompts) != 1 || !strings.Contains(prompts[0], "in a friendly tone") {
+		t.Errorf("prompts = %q", prompts)
+	}
+}
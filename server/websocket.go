@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// errPolicyViolation is returned for a message the client's limits refused;
+// the client has already been closed with ClosePolicyViolation
+var errPolicyViolation = errors.New("inbound limit exceeded")
+
+// WebSocketSession is an active WebSocket connection. The read loop only
+// reads; every write (messages, pings, pongs and the close frame) goes
+// through the write loop, which also owns closing the connection.
+type WebSocketSession struct {
+	conn   net.Conn
+	client *Client
+	room   *Room
+	config CollabConfig
+
+	// pongs carries ping payloads from the read loop to the write loop
+	pongs chan []byte
+}
+
+// HandleWebSocket handles WebSocket connections (zero-copy)
+func (h *CollaborationHub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Browsers send Origin on WebSocket upgrades but do not enforce CORS on
+	// them, so the policy has to be checked here
+	if !h.origins.CheckRequest(r) {
+		writeError(w, r, errOriginForbidden())
+		return
+	}
+
+	roomID := r.URL.Path[len("/collab/"):]
+	if err := checkRoomID(roomID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	caller, role, err := h.joinRole(r, roomID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Upgrade to WebSocket
+	conn, _, _, err := ws.UpgradeHTTP(r, w)
+	if err != nil {
+		log.Printf("[WARN] WebSocket upgrade failed: %v", err)
+		return
+	}
+
+	// Joiners over a capacity limit are told why with the close status
+	client, err := h.JoinAs(roomID, "WebSocket", caller.User, role)
+	if err != nil {
+		code, reason := joinCloseStatus(err)
+		_ = conn.SetWriteDeadline(time.Now().Add(h.config.WriteTimeout))
+		closeWebSocket(conn, code, reason)
+		return
+	}
+
+	s := &WebSocketSession{
+		conn:   conn,
+		client: client,
+		room:   client.Room,
+		config: h.config,
+		pongs:  make(chan []byte, 1),
+	}
+	// Ask for whatever the client has that the server does not; the client
+	// asks for the server's state in turn
+	s.room.SendTo(client, encodeSyncMessage(syncStep1, s.room.State.StateVector()))
+	go s.readLoop()
+	go s.writeLoop()
+}
+
+// readLoop relays messages from the client to the room until the
+// connection fails, the client closes it or the client is closed. It is the
+// only place the client leaves the room, so that happens exactly once
+// whatever ends the session.
+func (s *WebSocketSession) readLoop() {
+	defer s.room.Leave(s.client)
+
+	rd := &wsutil.Reader{
+		Source:         s.conn,
+		State:          ws.StateServerSide,
+		CheckUTF8:      true,
+		OnIntermediate: s.handleControl,
+	}
+	for {
+		msg, op, err := s.readMessage(rd)
+		if err != nil {
+			var closed wsutil.ClosedError
+			switch {
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				log.Printf("[INFO] WebSocket client %s timed out after %s without traffic", s.client.ID, s.config.ReadTimeout)
+				s.client.Close(int(ws.StatusGoingAway), "Keepalive timeout")
+			case err != io.EOF && err != errPolicyViolation && !errors.As(err, &closed) && !errors.Is(err, net.ErrClosed):
+				log.Printf("[WARN] WebSocket read error: %v", err)
+			}
+			// Unblocks the write loop if nothing else has closed the client
+			s.client.Close(int(ws.StatusNormalClosure), "")
+			return
+		}
+		if !s.client.Admit(len(msg)) {
+			return
+		}
+
+		// Only handle binary messages (y-protocols)
+		if op == ws.OpBinary {
+			s.handleMessage(msg)
+		}
+	}
+}
+
+// handleMessage applies sync messages to the room's document, carries out
+// suggestion actions and relays everything else (awareness and custom
+// messages) as it is
+func (s *WebSocketSession) handleMessage(msg []byte) {
+	if action, ok := parseSuggestionMessage(msg); ok {
+		if err := s.room.HandleSuggestionAction(s.client, action); err != nil {
+			log.Printf("[WARN] Suggestion action from client %s in room %s failed: %v", s.client.ID, s.room.ID, err)
+		}
+		return
+	}
+	step, payload, ok, err := parseSyncMessage(msg)
+	if !ok {
+		if id, ok := parseAwarenessClient(msg); ok {
+			s.client.declareDocClient(id)
+		}
+		s.room.BroadcastMessage(msg, s.client)
+		return
+	}
+	if err != nil {
+		log.Printf("[WARN] Malformed sync message from client %s: %v", s.client.ID, err)
+		return
+	}
+
+	switch step {
+	case syncStep1:
+		update, err := s.room.State.Diff(payload)
+		if err != nil {
+			log.Printf("[WARN] Invalid state vector from client %s: %v", s.client.ID, err)
+			return
+		}
+		s.room.SendTo(s.client, encodeSyncMessage(syncStep2, update))
+	case syncStep2:
+		if err := s.room.ApplyUpdate(payload, s.client); err != nil {
+			log.Printf("[WARN] Dropped invalid update from client %s in room %s: %v", s.client.ID, s.room.ID, err)
+		}
+	case syncUpdate:
+		if err := s.room.ApplyEdit(payload, s.client); err != nil {
+			log.Printf("[WARN] Dropped invalid update from client %s in room %s: %v", s.client.ID, s.room.ID, err)
+		}
+	default:
+		log.Printf("[WARN] Unknown sync step %d from client %s", step, s.client.ID)
+	}
+}
+
+// readMessage reads the next data message from rd, handling control frames
+// on the way. Every frame extends the read deadline, so a client that
+// answers pings is never timed out. A message over the client's size limit
+// is refused before its payload is read.
+func (s *WebSocketSession) readMessage(rd *wsutil.Reader) ([]byte, ws.OpCode, error) {
+	for {
+		if err := s.conn.SetReadDeadline(time.Now().Add(s.config.ReadTimeout)); err != nil {
+			return nil, 0, err
+		}
+		hdr, err := rd.NextFrame()
+		if err != nil {
+			return nil, 0, err
+		}
+		if hdr.OpCode.IsControl() {
+			if err := s.handleControl(hdr, rd); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if !s.client.AdmitSize(int(hdr.Length)) {
+			return nil, 0, errPolicyViolation
+		}
+
+		// Fragmented messages can grow past the first frame's length
+		var src io.Reader = rd
+		if limit := s.client.limiter.maxMessageSize; limit > 0 {
+			src = io.LimitReader(rd, int64(limit)+1)
+		}
+		msg, err := io.ReadAll(src)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !s.client.AdmitSize(len(msg)) {
+			return nil, 0, errPolicyViolation
+		}
+		return msg, hdr.OpCode, nil
+	}
+}
+
+// handleControl handles a ping, pong or close frame. Replies are handed to
+// the write loop rather than written here.
+func (s *WebSocketSession) handleControl(hdr ws.Header, r io.Reader) error {
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	switch hdr.OpCode {
+	case ws.OpPing:
+		select {
+		case s.pongs <- payload:
+		default:
+			// A pong is already queued; one answer for a burst of pings is enough
+		}
+	case ws.OpClose:
+		// Echo the client's status, as the closing handshake requires
+		code, reason := ws.ParseCloseFrameData(payload)
+		if code.Empty() || code.IsProtocolReserved() {
+			code = ws.StatusNormalClosure
+		}
+		s.client.Close(int(code), reason)
+		return wsutil.ClosedError{Code: code, Reason: reason}
+	}
+	// Pongs need no answer; receiving one already extended the deadline
+	return nil
+}
+
+// writeLoop sends room messages, pongs and periodic pings until the client
+// is closed or leaves the room, then sends the close frame and closes the
+// connection
+func (s *WebSocketSession) writeLoop() {
+	ticker := time.NewTicker(s.config.PingInterval)
+	defer ticker.Stop()
+	defer func() { _ = s.conn.Close() }()
+
+	for {
+		select {
+		case msg, ok := <-s.client.Send:
+			if !ok {
+				// Left the room; pass on the close status if there is one
+				select {
+				case <-s.client.Done():
+					s.sendClose()
+				default:
+				}
+				return
+			}
+			if err := s.write(ws.NewBinaryFrame(msg)); err != nil {
+				log.Printf("[WARN] WebSocket write error: %v", err)
+				return
+			}
+			s.client.bytesOut.Add(int64(len(msg)))
+
+		case payload := <-s.pongs:
+			if err := s.write(ws.NewPongFrame(payload)); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			if err := s.write(ws.NewPingFrame(nil)); err != nil {
+				log.Printf("[INFO] WebSocket ping to client %s failed: %v", s.client.ID, err)
+				return
+			}
+
+		case <-s.client.Done():
+			s.sendClose()
+			return
+		}
+	}
+}
+
+// write sends one frame, giving up after the write timeout so a client that
+// stopped reading cannot block the loop forever
+func (s *WebSocketSession) write(frame ws.Frame) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout)); err != nil {
+		return err
+	}
+	return ws.WriteFrame(s.conn, frame)
+}
+
+// sendClose sends the client's close status
+func (s *WebSocketSession) sendClose() {
+	code, reason := s.client.CloseStatus()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+	closeWebSocket(s.conn, code, reason)
+}
+
+// closeWebSocket sends a close frame with code and reason and closes conn
+func closeWebSocket(conn net.Conn, code int, reason string) {
+	body := ws.NewCloseFrameBody(ws.StatusCode(code), reason)
+	_ = ws.WriteFrame(conn, ws.NewCloseFrame(body))
+	_ = conn.Close()
+}
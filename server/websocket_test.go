@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// wsTestConn is the client side of a test WebSocket connection
+type wsTestConn struct {
+	t *testing.T
+	net.Conn
+	// br holds frames read along with the handshake response
+	br *bufio.Reader
+}
+
+func (c *wsTestConn) Read(p []byte) (int, error) {
+	if c.br != nil && c.br.Buffered() > 0 {
+		return c.br.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+// readFrame reads one unfragmented server frame
+func (c *wsTestConn) readFrame() (ws.Header, []byte) {
+	c.t.Helper()
+	hdr, err := ws.ReadHeader(c)
+	if err != nil {
+		c.t.Fatalf("read frame: %v", err)
+	}
+	payload := make([]byte, hdr.Length)
+	if _, err := io.ReadFull(c, payload); err != nil {
+		c.t.Fatalf("read payload: %v", err)
+	}
+	return hdr, payload
+}
+
+// readCloseCode skips server frames until the close frame and returns its
+// status code
+func (c *wsTestConn) readCloseCode() int {
+	c.t.Helper()
+	for {
+		hdr, payload := c.readFrame()
+		if hdr.OpCode == ws.OpClose {
+			code, _ := ws.ParseCloseFrameData(payload)
+			return int(code)
+		}
+	}
+}
+
+// dialTestWebSocket joins roomID on a test server running the hub
+func dialTestWebSocket(t *testing.T, hub *CollaborationHub, roomID string) *wsTestConn {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(hub.HandleWebSocket))
+	t.Cleanup(srv.Close)
+
+	conn, br, _, err := ws.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http")+"/collab/"+roomID)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &wsTestConn{t: t, Conn: conn, br: br}
+}
+
+// waitForConnections polls until the hub counts n clients
+func waitForConnections(t *testing.T, hub *CollaborationHub, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.connections.Load() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("connections = %d, want %d", hub.connections.Load(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebSocketKeepalive(t *testing.T) {
+	cfg := DefaultConfig().Collab
+	cfg.PingInterval = 20 * time.Millisecond
+	cfg.ReadTimeout = 200 * time.Millisecond
+	hub := NewCollaborationHub(cfg, &OriginPolicy{allowAll: true})
+
+	// wsutil answers the server's pings while reading
+	conn := dialTestWebSocket(t, hub, "doc")
+	rd := wsutil.NewClientSideReader(conn)
+	rd.OnIntermediate = wsutil.ControlFrameHandler(conn, ws.StateClientSide)
+	// Answering pings for longer than the read timeout keeps the client
+	pings := 0
+	until := time.Now().Add(2 * cfg.ReadTimeout)
+	for pings < 3 || time.Now().Before(until) {
+		hdr, err := rd.NextFrame()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if !hdr.OpCode.IsControl() {
+			// The server's sync messages
+			if err := rd.Discard(); err != nil {
+				t.Fatalf("discard message: %v", err)
+			}
+			continue
+		}
+		if hdr.OpCode == ws.OpPing {
+			pings++
+		}
+		if err := rd.OnIntermediate(hdr, rd); err != nil {
+			t.Fatalf("answer ping: %v", err)
+		}
+	}
+	if n := hub.connections.Load(); n != 1 {
+		t.Errorf("connections = %d after answering pings, want 1", n)
+	}
+}
+
+func TestWebSocketDeadClient(t *testing.T) {
+	cfg := DefaultConfig().Collab
+	cfg.PingInterval = 20 * time.Millisecond
+	cfg.ReadTimeout = 100 * time.Millisecond
+	hub := NewCollaborationHub(cfg, &OriginPolicy{allowAll: true})
+
+	// A client that never answers is dropped and leaves the room
+	conn := dialTestWebSocket(t, hub, "doc")
+	waitForConnections(t, hub, 1)
+	if code := conn.readCloseCode(); code != int(ws.StatusGoingAway) {
+		t.Errorf("close code = %d, want %d", code, ws.StatusGoingAway)
+	}
+	waitForConnections(t, hub, 0)
+	if _, ok := hub.Room("doc"); ok {
+		t.Errorf("room of the dead client is still open")
+	}
+}
+
+func TestWebSocketControlFrames(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, &OriginPolicy{allowAll: true})
+	conn := dialTestWebSocket(t, hub, "doc")
+
+	// Ping is answered with a pong carrying the same payload
+	if err := ws.WriteFrame(conn, ws.MaskFrame(ws.NewPingFrame([]byte("hi")))); err != nil {
+		t.Fatalf("write ping: %v", err)
+	}
+	hdr, payload := conn.readFrame()
+	for hdr.OpCode == ws.OpBinary {
+		// Skip the server's sync step 1
+		hdr, payload = conn.readFrame()
+	}
+	if hdr.OpCode != ws.OpPong {
+		t.Fatalf("got %v, want a pong", hdr.OpCode)
+	}
+	if string(payload) != "hi" {
+		t.Errorf("pong payload = %q", payload)
+	}
+
+	// Close is echoed and the client leaves the room once
+	body := ws.NewCloseFrameBody(ws.StatusGoingAway, "bye")
+	if err := ws.WriteFrame(conn, ws.MaskFrame(ws.NewCloseFrame(body))); err != nil {
+		t.Fatalf("write close: %v", err)
+	}
+	if code := conn.readCloseCode(); code != int(ws.StatusGoingAway) {
+		t.Errorf("echoed close code = %d, want %d", code, ws.StatusGoingAway)
+	}
+	waitForConnections(t, hub, 0)
+}
+
+func TestWebSocketSync(t *testing.T) {
+	hub := NewCollaborationHub(DefaultConfig().Collab, &OriginPolicy{allowAll: true})
+	send := func(conn *wsTestConn, msg []byte) {
+		if err := ws.WriteFrame(conn, ws.MaskFrame(ws.NewBinaryFrame(msg))); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	// syncMessage reads frames until a sync message with the given step
+	syncMessage := func(conn *wsTestConn, want int) []byte {
+		for {
+			hdr, msg := conn.readFrame()
+			if hdr.OpCode != ws.OpBinary {
+				continue
+			}
+			if step, payload, ok, err := parseSyncMessage(msg); ok && err == nil && step == want {
+				return payload
+			}
+		}
+	}
+
+	// The server asks a new client for its state and keeps the answer
+	writer := dialTestWebSocket(t, hub, "doc")
+	syncMessage(writer, syncStep1)
+	local := NewYDoc()
+	send(writer, encodeSyncMessage(syncStep2, insertText(local, "t", "hello")))
+	send(writer, encodeSyncMessage(syncUpdate, insertText(local, "t", " world")))
+
+	// A later client gets the document in answer to its sync step 1
+	reader := dialTestWebSocket(t, hub, "doc")
+	replica := NewYDoc()
+	deadline := time.Now().Add(5 * time.Second)
+	for replica.root("t").text() != "hello world" {
+		if time.Now().After(deadline) {
+			t.Fatalf("replica text = %q", replica.root("t").text())
+		}
+		send(reader, encodeSyncMessage(syncStep1, replica.StateVector().encode()))
+		mustApply(t, replica, syncMessage(reader, syncStep2))
+	}
+
+	// Malformed updates are dropped without disconnecting the client
+	send(writer, encodeSyncMessage(syncUpdate, []byte{0xff, 0xff}))
+	send(writer, encodeSyncMessage(syncUpdate, insertText(local, "t", "!")))
+	mustApply(t, replica, syncMessage(reader, syncUpdate))
+	if got := replica.root("t").text(); got != "hello world!" {
+		t.Errorf("replica text = %q", got)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -19,6 +20,9 @@ type WebTransportSession struct {
 	textStream       *webtransport.Stream // Stream 1: Text operations
 	formattingStream *webtransport.Stream // Stream 2: Formatting
 	structureStream  *webtransport.Stream // Stream 3: Structure
+	// eventStreams carry comment and suggestion events by stream type;
+	// each is opened by the server on its first event
+	eventStreams map[byte]*webtransport.SendStream
 
 	// Synchronization: signals when streams are ready
 	streamsReady chan struct{}
@@ -26,20 +30,37 @@ type WebTransportSession struct {
 	streamsCount int
 }
 
-// StartWebTransportServer starts an HTTP/3 server for WebTransport
-func StartWebTransportServer(port string, hub *CollaborationHub, certFile, keyFile string) error {
-	// Create the WebTransport server
-	wt := webtransport.Server{
+// NewWebTransportServer creates the HTTP/3 server for WebTransport. Requests
+// other than WebTransport sessions are passed to api, so the HTTP/3 server
+// serves the same REST routes as the TCP listener. The caller serves it on a
+// UDP socket with Serve and stops it with Close.
+func NewWebTransportServer(cfg *Config, hub *CollaborationHub, certs *CertManager, api http.Handler) *webtransport.Server {
+	// Create the WebTransport server. Certificates come from the manager on
+	// every handshake, so rotations apply without restarting the listener.
+	wt := &webtransport.Server{
 		H3: http3.Server{
-			Addr: ":" + port,
+			Addr:      fmt.Sprintf(":%d", cfg.HTTP3Port),
+			TLSConfig: certs.TLSConfig(),
 		},
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin: hub.origins.CheckRequest,
 	}
 
 	// Create a mux for the WebTransport server
 	mux := http.NewServeMux()
 	mux.HandleFunc("/collab/", func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("[DEBUG] WebTransport handler received request: %s %s", r.Method, r.URL.Path)
+		// Only extended CONNECT requests can become WebTransport sessions
+		if r.Method != http.MethodConnect {
+			writeError(w, r, errBadRequest("WebTransport sessions must be opened with CONNECT"))
+			return
+		}
+
+		// Reject before creating the room; Upgrade would check again
+		if !hub.origins.CheckRequest(r) {
+			writeError(w, r, errOriginForbidden())
+			return
+		}
+
 		// Extract room ID from path
 		// Path is /collab/{roomID}
 		roomID := r.URL.Path[len("/collab/"):]
@@ -47,8 +68,15 @@ func StartWebTransportServer(port string, hub *CollaborationHub, certFile, keyFi
 			http.Error(w, "Missing room ID", http.StatusBadRequest)
 			return
 		}
-
-		room := hub.GetOrCreateRoom(roomID)
+		if err := checkRoomID(roomID); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		caller, role, err := hub.joinRole(r, roomID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
 
 		// Upgrade to WebTransport
 		session, err := wt.Upgrade(w, r)
@@ -58,33 +86,52 @@ func StartWebTransportServer(port string, hub *CollaborationHub, certFile, keyFi
 			return
 		}
 
-		client := NewClient(room, "WebTransport")
-		room.Register <- client
+		// Joiners over a capacity limit are told why with the session error
+		client, err := hub.JoinAs(roomID, "WebTransport", caller.User, role)
+		if err != nil {
+			code, reason := joinCloseStatus(err)
+			_ = session.CloseWithError(webtransport.SessionErrorCode(code), reason)
+			return
+		}
+		room := client.Room
 
 		wts := &WebTransportSession{
 			session:      session,
 			client:       client,
 			room:         room,
+			eventStreams: make(map[byte]*webtransport.SendStream),
 			streamsReady: make(chan struct{}),
 			streamsCount: 0,
 		}
 
 		log.Printf("[INFO] WebTransport session established for room %s", roomID)
 
+		// The client starts from the server's copy of the document; the
+		// messages wait in the send queue until its streams are open
+		state, err := room.State.Diff(nil)
+		if err == nil {
+			var msgs [][]byte
+			if msgs, err = encodeWebTransportUpdate(state); err == nil {
+				room.SendTo(client, msgs...)
+			}
+		}
+		if err != nil {
+			log.Printf("[WARN] Could not send room %s state to client %s: %v", roomID, client.ID, err)
+		}
+
 		// Handle the session
 		wts.handleSession()
 	})
+	mux.Handle("/", api)
 
 	wt.H3.Handler = mux
-
-	log.Printf("[INFO] Starting HTTP/3 (QUIC) server on port %s for WebTransport", port)
-	return wt.ListenAndServeTLS(certFile, keyFile)
+	return wt
 }
 
 // handleSession manages the WebTransport session lifecycle
 func (wts *WebTransportSession) handleSession() {
 	defer func() {
-		wts.room.Unregister <- wts.client
+		wts.room.Leave(wts.client)
 		_ = wts.session.CloseWithError(0, "session closed")
 		log.Printf("[INFO] WebTransport session closed for client %s", wts.client.ID)
 	}()
@@ -101,8 +148,13 @@ func (wts *WebTransportSession) handleSession() {
 	// We run this in the same goroutine or separate? Separate is fine.
 	go wts.handleOutgoingMessages(ctx)
 
-	// Wait for session to close
-	<-wts.session.Context().Done()
+	// Wait for session to close, or for the server to close it
+	select {
+	case <-wts.session.Context().Done():
+	case <-wts.client.Done():
+		code, reason := wts.client.CloseStatus()
+		_ = wts.session.CloseWithError(webtransport.SessionErrorCode(code), reason)
+	}
 }
 
 // handleIncomingStreams processes incoming bidirectional streams
@@ -144,6 +196,8 @@ func (wts *WebTransportSession) handleStream(stream *webtransport.Stream) {
 		wts.handleFormattingStream(stream)
 	case 0x03: // Structure stream
 		wts.handleStructureStream(stream)
+	case streamSuggestions: // Suggestion actions
+		wts.handleSuggestionStream(stream)
 	default:
 		log.Printf("[WARN] Unknown stream type: 0x%02x", streamType)
 	}
@@ -188,6 +242,9 @@ func (wts *WebTransportSession) handleTextOpStream(stream *webtransport.Stream)
 
 		msgLen := int(lenBuf[0])<<8 | int(lenBuf[1])
 		log.Printf("[DEBUG] Message length: %d. Reading payload...", msgLen)
+		if !wts.client.AdmitSize(msgLen) {
+			return
+		}
 
 		// Read message
 		msg := make([]byte, msgLen)
@@ -197,9 +254,26 @@ func (wts *WebTransportSession) handleTextOpStream(stream *webtransport.Stream)
 			return
 		}
 
-		// Broadcast to room (zero-copy relay)
+		if !wts.client.Admit(2 + msgLen) {
+			return
+		}
+
+		// Y.js updates go through the room's document
+		if msgLen > 0 && msg[0] == opYjsUpdate {
+			if err := wts.room.ApplyEdit(msg[1:], wts.client); err != nil {
+				log.Printf("[WARN] Dropped invalid update from client %s in room %s: %v", wts.client.ID, wts.room.ID, err)
+			}
+			continue
+		}
+
+		// Legacy ops bypass the document, so only editors may send them
+		if !wts.client.Role.AtLeast(RoleEditor) {
+			continue
+		}
+
+		// Broadcast legacy text ops to room (zero-copy relay)
 		// Prefix with 0x01 to indicate Text Op
-		broadcastMsg := append([]byte{0x01}, msg...)
+		broadcastMsg := append([]byte{streamTextOps}, msg...)
 		log.Printf("[DEBUG] Broadcasting text op to room...")
 		wts.room.BroadcastMessage(broadcastMsg, wts.client)
 
@@ -223,6 +297,9 @@ func (wts *WebTransportSession) handleFormattingStream(stream *webtransport.Stre
 		}
 
 		msgLen := int(lenBuf[0])<<8 | int(lenBuf[1])
+		if !wts.client.AdmitSize(msgLen) {
+			return
+		}
 		msg := make([]byte, msgLen)
 		_, err = io.ReadFull(stream, msg)
 		if err != nil {
@@ -230,6 +307,14 @@ func (wts *WebTransportSession) handleFormattingStream(stream *webtransport.Stre
 			return
 		}
 
+		if !wts.client.Admit(2 + msgLen) {
+			return
+		}
+
+		if !wts.client.Role.AtLeast(RoleEditor) {
+			continue
+		}
+
 		// Prefix with 0x02 for Formatting
 		broadcastMsg := append([]byte{0x02}, msg...)
 		wts.room.BroadcastMessage(broadcastMsg, wts.client)
@@ -253,6 +338,9 @@ func (wts *WebTransportSession) handleStructureStream(stream *webtransport.Strea
 		}
 
 		msgLen := int(lenBuf[0])<<8 | int(lenBuf[1])
+		if !wts.client.AdmitSize(msgLen) {
+			return
+		}
 		msg := make([]byte, msgLen)
 		_, err = io.ReadFull(stream, msg)
 		if err != nil {
@@ -260,6 +348,14 @@ func (wts *WebTransportSession) handleStructureStream(stream *webtransport.Strea
 			return
 		}
 
+		if !wts.client.Admit(2 + msgLen) {
+			return
+		}
+
+		if !wts.client.Role.AtLeast(RoleEditor) {
+			continue
+		}
+
 		// Prefix with 0x03 for Structure
 		broadcastMsg := append([]byte{0x03}, msg...)
 		wts.room.BroadcastMessage(broadcastMsg, wts.client)
@@ -279,6 +375,10 @@ func (wts *WebTransportSession) handleIncomingDatagrams(ctx context.Context) {
 			return
 		}
 
+		if !wts.client.Admit(len(msg)) {
+			return
+		}
+
 		// Broadcast awareness (cursor position) to all clients
 		// Prefix with 0x04 for Awareness (Datagram)
 		broadcastMsg := append([]byte{0x04}, msg...)
@@ -327,6 +427,7 @@ func (wts *WebTransportSession) handleOutgoingMessages(ctx context.Context) {
 					log.Printf("[WARN] Failed to write payload to text stream: %v", err)
 					return
 				}
+				wts.client.bytesOut.Add(int64(2 + len(payload)))
 				log.Printf("[DEBUG] Text op sent successfully to client %s", wts.client.ID)
 			} else {
 				log.Printf("[WARN] textStream is nil for client %s, cannot send text op!", wts.client.ID)
@@ -342,6 +443,7 @@ func (wts *WebTransportSession) handleOutgoingMessages(ctx context.Context) {
 					log.Printf("[WARN] Failed to write payload to formatting stream: %v", err)
 					return
 				}
+				wts.client.bytesOut.Add(int64(2 + len(payload)))
 			}
 		} else if msgType == 0x03 { // Structure -> Reliable Stream
 			if wts.structureStream != nil {
@@ -354,6 +456,7 @@ func (wts *WebTransportSession) handleOutgoingMessages(ctx context.Context) {
 					log.Printf("[WARN] Failed to write payload to structure stream: %v", err)
 					return
 				}
+				wts.client.bytesOut.Add(int64(2 + len(payload)))
 			}
 		} else if msgType == 0x04 { // Awareness -> Datagram
 			err := wts.session.SendDatagram(payload)
@@ -361,9 +464,92 @@ func (wts *WebTransportSession) handleOutgoingMessages(ctx context.Context) {
 				log.Printf("[WARN] Failed to send datagram: %v", err)
 				return
 			}
+			wts.client.bytesOut.Add(int64(len(payload)))
+		} else if msgType == streamSystemNotice { // System notice -> its own uni stream
+			if err := wts.sendNotice(msg); err != nil {
+				log.Printf("[WARN] Failed to send system notice: %v", err)
+				return
+			}
+			wts.client.bytesOut.Add(int64(len(msg)))
+		} else if msgType == streamComments || msgType == streamSuggestions { // Event -> its event stream
+			if err := wts.sendEvent(msgType, payload); err != nil {
+				log.Printf("[WARN] Failed to send event on stream 0x%02x: %v", msgType, err)
+				return
+			}
+			wts.client.bytesOut.Add(int64(2 + len(payload)))
 		} else {
 			// Fallback for other types or if stream not ready
 			// log.Printf("[WARN] Unknown message type or no stream: 0x%02x", msgType)
 		}
 	}
 }
+
+// sendNotice delivers a system notice on a new unidirectional stream: the
+// stream type byte followed by the notice JSON
+func (wts *WebTransportSession) sendNotice(msg []byte) error {
+	stream, err := wts.session.OpenUniStream()
+	if err != nil {
+		return err
+	}
+	if _, err := stream.Write(msg); err != nil {
+		stream.CancelWrite(0)
+		return err
+	}
+	return stream.Close()
+}
+
+// sendEvent writes a comment or suggestion event to the event stream of
+// that type, opening it with the type byte first. Events are length-prefixed
+// like the other streams' messages, so larger ones are dropped.
+func (wts *WebTransportSession) sendEvent(streamType byte, payload []byte) error {
+	if len(payload) > 0xFFFF {
+		log.Printf("[WARN] Dropped a %d byte event for client %s", len(payload), wts.client.ID)
+		return nil
+	}
+	stream := wts.eventStreams[streamType]
+	if stream == nil {
+		var err error
+		if stream, err = wts.session.OpenUniStream(); err != nil {
+			return err
+		}
+		if _, err := stream.Write([]byte{streamType}); err != nil {
+			stream.CancelWrite(0)
+			return err
+		}
+		wts.eventStreams[streamType] = stream
+	}
+	lenBuf := []byte{byte(len(payload) >> 8), byte(len(payload) & 0xFF)}
+	_, err := stream.Write(append(lenBuf, payload...))
+	return err
+}
+
+// handleSuggestionStream carries out the accept and reject actions an owner
+// sends as length-prefixed JSON
+func (wts *WebTransportSession) handleSuggestionStream(stream *webtransport.Stream) {
+	for {
+		lenBuf := make([]byte, 2)
+		if _, err := io.ReadFull(stream, lenBuf); err != nil {
+			if err != io.EOF {
+				log.Printf("[WARN] Suggestion stream read error: %v", err)
+			}
+			return
+		}
+
+		msgLen := int(lenBuf[0])<<8 | int(lenBuf[1])
+		if !wts.client.AdmitSize(msgLen) {
+			return
+		}
+		msg := make([]byte, msgLen)
+		if _, err := io.ReadFull(stream, msg); err != nil {
+			log.Printf("[WARN] Failed to read suggestion action: %v", err)
+			return
+		}
+		if !wts.client.Admit(2 + msgLen) {
+			return
+		}
+
+		if err := wts.room.HandleSuggestionAction(wts.client, msg); err != nil {
+			log.Printf("[WARN] Suggestion action from client %s in room %s failed: %v", wts.client.ID, wts.room.ID, err)
+		}
+	}
+}
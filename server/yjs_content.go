@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf16"
+)
+
+// Content reference numbers, stored in the low five bits of a struct's info
+// byte
+const (
+	refGC      = 0
+	refDeleted = 1
+	refJSON    = 2
+	refBinary  = 3
+	refString  = 4
+	refEmbed   = 5
+	refFormat  = 6
+	refType    = 7
+	refAny     = 8
+	refDoc     = 9
+	refSkip    = 10
+)
+
+// Shared type references written by ContentType
+const (
+	yArrayRef       = 0
+	yMapRef         = 1
+	yTextRef        = 2
+	yXmlElementRef  = 3
+	yXmlFragmentRef = 4
+	yXmlHookRef     = 5
+	yXmlTextRef     = 6
+)
+
+// yContent is the payload of an item. Lengths are in clock units: UTF-16
+// code units for strings, elements for arrays, one for everything else.
+type yContent interface {
+	ref() byte
+	length() int
+	// countable reports whether the content counts towards its parent's
+	// length; formatting marks and deleted content do not
+	countable() bool
+	// splice keeps the first offset units and returns the rest
+	splice(offset int) yContent
+	// write encodes the content, skipping the first offset units
+	write(e *yEncoder, offset int)
+	// mergeWith appends right if both are the same kind of content
+	mergeWith(right yContent) bool
+}
+
+// contentDeleted stands in for content that was deleted and collected
+type contentDeleted struct{ n int }
+
+func (c *contentDeleted) ref() byte       { return refDeleted }
+func (c *contentDeleted) length() int     { return c.n }
+func (c *contentDeleted) countable() bool { return false }
+func (c *contentDeleted) splice(offset int) yContent {
+	right := &contentDeleted{n: c.n - offset}
+	c.n = offset
+	return right
+}
+func (c *contentDeleted) write(e *yEncoder, offset int) { e.writeLen(c.n - offset) }
+func (c *contentDeleted) mergeWith(right yContent) bool {
+	r, ok := right.(*contentDeleted)
+	if ok {
+		c.n += r.n
+	}
+	return ok
+}
+
+// contentJSON is the legacy JSON array content; values are kept as their
+// JSON text, with "undefined" for undefined
+type contentJSON struct{ values []string }
+
+func (c *contentJSON) ref() byte       { return refJSON }
+func (c *contentJSON) length() int     { return len(c.values) }
+func (c *contentJSON) countable() bool { return true }
+func (c *contentJSON) splice(offset int) yContent {
+	right := &contentJSON{values: append([]string(nil), c.values[offset:]...)}
+	c.values = c.values[:offset]
+	return right
+}
+func (c *contentJSON) write(e *yEncoder, offset int) {
+	e.writeLen(len(c.values) - offset)
+	for _, v := range c.values[offset:] {
+		e.writeVarString(v)
+	}
+}
+func (c *contentJSON) mergeWith(right yContent) bool {
+	r, ok := right.(*contentJSON)
+	if ok {
+		c.values = append(c.values, r.values...)
+	}
+	return ok
+}
+
+// contentBinary is a Uint8Array inserted into an array or map
+type contentBinary struct{ data []byte }
+
+func (c *contentBinary) ref() byte                     { return refBinary }
+func (c *contentBinary) length() int                   { return 1 }
+func (c *contentBinary) countable() bool               { return true }
+func (c *contentBinary) splice(int) yContent           { panic("yjs: binary content cannot be split") }
+func (c *contentBinary) write(e *yEncoder, _ int)      { e.writeVarBytes(c.data) }
+func (c *contentBinary) mergeWith(right yContent) bool { return false }
+
+// contentString is text, stored as UTF-16 so it splits at the same clocks
+// as in JavaScript
+type contentString struct{ s []uint16 }
+
+func newContentString(s string) *contentString {
+	return &contentString{s: utf16.Encode([]rune(s))}
+}
+
+func (c *contentString) ref() byte       { return refString }
+func (c *contentString) length() int     { return len(c.s) }
+func (c *contentString) countable() bool { return true }
+func (c *contentString) String() string  { return string(utf16.Decode(c.s)) }
+
+// splice splits like Y.js does: a surrogate pair cut in half becomes a
+// replacement character on both sides
+func (c *contentString) splice(offset int) yContent {
+	right := &contentString{s: append([]uint16(nil), c.s[offset:]...)}
+	c.s = c.s[:offset:offset]
+	if last := c.s[offset-1]; last >= 0xd800 && last <= 0xdbff {
+		c.s[offset-1] = 0xfffd
+		right.s[0] = 0xfffd
+	}
+	return right
+}
+func (c *contentString) write(e *yEncoder, offset int) {
+	e.writeVarString(string(utf16.Decode(c.s[offset:])))
+}
+func (c *contentString) mergeWith(right yContent) bool {
+	r, ok := right.(*contentString)
+	if ok {
+		c.s = append(c.s, r.s...)
+	}
+	return ok
+}
+
+// contentEmbed is an embed in rich text, kept as JSON text
+type contentEmbed struct{ embed string }
+
+func (c *contentEmbed) ref() byte                     { return refEmbed }
+func (c *contentEmbed) length() int                   { return 1 }
+func (c *contentEmbed) countable() bool               { return true }
+func (c *contentEmbed) splice(int) yContent           { panic("yjs: embed content cannot be split") }
+func (c *contentEmbed) write(e *yEncoder, _ int)      { e.writeVarString(c.embed) }
+func (c *contentEmbed) mergeWith(right yContent) bool { return false }
+
+// contentFormat starts (or, with a null value, ends) a formatting attribute
+// in rich text. value is the attribute's JSON text.
+type contentFormat struct {
+	key   string
+	value string
+}
+
+func (c *contentFormat) ref() byte           { return refFormat }
+func (c *contentFormat) length() int         { return 1 }
+func (c *contentFormat) countable() bool     { return false }
+func (c *contentFormat) splice(int) yContent { panic("yjs: format content cannot be split") }
+func (c *contentFormat) write(e *yEncoder, _ int) {
+	e.writeVarString(c.key)
+	e.writeVarString(c.value)
+}
+func (c *contentFormat) mergeWith(right yContent) bool { return false }
+
+// contentType is a nested shared type (map, array, text or XML node)
+type contentType struct{ t *yType }
+
+func (c *contentType) ref() byte           { return refType }
+func (c *contentType) length() int         { return 1 }
+func (c *contentType) countable() bool     { return true }
+func (c *contentType) splice(int) yContent { panic("yjs: type content cannot be split") }
+func (c *contentType) write(e *yEncoder, _ int) {
+	e.writeVarUint(uint64(c.t.kind))
+	if c.t.kind == yXmlElementRef || c.t.kind == yXmlHookRef {
+		e.writeVarString(c.t.nodeName)
+	}
+}
+func (c *contentType) mergeWith(right yContent) bool { return false }
+
+// contentAny is an array of JSON-like values
+type contentAny struct{ values []interface{} }
+
+func (c *contentAny) ref() byte       { return refAny }
+func (c *contentAny) length() int     { return len(c.values) }
+func (c *contentAny) countable() bool { return true }
+func (c *contentAny) splice(offset int) yContent {
+	right := &contentAny{values: append([]interface{}(nil), c.values[offset:]...)}
+	c.values = c.values[:offset:offset]
+	return right
+}
+func (c *contentAny) write(e *yEncoder, offset int) {
+	e.writeLen(len(c.values) - offset)
+	for _, v := range c.values[offset:] {
+		e.writeAny(v)
+	}
+}
+func (c *contentAny) mergeWith(right yContent) bool {
+	r, ok := right.(*contentAny)
+	if ok {
+		c.values = append(c.values, r.values...)
+	}
+	return ok
+}
+
+// contentDoc is a subdocument reference
+type contentDoc struct {
+	guid string
+	opts interface{}
+}
+
+func (c *contentDoc) ref() byte           { return refDoc }
+func (c *contentDoc) length() int         { return 1 }
+func (c *contentDoc) countable() bool     { return true }
+func (c *contentDoc) splice(int) yContent { panic("yjs: doc content cannot be split") }
+func (c *contentDoc) write(e *yEncoder, _ int) {
+	e.writeVarString(c.guid)
+	e.writeAny(c.opts)
+}
+func (c *contentDoc) mergeWith(right yContent) bool { return false }
+
+// readContent decodes the content of a struct with the given info byte
+func readContent(d *yDecoder, info byte) (yContent, error) {
+	switch info & 0x1f {
+	case refDeleted:
+		n, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		return &contentDeleted{n: n}, nil
+	case refJSON:
+		n, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		c := &contentJSON{values: make([]string, 0, min(n, 64))}
+		for i := 0; i < n; i++ {
+			s, err := d.readVarString()
+			if err != nil {
+				return nil, err
+			}
+			c.values = append(c.values, s)
+		}
+		return c, nil
+	case refBinary:
+		b, err := d.readVarBytes()
+		if err != nil {
+			return nil, err
+		}
+		return &contentBinary{data: append([]byte(nil), b...)}, nil
+	case refString:
+		s, err := d.readVarString()
+		if err != nil {
+			return nil, err
+		}
+		return newContentString(s), nil
+	case refEmbed:
+		s, err := d.readVarString()
+		if err != nil {
+			return nil, err
+		}
+		return &contentEmbed{embed: s}, nil
+	case refFormat:
+		key, err := d.readVarString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.readVarString()
+		if err != nil {
+			return nil, err
+		}
+		return &contentFormat{key: key, value: value}, nil
+	case refType:
+		kind, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		if kind > yXmlTextRef {
+			return nil, fmt.Errorf("yjs: unknown type reference %d", kind)
+		}
+		t := &yType{kind: int(kind)}
+		if kind == yXmlElementRef || kind == yXmlHookRef {
+			if t.nodeName, err = d.readVarString(); err != nil {
+				return nil, err
+			}
+		}
+		return &contentType{t: t}, nil
+	case refAny:
+		n, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		c := &contentAny{values: make([]interface{}, 0, min(n, 64))}
+		for i := 0; i < n; i++ {
+			v, err := d.readAny()
+			if err != nil {
+				return nil, err
+			}
+			c.values = append(c.values, v)
+		}
+		return c, nil
+	case refDoc:
+		guid, err := d.readVarString()
+		if err != nil {
+			return nil, err
+		}
+		opts, err := d.readAny()
+		if err != nil {
+			return nil, err
+		}
+		return &contentDoc{guid: guid, opts: opts}, nil
+	default:
+		return nil, fmt.Errorf("yjs: unknown content reference %d", info&0x1f)
+	}
+}
+
+// copyContent returns an independent copy of c for inserting elsewhere.
+// Nested types are copied empty; the caller fills them.
+func copyContent(c yContent) yContent {
+	switch c := c.(type) {
+	case *contentJSON:
+		return &contentJSON{values: append([]string(nil), c.values...)}
+	case *contentBinary:
+		return &contentBinary{data: append([]byte(nil), c.data...)}
+	case *contentString:
+		return &contentString{s: append([]uint16(nil), c.s...)}
+	case *contentEmbed:
+		return &contentEmbed{embed: c.embed}
+	case *contentFormat:
+		return &contentFormat{key: c.key, value: c.value}
+	case *contentType:
+		return &contentType{t: &yType{kind: c.t.kind, nodeName: c.t.nodeName}}
+	case *contentAny:
+		return &contentAny{values: append([]interface{}(nil), c.values...)}
+	case *contentDoc:
+		return &contentDoc{guid: c.guid, opts: c.opts}
+	default:
+		return &contentDeleted{n: c.length()}
+	}
+}
+
+// contentValues returns the JSON values held by c, one per clock unit
+func contentValues(c yContent) []interface{} {
+	switch c := c.(type) {
+	case *contentAny:
+		return c.values
+	case *contentJSON:
+		values := make([]interface{}, len(c.values))
+		for i, s := range c.values {
+			if s == "undefined" {
+				continue
+			}
+			_ = json.Unmarshal([]byte(s), &values[i])
+		}
+		return values
+	case *contentBinary:
+		return []interface{}{c.data}
+	case *contentString:
+		return []interface{}{c.String()}
+	case *contentEmbed:
+		var v interface{}
+		_ = json.Unmarshal([]byte(c.embed), &v)
+		return []interface{}{v}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,1063 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+)
+
+// A server-side replica of a Y.js document. It integrates updates exactly as
+// Y.js does (the YATA algorithm, delete sets, garbage collection of deleted
+// content), so the server can hold the authoritative state of a room, serve
+// it to new clients and edit it itself. Updates use the v1 encoding that
+// y-websocket and the editor send.
+
+// yID identifies the first clock unit of a struct
+type yID struct {
+	client uint64
+	clock  int
+}
+
+func idEqual(a, b *yID) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+// yItem is a struct in the document: an item with content, or (gc set) a
+// garbage-collected range of which only the clocks are kept
+type yItem struct {
+	id     yID
+	length int
+	gc     bool
+
+	left, right         *yItem
+	origin, rightOrigin *yID
+	parent              *yType
+	parentSub           string
+	hasParentSub        bool
+	content             yContent
+	deleted             bool
+
+	// The parent as decoded, for items that do not have a neighbor to take
+	// it from: a root type name or the ID of the item holding the type
+	parentKey   string
+	parentIsKey bool
+	parentID    *yID
+}
+
+func (it *yItem) lastID() yID {
+	return yID{it.id.client, it.id.clock + it.length - 1}
+}
+
+// yType is a shared type: a root type, or one nested in a ContentType item.
+// Sequence content is the linked list from start; map content (including
+// XML attributes) is in entries, each key pointing at its newest item.
+type yType struct {
+	item     *yItem // nil for a root type
+	name     string // root types only
+	kind     int    // one of the y*Ref constants, or -1 for a root type
+	nodeName string // XML elements and hooks
+	start    *yItem
+	entries  map[string]*yItem
+	length   int
+}
+
+// yRange is a run of deleted clocks
+type yRange struct {
+	clock, length int
+}
+
+// yDeleteSet lists deleted ranges per client
+type yDeleteSet map[uint64][]yRange
+
+func (ds yDeleteSet) add(client uint64, clock, length int) {
+	ds[client] = append(ds[client], yRange{clock, length})
+}
+
+// normalize sorts each client's ranges and merges overlapping ones
+func (ds yDeleteSet) normalize() {
+	for client, ranges := range ds {
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i].clock < ranges[j].clock })
+		merged := ranges[:0]
+		for _, r := range ranges {
+			if n := len(merged); n > 0 && merged[n-1].clock+merged[n-1].length >= r.clock {
+				if end := r.clock + r.length; end > merged[n-1].clock+merged[n-1].length {
+					merged[n-1].length = end - merged[n-1].clock
+				}
+				continue
+			}
+			merged = append(merged, r)
+		}
+		ds[client] = merged
+	}
+}
+
+func (ds yDeleteSet) write(e *yEncoder) {
+	clients := make([]uint64, 0, len(ds))
+	for client, ranges := range ds {
+		if len(ranges) > 0 {
+			clients = append(clients, client)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] > clients[j] })
+	e.writeLen(len(clients))
+	for _, client := range clients {
+		e.writeVarUint(client)
+		e.writeLen(len(ds[client]))
+		for _, r := range ds[client] {
+			e.writeLen(r.clock)
+			e.writeLen(r.length)
+		}
+	}
+}
+
+// YDoc is a Y.js document. It is not safe for concurrent use.
+type YDoc struct {
+	// clientID authors the server's own edits
+	clientID uint64
+	clients  map[uint64][]*yItem
+	roots    map[string]*yType
+
+	// Structs and deletions that arrived before what they depend on
+	pending        map[uint64][]*yItem
+	pendingDeletes yDeleteSet
+}
+
+// NewYDoc creates an empty document with a random client ID for local edits
+func NewYDoc() *YDoc {
+	return &YDoc{
+		clientID:       uint64(rand.Uint32()),
+		clients:        make(map[uint64][]*yItem),
+		roots:          make(map[string]*yType),
+		pending:        make(map[uint64][]*yItem),
+		pendingDeletes: make(yDeleteSet),
+	}
+}
+
+// renewClientID gives the document's own edits a new client ID, one no
+// other client has used in it
+func (d *YDoc) renewClientID() {
+	for {
+		d.clientID = uint64(rand.Uint32())
+		if _, used := d.clients[d.clientID]; !used {
+			return
+		}
+	}
+}
+
+// yTransaction collects what a batch of changes touched so deleted content
+// can be collected and adjacent structs merged once at the end
+type yTransaction struct {
+	doc     *YDoc
+	deletes yDeleteSet
+	// merge lists structs that may now be mergeable with a neighbor
+	merge []*yItem
+	// collect lists items deleted in this transaction
+	collect []*yItem
+}
+
+func (d *YDoc) newTransaction() *yTransaction {
+	return &yTransaction{doc: d, deletes: make(yDeleteSet)}
+}
+
+// root returns the root type with the given name, creating it
+func (d *YDoc) root(name string) *yType {
+	t, ok := d.roots[name]
+	if !ok {
+		t = &yType{name: name, kind: -1}
+		d.roots[name] = t
+	}
+	return t
+}
+
+// state is the next clock expected from client
+func (d *YDoc) state(client uint64) int {
+	structs := d.clients[client]
+	if len(structs) == 0 {
+		return 0
+	}
+	last := structs[len(structs)-1]
+	return last.id.clock + last.length
+}
+
+// StateVector reports the next expected clock of every client
+func (d *YDoc) StateVector() yStateVector {
+	sv := make(yStateVector, len(d.clients))
+	for client := range d.clients {
+		sv[client] = d.state(client)
+	}
+	return sv
+}
+
+// findIndex returns the index of the struct containing clock, or -1
+func findIndex(structs []*yItem, clock int) int {
+	lo, hi := 0, len(structs)-1
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		s := structs[mid]
+		if s.id.clock <= clock {
+			if clock < s.id.clock+s.length {
+				return mid
+			}
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	return -1
+}
+
+// item returns the struct containing id, or nil
+func (d *YDoc) item(id yID) *yItem {
+	structs := d.clients[id.client]
+	if i := findIndex(structs, id.clock); i >= 0 {
+		return structs[i]
+	}
+	return nil
+}
+
+func (d *YDoc) mustIndex(id yID) int {
+	i := findIndex(d.clients[id.client], id.clock)
+	if i < 0 {
+		panic(fmt.Sprintf("yjs: missing struct %d:%d", id.client, id.clock))
+	}
+	return i
+}
+
+// cleanStart returns the struct starting at id, splitting an item if needed
+func (d *YDoc) cleanStart(tx *yTransaction, id yID) *yItem {
+	s := d.clients[id.client][d.mustIndex(id)]
+	if s.id.clock < id.clock && !s.gc {
+		return d.split(tx, s, id.clock-s.id.clock)
+	}
+	return s
+}
+
+// cleanEnd returns the struct ending at id, splitting an item if needed
+func (d *YDoc) cleanEnd(tx *yTransaction, id yID) *yItem {
+	s := d.clients[id.client][d.mustIndex(id)]
+	if id.clock != s.id.clock+s.length-1 && !s.gc {
+		d.split(tx, s, id.clock-s.id.clock+1)
+	}
+	return s
+}
+
+// split cuts left after diff clock units and returns the new right half,
+// which takes left's place in the sequence after it
+func (d *YDoc) split(tx *yTransaction, left *yItem, diff int) *yItem {
+	origin := yID{left.id.client, left.id.clock + diff - 1}
+	right := &yItem{
+		id:           yID{left.id.client, left.id.clock + diff},
+		left:         left,
+		origin:       &origin,
+		right:        left.right,
+		rightOrigin:  left.rightOrigin,
+		parent:       left.parent,
+		parentSub:    left.parentSub,
+		hasParentSub: left.hasParentSub,
+		content:      left.content.splice(diff),
+		deleted:      left.deleted,
+	}
+	right.length = right.content.length()
+	left.right = right
+	if right.right != nil {
+		right.right.left = right
+	}
+	if right.hasParentSub && right.right == nil {
+		right.parent.entries[right.parentSub] = right
+	}
+	left.length = diff
+
+	structs := d.clients[left.id.client]
+	i := findIndex(structs, left.id.clock)
+	structs = append(structs, nil)
+	copy(structs[i+2:], structs[i+1:])
+	structs[i+1] = right
+	d.clients[left.id.client] = structs
+
+	tx.merge = append(tx.merge, right)
+	return right
+}
+
+// Apply integrates a v1 update. Structs whose dependencies have not arrived
+// yet are kept and integrated by a later update, as in Y.js. A malformed
+// update is rejected without changing the document: it is decoded and its
+// references checked before anything is integrated.
+func (d *YDoc) Apply(update []byte) (err error) {
+	u, err := decodeUpdate(update)
+	if err != nil {
+		return err
+	}
+	if err := u.validate(); err != nil {
+		return err
+	}
+	defer func() {
+		// The checks above leave nothing that should fail to integrate; if
+		// something does anyway it is reported instead of crashing
+		if r := recover(); r != nil {
+			err = fmt.Errorf("yjs: inconsistent update: %v", r)
+		}
+	}()
+
+	tx := d.newTransaction()
+	d.integrateStructs(tx, u.structs)
+	for client, ranges := range u.deletes {
+		d.pendingDeletes[client] = append(d.pendingDeletes[client], ranges...)
+	}
+	pending := d.pendingDeletes
+	d.pendingDeletes = make(yDeleteSet)
+	d.applyDeleteSet(tx, pending)
+	d.commit(tx)
+	return nil
+}
+
+// integrateStructs adds decoded structs to the document in clock order per
+// client, skipping what is already known and holding back structs whose
+// predecessor or referenced items are missing
+func (d *YDoc) integrateStructs(tx *yTransaction, structs []*yItem) {
+	queues := d.pending
+	d.pending = make(map[uint64][]*yItem)
+	for _, s := range structs {
+		queues[s.id.client] = append(queues[s.id.client], s)
+	}
+	clients := make([]uint64, 0, len(queues))
+	for client, queue := range queues {
+		sort.SliceStable(queue, func(i, j int) bool { return queue[i].id.clock < queue[j].id.clock })
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] < clients[j] })
+
+	// Integrating one client's structs can unblock another's, so repeat
+	// until nothing moves
+	for progress := true; progress; {
+		progress = false
+		for _, client := range clients {
+			queue := queues[client]
+			for len(queue) > 0 {
+				s := queue[0]
+				offset := d.state(client) - s.id.clock
+				if offset < 0 {
+					break
+				}
+				if offset >= s.length {
+					queue = queue[1:]
+					continue
+				}
+				if !s.gc && !d.resolve(tx, s) {
+					break
+				}
+				d.integrate(tx, s, offset)
+				queue = queue[1:]
+				progress = true
+			}
+			queues[client] = queue
+		}
+	}
+	for client, queue := range queues {
+		if len(queue) > 0 {
+			d.pending[client] = queue
+		}
+	}
+}
+
+// resolve finds the neighbors and parent of a decoded item. It returns
+// false, changing nothing, if a struct it references has not arrived.
+func (d *YDoc) resolve(tx *yTransaction, s *yItem) bool {
+	missing := func(id *yID) bool {
+		return id != nil && id.client != s.id.client && id.clock >= d.state(id.client)
+	}
+	if missing(s.origin) || missing(s.rightOrigin) || missing(s.parentID) {
+		return false
+	}
+
+	if s.origin != nil {
+		s.left = d.cleanEnd(tx, *s.origin)
+		origin := s.left.lastID()
+		s.origin = &origin
+	}
+	if s.rightOrigin != nil {
+		s.right = d.cleanStart(tx, *s.rightOrigin)
+		rightOrigin := s.right.id
+		s.rightOrigin = &rightOrigin
+	}
+
+	switch {
+	case (s.left != nil && s.left.gc) || (s.right != nil && s.right.gc):
+		// The neighborhood was collected; the item ends up collected too
+		s.parent = nil
+	case s.parentIsKey:
+		s.parent = d.root(s.parentKey)
+	case s.parentID != nil:
+		s.parent = nil
+		if p := d.item(*s.parentID); p != nil && !p.gc {
+			if ct, ok := p.content.(*contentType); ok {
+				s.parent = ct.t
+			}
+		}
+	default:
+		if s.left != nil {
+			s.parent, s.parentSub, s.hasParentSub = s.left.parent, s.left.parentSub, s.left.hasParentSub
+		}
+		if s.right != nil {
+			s.parent, s.parentSub, s.hasParentSub = s.right.parent, s.right.parentSub, s.right.hasParentSub
+		}
+	}
+	return true
+}
+
+// integrate places s in its parent, resolving conflicts with concurrent
+// inserts at the same position (YATA), and adds it to the struct store.
+// offset skips clock units the document already has.
+func (d *YDoc) integrate(tx *yTransaction, s *yItem, offset int) {
+	if offset > 0 {
+		s.id.clock += offset
+		s.length -= offset
+		if !s.gc {
+			s.left = d.cleanEnd(tx, yID{s.id.client, s.id.clock - 1})
+			origin := s.left.lastID()
+			s.origin = &origin
+			s.content = s.content.splice(offset)
+		}
+	}
+	if s.gc || s.parent == nil {
+		d.collectStruct(s)
+		d.addStruct(s)
+		return
+	}
+
+	parent := s.parent
+	if (s.left == nil && (s.right == nil || s.right.left != nil)) || (s.left != nil && s.left.right != s.right) {
+		left := s.left
+		var o *yItem
+		switch {
+		case left != nil:
+			o = left.right
+		case s.hasParentSub:
+			o = parent.entries[s.parentSub]
+			for o != nil && o.left != nil {
+				o = o.left
+			}
+		default:
+			o = parent.start
+		}
+
+		conflicting := make(map[*yItem]bool)
+		beforeOrigin := make(map[*yItem]bool)
+		for o != nil && o != s.right {
+			beforeOrigin[o] = true
+			conflicting[o] = true
+			if idEqual(s.origin, o.origin) {
+				// Same origin: the lower client ID goes first
+				if o.id.client < s.id.client {
+					left = o
+					clear(conflicting)
+				} else if idEqual(s.rightOrigin, o.rightOrigin) {
+					break
+				}
+			} else if o.origin != nil && beforeOrigin[d.item(*o.origin)] {
+				if !conflicting[d.item(*o.origin)] {
+					left = o
+					clear(conflicting)
+				}
+			} else {
+				break
+			}
+			o = o.right
+		}
+		s.left = left
+	}
+
+	if s.left != nil {
+		s.right = s.left.right
+		s.left.right = s
+	} else {
+		var r *yItem
+		if s.hasParentSub {
+			r = parent.entries[s.parentSub]
+			for r != nil && r.left != nil {
+				r = r.left
+			}
+		} else {
+			r = parent.start
+			parent.start = s
+		}
+		s.right = r
+	}
+	if s.right != nil {
+		s.right.left = s
+	} else if s.hasParentSub {
+		if parent.entries == nil {
+			parent.entries = make(map[string]*yItem)
+		}
+		parent.entries[s.parentSub] = s
+		if s.left != nil {
+			// The previous value of a map key is overwritten
+			d.deleteItem(tx, s.left)
+		}
+	}
+	if !s.hasParentSub && s.content.countable() && !s.deleted {
+		parent.length += s.length
+	}
+	d.addStruct(s)
+	tx.merge = append(tx.merge, s)
+
+	switch c := s.content.(type) {
+	case *contentType:
+		c.t.item = s
+	case *contentDeleted:
+		s.deleted = true
+		tx.deletes.add(s.id.client, s.id.clock, s.length)
+	}
+	if (parent.item != nil && parent.item.deleted) || (s.hasParentSub && s.right != nil) {
+		d.deleteItem(tx, s)
+	}
+}
+
+func (d *YDoc) addStruct(s *yItem) {
+	d.clients[s.id.client] = append(d.clients[s.id.client], s)
+}
+
+// collectStruct turns s into a GC struct
+func (d *YDoc) collectStruct(s *yItem) {
+	s.gc = true
+	s.deleted = true
+	s.content = nil
+	s.parent = nil
+	s.left, s.right = nil, nil
+	s.origin, s.rightOrigin = nil, nil
+	s.hasParentSub, s.parentSub = false, ""
+}
+
+// deleteItem marks an item deleted, along with everything in a type it holds
+func (d *YDoc) deleteItem(tx *yTransaction, it *yItem) {
+	if it.deleted {
+		return
+	}
+	if it.content.countable() && !it.hasParentSub {
+		it.parent.length -= it.length
+	}
+	it.deleted = true
+	tx.deletes.add(it.id.client, it.id.clock, it.length)
+	tx.collect = append(tx.collect, it)
+
+	if ct, ok := it.content.(*contentType); ok {
+		for child := ct.t.start; child != nil; child = child.right {
+			d.deleteItem(tx, child)
+		}
+		for _, entry := range ct.t.entries {
+			d.deleteItem(tx, entry)
+		}
+	}
+}
+
+// applyDeleteSet deletes the given ranges. Ranges beyond what the document
+// has are kept for when the structs arrive.
+func (d *YDoc) applyDeleteSet(tx *yTransaction, ds yDeleteSet) {
+	for client, ranges := range ds {
+		state := d.state(client)
+		for _, r := range ranges {
+			end := r.clock + r.length
+			if r.clock >= state {
+				d.pendingDeletes.add(client, r.clock, r.length)
+				continue
+			}
+			if state < end {
+				d.pendingDeletes.add(client, state, end-state)
+			}
+
+			i := findIndex(d.clients[client], r.clock)
+			if s := d.clients[client][i]; !s.deleted && s.id.clock < r.clock {
+				d.split(tx, s, r.clock-s.id.clock)
+				i++
+			}
+			for i < len(d.clients[client]) {
+				s := d.clients[client][i]
+				i++
+				if s.id.clock >= end {
+					break
+				}
+				if !s.deleted {
+					if end < s.id.clock+s.length {
+						d.split(tx, s, end-s.id.clock)
+					}
+					d.deleteItem(tx, s)
+				}
+			}
+		}
+	}
+}
+
+// commit collects the content of items deleted in tx and merges adjacent
+// structs, as Y.js does when a transaction ends
+func (d *YDoc) commit(tx *yTransaction) {
+	for _, it := range tx.collect {
+		if !it.gc && it.deleted {
+			d.collectItem(it, false)
+			tx.merge = append(tx.merge, it)
+		}
+	}
+	for _, s := range tx.merge {
+		d.tryMerge(s)
+	}
+}
+
+// collectItem drops a deleted item's content. Items inside a collected type
+// become GC structs.
+func (d *YDoc) collectItem(it *yItem, parentCollected bool) {
+	if ct, ok := it.content.(*contentType); ok {
+		for child := ct.t.start; child != nil; {
+			next := child.right
+			if !child.gc {
+				d.collectItem(child, true)
+			}
+			child = next
+		}
+		for _, entry := range ct.t.entries {
+			for e := entry; e != nil; {
+				next := e.left
+				if !e.gc {
+					d.collectItem(e, true)
+				}
+				e = next
+			}
+		}
+		ct.t.start = nil
+		ct.t.entries = nil
+	}
+	if parentCollected {
+		d.collectStruct(it)
+	} else {
+		it.content = &contentDeleted{n: it.length}
+	}
+}
+
+// tryMerge merges s with its neighbors in the struct store where they form
+// one run, keeping memory proportional to edits rather than keystrokes
+func (d *YDoc) tryMerge(s *yItem) {
+	structs := d.clients[s.id.client]
+	i := findIndex(structs, s.id.clock)
+	if i < 0 || structs[i] != s {
+		return
+	}
+	for i+1 < len(structs) && d.mergeStructs(structs[i], structs[i+1]) {
+		structs = append(structs[:i+1], structs[i+2:]...)
+	}
+	for i > 0 && d.mergeStructs(structs[i-1], structs[i]) {
+		structs = append(structs[:i], structs[i+1:]...)
+		i--
+	}
+	d.clients[s.id.client] = structs
+}
+
+// mergeStructs appends right to left if they can be one struct
+func (d *YDoc) mergeStructs(left, right *yItem) bool {
+	if left.gc || right.gc {
+		if left.gc && right.gc {
+			left.length += right.length
+			return true
+		}
+		return false
+	}
+	lastID := left.lastID()
+	if !idEqual(right.origin, &lastID) || left.right != right || !idEqual(left.rightOrigin, right.rightOrigin) ||
+		left.id.clock+left.length != right.id.clock || left.deleted != right.deleted ||
+		!left.content.mergeWith(right.content) {
+		return false
+	}
+	if right.hasParentSub && right.parent.entries[right.parentSub] == right {
+		right.parent.entries[right.parentSub] = left
+	}
+	left.right = right.right
+	if left.right != nil {
+		left.right.left = left
+	}
+	left.length += right.length
+	return true
+}
+
+// EncodeStateAsUpdate encodes everything the holder of sv is missing (the
+// whole document for an empty or nil sv), including pending structs
+func (d *YDoc) EncodeStateAsUpdate(sv yStateVector) []byte {
+	var e yEncoder
+	d.writeStructs(&e, sv, true)
+
+	ds := d.deleteSet()
+	for client, ranges := range d.pendingDeletes {
+		ds[client] = append(ds[client], ranges...)
+	}
+	ds.normalize()
+	ds.write(&e)
+	return e.bytes()
+}
+
+// writeStructs writes, per client, the structs from the clock in sv on. A
+// gap before pending structs is written as a skip.
+func (d *YDoc) writeStructs(e *yEncoder, sv yStateVector, withPending bool) {
+	type group struct {
+		client  uint64
+		clock   int
+		structs []*yItem
+	}
+	var groups []group
+	clients := make(map[uint64]bool, len(d.clients))
+	for client := range d.clients {
+		clients[client] = true
+	}
+	if withPending {
+		for client := range d.pending {
+			clients[client] = true
+		}
+	}
+	for client := range clients {
+		from := sv[client]
+		var list []*yItem
+		if structs := d.clients[client]; d.state(client) > from {
+			i := findIndex(structs, from)
+			if i < 0 {
+				i, from = 0, structs[0].id.clock
+			}
+			list = structs[i:]
+		}
+		if withPending {
+			for _, s := range d.pending[client] {
+				if s.id.clock+s.length > from {
+					list = append(list, s)
+				}
+			}
+		}
+		if len(list) > 0 {
+			if list[0].id.clock > from {
+				from = list[0].id.clock
+			}
+			groups = append(groups, group{client, from, list})
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].client > groups[j].client })
+
+	e.writeLen(len(groups))
+	for _, g := range groups {
+		var body yEncoder
+		n := 0
+		clock := g.clock
+		for _, s := range g.structs {
+			if s.id.clock+s.length <= clock {
+				continue
+			}
+			if s.id.clock > clock {
+				body.writeUint8(refSkip)
+				body.writeLen(s.id.clock - clock)
+				n++
+				clock = s.id.clock
+			}
+			writeStruct(&body, s, clock-s.id.clock)
+			n++
+			clock = s.id.clock + s.length
+		}
+		e.writeLen(n)
+		e.writeVarUint(g.client)
+		e.writeLen(g.clock)
+		e.buf = append(e.buf, body.buf...)
+	}
+}
+
+// writeStruct encodes s without its first offset clock units
+func writeStruct(e *yEncoder, s *yItem, offset int) {
+	if s.gc {
+		e.writeUint8(refGC)
+		e.writeLen(s.length - offset)
+		return
+	}
+	origin := s.origin
+	if offset > 0 {
+		origin = &yID{s.id.client, s.id.clock + offset - 1}
+	}
+	info := s.content.ref()
+	if origin != nil {
+		info |= 0x80
+	}
+	if s.rightOrigin != nil {
+		info |= 0x40
+	}
+	if s.hasParentSub {
+		info |= 0x20
+	}
+	e.writeUint8(info)
+	if origin != nil {
+		e.writeVarUint(origin.client)
+		e.writeLen(origin.clock)
+	}
+	if s.rightOrigin != nil {
+		e.writeVarUint(s.rightOrigin.client)
+		e.writeLen(s.rightOrigin.clock)
+	}
+	if origin == nil && s.rightOrigin == nil {
+		switch {
+		case s.parent != nil && s.parent.item == nil:
+			e.writeVarUint(1)
+			e.writeVarString(s.parent.name)
+		case s.parent != nil:
+			e.writeVarUint(0)
+			e.writeVarUint(s.parent.item.id.client)
+			e.writeLen(s.parent.item.id.clock)
+		case s.parentIsKey:
+			e.writeVarUint(1)
+			e.writeVarString(s.parentKey)
+		case s.parentID != nil:
+			e.writeVarUint(0)
+			e.writeVarUint(s.parentID.client)
+			e.writeLen(s.parentID.clock)
+		}
+		if s.hasParentSub {
+			e.writeVarString(s.parentSub)
+		}
+	}
+	s.content.write(e, offset)
+}
+
+// deleteSet lists every deleted range in the struct store
+func (d *YDoc) deleteSet() yDeleteSet {
+	ds := make(yDeleteSet)
+	for client, structs := range d.clients {
+		for i := 0; i < len(structs); i++ {
+			s := structs[i]
+			if !s.deleted {
+				continue
+			}
+			r := yRange{s.id.clock, s.length}
+			for i+1 < len(structs) && structs[i+1].deleted {
+				i++
+				r.length += structs[i].length
+			}
+			ds[client] = append(ds[client], r)
+		}
+	}
+	return ds
+}
+
+// yUpdate is a decoded update: structs in the order they were written and
+// the delete set
+type yUpdate struct {
+	structs []*yItem
+	deletes yDeleteSet
+}
+
+// validate rejects structs that can never integrate. A struct's references
+// to other clients may still be missing (it then waits in pending), but one
+// to its own client must point at an earlier clock: those are the only
+// structs of that client integrated before it.
+func (u *yUpdate) validate() error {
+	for _, s := range u.structs {
+		if s.gc {
+			continue
+		}
+		for _, ref := range []*yID{s.origin, s.rightOrigin, s.parentID} {
+			if ref != nil && ref.client == s.id.client && ref.clock >= s.id.clock {
+				return fmt.Errorf("yjs: struct %d:%d refers to %d:%d, which comes after it", s.id.client, s.id.clock, ref.client, ref.clock)
+			}
+		}
+	}
+	return nil
+}
+
+// decodeUpdate parses a v1 update without applying it
+func decodeUpdate(b []byte) (*yUpdate, error) {
+	d := newYDecoder(b)
+	u := &yUpdate{deletes: make(yDeleteSet)}
+
+	numClients, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < numClients; i++ {
+		numStructs, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		clock, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < numStructs; j++ {
+			s, err := readStruct(d, client, clock)
+			if err != nil {
+				return nil, err
+			}
+			if s.length <= 0 {
+				return nil, errors.New("yjs: struct with zero length")
+			}
+			clock += s.length
+			if s.content == nil && !s.gc {
+				// A skip only advances the clock
+				continue
+			}
+			u.structs = append(u.structs, s)
+		}
+	}
+
+	numClients, err = d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < numClients; i++ {
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		n, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < n; j++ {
+			clock, err := d.readLen()
+			if err != nil {
+				return nil, err
+			}
+			length, err := d.readLen()
+			if err != nil {
+				return nil, err
+			}
+			u.deletes.add(client, clock, length)
+		}
+	}
+	return u, nil
+}
+
+// readStruct decodes one struct starting at clock
+func readStruct(d *yDecoder, client uint64, clock int) (*yItem, error) {
+	info, err := d.readUint8()
+	if err != nil {
+		return nil, err
+	}
+	s := &yItem{id: yID{client, clock}}
+
+	switch info & 0x1f {
+	case refGC, refSkip:
+		if s.length, err = d.readLen(); err != nil {
+			return nil, err
+		}
+		s.gc = info&0x1f == refGC
+		s.deleted = s.gc
+		return s, nil
+	}
+
+	readID := func() (*yID, error) {
+		c, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		k, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		return &yID{c, k}, nil
+	}
+	if info&0x80 != 0 {
+		if s.origin, err = readID(); err != nil {
+			return nil, err
+		}
+	}
+	if info&0x40 != 0 {
+		if s.rightOrigin, err = readID(); err != nil {
+			return nil, err
+		}
+	}
+	if info&0xc0 == 0 {
+		isKey, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		if isKey == 1 {
+			s.parentIsKey = true
+			if s.parentKey, err = d.readVarString(); err != nil {
+				return nil, err
+			}
+		} else if s.parentID, err = readID(); err != nil {
+			return nil, err
+		}
+		if info&0x20 != 0 {
+			s.hasParentSub = true
+			if s.parentSub, err = d.readVarString(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if s.content, err = readContent(d, info); err != nil {
+		return nil, err
+	}
+	s.length = s.content.length()
+	return s, nil
+}
+
+// Transact runs fn to edit the document as the server's own client and
+// returns the resulting update for connected clients
+func (d *YDoc) Transact(fn func(tx *yTransaction)) []byte {
+	before := d.StateVector()
+	tx := d.newTransaction()
+	fn(tx)
+	d.commit(tx)
+
+	// Only the server's own client has new structs
+	var e yEncoder
+	d.writeStructs(&e, before, false)
+	tx.deletes.normalize()
+	tx.deletes.write(&e)
+	return e.bytes()
+}
+
+// insert adds content to parent after left, or at the start when left is
+// nil, and returns the new item
+func (tx *yTransaction) insert(parent *yType, left *yItem, content yContent) *yItem {
+	d := tx.doc
+	right := parent.start
+	if left != nil {
+		right = left.right
+	}
+	it := &yItem{
+		id:      yID{d.clientID, d.state(d.clientID)},
+		length:  content.length(),
+		left:    left,
+		right:   right,
+		parent:  parent,
+		content: content,
+	}
+	if left != nil {
+		origin := left.lastID()
+		it.origin = &origin
+	}
+	if right != nil {
+		rightOrigin := right.id
+		it.rightOrigin = &rightOrigin
+	}
+	d.integrate(tx, it, 0)
+	return it
+}
+
+// set stores content under key in parent's map, replacing the old value
+func (tx *yTransaction) set(parent *yType, key string, content yContent) *yItem {
+	d := tx.doc
+	left := parent.entries[key]
+	it := &yItem{
+		id:           yID{d.clientID, d.state(d.clientID)},
+		length:       content.length(),
+		left:         left,
+		parent:       parent,
+		parentSub:    key,
+		hasParentSub: true,
+		content:      content,
+	}
+	if left != nil {
+		origin := left.lastID()
+		it.origin = &origin
+	}
+	d.integrate(tx, it, 0)
+	return it
+}
+
+// delete removes an item
+func (tx *yTransaction) delete(it *yItem) {
+	tx.doc.deleteItem(tx, it)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf8"
+)
+
+// The lib0 binary encoding used by Y.js updates, state vectors and the
+// y-protocols sync messages. Only the parts the server needs are here.
+
+// errUnexpectedEnd is returned when a Y.js message ends in the middle of a value
+var errUnexpectedEnd = errors.New("yjs: unexpected end of data")
+
+// yUndefined is JavaScript's undefined, which lib0 encodes separately from null
+type yUndefinedValue struct{}
+
+var yUndefined = yUndefinedValue{}
+
+// yBigInt is a JavaScript BigInt; plain integers decode as int64
+type yBigInt int64
+
+// yDecoder reads lib0-encoded values from a byte slice
+type yDecoder struct {
+	buf []byte
+	pos int
+}
+
+func newYDecoder(buf []byte) *yDecoder {
+	return &yDecoder{buf: buf}
+}
+
+// more reports whether unread bytes remain
+func (d *yDecoder) more() bool {
+	return d.pos < len(d.buf)
+}
+
+func (d *yDecoder) readUint8() (byte, error) {
+	if d.pos >= len(d.buf) {
+		return 0, errUnexpectedEnd
+	}
+	b := d.buf[d.pos]
+	d.pos++
+	return b, nil
+}
+
+// readVarUint reads an unsigned integer in 7-bit groups, least significant first
+func (d *yDecoder) readVarUint() (uint64, error) {
+	var n uint64
+	for shift := uint(0); ; shift += 7 {
+		b, err := d.readUint8()
+		if err != nil {
+			return 0, err
+		}
+		if shift > 56 {
+			return 0, errors.New("yjs: varuint overflows 64 bits")
+		}
+		n |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return n, nil
+		}
+	}
+}
+
+// readLen reads a varuint that is used as a length or clock. Lengths larger
+// than the remaining input cannot be genuine and are refused early, so a
+// corrupt message cannot make the decoder allocate huge slices.
+func (d *yDecoder) readLen() (int, error) {
+	n, err := d.readVarUint()
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("yjs: length %d out of range", n)
+	}
+	return int(n), nil
+}
+
+// readVarInt reads a signed integer: the first byte holds the sign and six
+// bits, later bytes seven bits each
+func (d *yDecoder) readVarInt() (int64, error) {
+	b, err := d.readUint8()
+	if err != nil {
+		return 0, err
+	}
+	n := int64(b & 0x3f)
+	negative := b&0x40 != 0
+	shift := uint(6)
+	for b&0x80 != 0 {
+		if b, err = d.readUint8(); err != nil {
+			return 0, err
+		}
+		if shift > 56 {
+			return 0, errors.New("yjs: varint overflows 64 bits")
+		}
+		n |= int64(b&0x7f) << shift
+		shift += 7
+	}
+	if negative {
+		n = -n
+	}
+	return n, nil
+}
+
+func (d *yDecoder) readBytes(n int) ([]byte, error) {
+	if n < 0 || n > len(d.buf)-d.pos {
+		return nil, errUnexpectedEnd
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// readVarBytes reads a varuint length followed by that many bytes
+func (d *yDecoder) readVarBytes() ([]byte, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	return d.readBytes(n)
+}
+
+// readVarString reads a length-prefixed UTF-8 string
+func (d *yDecoder) readVarString() (string, error) {
+	b, err := d.readVarBytes()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readAny reads a value in lib0's self-describing "any" encoding
+func (d *yDecoder) readAny() (interface{}, error) {
+	t, err := d.readUint8()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case 127:
+		return yUndefined, nil
+	case 126:
+		return nil, nil
+	case 125:
+		return d.readVarInt()
+	case 124:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 123:
+		b, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 122:
+		b, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return yBigInt(binary.BigEndian.Uint64(b)), nil
+	case 121:
+		return false, nil
+	case 120:
+		return true, nil
+	case 119:
+		return d.readVarString()
+	case 118:
+		n, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		obj := make(map[string]interface{}, min(n, 64))
+		for i := 0; i < n; i++ {
+			key, err := d.readVarString()
+			if err != nil {
+				return nil, err
+			}
+			if obj[key], err = d.readAny(); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	case 117:
+		n, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		arr := make([]interface{}, 0, min(n, 64))
+		for i := 0; i < n; i++ {
+			v, err := d.readAny()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case 116:
+		b, err := d.readVarBytes()
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	default:
+		return nil, fmt.Errorf("yjs: unknown value type %d", t)
+	}
+}
+
+// yEncoder builds lib0-encoded data
+type yEncoder struct {
+	buf []byte
+}
+
+func (e *yEncoder) bytes() []byte {
+	return e.buf
+}
+
+func (e *yEncoder) writeUint8(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *yEncoder) writeVarUint(n uint64) {
+	e.buf = binary.AppendUvarint(e.buf, n)
+}
+
+func (e *yEncoder) writeLen(n int) {
+	e.writeVarUint(uint64(n))
+}
+
+func (e *yEncoder) writeVarInt(n int64) {
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+	b := byte(n & 0x3f)
+	if negative {
+		b |= 0x40
+	}
+	n >>= 6
+	if n > 0 {
+		b |= 0x80
+	}
+	e.buf = append(e.buf, b)
+	for n > 0 {
+		b = byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			b |= 0x80
+		}
+		e.buf = append(e.buf, b)
+	}
+}
+
+func (e *yEncoder) writeVarBytes(b []byte) {
+	e.writeLen(len(b))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *yEncoder) writeVarString(s string) {
+	if !utf8.ValidString(s) {
+		s = string([]rune(s))
+	}
+	e.writeLen(len(s))
+	e.buf = append(e.buf, s...)
+}
+
+// writeAny writes v in lib0's "any" encoding, choosing number encodings the
+// way JavaScript does: integers that fit in 31 bits as varints, then
+// float32 when lossless, then float64
+func (e *yEncoder) writeAny(v interface{}) {
+	switch v := v.(type) {
+	case yUndefinedValue:
+		e.writeUint8(127)
+	case nil:
+		e.writeUint8(126)
+	case bool:
+		if v {
+			e.writeUint8(120)
+		} else {
+			e.writeUint8(121)
+		}
+	case string:
+		e.writeUint8(119)
+		e.writeVarString(v)
+	case int:
+		e.writeNumber(float64(v))
+	case int64:
+		e.writeNumber(float64(v))
+	case float64:
+		e.writeNumber(v)
+	case yBigInt:
+		e.writeUint8(122)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v))
+	case []byte:
+		e.writeUint8(116)
+		e.writeVarBytes(v)
+	case []interface{}:
+		e.writeUint8(117)
+		e.writeLen(len(v))
+		for _, item := range v {
+			e.writeAny(item)
+		}
+	case map[string]interface{}:
+		e.writeUint8(118)
+		e.writeLen(len(v))
+		for _, key := range sortedKeys(v) {
+			e.writeVarString(key)
+			e.writeAny(v[key])
+		}
+	default:
+		// Anything else has no lib0 representation
+		e.writeUint8(127)
+	}
+}
+
+func (e *yEncoder) writeNumber(f float64) {
+	switch {
+	case f == math.Trunc(f) && math.Abs(f) <= math.MaxInt32:
+		e.writeUint8(125)
+		e.writeVarInt(int64(f))
+	case float64(float32(f)) == f:
+		e.writeUint8(124)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, math.Float32bits(float32(f)))
+	default:
+		e.writeUint8(123)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(f))
+	}
+}
+
+// yStateVector maps each Y.js client ID to the next clock expected from it
+type yStateVector map[uint64]int
+
+// decodeStateVector reads a state vector as sent in sync step 1
+func decodeStateVector(b []byte) (yStateVector, error) {
+	d := newYDecoder(b)
+	n, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	sv := make(yStateVector, min(n, 1024))
+	for i := 0; i < n; i++ {
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		clock, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		sv[client] = clock
+	}
+	return sv, nil
+}
+
+// encode writes the state vector, clients in descending order for stable output
+func (sv yStateVector) encode() []byte {
+	clients := make([]uint64, 0, len(sv))
+	for client := range sv {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] > clients[j] })
+
+	var e yEncoder
+	e.writeLen(len(clients))
+	for _, client := range clients {
+		e.writeVarUint(client)
+		e.writeLen(sv[client])
+	}
+	return e.bytes()
+}
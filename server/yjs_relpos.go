@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// Relative positions (Y.RelativePosition) point next to an item rather than
+// at an index, so they move with the text around them under concurrent
+// edits. Clients create them with Y.createRelativePositionFromTypeIndex (or
+// y-prosemirror's absolutePositionToRelativePosition) and send them encoded
+// with Y.encodeRelativePosition.
+
+// yRelativePosition is a decoded relative position. Exactly one of item,
+// tname and typeID is set: the item next to the position, or for a
+// position at the start or end of a type, the root type's name or the ID
+// of the item holding a nested type.
+type yRelativePosition struct {
+	item   *yID
+	tname  string
+	typeID *yID
+	// assoc < 0 associates the position with the item on its left
+	assoc int
+}
+
+// decodeRelativePosition reads a position written by Y.encodeRelativePosition
+func decodeRelativePosition(b []byte) (*yRelativePosition, error) {
+	d := newYDecoder(b)
+	kind, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	p := &yRelativePosition{}
+	readID := func() (*yID, error) {
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		clock, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		return &yID{client, clock}, nil
+	}
+	switch kind {
+	case 0:
+		p.item, err = readID()
+	case 1:
+		p.tname, err = d.readVarString()
+	case 2:
+		p.typeID, err = readID()
+	default:
+		return nil, fmt.Errorf("yjs: unknown relative position kind %d", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.more() {
+		assoc, err := d.readVarInt()
+		if err != nil {
+			return nil, err
+		}
+		p.assoc = int(assoc)
+	}
+	if d.more() {
+		return nil, errors.New("yjs: trailing bytes after relative position")
+	}
+	return p, nil
+}
+
+// encode writes the position like Y.encodeRelativePosition
+func (p *yRelativePosition) encode() []byte {
+	var e yEncoder
+	switch {
+	case p.item != nil:
+		e.writeVarUint(0)
+		e.writeVarUint(p.item.client)
+		e.writeLen(p.item.clock)
+	case p.typeID != nil:
+		e.writeVarUint(2)
+		e.writeVarUint(p.typeID.client)
+		e.writeLen(p.typeID.clock)
+	default:
+		e.writeVarUint(1)
+		e.writeVarString(p.tname)
+	}
+	e.writeVarInt(int64(p.assoc))
+	return e.bytes()
+}
+
+// relativePosition is Y.createRelativePositionFromTypeIndex: the position
+// before the index-th element of t (after the one before it for assoc < 0)
+func (t *yType) relativePosition(index, assoc int) *yRelativePosition {
+	p := &yRelativePosition{assoc: assoc}
+	if t.item != nil {
+		id := t.item.id
+		p.typeID = &id
+	} else {
+		p.tname = t.name
+	}
+	if assoc < 0 {
+		if index == 0 {
+			return p
+		}
+		index--
+	}
+	for it := t.start; it != nil; it = it.right {
+		if !it.deleted && it.content.countable() {
+			if it.length > index {
+				return &yRelativePosition{item: &yID{it.id.client, it.id.clock + index}, assoc: assoc}
+			}
+			index -= it.length
+		}
+		if it.right == nil && assoc < 0 {
+			last := it.lastID()
+			return &yRelativePosition{item: &last, assoc: assoc}
+		}
+	}
+	return p
+}
+
+// yAbsolutePosition is a relative position resolved against a document
+type yAbsolutePosition struct {
+	t     *yType
+	index int
+}
+
+// resolveRelativePosition is Y.createAbsolutePositionFromRelativePosition.
+// It fails for positions in content the document has not received (yet),
+// and in types that were deleted.
+func (d *YDoc) resolveRelativePosition(p *yRelativePosition) (yAbsolutePosition, bool) {
+	if p.item != nil {
+		if d.state(p.item.client) <= p.item.clock {
+			return yAbsolutePosition{}, false
+		}
+		it := d.item(*p.item)
+		if it == nil || it.gc || it.parent == nil || it.parent.deleted() {
+			return yAbsolutePosition{}, false
+		}
+		index := 0
+		if !it.deleted && it.content.countable() {
+			index = p.item.clock - it.id.clock
+			if p.assoc < 0 {
+				index++
+			}
+		}
+		for n := it.left; n != nil; n = n.left {
+			if !n.deleted && n.content.countable() {
+				index += n.length
+			}
+		}
+		return yAbsolutePosition{it.parent, index}, true
+	}
+
+	var t *yType
+	if p.typeID != nil {
+		it := d.item(*p.typeID)
+		if it == nil || it.gc || it.deleted {
+			return yAbsolutePosition{}, false
+		}
+		ct, ok := it.content.(*contentType)
+		if !ok {
+			return yAbsolutePosition{}, false
+		}
+		t = ct.t
+	} else if t = d.roots[p.tname]; t == nil {
+		return yAbsolutePosition{}, false
+	}
+	if p.assoc >= 0 {
+		return yAbsolutePosition{t, t.length}, true
+	}
+	return yAbsolutePosition{t, 0}, true
+}
+
+// deleted reports whether t is nested in a deleted item
+func (t *yType) deleted() bool {
+	return t.item != nil && t.item.deleted
+}
+
+// rootOf returns the root type t is nested in
+func (t *yType) rootOf() *yType {
+	for t.item != nil && t.item.parent != nil {
+		t = t.item.parent
+	}
+	return t
+}
+
+// textBetween returns the text from one position to another, in document
+// order, with a newline between XML elements. It is "" if the positions are
+// in different root types or out of order.
+func (d *YDoc) textBetween(from, to yAbsolutePosition) string {
+	if from.t.rootOf() != to.t.rootOf() {
+		return ""
+	}
+	w := &textWalk{from: from, to: to}
+	w.walk(from.t.rootOf())
+	if !w.done {
+		return ""
+	}
+	return strings.TrimSpace(string(utf16.Decode(w.text)))
+}
+
+// textWalk collects the text between two positions while walking a type
+type textWalk struct {
+	from, to     yAbsolutePosition
+	inside, done bool
+	text         []uint16
+}
+
+// at marks reaching index in t
+func (w *textWalk) at(t *yType, index int) {
+	if !w.inside && w.from.t == t && w.from.index == index {
+		w.inside = true
+	}
+	if w.inside && w.to.t == t && w.to.index == index {
+		w.inside, w.done = false, true
+	}
+}
+
+func (w *textWalk) walk(t *yType) {
+	index := 0
+	for it := t.start; it != nil && !w.done; it = it.right {
+		if it.deleted || !it.content.countable() {
+			continue
+		}
+		switch c := it.content.(type) {
+		case *contentString:
+			for i, unit := range c.s {
+				if w.at(t, index+i); w.done {
+					return
+				}
+				if w.inside {
+					w.text = append(w.text, unit)
+				}
+			}
+		case *contentType:
+			if w.at(t, index); w.done {
+				return
+			}
+			if w.inside && c.t.kind == yXmlElementRef && len(w.text) > 0 && w.text[len(w.text)-1] != '\n' {
+				w.text = append(w.text, '\n')
+			}
+			w.walk(c.t)
+		default:
+			w.at(t, index)
+		}
+		index += it.length
+	}
+	if !w.done {
+		w.at(t, index)
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Suggestions are tracked changes in rich text. Suggested text carries an
+// "insertion" mark and text suggested for deletion a "deletion" mark, both
+// valued {"id": ..., "author": ...}. y-prosemirror keeps marks as formatting
+// attributes of the Y.XmlText holding the text, keyed by the mark name, or
+// "<name>--<hash>" for marks that may overlap.
+
+const (
+	markInsertion = "insertion"
+	markDeletion  = "deletion"
+)
+
+// errReadOnly is returned for changes from a client that may not edit
+var errReadOnly = errors.New("client may not edit the document")
+
+// suggestionMark returns the suggestion mark a formatting key stores, or ""
+// for other formatting
+func suggestionMark(key string) string {
+	name, _, _ := strings.Cut(key, "--")
+	if name == markInsertion || name == markDeletion {
+		return name
+	}
+	return ""
+}
+
+// suggestionValue reads the ID and author of a suggestion mark
+func suggestionValue(v interface{}) (id, author string, ok bool) {
+	m, isMap := v.(map[string]interface{})
+	if !isMap {
+		return "", "", false
+	}
+	id, _ = m["id"].(string)
+	author, _ = m["author"].(string)
+	return id, author, id != ""
+}
+
+// ownMark reports whether v is a suggestion mark by user
+func ownMark(v interface{}, user string) bool {
+	_, author, ok := suggestionValue(v)
+	return ok && author == user
+}
+
+// sameValue compares two attribute values by their JSON
+func sameValue(a, b interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
+
+// textTypes returns the XML text types of the document in document order,
+// leaving out deleted ones
+func (d *YDoc) textTypes() []*yType {
+	var out []*yType
+	var walk func(t *yType)
+	walk = func(t *yType) {
+		if t.kind == yXmlTextRef {
+			out = append(out, t)
+		}
+		for it := t.start; it != nil; it = it.right {
+			if c, ok := it.content.(*contentType); ok && !it.deleted {
+				walk(c.t)
+			}
+		}
+	}
+	for _, name := range d.RootNames() {
+		walk(d.roots[name])
+	}
+	return out
+}
+
+// formatting records the attributes in effect at each of t's countable
+// items, as delta computes them for its runs
+func (t *yType) formatting(into map[*yItem]map[string]interface{}) {
+	attrs := map[string]interface{}{}
+	for it := t.start; it != nil; it = it.right {
+		if it.deleted {
+			continue
+		}
+		if c, ok := it.content.(*contentFormat); ok {
+			var v interface{}
+			if err := json.Unmarshal([]byte(c.value), &v); err != nil || v == nil {
+				delete(attrs, c.key)
+			} else {
+				attrs[c.key] = v
+			}
+			continue
+		}
+		if it.content.countable() {
+			into[it] = copyAttributes(attrs)
+		}
+	}
+}
+
+// formatting records the attributes of every countable item in the
+// document's text
+func (d *YDoc) formatting() map[*yItem]map[string]interface{} {
+	attrs := make(map[*yItem]map[string]interface{})
+	for _, t := range d.textTypes() {
+		t.formatting(attrs)
+	}
+	return attrs
+}
+
+// pendingSize counts the clocks held back for missing dependencies
+func (d *YDoc) pendingSize() int {
+	n := 0
+	for _, structs := range d.pending {
+		for _, s := range structs {
+			n += s.length
+		}
+	}
+	for _, ranges := range d.pendingDeletes {
+		for _, r := range ranges {
+			n += r.length
+		}
+	}
+	return n
+}
+
+// adds reports whether applying update would change the document: it has
+// structs or deletions the document does not have yet
+func (d *YDoc) adds(update []byte) (bool, error) {
+	u, err := decodeUpdate(update)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range u.structs {
+		if s.id.clock+s.length > d.state(s.id.client) {
+			return true, nil
+		}
+	}
+	for client, ranges := range u.deletes {
+		structs := d.clients[client]
+		for _, r := range ranges {
+			end := r.clock + r.length
+			if end > d.state(client) {
+				return true, nil
+			}
+			for i := findIndex(structs, r.clock); i < len(structs) && structs[i].id.clock < end; i++ {
+				if !structs[i].deleted {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// checkSuggestion reports why update is more than suggestions by user, or
+// nil if it is not. New text must carry the user's insertion mark, and
+// existing text may only gain or lose the user's deletion mark; of the
+// existing text only what the user suggested inserting may be deleted. The
+// update is applied to scratch, a copy of d, and only what it touches is
+// compared; d is not changed.
+func (d *YDoc) checkSuggestion(scratch *YDoc, update []byte, user string) error {
+	u, err := decodeUpdate(update)
+	if err != nil {
+		return err
+	}
+	if err := scratch.Apply(update); err != nil {
+		return err
+	}
+	if scratch.pendingSize() > d.pendingSize() {
+		return errors.New("suggestion depends on changes the server does not have")
+	}
+
+	// The items the update adds and the existing ones it deletes, and the
+	// types in scratch they belong to
+	touched := make(map[*yType]bool)
+	var added, removed []*yItem
+	for _, s := range u.structs {
+		client, end := s.id.client, s.id.clock+s.length
+		for clock := max(s.id.clock, d.state(client)); clock < end; {
+			it := scratch.item(yID{client, clock})
+			if it == nil {
+				break // Held back
+			}
+			clock = it.id.clock + it.length
+			if !it.gc {
+				added = append(added, it)
+				touched[it.parent] = true
+			}
+		}
+	}
+	for client, ranges := range u.deletes {
+		state := d.state(client)
+		for _, r := range ranges {
+			// Existing content may be split differently in the document
+			for clock := r.clock; clock < r.clock+r.length && clock < state; {
+				old := d.item(yID{client, clock})
+				clock = old.id.clock + old.length
+				if old.gc || old.deleted {
+					continue
+				}
+				removed = append(removed, old)
+				if it := scratch.item(old.id); it != nil {
+					touched[it.parent] = true
+				}
+			}
+		}
+	}
+
+	before, after := make(map[*yItem]map[string]interface{}), make(map[*yItem]map[string]interface{})
+	var texts []*yType
+	for t := range touched {
+		if t == nil || t.kind != yXmlTextRef {
+			continue
+		}
+		texts = append(texts, t)
+		t.formatting(after)
+		if old := d.counterpart(t); old != nil {
+			old.formatting(before)
+		}
+	}
+
+	for _, it := range added {
+		if err := checkSuggestedItem(it, after[it], user); err != nil {
+			return err
+		}
+	}
+	for _, old := range removed {
+		if _, ok := old.content.(*contentFormat); ok {
+			// Checked by its effect on the formatting below
+			continue
+		}
+		if !ownMark(insertionOf(before[old]), user) {
+			return errors.New("suggestion deletes text instead of marking it for deletion")
+		}
+	}
+	for _, t := range texts {
+		for it := t.start; it != nil; it = it.right {
+			if it.deleted || !it.content.countable() || it.id.clock >= d.state(it.id.client) {
+				continue
+			}
+			if err := checkSuggestedFormatting(before[d.item(it.id)], after[it], user); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// counterpart returns d's copy of a type in another replica of d, or nil if
+// d does not have it
+func (d *YDoc) counterpart(t *yType) *yType {
+	if t.item == nil {
+		return d.roots[t.name]
+	}
+	it := d.item(t.item.id)
+	if it == nil {
+		return nil
+	}
+	if c, ok := it.content.(*contentType); ok {
+		return c.t
+	}
+	return nil
+}
+
+// checkSuggestedItem checks an item added by a suggestion: text and embeds
+// in rich text with the user's insertion mark, or the formatting around
+// them. Items that are already deleted change nothing.
+func checkSuggestedItem(it *yItem, attrs map[string]interface{}, user string) error {
+	if it.deleted {
+		return nil
+	}
+	if it.parent == nil || it.parent.kind != yXmlTextRef || it.hasParentSub {
+		return errors.New("suggestion changes the document's structure")
+	}
+	switch it.content.(type) {
+	case *contentFormat:
+		return nil
+	case *contentString, *contentEmbed:
+		if ownMark(insertionOf(attrs), user) {
+			return nil
+		}
+		return errors.New("suggested text lacks the author's insertion mark")
+	}
+	return fmt.Errorf("suggestion adds content of type %d", it.content.ref())
+}
+
+// checkSuggestedFormatting compares the attributes of existing text before
+// and after a suggestion. Only the user's own deletion marks may come or go.
+func checkSuggestedFormatting(before, after map[string]interface{}, user string) error {
+	for key, v := range after {
+		if _, ok := before[key]; !ok && !suggestedChange(key, nil, v, user) {
+			return fmt.Errorf("suggestion changes the %q formatting of existing text", key)
+		}
+	}
+	for key, v := range before {
+		if !suggestedChange(key, v, after[key], user) {
+			return fmt.Errorf("suggestion changes the %q formatting of existing text", key)
+		}
+	}
+	return nil
+}
+
+// suggestedChange reports whether a change of an attribute from one value
+// to another (nil when it is not set) is allowed in a suggestion by user
+func suggestedChange(key string, from, to interface{}, user string) bool {
+	if sameValue(from, to) {
+		return true
+	}
+	if suggestionMark(key) != markDeletion {
+		return false
+	}
+	return (from == nil || ownMark(from, user)) && (to == nil || ownMark(to, user))
+}
+
+// insertionOf returns the insertion mark among attrs, or nil
+func insertionOf(attrs map[string]interface{}) interface{} {
+	for key, v := range attrs {
+		if suggestionMark(key) == markInsertion {
+			return v
+		}
+	}
+	return nil
+}
+
+// suggestions lists the suggestions in the document's text, in the order
+// they first appear
+func (d *YDoc) suggestions() []Suggestion {
+	list := []Suggestion{}
+	index := make(map[string]int)
+	last := make(map[string]*yType)
+	for _, t := range d.textTypes() {
+		attrs := make(map[*yItem]map[string]interface{})
+		t.formatting(attrs)
+		for it := t.start; it != nil; it = it.right {
+			a, ok := attrs[it]
+			if !ok {
+				continue
+			}
+			keys := make([]string, 0, len(a))
+			for key := range a {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				mark, v := suggestionMark(key), a[key]
+				id, author, ok := suggestionValue(v)
+				if mark == "" || !ok {
+					continue
+				}
+				i, seen := index[id]
+				if !seen {
+					i = len(list)
+					index[id] = i
+					list = append(list, Suggestion{ID: id, Author: author})
+				}
+				text := "\uFFFC"
+				if c, ok := it.content.(*contentString); ok {
+					text = c.String()
+				}
+				field := &list[i].Inserted
+				if mark == markDeletion {
+					field = &list[i].Deleted
+				}
+				if *field != "" && last[id+mark] != t {
+					*field += "\n"
+				}
+				*field += text
+				last[id+mark] = t
+			}
+		}
+	}
+	return list
+}
+
+// resolveSuggestion accepts or rejects the suggestion with the given ID as
+// the server's own edit: the text it inserts is kept or deleted, the text it
+// marks for deletion deleted or kept, and its marks are removed. It returns
+// nil if no text carries the suggestion.
+func (d *YDoc) resolveSuggestion(id string, accept bool) []byte {
+	type mark struct {
+		it    *yItem
+		prior interface{}
+	}
+	var marks []mark
+	var remove []*yItem
+	for _, t := range d.textTypes() {
+		attrs := map[string]interface{}{}
+		for it := t.start; it != nil; it = it.right {
+			if it.deleted {
+				continue
+			}
+			if c, ok := it.content.(*contentFormat); ok {
+				var v interface{}
+				if err := json.Unmarshal([]byte(c.value), &v); err != nil {
+					v = nil
+				}
+				if markID, _, ok := suggestionValue(v); ok && markID == id && suggestionMark(c.key) != "" {
+					marks = append(marks, mark{it, attrs[c.key]})
+				}
+				if v == nil {
+					delete(attrs, c.key)
+				} else {
+					attrs[c.key] = v
+				}
+				continue
+			}
+			if !it.content.countable() {
+				continue
+			}
+			for key, v := range attrs {
+				markID, _, ok := suggestionValue(v)
+				if !ok || markID != id {
+					continue
+				}
+				switch suggestionMark(key) {
+				case markInsertion:
+					if !accept {
+						remove = append(remove, it)
+					}
+				case markDeletion:
+					if accept {
+						remove = append(remove, it)
+					}
+				}
+			}
+		}
+	}
+	if len(marks) == 0 && len(remove) == 0 {
+		return nil
+	}
+
+	return d.Transact(func(tx *yTransaction) {
+		for _, m := range marks {
+			// Without the mark the text after it falls back to the value
+			// before it, which may be another suggestion's
+			if m.prior != nil {
+				tx.insert(m.it.parent, m.it, &contentFormat{key: m.it.content.(*contentFormat).key, value: "null"})
+			}
+			tx.delete(m.it)
+		}
+		for _, it := range remove {
+			if !it.deleted {
+				tx.delete(it)
+			}
+		}
+	})
+}
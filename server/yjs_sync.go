@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+)
+
+// y-protocols message types used on WebSocket connections
+const (
+	messageSync      = 0
+	messageAwareness = 1
+)
+
+// Steps of the y-protocols sync message: a state vector asking for what is
+// missing, the answer, and an incremental update
+const (
+	syncStep1  = 0
+	syncStep2  = 1
+	syncUpdate = 2
+)
+
+// WebTransport text stream messages carrying a raw Y.js update start with
+// this op code (see DocSyncProvider.sendYjsUpdate)
+const opYjsUpdate = 0x00
+
+// streamTextOps prefixes messages queued for a WebTransport client's text
+// stream. Stream messages have a two-byte length, which bounds their size.
+const (
+	streamTextOps    = 0x01
+	maxStreamMessage = 0xffff
+)
+
+// encodeSyncMessage frames a sync step for y-websocket
+func encodeSyncMessage(step int, payload []byte) []byte {
+	var e yEncoder
+	e.writeVarUint(messageSync)
+	e.writeVarUint(uint64(step))
+	e.writeVarBytes(payload)
+	return e.bytes()
+}
+
+// parseSyncMessage reads a y-websocket sync message. ok is false for other
+// message types, which are relayed untouched.
+func parseSyncMessage(msg []byte) (step int, payload []byte, ok bool, err error) {
+	d := newYDecoder(msg)
+	kind, err := d.readVarUint()
+	if err != nil || kind != messageSync {
+		return 0, nil, false, err
+	}
+	s, err := d.readVarUint()
+	if err != nil {
+		return 0, nil, true, err
+	}
+	if payload, err = d.readVarBytes(); err != nil {
+		return 0, nil, true, err
+	}
+	return int(s), payload, true, nil
+}
+
+// parseAwarenessClient reads the first Y.js client ID of a y-websocket
+// awareness message. Clients send their own state first, so it is the
+// client ID their document edits with.
+func parseAwarenessClient(msg []byte) (uint64, bool) {
+	d := newYDecoder(msg)
+	if kind, err := d.readVarUint(); err != nil || kind != messageAwareness {
+		return 0, false
+	}
+	payload, err := d.readVarBytes()
+	if err != nil {
+		return 0, false
+	}
+	d = newYDecoder(payload)
+	if n, err := d.readLen(); err != nil || n == 0 {
+		return 0, false
+	}
+	id, err := d.readVarUint()
+	return id, err == nil
+}
+
+// encodeWebTransportUpdate frames an update for a WebTransport client's
+// text stream, split into several updates if it does not fit one message
+func encodeWebTransportUpdate(update []byte) ([][]byte, error) {
+	// Two bytes go to the stream prefix and the op code
+	parts, err := splitUpdate(update, maxStreamMessage-1)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([][]byte, len(parts))
+	for i, part := range parts {
+		msgs[i] = append([]byte{streamTextOps, opYjsUpdate}, part...)
+	}
+	return msgs, nil
+}
+
+// splitUpdate breaks an update into updates of at most max bytes that
+// together have the same effect. Y.js accepts the parts in any order.
+func splitUpdate(update []byte, max int) ([][]byte, error) {
+	if len(update) <= max {
+		return [][]byte{update}, nil
+	}
+	u, err := decodeUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+
+	// Room for the counts and IDs framing each part
+	const overhead = 40
+	var parts [][]byte
+	type group struct {
+		client     uint64
+		clock, end int
+		n          int
+		body       yEncoder
+	}
+	var groups []*group
+	size := 0
+	flush := func() {
+		if len(groups) == 0 {
+			return
+		}
+		var e yEncoder
+		e.writeLen(len(groups))
+		for _, g := range groups {
+			e.writeLen(g.n)
+			e.writeVarUint(g.client)
+			e.writeLen(g.clock)
+			e.buf = append(e.buf, g.body.buf...)
+		}
+		e.writeLen(0)
+		parts = append(parts, e.bytes())
+		groups, size = nil, 0
+	}
+
+	for _, s := range u.structs {
+		pieces, err := splitStruct(s, max-overhead)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pieces {
+			var b yEncoder
+			writeStruct(&b, p, 0)
+			if size+len(b.buf)+overhead > max {
+				flush()
+			}
+			var g *group
+			if n := len(groups); n > 0 && groups[n-1].client == p.id.client && groups[n-1].end == p.id.clock {
+				g = groups[n-1]
+			} else {
+				g = &group{client: p.id.client, clock: p.id.clock}
+				groups = append(groups, g)
+				size += overhead
+			}
+			g.body.buf = append(g.body.buf, b.buf...)
+			g.n++
+			g.end = p.id.clock + p.length
+			size += len(b.buf)
+		}
+	}
+	flush()
+
+	// Delete ranges go last, in as many parts as they need
+	ranges := make(yDeleteSet)
+	n := 0
+	flushDeletes := func() {
+		if n == 0 {
+			return
+		}
+		var e yEncoder
+		e.writeLen(0)
+		ranges.write(&e)
+		parts = append(parts, e.bytes())
+		ranges, n = make(yDeleteSet), 0
+	}
+	for client, list := range u.deletes {
+		for _, r := range list {
+			if (n+1)*overhead > max {
+				flushDeletes()
+			}
+			ranges.add(client, r.clock, r.length)
+			n++
+		}
+	}
+	flushDeletes()
+	return parts, nil
+}
+
+// splitStruct cuts s into pieces whose encoding fits in max bytes
+func splitStruct(s *yItem, max int) ([]*yItem, error) {
+	var b yEncoder
+	writeStruct(&b, s, 0)
+	if len(b.buf) <= max {
+		return []*yItem{s}, nil
+	}
+	switch s.content.(type) {
+	case *contentString, *contentAny, *contentJSON, *contentDeleted:
+	default:
+		return nil, fmt.Errorf("yjs: a %d byte struct cannot be split", len(b.buf))
+	}
+	if s.length < 2 {
+		return nil, fmt.Errorf("yjs: a %d byte struct cannot be split", len(b.buf))
+	}
+
+	half := s.length / 2
+	if c, ok := s.content.(*contentString); ok && c.s[half-1] >= 0xd800 && c.s[half-1] <= 0xdbff {
+		// Keep surrogate pairs together
+		if half--; half == 0 {
+			half = 2
+		}
+	}
+	if half >= s.length {
+		return nil, fmt.Errorf("yjs: a %d byte struct cannot be split", len(b.buf))
+	}
+	left, right := *s, *s
+	left.content = copyContent(s.content)
+	right.content = left.content.splice(half)
+	left.length, right.length = half, s.length-half
+	right.id.clock += half
+	right.origin = &yID{s.id.client, s.id.clock + half - 1}
+
+	lefts, err := splitStruct(&left, max)
+	if err != nil {
+		return nil, err
+	}
+	rights, err := splitStruct(&right, max)
+	if err != nil {
+		return nil, err
+	}
+	return append(lefts, rights...), nil
+}
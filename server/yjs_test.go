@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand/v2"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// insertText appends s to the root text type name as the doc's own client
+func insertText(d *YDoc, name, s string) []byte {
+	return d.Transact(func(tx *yTransaction) {
+		root := d.root(name)
+		var last *yItem
+		for it := root.start; it != nil; it = it.right {
+			last = it
+		}
+		tx.insert(root, last, newContentString(s))
+	})
+}
+
+// deleteUpdate is an update deleting clocks [clock, clock+length) of client
+func deleteUpdate(client uint64, clock, length int) []byte {
+	ds := yDeleteSet{client: {{clock, length}}}
+	e := yEncoder{}
+	e.writeLen(0)
+	ds.write(&e)
+	return e.bytes()
+}
+
+func mustApply(t *testing.T, d *YDoc, update []byte) {
+	t.Helper()
+	if err := d.Apply(update); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+}
+
+func TestYDocDecodesYjsUpdate(t *testing.T) {
+	// Y.encodeStateAsUpdate of a doc with client ID 1 after
+	// doc.getText('t').insert(0, 'abc')
+	update, _ := hex.DecodeString("010101000401017403616263" + "00")
+
+	d := NewYDoc()
+	mustApply(t, d, update)
+	if got := d.root("t").text(); got != "abc" {
+		t.Fatalf("text = %q, want abc", got)
+	}
+	if got := d.EncodeStateAsUpdate(nil); !bytes.Equal(got, update) {
+		t.Errorf("re-encoded state = %x, want %x", got, update)
+	}
+	if sv := d.StateVector(); sv[1] != 3 {
+		t.Errorf("state vector = %v, want client 1 at clock 3", sv)
+	}
+
+	// Deleting "b" splits the item
+	mustApply(t, d, deleteUpdate(1, 1, 1))
+	if got := d.root("t").text(); got != "ac" {
+		t.Errorf("after delete text = %q, want ac", got)
+	}
+
+	if err := d.Apply([]byte{1, 1, 1}); err == nil {
+		t.Errorf("truncated update was accepted")
+	}
+}
+
+func TestYDocRejectsInconsistentUpdate(t *testing.T) {
+	// Client 1 inserts "x" into "t"; client 2 inserts "y" after 2:5, a
+	// struct of its own that cannot exist before its clock 0
+	update, _ := hex.DecodeString("02" + "010100040101740178" + "0102008402050179" + "00")
+
+	d := NewYDoc()
+	if err := d.Apply(update); err == nil {
+		t.Fatalf("inconsistent update was accepted")
+	}
+	if got, sv := d.root("t").text(), d.StateVector(); got != "" || len(sv) != 0 {
+		t.Errorf("rejected update changed the doc: text %q, state vector %v", got, sv)
+	}
+}
+
+// Corrupted updates either apply or leave the document exactly as it was
+func TestYDocCorruptUpdatesChangeNothing(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	for round := 0; round < 50; round++ {
+		a, b := NewYDoc(), NewYDoc()
+		var updates [][]byte
+		for step := 0; step < 10; step++ {
+			d, other := a, b
+			if rng.IntN(2) == 0 {
+				d, other = b, a
+			}
+			length := len([]rune(d.root("t").text()))
+			pos := rng.IntN(length + 1)
+			del := 0
+			if length > pos && rng.IntN(3) == 0 {
+				del = rng.IntN(length-pos) + 1
+			}
+			updates = append(updates, textEdit(d, "t", pos, "abc"[:rng.IntN(3)+1], del))
+			if rng.IntN(2) == 0 {
+				mustApply(t, other, updates[len(updates)-1])
+			}
+		}
+
+		for i := 0; i < 50; i++ {
+			target := NewYDoc()
+			for _, u := range updates[:rng.IntN(len(updates))] {
+				mustApply(t, target, u)
+			}
+			before := target.EncodeStateAsUpdate(nil)
+			corrupt := append([]byte{}, updates[rng.IntN(len(updates))]...)
+			for n := rng.IntN(3) + 1; n > 0; n-- {
+				corrupt[rng.IntN(len(corrupt))] = byte(rng.IntN(256))
+			}
+			if err := target.Apply(corrupt); err != nil {
+				if after := target.EncodeStateAsUpdate(nil); !bytes.Equal(after, before) {
+					t.Fatalf("round %d: rejected update %x changed the doc (%v)", round, corrupt, err)
+				}
+			}
+		}
+	}
+}
+
+func TestYDocConcurrentInsertsConverge(t *testing.T) {
+	a, b := NewYDoc(), NewYDoc()
+	a.clientID, b.clientID = 1, 2
+
+	base := insertText(a, "t", "middle")
+	mustApply(t, b, base)
+
+	// Both insert at the same position without seeing each other
+	ua := insertText(a, "t", " from a")
+	ub := insertText(b, "t", " from b")
+	mustApply(t, a, ub)
+	mustApply(t, b, ua)
+
+	ta, tb := a.root("t").text(), b.root("t").text()
+	if ta != tb {
+		t.Fatalf("replicas diverged: %q vs %q", ta, tb)
+	}
+	// The lower client ID is ordered first
+	if ta != "middle from a from b" {
+		t.Errorf("text = %q", ta)
+	}
+	if !bytes.Equal(a.StateVector().encode(), b.StateVector().encode()) {
+		t.Errorf("state vectors differ")
+	}
+}
+
+func TestYDocPendingUpdates(t *testing.T) {
+	src := NewYDoc()
+	first := insertText(src, "t", "hello")
+	second := insertText(src, "t", " world")
+
+	d := NewYDoc()
+	mustApply(t, d, second)
+	if got := d.root("t").text(); got != "" {
+		t.Fatalf("update applied before its dependency: %q", got)
+	}
+	// The pending struct is still part of the encoded state
+	if state := d.EncodeStateAsUpdate(nil); len(state) <= 3 {
+		t.Errorf("pending struct missing from state %x", state)
+	}
+	mustApply(t, d, first)
+	if got := d.root("t").text(); got != "hello world" {
+		t.Errorf("text = %q, want hello world", got)
+	}
+}
+
+func TestYDocMergesAndCollects(t *testing.T) {
+	src := NewYDoc()
+	src.clientID = 7
+	d := NewYDoc()
+	for _, ch := range "typing one keystroke at a time" {
+		mustApply(t, d, insertText(src, "t", string(ch)))
+	}
+	if n := len(d.clients[7]); n != 1 {
+		t.Errorf("%d structs for consecutive keystrokes, want 1", n)
+	}
+
+	mustApply(t, d, deleteUpdate(7, 0, 7))
+	if got := d.root("t").text(); got != "one keystroke at a time" {
+		t.Errorf("text = %q", got)
+	}
+	first := d.clients[7][0]
+	if _, ok := first.content.(*contentDeleted); !ok || !first.deleted {
+		t.Errorf("deleted content was not collected: %#v", first.content)
+	}
+}
+
+func TestYDocXMLRoundTrip(t *testing.T) {
+	d := NewYDoc()
+	update := d.Transact(func(tx *yTransaction) {
+		root := d.root("prosemirror")
+		para := &yType{kind: yXmlElementRef, nodeName: "paragraph"}
+		tx.insert(root, nil, &contentType{t: para})
+		tx.set(para, "textAlign", &contentAny{values: []interface{}{"center"}})
+		text := &yType{kind: yXmlTextRef}
+		tx.insert(para, nil, &contentType{t: text})
+		f := tx.insert(text, nil, &contentFormat{key: "bold", value: "{}"})
+		s := tx.insert(text, f, newContentString("Hi"))
+		e := tx.insert(text, s, &contentFormat{key: "bold", value: "null"})
+		tx.insert(text, e, newContentString(" there"))
+	})
+
+	replica := NewYDoc()
+	mustApply(t, replica, update)
+	want := `<paragraph textAlign="center"><bold>Hi</bold> there</paragraph>`
+	if got := replica.root("prosemirror").xmlString(); got != want {
+		t.Errorf("xml = %s, want %s", got, want)
+	}
+	if lines := replica.root("prosemirror").textLines(); len(lines) != 1 || lines[0] != "Hi there" {
+		t.Errorf("text lines = %q", lines)
+	}
+}
+
+func TestYDocMapOverwrite(t *testing.T) {
+	d := NewYDoc()
+	root := d.root("settings")
+	d.Transact(func(tx *yTransaction) { tx.set(root, "theme", &contentAny{values: []interface{}{"light"}}) })
+	update := d.Transact(func(tx *yTransaction) { tx.set(root, "theme", &contentAny{values: []interface{}{"dark"}}) })
+
+	replica := NewYDoc()
+	mustApply(t, replica, d.EncodeStateAsUpdate(nil))
+	mustApply(t, replica, update)
+	got := replica.root("settings").toJSON().(map[string]interface{})
+	if got["theme"] != "dark" {
+		t.Errorf("theme = %v, want dark", got["theme"])
+	}
+}
+
+func TestYDocRestoreFrom(t *testing.T) {
+	d := NewYDoc()
+	insertText(d, "t", "first version")
+	saved := NewYDoc()
+	mustApply(t, saved, d.EncodeStateAsUpdate(nil))
+
+	// A collaborator replaces the text
+	peer := NewYDoc()
+	mustApply(t, peer, d.EncodeStateAsUpdate(nil))
+	edit := peer.Transact(func(tx *yTransaction) {
+		for _, it := range peer.root("t").visible() {
+			tx.delete(it)
+		}
+	})
+	mustApply(t, d, edit)
+	mustApply(t, d, insertText(d, "t", "rewritten"))
+	mustApply(t, peer, d.EncodeStateAsUpdate(peer.StateVector()))
+
+	// Restoring is a forward update the peer can apply
+	restore := d.RestoreFrom(saved)
+	mustApply(t, peer, restore)
+	for name, doc := range map[string]*YDoc{"server": d, "peer": peer} {
+		if got := doc.root("t").text(); got != "first version" {
+			t.Errorf("%s text after restore = %q", name, got)
+		}
+	}
+}
+
+// textEdit inserts s at pos and then deletes n units after it in the root
+// text type name, splitting items as a Y.js client would
+func textEdit(d *YDoc, name string, pos int, s string, n int) []byte {
+	return d.Transact(func(tx *yTransaction) {
+		root := d.root(name)
+		// at returns the item ending just before pos (nil for the start)
+		at := func(pos int) *yItem {
+			var left *yItem
+			for it := root.start; it != nil && pos > 0; it = it.right {
+				if it.deleted || !it.content.countable() {
+					left = it
+					continue
+				}
+				if pos < it.length {
+					d.split(tx, it, pos)
+				}
+				pos -= it.length
+				left = it
+			}
+			return left
+		}
+		left := at(pos)
+		if s != "" {
+			left = tx.insert(root, left, newContentString(s))
+		}
+		right := root.start
+		if left != nil {
+			right = left.right
+		}
+		for it := right; it != nil && n > 0; it = it.right {
+			if it.deleted || !it.content.countable() {
+				continue
+			}
+			if n < it.length {
+				d.split(tx, it, n)
+			}
+			n -= it.length
+			tx.delete(it)
+		}
+	})
+}
+
+func TestYDocRandomEditsConverge(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for round := 0; round < 50; round++ {
+		docs := []*YDoc{NewYDoc(), NewYDoc(), NewYDoc()}
+		var updates [][]byte
+		for step := 0; step < 40; step++ {
+			d := docs[rng.IntN(len(docs))]
+			length := len([]rune(d.root("t").text()))
+			pos := rng.IntN(length + 1)
+			del := 0
+			if length > pos && rng.IntN(3) == 0 {
+				del = rng.IntN(length-pos) + 1
+			}
+			update := textEdit(d, "t", pos, string(rune('a'+rng.IntN(26)))+"xy"[:rng.IntN(3)], del)
+			updates = append(updates, update)
+			// Deliver some updates early and out of order
+			if other := docs[rng.IntN(len(docs))]; other != d && rng.IntN(2) == 0 {
+				mustApply(t, other, updates[rng.IntN(len(updates))])
+			}
+		}
+		for _, d := range docs {
+			for _, i := range rng.Perm(len(updates)) {
+				mustApply(t, d, updates[i])
+			}
+		}
+		want := docs[0].root("t").text()
+		for i, d := range docs[1:] {
+			if got := d.root("t").text(); got != want {
+				t.Fatalf("round %d: replica %d = %q, replica 0 = %q", round, i+1, got, want)
+			}
+			if len(d.pending) != 0 || len(d.pendingDeletes) != 0 {
+				t.Fatalf("round %d: replica %d still has pending structs", round, i+1)
+			}
+		}
+
+		// A fresh replica built from the encoded state agrees too
+		fresh := NewYDoc()
+		mustApply(t, fresh, docs[1].EncodeStateAsUpdate(nil))
+		if got := fresh.root("t").text(); got != want {
+			t.Fatalf("round %d: state round trip = %q, want %q", round, got, want)
+		}
+	}
+}
+
+func TestSplitUpdate(t *testing.T) {
+	src := NewYDoc()
+	big := strings.Repeat("lorem ipsum 😀 ", 20000)
+	insertText(src, "t", big)
+	insertText(src, "other", "small")
+	mustApply(t, src, deleteUpdate(src.clientID, 5, 100000))
+	update := src.EncodeStateAsUpdate(nil)
+
+	parts, err := splitUpdate(update, maxStreamMessage-1)
+	if err != nil {
+		t.Fatalf("splitUpdate: %v", err)
+	}
+	if len(parts) < 2 {
+		t.Fatalf("%d byte update was not split", len(update))
+	}
+	d := NewYDoc()
+	for i := len(parts) - 1; i >= 0; i-- {
+		if len(parts[i]) > maxStreamMessage-1 {
+			t.Errorf("part %d is %d bytes", i, len(parts[i]))
+		}
+		mustApply(t, d, parts[i])
+	}
+	for _, name := range []string{"t", "other"} {
+		if got, want := d.root(name).text(), src.root(name).text(); got != want {
+			t.Errorf("%s: %d units after reassembly, want %d", name, len(got), len(want))
+		}
+	}
+}
+
+func TestRelativePosition(t *testing.T) {
+	// Encodings produced by Y.encodeRelativePosition
+	for _, tc := range []struct {
+		pos  yRelativePosition
+		want []byte
+	}{
+		{yRelativePosition{item: &yID{1, 2}}, []byte{0, 1, 2, 0}},
+		{yRelativePosition{tname: "t", assoc: -1}, []byte{1, 1, 't', 0x41}},
+		{yRelativePosition{typeID: &yID{300, 0}}, []byte{2, 0xac, 0x02, 0, 0}},
+	} {
+		got := tc.pos.encode()
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("encode(%+v) = %v, want %v", tc.pos, got, tc.want)
+		}
+		decoded, err := decodeRelativePosition(got)
+		if err != nil || !reflect.DeepEqual(*decoded, tc.pos) {
+			t.Errorf("decode(%v) = %+v, %v", got, decoded, err)
+		}
+	}
+	if _, err := decodeRelativePosition([]byte{7, 0}); err == nil {
+		t.Errorf("unknown kind decoded")
+	}
+
+	d := NewYDoc()
+	mustApply(t, d, insertText(NewYDoc(), "t", "hello world"))
+	text := d.root("t")
+	start, end := text.relativePosition(6, 0), text.relativePosition(11, -1)
+	quote := func() string {
+		from, ok1 := d.resolveRelativePosition(start)
+		to, ok2 := d.resolveRelativePosition(end)
+		if !ok1 || !ok2 {
+			t.Fatalf("positions do not resolve")
+		}
+		return d.textBetween(from, to)
+	}
+	if got := quote(); got != "world" {
+		t.Fatalf("quote = %q, want world", got)
+	}
+
+	// The positions follow their text through edits around and inside it
+	mustApply(t, d, textEdit(d, "t", 0, "big ", 0))
+	mustApply(t, d, textEdit(d, "t", 10, "wide ", 0))
+	if got := quote(); got != "world" {
+		t.Errorf("after inserts: quote = %q, want world", got)
+	}
+	if got := d.root("t").text(); got != "big hello wide world" {
+		t.Fatalf("text = %q", got)
+	}
+	mustApply(t, d, textEdit(d, "t", 15, "", 5))
+	if got := quote(); got != "" {
+		t.Errorf("after deleting the range: quote = %q, want empty", got)
+	}
+	if _, ok := d.resolveRelativePosition(&yRelativePosition{item: &yID{12345, 0}}); ok {
+		t.Errorf("position in unknown content resolved")
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Reading and copying shared types. The server does not know which kind of
+// type the editor declared a root as (Y.js only records it for nested
+// types), so root kinds are inferred from their content.
+
+// MarshalJSON encodes undefined as null, the closest JSON has
+func (yUndefinedValue) MarshalJSON() ([]byte, error) {
+	return []byte("null"), nil
+}
+
+// RootNames lists the root types that have content, sorted
+func (d *YDoc) RootNames() []string {
+	var names []string
+	for name, t := range d.roots {
+		if t.start != nil || len(t.entries) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// effectiveKind is t's type reference, inferred from the content for roots
+func (t *yType) effectiveKind() int {
+	if t.kind >= 0 {
+		return t.kind
+	}
+	for it := t.start; it != nil; it = it.right {
+		if it.deleted {
+			continue
+		}
+		switch c := it.content.(type) {
+		case *contentString, *contentFormat, *contentEmbed:
+			return yTextRef
+		case *contentType:
+			if c.t.kind == yXmlElementRef || c.t.kind == yXmlTextRef || c.t.kind == yXmlHookRef {
+				return yXmlFragmentRef
+			}
+		}
+	}
+	if t.start == nil && len(t.entries) > 0 {
+		return yMapRef
+	}
+	return yArrayRef
+}
+
+// visible returns the sequence items that are not deleted
+func (t *yType) visible() []*yItem {
+	var items []*yItem
+	for it := t.start; it != nil; it = it.right {
+		if !it.deleted {
+			items = append(items, it)
+		}
+	}
+	return items
+}
+
+// attributes returns the current map entries (XML attributes) as values
+func (t *yType) attributes() map[string]interface{} {
+	attrs := make(map[string]interface{}, len(t.entries))
+	for key, it := range t.entries {
+		if !it.deleted {
+			attrs[key] = itemValue(it)
+		}
+	}
+	return attrs
+}
+
+// itemValue is the value held by a map entry
+func itemValue(it *yItem) interface{} {
+	if ct, ok := it.content.(*contentType); ok {
+		return ct.t.toJSON()
+	}
+	values := contentValues(it.content)
+	if len(values) == 0 {
+		return nil
+	}
+	return values[len(values)-1]
+}
+
+// yTextRun is a stretch of rich text with the same formatting, or an embed
+type yTextRun struct {
+	Insert     string                 `json:"insert,omitempty"`
+	Embed      interface{}            `json:"embed,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// delta returns t's text as runs of equally formatted text, like
+// Y.Text.toDelta
+func (t *yType) delta() []yTextRun {
+	var runs []yTextRun
+	attrs := map[string]interface{}{}
+	for it := t.start; it != nil; it = it.right {
+		if it.deleted {
+			continue
+		}
+		switch c := it.content.(type) {
+		case *contentFormat:
+			var v interface{}
+			if err := json.Unmarshal([]byte(c.value), &v); err != nil || v == nil {
+				delete(attrs, c.key)
+			} else {
+				attrs[c.key] = v
+			}
+		case *contentString:
+			s := c.String()
+			if n := len(runs); n > 0 && runs[n-1].Embed == nil && sameAttributes(runs[n-1].Attributes, attrs) {
+				runs[n-1].Insert += s
+				continue
+			}
+			runs = append(runs, yTextRun{Insert: s, Attributes: copyAttributes(attrs)})
+		case *contentEmbed:
+			runs = append(runs, yTextRun{Embed: contentValues(c)[0], Attributes: copyAttributes(attrs)})
+		case *contentType:
+			runs = append(runs, yTextRun{Embed: c.t.toJSON(), Attributes: copyAttributes(attrs)})
+		}
+	}
+	return runs
+}
+
+func copyAttributes(attrs map[string]interface{}) map[string]interface{} {
+	if len(attrs) == 0 {
+		return nil
+	}
+	out := make(map[string]interface{}, len(attrs))
+	for k, v := range attrs {
+		out[k] = v
+	}
+	return out
+}
+
+func sameAttributes(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		w, ok := b[k]
+		if !ok {
+			return false
+		}
+		x, _ := json.Marshal(v)
+		y, _ := json.Marshal(w)
+		if string(x) != string(y) {
+			return false
+		}
+	}
+	return true
+}
+
+// text is the plain text of a text type
+func (t *yType) text() string {
+	var b strings.Builder
+	for it := t.start; it != nil; it = it.right {
+		if c, ok := it.content.(*contentString); ok && !it.deleted {
+			b.WriteString(c.String())
+		}
+	}
+	return b.String()
+}
+
+// toJSON converts t the way Y.Doc.toJSON does: maps to objects, arrays to
+// arrays, text to strings and XML to its string form
+func (t *yType) toJSON() interface{} {
+	switch t.effectiveKind() {
+	case yMapRef:
+		return t.attributes()
+	case yTextRef:
+		return t.text()
+	case yXmlTextRef, yXmlElementRef, yXmlFragmentRef, yXmlHookRef:
+		return t.xmlString()
+	default:
+		values := []interface{}{}
+		for _, it := range t.visible() {
+			if ct, ok := it.content.(*contentType); ok {
+				values = append(values, ct.t.toJSON())
+				continue
+			}
+			values = append(values, contentValues(it.content)...)
+		}
+		return values
+	}
+}
+
+// xmlString renders an XML type like Y.XmlElement.toString: elements as
+// tags with sorted attributes, formatted text as nested tags
+func (t *yType) xmlString() string {
+	var b strings.Builder
+	t.writeXML(&b)
+	return b.String()
+}
+
+func (t *yType) writeXML(b *strings.Builder) {
+	switch t.effectiveKind() {
+	case yXmlTextRef, yTextRef:
+		for _, run := range t.delta() {
+			keys := sortedKeys(run.Attributes)
+			for _, key := range keys {
+				b.WriteString("<" + key)
+				if attrs, ok := run.Attributes[key].(map[string]interface{}); ok {
+					for _, name := range sortedKeys(attrs) {
+						fmt.Fprintf(b, ` %s="%s"`, name, jsString(attrs[name]))
+					}
+				}
+				b.WriteString(">")
+			}
+			b.WriteString(run.Insert)
+			for i := len(keys) - 1; i >= 0; i-- {
+				b.WriteString("</" + keys[i] + ">")
+			}
+		}
+	case yXmlElementRef, yXmlHookRef:
+		name := strings.ToLower(t.nodeName)
+		b.WriteString("<" + name)
+		attrs := t.attributes()
+		for _, key := range sortedKeys(attrs) {
+			fmt.Fprintf(b, ` %s="%s"`, key, jsString(attrs[key]))
+		}
+		b.WriteString(">")
+		t.writeXMLChildren(b)
+		b.WriteString("</" + name + ">")
+	default:
+		t.writeXMLChildren(b)
+	}
+}
+
+func (t *yType) writeXMLChildren(b *strings.Builder) {
+	for _, it := range t.visible() {
+		if ct, ok := it.content.(*contentType); ok {
+			ct.t.writeXML(b)
+		}
+	}
+}
+
+// jsString formats a value as JavaScript's String() would for attributes
+func jsString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return "null"
+	case yUndefinedValue:
+		return "undefined"
+	case map[string]interface{}:
+		return "[object Object]"
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// textLines renders t as plain text, one line per paragraph or block, for
+// comparing versions
+func (t *yType) textLines() []string {
+	switch t.effectiveKind() {
+	case yTextRef, yXmlTextRef:
+		return strings.Split(t.text(), "\n")
+	case yMapRef:
+		attrs := t.attributes()
+		lines := make([]string, 0, len(attrs))
+		for _, key := range sortedKeys(attrs) {
+			v, _ := json.Marshal(attrs[key])
+			lines = append(lines, key+": "+string(v))
+		}
+		return lines
+	case yXmlElementRef, yXmlFragmentRef, yXmlHookRef:
+		return t.blockLines()
+	default:
+		var lines []string
+		for _, it := range t.visible() {
+			if ct, ok := it.content.(*contentType); ok {
+				lines = append(lines, ct.t.textLines()...)
+				continue
+			}
+			for _, v := range contentValues(it.content) {
+				b, _ := json.Marshal(v)
+				lines = append(lines, string(b))
+			}
+		}
+		return lines
+	}
+}
+
+// blockLines gives each text block of an XML tree its own line. An element
+// holding text (or nothing) is a text block; other elements are containers
+// such as lists, whose blocks are listed in turn.
+func (t *yType) blockLines() []string {
+	var lines []string
+	for _, it := range t.visible() {
+		ct, ok := it.content.(*contentType)
+		if !ok {
+			continue
+		}
+		if ct.t.isTextBlock() {
+			lines = append(lines, ct.t.inlineText())
+		} else {
+			lines = append(lines, ct.t.blockLines()...)
+		}
+	}
+	return lines
+}
+
+func (t *yType) isTextBlock() bool {
+	if t.kind == yXmlTextRef || t.kind == yTextRef {
+		return true
+	}
+	children := t.visible()
+	if len(children) == 0 {
+		return true
+	}
+	for _, it := range children {
+		if ct, ok := it.content.(*contentType); ok && ct.t.kind == yXmlTextRef {
+			return true
+		}
+	}
+	return false
+}
+
+// inlineText is the text of a text block; hard breaks become newlines
+func (t *yType) inlineText() string {
+	if t.kind == yXmlTextRef || t.kind == yTextRef {
+		return t.text()
+	}
+	var b strings.Builder
+	for _, it := range t.visible() {
+		ct, ok := it.content.(*contentType)
+		if !ok {
+			continue
+		}
+		if ct.t.kind == yXmlElementRef && ct.t.nodeName == "hardBreak" {
+			b.WriteString("\n")
+			continue
+		}
+		b.WriteString(ct.t.inlineText())
+	}
+	return b.String()
+}
+
+// copyInto appends the visible content of src to dst, nested types
+// included, as new items authored by the transaction's document
+func (tx *yTransaction) copyInto(dst, src *yType) {
+	var left *yItem
+	for _, it := range src.visible() {
+		content := copyContent(it.content)
+		left = tx.insert(dst, left, content)
+		if ct, ok := content.(*contentType); ok {
+			tx.copyInto(ct.t, it.content.(*contentType).t)
+		}
+	}
+	for _, key := range sortedKeys(src.entries) {
+		it := src.entries[key]
+		if it.deleted {
+			continue
+		}
+		content := copyContent(it.content)
+		tx.set(dst, key, content)
+		if ct, ok := content.(*contentType); ok {
+			tx.copyInto(ct.t, it.content.(*contentType).t)
+		}
+	}
+}
+
+// replace makes dst's content a copy of src's (empty when src is nil) by
+// deleting what dst has and inserting copies. Every change is a new
+// operation, so clients apply it like any other edit.
+func (tx *yTransaction) replace(dst, src *yType) {
+	for _, it := range dst.visible() {
+		tx.delete(it)
+	}
+	for key, it := range dst.entries {
+		if !it.deleted && (src == nil || src.entries[key] == nil || src.entries[key].deleted) {
+			tx.delete(it)
+		}
+	}
+	if src != nil {
+		tx.copyInto(dst, src)
+	}
+}
+
+// RestoreFrom returns the update that makes d's content equal to src's
+func (d *YDoc) RestoreFrom(src *YDoc) []byte {
+	names := map[string]bool{}
+	for _, name := range d.RootNames() {
+		names[name] = true
+	}
+	for _, name := range src.RootNames() {
+		names[name] = true
+	}
+	return d.Transact(func(tx *yTransaction) {
+		for _, name := range sortedKeys(names) {
+			tx.replace(d.root(name), src.roots[name])
+		}
+	})
+}
@@ -70,14 +70,18 @@ export const CollaborationProvider = ({ children, roomID, username }: Collaborat
                     const res = await fetch(`${apiUrl}/api/cert-hash`);
                     if (res.ok) {
                         const data = await res.json();
-                        if (data.hash) {
-                            const binaryString = window.atob(data.hash);
-                            const bytes = new Uint8Array(binaryString.length);
-                            for (let i = 0; i < binaryString.length; i++) {
-                                bytes[i] = binaryString.charCodeAt(i);
-                            }
+                        // During a certificate rotation the server lists every valid hash
+                        const hashes: string[] = data.hashes?.length ? data.hashes : (data.hash ? [data.hash] : []);
+                        if (hashes.length > 0) {
                             options = {
-                                serverCertificateHashes: [{ algorithm: 'sha-256', value: bytes }]
+                                serverCertificateHashes: hashes.map((hash) => {
+                                    const binaryString = window.atob(hash);
+                                    const bytes = new Uint8Array(binaryString.length);
+                                    for (let i = 0; i < binaryString.length; i++) {
+                                        bytes[i] = binaryString.charCodeAt(i);
+                                    }
+                                    return { algorithm: 'sha-256', value: bytes };
+                                })
                             };
                             console.log('Using server certificate hash for WebTransport');
                         }
@@ -45,7 +45,7 @@ export const AIPrompt = ({ onClose, onGenerateTemplate }: AIPromptProps) => {
       }
 
       if (!response.ok) {
-        const errorMsg = data.error || 'Failed to generate template';
+        const errorMsg = data.error?.message || data.error || 'Failed to generate template';
         setDebugInfo(JSON.stringify(data, null, 2));
         throw new Error(errorMsg);
       }
@@ -1,4 +1,5 @@
 import { Extension } from '@tiptap/core';
+import type { Node as ProseMirrorNode } from '@tiptap/pm/model';
 import { Plugin, PluginKey } from '@tiptap/pm/state';
 import { Decoration, DecorationSet } from '@tiptap/pm/view';
 
@@ -45,8 +46,45 @@ function dispatchUIMessage(message: string, type: 'info' | 'success' | 'error' |
   }));
 }
 
+// Document text and cursor sent to the server, which builds the prompt from
+// the section the cursor is in and the text around it
+interface DocumentContext {
+  document: string;
+  cursor: number;
+}
+
+// Serialize the document the way the server reads it: one paragraph per
+// textblock, separated by blank lines, with headings as Markdown "#" lines.
+// The cursor is an offset into that string in UTF-16 code units, which is
+// what JavaScript string lengths count.
+function getDocumentContext(doc: ProseMirrorNode, pos: number): DocumentContext {
+  const parts: string[] = [];
+  let length = 0;
+  let cursor = -1;
+
+  doc.descendants((node, nodePos) => {
+    if (!node.isTextblock) return true;
+
+    const prefix = node.type.name === 'heading' ? '#'.repeat(node.attrs.level ?? 1) + ' ' : '';
+    const text = node.textBetween(0, node.content.size, undefined, '\n');
+    if (parts.length > 0) length += 2;
+
+    const start = nodePos + 1;
+    if (cursor < 0 && pos >= start && pos <= start + node.content.size) {
+      cursor = length + prefix.length + node.textBetween(0, pos - start, undefined, '\n').length;
+    }
+
+    parts.push(prefix + text);
+    length += prefix.length + text.length;
+    return false;
+  });
+
+  const serialized = parts.join('\n\n');
+  return { document: serialized, cursor: cursor < 0 ? serialized.length : cursor };
+}
+
 // Enhanced completion request with better error handling and retries
-async function getLLMCompletion(text: string): Promise<string | null> {
+async function getLLMCompletion(text: string, context: DocumentContext): Promise<string | null> {
   try {
     // Check cache first
     const cached = completionCache.get(text);
@@ -72,7 +110,7 @@ async function getLLMCompletion(text: string): Promise<string | null> {
       headers: {
         'Content-Type': 'application/json',
       },
-      body: JSON.stringify({ text }),
+      body: JSON.stringify({ text, document: context.document, cursor: context.cursor }),
       signal: controller.signal,
     });
 
@@ -84,7 +122,7 @@ async function getLLMCompletion(text: string): Promise<string | null> {
     }
 
     const data = await response.json();
-    const completion = data.completion?.trim();
+    const completion = (data.suggestion ?? data.completion)?.trim();
 
     if (!completion || completion.length > 50) {
       log('Invalid completion received:', completion);
@@ -173,7 +211,7 @@ function getSmartFallbackSuggestion(text: string): string | null {
 }
 
 // Optimized completion request with better debouncing
-function requestCompletion(text: string): void {
+function requestCompletion(text: string, context: DocumentContext): void {
   const textKey = text.trim();
 
   // Don't make requests for very short text
@@ -219,7 +257,7 @@ function requestCompletion(text: string): void {
       log('Making API call for:', textKey);
 
       // Try API first
-      let completion = await getLLMCompletion(textKey);
+      let completion = await getLLMCompletion(textKey, context);
 
       // Fall back to smart suggestions if API fails
       if (!completion) {
@@ -537,7 +575,7 @@ export const AutocompleteExtension = Extension.create<AutocompleteOptions>({
 
               if (shouldRequest) {
                 log('Requesting new completion for:', textKey);
-                requestCompletion(textBeforeCursor);
+                requestCompletion(textBeforeCursor, getDocumentContext(doc, currentPos));
               } else {
                 log('Skipping request for:', textKey, {
                   pending: pendingCompletions.has(textKey),